@@ -0,0 +1,784 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// registerAdminRoutes mounts the admin API on mux. The API is disabled unless
+// an admin token, principal or OIDC issuer is configured. Each route names
+// the role needed to read and to change.
+func (s *RelayServer) registerAdminRoutes(mux *http.ServeMux) {
+	if !s.adminAuth.enabled() {
+		log.Printf("Admin API disabled (set admin.token, admin.principals or admin.oidc in config to enable)")
+		return
+	}
+
+	mux.HandleFunc("/admin/tenants", s.requireAdmin(roleViewer, roleOperator, s.handleAdminTenants))
+	mux.HandleFunc("/admin/tenants/", s.requireAdmin(roleViewer, roleOperator, s.handleAdminTenant))
+	mux.HandleFunc("/admin/events", s.requireAdmin(roleViewer, roleAdmin, s.handleAdminEvents))
+	mux.HandleFunc("/admin/departures", s.requireAdmin(roleViewer, roleAdmin, s.handleAdminDepartures))
+	mux.HandleFunc("/admin/connections", s.requireAdmin(roleViewer, roleAdmin, s.handleAdminConnections))
+	mux.HandleFunc("/admin/timeseries", s.requireAdmin(roleViewer, roleAdmin, s.handleAdminTimeSeries))
+	mux.HandleFunc("/admin/features", s.requireAdmin(roleViewer, roleAdmin, s.handleAdminFeatures))
+	mux.HandleFunc("/admin/incident", s.requireAdmin(roleViewer, roleOperator, s.handleAdminIncident))
+	mux.HandleFunc("/admin/features/", s.requireAdmin(roleViewer, roleAdmin, s.handleAdminFeature))
+	mux.HandleFunc("/admin/sync", s.requireAdmin(roleOperator, roleOperator, s.handleAdminSync))
+	mux.HandleFunc("/admin/compliance", s.requireAdmin(roleOperator, roleAdmin, s.handleAdminCompliance))
+	mux.HandleFunc("/admin/audit", s.requireAdmin(roleAdmin, roleAdmin, s.handleAdminAudit))
+	mux.HandleFunc("/admin/ports", s.requireAdmin(roleViewer, roleAdmin, s.handleAdminPorts))
+	mux.HandleFunc("/admin/ports/", s.requireAdmin(roleViewer, roleAdmin, s.handleAdminPorts))
+	mux.HandleFunc("/admin/ports/history", s.requireAdmin(roleViewer, roleAdmin, s.handleAdminPortHistory))
+	mux.HandleFunc("/admin/slo", s.requireAdmin(roleViewer, roleAdmin, s.handleAdminSLO))
+	mux.HandleFunc("/admin/blocklist", s.requireAdmin(roleViewer, roleAdmin, s.handleAdminBlocklist))
+	mux.HandleFunc("/admin/blocklist/", s.requireAdmin(roleViewer, roleAdmin, s.handleAdminBlocklistEntry))
+	mux.HandleFunc("/admin/clock", s.requireAdmin(roleViewer, roleAdmin, s.handleAdminClock))
+
+	// Dashboard single sign-on
+	if oidc := s.adminAuth.oidc; oidc != nil && oidc.cfg.RedirectURL != "" {
+		mux.HandleFunc("/admin/login", oidc.handleLogin)
+		mux.HandleFunc("/admin/callback", oidc.handleCallback)
+	}
+}
+
+// requireAdmin rejects unauthenticated requests and callers without the
+// role for the request (readRole for GET, writeRole otherwise), attaches the
+// caller's principal and audits every mutating call, refused or not
+func (s *RelayServer) requireAdmin(readRole, writeRole string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, err := s.adminAuth.authenticate(r)
+		if err != nil {
+			s.siem.Record(siemAdminAuthFailed, "", r.RemoteAddr, fmt.Sprintf("%s %s: %v", r.Method, r.URL.Path, err))
+			writeJSONError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		r = withPrincipal(r, principal)
+
+		role := readRole
+		if auditable(r) {
+			role = writeRole
+		}
+		handler := next
+		if !principal.allows(role) {
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				writeJSONError(w, http.StatusForbidden, fmt.Sprintf("requires the %s role", role))
+			}
+		}
+
+		if auditable(r) {
+			s.audited(w, r, handler)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// handleAdminTenants searches registered tenants; see parseTenantQuery for
+// the supported filters, sorting and paging
+func (s *RelayServer) handleAdminTenants(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query, err := parseTenantQuery(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	page, total := s.queryTenants(query)
+	tenants := make([]map[string]interface{}, 0, len(page))
+	for _, tenant := range page {
+		tenants = append(tenants, s.tenantSnapshot(tenant))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tenants": tenants,
+		"total":   total,
+		"offset":  query.offset,
+		"limit":   query.limit,
+	})
+}
+
+// handleAdminTenant routes /admin/tenants/{tenantId}[/{action}]
+func (s *RelayServer) handleAdminTenant(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/tenants/"), "/")
+	if len(parts) > 2 || parts[0] == "" {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	tenantID, action := parts[0], ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	switch action {
+	case "":
+		s.handleAdminTenantDetail(w, r, tenantID)
+	case "mirror":
+		s.handleAdminMirror(w, r, tenantID)
+	case "labels":
+		s.handleAdminLabels(w, r, tenantID)
+	case "recording":
+		s.handleAdminRecording(w, r, tenantID)
+	case "trace":
+		s.handleAdminTenantTrace(w, r, tenantID)
+	case "sync":
+		s.handleAdminTenantSync(w, r, tenantID)
+	case "port":
+		s.handleAdminTenantPort(w, r, tenantID)
+	case "bandwidth":
+		s.handleAdminTenantBandwidth(w, r, tenantID)
+	case "latency":
+		s.handleAdminTenantLatency(w, r, tenantID)
+	case "freeze":
+		s.handleAdminTenantFreeze(w, r, tenantID)
+	case "connections":
+		s.handleAdminTenantConnections(w, r, tenantID)
+	case "state":
+		s.handleAdminTenantState(w, r, tenantID)
+	case "credentials":
+		s.handleAdminTenantCredentials(w, r, tenantID)
+	case "source-ips":
+		s.handleAdminTenantSourceIPs(w, r, tenantID)
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// handleAdminTenantDetail returns a registered tenant's state, including its
+// yamux session statistics
+func (s *RelayServer) handleAdminTenantDetail(w http.ResponseWriter, r *http.Request, tenantID string) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tenant, ok := s.tenants[tenantID]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "tenant not registered")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.tenantSnapshot(tenant))
+}
+
+// handleAdminMirror enables (PUT), disables (DELETE) or shows (GET) traffic
+// mirroring for a tenant. Enabling sends clinic traffic to an arbitrary
+// host, so it needs the admin role and the target is audited.
+func (s *RelayServer) handleAdminMirror(w http.ResponseWriter, r *http.Request, tenantID string) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.RLock()
+		target := s.mirrors[tenantID]
+		s.mu.RUnlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"tenantId": tenantID,
+			"enabled":  target != "",
+			"target":   target,
+		})
+
+	case http.MethodPut:
+		if p := principalFrom(r); p == nil || !p.allows(roleAdmin) {
+			writeJSONError(w, http.StatusForbidden, fmt.Sprintf("requires the %s role", roleAdmin))
+			return
+		}
+		var req struct {
+			Target string `json:"target"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if _, _, err := net.SplitHostPort(req.Target); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "target must be host:port")
+			return
+		}
+		auditMirrorTarget(w, req.Target)
+
+		s.mu.Lock()
+		s.mirrors[tenantID] = req.Target
+		s.mu.Unlock()
+
+		log.Printf("🪞 Mirroring enabled for tenant %s -> %s (by %s)", tenantID, req.Target, adminActor(r))
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"tenantId": tenantID,
+			"enabled":  true,
+			"target":   req.Target,
+		})
+
+	case http.MethodDelete:
+		s.mu.Lock()
+		delete(s.mirrors, tenantID)
+		s.mu.Unlock()
+
+		log.Printf("🪞 Mirroring disabled for tenant %s (by %s)", tenantID, adminActor(r))
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"tenantId": tenantID,
+			"enabled":  false,
+		})
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleAdminLabels shows (GET), replaces (PUT), merges (PATCH) or clears
+// (DELETE) a tenant's labels. Labels may be set before the tenant registers.
+func (s *RelayServer) handleAdminLabels(w http.ResponseWriter, r *http.Request, tenantID string) {
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPut, http.MethodPatch:
+		var labels map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&labels); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if err := s.setTenantLabels(tenantID, labels, r.Method == http.MethodPatch); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("🏷️  Labels for tenant %s set to {%s} (by %s)", tenantID, formatLabels(s.tenantLabels(tenantID)), adminActor(r))
+		s.refreshTenantTier(tenantID)
+
+	case http.MethodDelete:
+		s.setTenantLabels(tenantID, nil, false)
+		log.Printf("🏷️  Labels for tenant %s cleared (by %s)", tenantID, adminActor(r))
+		s.refreshTenantTier(tenantID)
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tenantId": tenantID,
+		"labels":   s.tenantLabels(tenantID),
+	})
+}
+
+// handleAdminRecording starts (PUT {"durationMinutes": n}), stops (DELETE) or
+// shows (GET) a tenant's forensic metadata recording. GET with ?download=1
+// exports the recording as JSON lines.
+func (s *RelayServer) handleAdminRecording(w http.ResponseWriter, r *http.Request, tenantID string) {
+	if s.recorder == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "forensic recording unavailable")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("download") != "" {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "recording-" + tenantID + ".jsonl"}))
+			http.ServeFile(w, r, s.recorder.path(tenantID))
+			return
+		}
+
+	case http.MethodPut:
+		var req struct {
+			DurationMinutes int `json:"durationMinutes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if _, err := s.recorder.Start(tenantID, time.Duration(req.DurationMinutes)*time.Minute); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.events.Emit("recording_started", tenantID, fmt.Sprintf("forensic recording for %d minutes (by %s)", req.DurationMinutes, adminActor(r)))
+
+	case http.MethodDelete:
+		s.recorder.Stop(tenantID)
+		s.events.Emit("recording_stopped", tenantID, fmt.Sprintf("forensic recording stopped (by %s)", adminActor(r)))
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.recorder.Status(tenantID))
+}
+
+// handleAdminTenantSync (POST) immediately re-sends a tenant's port
+// registration and heartbeat to HIS
+func (s *RelayServer) handleAdminTenantSync(w http.ResponseWriter, r *http.Request, tenantID string) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	s.mu.RLock()
+	tenant, ok := s.tenants[tenantID]
+	s.mu.RUnlock()
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "tenant not registered")
+		return
+	}
+
+	log.Printf("🔄 HIS sync requested for tenant %s (by %s)", tenantID, adminActor(r))
+	result := s.syncTenant(tenant)
+	status := http.StatusOK
+	if result.Error != "" {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, result)
+}
+
+// handleAdminTenantPort (PUT) remaps a tenant to {"port": n}, keeping the old
+// port open for {"graceSeconds": n}
+func (s *RelayServer) handleAdminTenantPort(w http.ResponseWriter, r *http.Request, tenantID string) {
+	if r.Method != http.MethodPut {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req struct {
+		Port         int `json:"port"`
+		GraceSeconds int `json:"graceSeconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	grace := time.Duration(req.GraceSeconds) * time.Second
+	oldPort, err := s.remapTenantPort(tenantID, req.Port, grace)
+	if errors.Is(err, errTenantNotRegistered) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	log.Printf("🔀 Port remap of tenant %s requested by %s", tenantID, adminActor(r))
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tenantId":         tenantID,
+		"port":             req.Port,
+		"previousPort":     oldPort,
+		"previousPortOpen": clock.Now().Add(grace).Format(time.RFC3339),
+	})
+}
+
+// handleAdminTenantBandwidth (PUT) changes a tenant's bandwidth cap to
+// {"maxKbps": n} (0 removes it) and pushes a throttle hint to the agent
+func (s *RelayServer) handleAdminTenantBandwidth(w http.ResponseWriter, r *http.Request, tenantID string) {
+	if r.Method != http.MethodPut {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req struct {
+		MaxKbps int `json:"maxKbps"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	err := s.setTenantBandwidth(tenantID, req.MaxKbps)
+	if errors.Is(err, errTenantNotRegistered) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Printf("Bandwidth cap of tenant %s set to %d kbps (by %s)", tenantID, req.MaxKbps, adminActor(r))
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tenantId": tenantID,
+		"maxKbps":  req.MaxKbps,
+	})
+}
+
+// handleAdminTenantConnections (PUT) sets the tenant's connection limit to
+// {"maxConnections": n}, overriding HIS and the token; 0 removes the override
+func (s *RelayServer) handleAdminTenantConnections(w http.ResponseWriter, r *http.Request, tenantID string) {
+	if r.Method != http.MethodPut {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req struct {
+		MaxConnections int `json:"maxConnections"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	effective, err := s.setConnLimitOverride(tenantID, req.MaxConnections)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Printf("Connection limit override of tenant %s set to %d (by %s)", tenantID, req.MaxConnections, adminActor(r))
+
+	resp := map[string]interface{}{
+		"tenantId":       tenantID,
+		"maxConnections": req.MaxConnections,
+		"registered":     effective > 0,
+	}
+	if effective > 0 {
+		resp["effective"] = effective
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleAdminTenantFreeze schedules (PUT {"start","end","closeExisting",
+// "reason"}), shows (GET) or lifts (DELETE) the tenant's access freeze
+func (s *RelayServer) handleAdminTenantFreeze(w http.ResponseWriter, r *http.Request, tenantID string) {
+	switch r.Method {
+	case http.MethodGet:
+		freeze, ok := s.accessFreeze(tenantID)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "no access freeze scheduled")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"tenantId": tenantID,
+			"freeze":   freeze,
+			"active":   freeze.activeAt(clock.Now()),
+		})
+
+	case http.MethodPut:
+		var req AccessFreeze
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		req.Source = "admin"
+		freeze, err := s.setAccessFreeze(tenantID, req)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.events.Emit("access_freeze_scheduled", tenantID, fmt.Sprintf("access frozen %s - %s (by %s)",
+			freeze.Start.UTC().Format(time.RFC3339), freeze.End.UTC().Format(time.RFC3339), adminActor(r)))
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"tenantId": tenantID,
+			"freeze":   freeze,
+		})
+
+	case http.MethodDelete:
+		// Also lifts a kill switch block, the other way access is paused
+		lifted := s.liftAccessFreeze(tenantID)
+		if s.liftKillBlock(tenantID) {
+			lifted = true
+		}
+		if !lifted {
+			writeJSONError(w, http.StatusNotFound, "no access freeze scheduled")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"tenantId": tenantID, "lifted": true})
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleAdminTenantState returns a tenant's lifecycle state and recent
+// transitions, including tenants in their grace period or recently evicted
+func (s *RelayServer) handleAdminTenantState(w http.ResponseWriter, r *http.Request, tenantID string) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	state, ok := s.tenantStates.Get(tenantID)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "tenant state unknown")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tenantId": tenantID,
+		"state":    state,
+	})
+}
+
+// handleAdminSync (POST) syncs every registered tenant with HIS, or the ones
+// matching ?label=
+func (s *RelayServer) handleAdminSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	selector, err := parseLabelSelector(r.URL.Query()["label"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.RLock()
+	tenants := make([]*Tenant, 0, len(s.tenants))
+	for _, tenant := range s.tenants {
+		if matchesLabels(s.tenantLabels(tenant.ID), selector) {
+			tenants = append(tenants, tenant)
+		}
+	}
+	s.mu.RUnlock()
+
+	log.Printf("🔄 HIS sync requested for %d tenants (by %s)", len(tenants), adminActor(r))
+	results := s.syncTenants(tenants)
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"synced":  len(results) - failed,
+		"failed":  failed,
+		"results": results,
+	})
+}
+
+// handleAdminEvents lists recent operator events such as flapping tenants
+func (s *RelayServer) handleAdminEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"events": s.events.Recent(),
+	})
+}
+
+// handleAdminDepartures lists recently departed tenants with their close
+// reasons, optionally filtered with ?tenant=
+func (s *RelayServer) handleAdminDepartures(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"departures": s.departures.Recent(r.URL.Query().Get("tenant")),
+	})
+}
+
+// handleAdminConnections exports the live connection table, optionally for
+// one tenant (?tenant=), as JSON or as CSV with ?format=csv
+func (s *RelayServer) handleAdminConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	tenantID := r.URL.Query().Get("tenant")
+	rows := s.conns.Snapshot(tenantID)
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"connections": rows,
+		})
+	case "csv":
+		filename := "connections.csv"
+		if tenantID != "" {
+			filename = "connections-" + tenantID + ".csv"
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"id", "tenant_id", "client_addr", "started_at", "duration",
+			"client_to_agent", "agent_to_client", "bytes_client_to_agent", "bytes_agent_to_client",
+			"client_to_agent_state", "client_to_agent_last_byte", "client_to_agent_idle_seconds", "client_to_agent_stalled_seconds", "client_to_agent_error",
+			"agent_to_client_state", "agent_to_client_last_byte", "agent_to_client_idle_seconds", "agent_to_client_stalled_seconds", "agent_to_client_error"})
+		for _, row := range rows {
+			record := []string{
+				strconv.FormatUint(row.ID, 10), row.TenantID, row.ClientAddr, row.StartedAt, row.Duration,
+				row.ClientToAgent, row.AgentToClient,
+				strconv.FormatInt(row.BytesClientToAgent, 10), strconv.FormatInt(row.BytesAgentToClient, 10),
+			}
+			for _, direction := range []ConnDirection{row.ClientToAgentState, row.AgentToClientState} {
+				record = append(record, direction.State, direction.LastByteAt,
+					strconv.FormatInt(direction.IdleSeconds, 10), strconv.FormatInt(direction.StalledSeconds, 10), direction.Error)
+			}
+			cw.Write(record)
+		}
+		cw.Flush()
+	default:
+		writeJSONError(w, http.StatusBadRequest, "format must be json or csv")
+	}
+}
+
+// handleAdminTimeSeries returns the minute snapshots of the last ?window=
+// (a duration, default and at most 24h), as JSON or as CSV with ?format=csv
+func (s *RelayServer) handleAdminTimeSeries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	window := timeSeriesPoints * timeSeriesInterval
+	if raw := r.URL.Query().Get("window"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "window must be a positive duration such as 6h")
+			return
+		}
+		if d < window {
+			window = d
+		}
+	}
+	points := s.timeSeries.Since(clock.BaseNow().Add(-window))
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"intervalSeconds": int(timeSeriesInterval.Seconds()),
+			"points":          points,
+		})
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "timeseries.csv"}))
+
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"time", "tenants", "connections", "bytes_client_to_agent", "bytes_agent_to_client", "cpu_percent"})
+		for _, p := range points {
+			cw.Write([]string{
+				p.Time.Format(time.RFC3339), strconv.Itoa(p.Tenants), strconv.Itoa(p.Connections),
+				strconv.FormatInt(p.BytesClientToAgent, 10), strconv.FormatInt(p.BytesAgentToClient, 10),
+				strconv.FormatFloat(p.CPUPercent, 'f', 1, 64),
+			})
+		}
+		cw.Flush()
+	default:
+		writeJSONError(w, http.StatusBadRequest, "format must be json or csv")
+	}
+}
+
+// handleAdminCompliance exports the monthly per-organization access report
+// for ?month=YYYY-MM (default this month), optionally for ?org=, as JSON or
+// as CSV with ?format=csv
+func (s *RelayServer) handleAdminCompliance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.ledger == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "compliance ledger unavailable")
+		return
+	}
+
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = s.ledger.currentMonth()
+	}
+	rows, err := s.ledger.Report(month, r.URL.Query().Get("org"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"month":         month,
+			"organizations": rows,
+		})
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "access-" + month + ".csv"}))
+
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"organization_id", "month", "sessions", "distinct_source_ips", "total_bytes", "out_of_hours_sessions"})
+		for _, row := range rows {
+			cw.Write([]string{
+				row.OrganizationID, row.Month, strconv.Itoa(row.Sessions), strconv.Itoa(row.DistinctSourceIPs),
+				strconv.FormatInt(row.TotalBytes, 10), strconv.Itoa(row.OutOfHoursSessions),
+			})
+		}
+		cw.Flush()
+	default:
+		writeJSONError(w, http.StatusBadRequest, "format must be json or csv")
+	}
+}
+
+// handleAdminFeatures lists feature flags with their state and overrides
+func (s *RelayServer) handleAdminFeatures(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"features": s.features.Describe(),
+	})
+}
+
+// handleAdminFeature overrides (PUT {"enabled": bool}) or clears the override
+// of (DELETE) /admin/features/{name}, for one tenant with ?tenant=
+func (s *RelayServer) handleAdminFeature(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/admin/features/")
+	if _, ok := featureDescriptions[name]; !ok {
+		writeJSONError(w, http.StatusNotFound, "unknown feature flag")
+		return
+	}
+	tenantID := r.URL.Query().Get("tenant")
+
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		s.features.Set(name, tenantID, req.Enabled)
+		log.Printf("🚩 Feature %s set to %v for %s (by %s)", name, req.Enabled, featureScope(tenantID), adminActor(r))
+
+	case http.MethodDelete:
+		s.features.Clear(name, tenantID)
+		log.Printf("🚩 Feature %s override cleared for %s (by %s)", name, featureScope(tenantID), adminActor(r))
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"name":     name,
+		"tenantId": tenantID,
+		"enabled":  s.features.Enabled(name, tenantID),
+	})
+}
+
+func featureScope(tenantID string) string {
+	if tenantID == "" {
+		return "all tenants"
+	}
+	return "tenant " + tenantID
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// minAdminTokenLen keeps guessable tokens out of principal definitions
+const minAdminTokenLen = 16
+
+// Admin roles, from least to most privileged. Viewers read, operators also
+// act on tenants, admins may do anything including feature flags and
+// reading the audit log.
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+)
+
+var roleRank = map[string]int{roleViewer: 1, roleOperator: 2, roleAdmin: 3}
+
+// AdminPrincipalConfig is a named admin API caller with its own static token
+type AdminPrincipalConfig struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Role  string `json:"role"` // default admin
+}
+
+// adminPrincipal is the authenticated caller of an admin request
+type adminPrincipal struct {
+	Name   string `json:"name"`
+	Method string `json:"method"` // how it authenticated: "token", "oidc" or "session"
+	Role   string `json:"role"`
+}
+
+// allows reports whether the principal holds at least role
+func (p *adminPrincipal) allows(role string) bool {
+	return roleRank[p.Role] >= roleRank[role]
+}
+
+var errAdminUnauthenticated = errors.New("invalid admin token")
+
+// adminAuth authenticates admin API callers
+type adminAuth struct {
+	principals []AdminPrincipalConfig
+	oidc       *oidcProvider // nil without SSO
+}
+
+// newAdminAuth collects the configured principals; the single admin.token is
+// the principal "admin"
+func newAdminAuth(cfg AdminConfig) *adminAuth {
+	auth := &adminAuth{}
+	if cfg.Token != "" {
+		auth.principals = append(auth.principals, AdminPrincipalConfig{Name: "admin", Token: cfg.Token})
+	}
+	auth.principals = append(auth.principals, cfg.Principals...)
+	if cfg.OIDC.Issuer != "" {
+		auth.oidc = newOIDCProvider(cfg.OIDC)
+	}
+	return auth
+}
+
+// validateAdminConfig checks principal names and tokens are set and unique
+func validateAdminConfig(cfg AdminConfig) error {
+	names := map[string]bool{}
+	tokens := map[string]bool{}
+	if cfg.Token != "" {
+		names["admin"], tokens[cfg.Token] = true, true
+	}
+	for i, p := range cfg.Principals {
+		switch {
+		case p.Name == "":
+			return fmt.Errorf("principals[%d].name is required", i)
+		case names[p.Name]:
+			return fmt.Errorf("principal %q is defined twice", p.Name)
+		case len(p.Token) < minAdminTokenLen:
+			return fmt.Errorf("token of principal %q must be at least %d characters", p.Name, minAdminTokenLen)
+		case tokens[p.Token]:
+			return fmt.Errorf("token of principal %q is shared with another principal", p.Name)
+		case p.Role != "" && roleRank[p.Role] == 0:
+			return fmt.Errorf("principal %q has unknown role %q (use viewer, operator or admin)", p.Name, p.Role)
+		}
+		names[p.Name], tokens[p.Token] = true, true
+	}
+	return validateOIDCConfig(cfg.OIDC)
+}
+
+// enabled reports whether any way to authenticate is configured
+func (a *adminAuth) enabled() bool {
+	return a != nil && (len(a.principals) > 0 || a.oidc != nil)
+}
+
+// authenticate identifies the caller from a bearer token (static or an IdP
+// JWT) or a dashboard session cookie. Every static principal is compared so
+// the response time doesn't reveal which one matched.
+func (a *adminAuth) authenticate(r *http.Request) (*adminPrincipal, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if a.oidc != nil {
+		if token == "" {
+			if cookie, err := r.Cookie(adminSessionCookie); err == nil {
+				return a.oidc.verifySession(cookie.Value)
+			}
+		} else if strings.Count(token, ".") == 2 {
+			return a.oidc.verifyBearer(r.Context(), token)
+		}
+	}
+
+	var match *adminPrincipal
+	for _, p := range a.principals {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(p.Token)) == 1 {
+			role := p.Role
+			if role == "" {
+				role = roleAdmin
+			}
+			match = &adminPrincipal{Name: p.Name, Method: "token", Role: role}
+		}
+	}
+	if match == nil {
+		return nil, errAdminUnauthenticated
+	}
+	return match, nil
+}
+
+type principalContextKey struct{}
+
+// withPrincipal attaches the authenticated caller to a request
+func withPrincipal(r *http.Request, p *adminPrincipal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalContextKey{}, p))
+}
+
+// principalFrom returns the authenticated caller of an admin request
+func principalFrom(r *http.Request) *adminPrincipal {
+	p, _ := r.Context().Value(principalContextKey{}).(*adminPrincipal)
+	return p
+}
+
+// adminActor names the caller of an admin request for logs and events
+func adminActor(r *http.Request) string {
+	if p := principalFrom(r); p != nil {
+		return fmt.Sprintf("%s from %s", p.Name, r.RemoteAddr)
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	// loadWindow is how long refusals at the connection limit are counted
+	// before the count starts over
+	loadWindow = time.Minute
+	// loadBackoffUtilization is the share of its limit at which a tenant is
+	// reported as one HIS pools should back off
+	loadBackoffUtilization = 0.9
+	// openLatencyWeight is the weight of each new stream open in the moving
+	// average, 1/openLatencyWeight
+	openLatencyWeight = 5
+)
+
+// Load advice for HIS connection pools
+const (
+	loadAdviceOK          = "ok"          // open connections as usual
+	loadAdviceBackoff     = "backoff"     // near or at the limit, or opens are failing; hold off
+	loadAdviceUnavailable = "unavailable" // no agent is connected here
+)
+
+// TenantLoad is how busy a tenant is, for HIS connection pools to steer by
+type TenantLoad struct {
+	TenantID          string  `json:"tenantId"`
+	Connected         bool    `json:"connected"`
+	ActiveConnections int     `json:"activeConnections"`
+	MaxConnections    int     `json:"maxConnections"`
+	Utilization       float64 `json:"utilization"` // active / max, 0-1
+	// StreamOpenMs is the moving average time to open a stream to the agent,
+	// the relay's share of a new connection's latency
+	StreamOpenMs       float64 `json:"streamOpenMs"`
+	RejectedLastMinute int     `json:"rejectedLastMinute"`
+	Degraded           bool    `json:"degraded"`
+	Advice             string  `json:"advice"`
+}
+
+// recordOpenLatencyLocked folds a successful stream open into the moving
+// average. Callers hold t.mu.
+func (t *Tenant) recordOpenLatencyLocked(took time.Duration) {
+	if t.openLatency == 0 {
+		t.openLatency = took
+		return
+	}
+	t.openLatency += (took - t.openLatency) / openLatencyWeight
+}
+
+// recordLimitRejectionLocked counts a client refused at the connection
+// limit. Callers hold t.mu.
+func (t *Tenant) recordLimitRejectionLocked() {
+	now := clock.Now()
+	if now.Sub(t.limitWindowStart) >= loadWindow {
+		t.limitWindowStart = now
+		t.limitRejections = 0
+	}
+	t.limitRejections++
+}
+
+// load reports the tenant's current load
+func (t *Tenant) load() TenantLoad {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	l := TenantLoad{
+		TenantID:          t.ID,
+		Connected:         true,
+		ActiveConnections: t.ActiveConns,
+		MaxConnections:    t.MaxConns,
+		StreamOpenMs:      float64(t.openLatency.Microseconds()) / 1000,
+		Degraded:          t.Degraded,
+		Advice:            loadAdviceOK,
+	}
+	if clock.Since(t.limitWindowStart) < loadWindow {
+		l.RejectedLastMinute = t.limitRejections
+	}
+	if t.MaxConns > 0 {
+		l.Utilization = float64(t.ActiveConns) / float64(t.MaxConns)
+	}
+	if l.Utilization >= loadBackoffUtilization || l.Degraded {
+		l.Advice = loadAdviceBackoff
+	}
+	return l
+}
+
+// tenantLoads reports the load of every registered tenant, sorted by ID
+func (s *RelayServer) tenantLoads() []TenantLoad {
+	s.mu.RLock()
+	tenants := make([]*Tenant, 0, len(s.tenants))
+	for _, tenant := range s.tenants {
+		tenants = append(tenants, tenant)
+	}
+	s.mu.RUnlock()
+
+	loads := make([]TenantLoad, 0, len(tenants))
+	for _, tenant := range tenants {
+		loads = append(loads, tenant.load())
+	}
+	sort.Slice(loads, func(i, j int) bool { return loads[i].TenantID < loads[j].TenantID })
+	return loads
+}
+
+// handleHISLoad serves GET /his/load: the load of every tenant on this relay,
+// so HIS connection pools can back off saturated tenants instead of opening
+// connections that will be refused
+func (s *RelayServer) handleHISLoad(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if _, ok := s.verifyHISCall(w, r); !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"instanceId":  s.instanceID,
+		"generatedAt": clock.Now().UTC().Format(time.RFC3339),
+		"tenants":     s.tenantLoads(),
+	})
+}
+
+// handleHISTenantLoad serves GET /his/tenants/{id}/load. A tenant without an
+// agent on this relay is reported unavailable rather than not found, so the
+// answer doesn't depend on which instance a load balancer picked.
+func (s *RelayServer) handleHISTenantLoad(w http.ResponseWriter, r *http.Request, tenantID string) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if _, ok := s.verifyHISCall(w, r); !ok {
+		return
+	}
+
+	s.mu.RLock()
+	tenant := s.tenants[tenantID]
+	s.mu.RUnlock()
+
+	load := TenantLoad{TenantID: tenantID, Advice: loadAdviceUnavailable}
+	if tenant != nil {
+		load = tenant.load()
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, load)
+}
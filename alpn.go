@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+)
+
+// ALPN protocol IDs accepted on the control port. Agents that send no ALPN
+// predate the negotiation and are treated as yamux control.
+const (
+	alpnControl   = "tatbeeb-link/1"    // yamux control session from an agent
+	alpnWebSocket = "tatbeeb-link-ws/1" // reserved for the WebSocket agent transport
+	alpnTDS       = "tds/8.0"           // SQL client using TDS 8.0 strict encryption
+)
+
+// controlALPNProtocols lists the protocols offered on the control port in
+// preference order. SQL clients are only offered when SNI routing can place
+// them on a tenant.
+func (s *RelayServer) controlALPNProtocols() []string {
+	protos := []string{alpnControl, alpnWebSocket}
+	if s.sni.Enabled {
+		protos = append(protos, alpnTDS)
+	}
+	return protos
+}
+
+// dispatchALPN handles a control port connection that negotiated something
+// other than yamux control; it reports false when the caller should go on
+// with agent registration. SQL clients outlive the registration timer, so it
+// is stopped before they are routed.
+func (s *RelayServer) dispatchALPN(conn *tls.Conn, handshakeTimer *Timer) bool {
+	switch conn.ConnectionState().NegotiatedProtocol {
+	case "":
+		s.counters.inc(&s.counters.alpnNone)
+		return false
+	case alpnControl:
+		s.counters.inc(&s.counters.alpnControl)
+		return false
+	case alpnTDS:
+		s.counters.inc(&s.counters.alpnSQL)
+		handshakeTimer.Stop()
+		s.routeSNIConnection(conn)
+		return true
+	default:
+		s.counters.inc(&s.counters.alpnRefused)
+		log.Printf("⚠️  Control connection from %s negotiated %q, which this relay does not serve yet",
+			conn.RemoteAddr(), conn.ConnectionState().NegotiatedProtocol)
+		return true
+	}
+}
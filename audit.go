@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxAuditRecords bounds the audit history kept in memory; the audit file,
+// when configured, keeps everything
+const maxAuditRecords = 1000
+
+// AuditRecord is one mutating admin API call
+type AuditRecord struct {
+	Time       time.Time `json:"time"`
+	Principal  string    `json:"principal"`
+	AuthMethod string    `json:"authMethod"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Query      string    `json:"query,omitempty"`
+	TenantID   string    `json:"tenantId,omitempty"`
+	Status     int       `json:"status"`
+	RemoteAddr string    `json:"remoteAddr"`
+	// CredentialPolicy names the policy of a credential the call issued
+	CredentialPolicy string `json:"credentialPolicy,omitempty"`
+	// MirrorTarget is where the call asked a tenant's traffic to be mirrored
+	MirrorTarget string `json:"mirrorTarget,omitempty"`
+}
+
+// AuditLog records who changed what through the admin API
+type AuditLog struct {
+	records []AuditRecord
+	file    *os.File // JSON lines, nil when only kept in memory
+	mu      sync.Mutex
+}
+
+// NewAuditLog creates an audit log that also appends to path when set
+func NewAuditLog(path string) (*AuditLog, error) {
+	audit := &AuditLog{}
+	if path == "" {
+		return audit, nil
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	audit.file = file
+	return audit, nil
+}
+
+// Record adds an audit record
+func (a *AuditLog) Record(rec AuditRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.records = append(a.records, rec)
+	if len(a.records) > maxAuditRecords {
+		a.records = a.records[len(a.records)-maxAuditRecords:]
+	}
+	if a.file != nil {
+		line, _ := json.Marshal(rec)
+		if _, err := a.file.Write(append(line, '\n')); err != nil {
+			log.Printf("⚠️  Failed to write audit record: %v", err)
+		}
+	}
+}
+
+// Recent returns up to limit records, newest first, optionally only those of
+// one principal or tenant
+func (a *AuditLog) Recent(principal, tenantID string, limit int) []AuditRecord {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	records := make([]AuditRecord, 0, limit)
+	for i := len(a.records) - 1; i >= 0 && len(records) < limit; i-- {
+		rec := a.records[i]
+		if (principal == "" || rec.Principal == principal) && (tenantID == "" || rec.TenantID == tenantID) {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+// statusRecorder captures the status code a handler writes
+type statusRecorder struct {
+	http.ResponseWriter
+	status           int
+	credentialPolicy string // set through auditCredentialPolicy
+	mirrorTarget     string // set through auditMirrorTarget
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// auditable reports whether a request changes relay state
+func auditable(r *http.Request) bool {
+	return r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions
+}
+
+// audited runs next and records the call with the caller's principal
+func (s *RelayServer) audited(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	next(recorder, r)
+
+	rec := AuditRecord{
+		Time:       clock.BaseNow(),
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Query:      r.URL.RawQuery,
+		Status:     recorder.status,
+		RemoteAddr: r.RemoteAddr,
+
+		CredentialPolicy: recorder.credentialPolicy,
+		MirrorTarget:     recorder.mirrorTarget,
+	}
+	if p := principalFrom(r); p != nil {
+		rec.Principal, rec.AuthMethod = p.Name, p.Method
+	}
+	if rest := strings.TrimPrefix(r.URL.Path, "/admin/tenants/"); rest != r.URL.Path {
+		rec.TenantID = strings.SplitN(rest, "/", 2)[0]
+	}
+	s.audit.Record(rec)
+}
+
+// auditMirrorTarget notes on the admin call's audit record where it mirrors
+// a tenant's traffic
+func auditMirrorTarget(w http.ResponseWriter, target string) {
+	if recorder, ok := w.(*statusRecorder); ok {
+		recorder.mirrorTarget = target
+	}
+}
+
+// handleAdminAudit serves GET /admin/audit[?principal=][&tenant=][&limit=]
+func (s *RelayServer) handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditRecords {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxAuditRecords))
+			return
+		}
+		limit = n
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"records": s.audit.Recent(r.URL.Query().Get("principal"), r.URL.Query().Get("tenant"), limit),
+	})
+}
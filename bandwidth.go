@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BandwidthLimiter is a token bucket shared by all connections of a tenant
+type BandwidthLimiter struct {
+	bytesPerSec float64
+	burst       float64
+	tokens      float64
+	last        time.Time
+	mu          sync.Mutex
+}
+
+// NewBandwidthLimiter creates a limiter for the given rate in kilobits per second
+func NewBandwidthLimiter(kbps int) *BandwidthLimiter {
+	bytesPerSec := float64(kbps) * 1000 / 8
+	return &BandwidthLimiter{
+		bytesPerSec: bytesPerSec,
+		burst:       bytesPerSec, // allow up to one second of traffic at once
+		tokens:      bytesPerSec,
+		last:        clock.Now(),
+	}
+}
+
+// SetRate changes the limit for every connection sharing the limiter; zero
+// lets traffic through unthrottled
+func (l *BandwidthLimiter) SetRate(kbps int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.bytesPerSec = float64(kbps) * 1000 / 8
+	l.burst = l.bytesPerSec
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Wait blocks until n bytes may be sent
+func (l *BandwidthLimiter) Wait(n int) {
+	l.mu.Lock()
+	if l.bytesPerSec <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := clock.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.bytesPerSec
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit > 0 {
+		clock.Sleep(time.Duration(deficit / l.bytesPerSec * float64(time.Second)))
+	}
+}
+
+// throttledWriter delays writes so they respect a BandwidthLimiter
+type throttledWriter struct {
+	w       io.Writer
+	limiter *BandwidthLimiter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		// Keep chunks below the burst size so a single large write can't stall
+		// every other connection sharing the bucket
+		chunk := len(p) - written
+		if limit := int(t.limiter.burst); chunk > limit && limit > 0 {
+			chunk = limit
+		}
+		t.limiter.Wait(chunk)
+		n, err := t.w.Write(p[written : written+chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// countingWriter adds the bytes written to a shared counter
+type countingWriter struct {
+	w       io.Writer
+	counter *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.counter, int64(n))
+	return n, err
+}
+
+// limitWriter wraps w with the limiter, or returns w unchanged when no limit applies
+func limitWriter(w io.Writer, limiter *BandwidthLimiter) io.Writer {
+	if limiter == nil {
+		return w
+	}
+	return &throttledWriter{w: w, limiter: limiter}
+}
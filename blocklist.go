@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TenantBlock is a blocklist entry: the tenant ID may never register again,
+// whatever token it presents
+type TenantBlock struct {
+	TenantID  string    `json:"tenantId"`
+	Reason    string    `json:"reason,omitempty"`
+	BlockedBy string    `json:"blockedBy"` // admin principal or "his"
+	BlockedAt time.Time `json:"blockedAt"`
+}
+
+// TenantBlocklist holds offboarded tenant IDs, persisted to a JSON file that
+// is rewritten on every change. A change is only applied once it is on disk.
+type TenantBlocklist struct {
+	path    string
+	entries map[string]TenantBlock
+	mu      sync.Mutex
+}
+
+// OpenTenantBlocklist loads the blocklist from path; an empty path keeps it
+// in memory only
+func OpenTenantBlocklist(path string) (*TenantBlocklist, error) {
+	b := &TenantBlocklist{path: path, entries: make(map[string]TenantBlock)}
+	if path == "" {
+		return b, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create blocklist dir: %w", err)
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blocklist: %w", err)
+	}
+	var entries []TenantBlock
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse blocklist: %w", err)
+	}
+	for _, entry := range entries {
+		b.entries[entry.TenantID] = entry
+	}
+	return b, nil
+}
+
+// saveLocked writes entries to the file. Callers hold b.mu.
+func (b *TenantBlocklist) saveLocked(entries map[string]TenantBlock) error {
+	if b.path == "" {
+		return nil
+	}
+	list := make([]TenantBlock, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].TenantID < list[j].TenantID })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode blocklist: %w", err)
+	}
+
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write blocklist: %w", err)
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		return fmt.Errorf("failed to write blocklist: %w", err)
+	}
+	return nil
+}
+
+// update persists the entries with change applied, then keeps them
+func (b *TenantBlocklist) update(change func(entries map[string]TenantBlock)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entries := make(map[string]TenantBlock, len(b.entries)+1)
+	for tenantID, entry := range b.entries {
+		entries[tenantID] = entry
+	}
+	change(entries)
+	if err := b.saveLocked(entries); err != nil {
+		return err
+	}
+	b.entries = entries
+	return nil
+}
+
+// Add blocks a tenant ID, replacing an earlier entry
+func (b *TenantBlocklist) Add(entry TenantBlock) error {
+	return b.update(func(entries map[string]TenantBlock) {
+		entries[entry.TenantID] = entry
+	})
+}
+
+// Remove unblocks a tenant ID, reporting whether it was blocked
+func (b *TenantBlocklist) Remove(tenantID string) (bool, error) {
+	if _, ok := b.Get(tenantID); !ok {
+		return false, nil
+	}
+	err := b.update(func(entries map[string]TenantBlock) {
+		delete(entries, tenantID)
+	})
+	return err == nil, err
+}
+
+// Get returns the tenant's entry, if it is blocked
+func (b *TenantBlocklist) Get(tenantID string) (TenantBlock, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.entries[tenantID]
+	return entry, ok
+}
+
+// List returns every entry by tenant ID
+func (b *TenantBlocklist) List() []TenantBlock {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	list := make([]TenantBlock, 0, len(b.entries))
+	for _, entry := range b.entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].TenantID < list[j].TenantID })
+	return list
+}
+
+// blockTenant adds a tenant to the blocklist and evicts its registration, if
+// any, so the agent has to register again and is refused
+func (s *RelayServer) blockTenant(entry TenantBlock) error {
+	entry.BlockedAt = clock.BaseNow().UTC()
+	if err := s.blocklist.Add(entry); err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("blocked by %s: %s", entry.BlockedBy, entry.Reason)
+	log.Printf("⛔ Tenant %s %s", entry.TenantID, msg)
+	s.events.Emit("tenant_blocked", entry.TenantID, msg)
+
+	s.mu.RLock()
+	tenant, ok := s.tenants[entry.TenantID]
+	s.mu.RUnlock()
+	if ok {
+		s.unregisterTenant(tenant, closeReasonBlocked, entry.Reason)
+		s.conns.CloseTenant(entry.TenantID)
+		if tenant.ControlSession != nil {
+			tenant.ControlSession.Close()
+		}
+	}
+	return nil
+}
+
+// unblockTenant removes a tenant from the blocklist, reporting whether it was
+// blocked
+func (s *RelayServer) unblockTenant(tenantID, by string) (bool, error) {
+	removed, err := s.blocklist.Remove(tenantID)
+	if err != nil || !removed {
+		return removed, err
+	}
+	log.Printf("⛔ Tenant %s unblocked by %s", tenantID, by)
+	s.events.Emit("tenant_unblocked", tenantID, fmt.Sprintf("unblocked by %s", by))
+	return true, nil
+}
+
+// handleAdminBlocklist serves GET /admin/blocklist, every blocked tenant ID
+func (s *RelayServer) handleAdminBlocklist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tenants": s.blocklist.List(),
+	})
+}
+
+// handleAdminBlocklistEntry shows (GET), adds (PUT {"reason": "..."}) or
+// removes (DELETE) /admin/blocklist/{tenantId}
+func (s *RelayServer) handleAdminBlocklistEntry(w http.ResponseWriter, r *http.Request) {
+	tenantID := strings.TrimPrefix(r.URL.Path, "/admin/blocklist/")
+	if tenantID == "" || strings.Contains(tenantID, "/") {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		entry, ok := s.blocklist.Get(tenantID)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "tenant not blocked")
+			return
+		}
+		writeJSON(w, http.StatusOK, entry)
+
+	case http.MethodPut:
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		entry := TenantBlock{TenantID: tenantID, Reason: req.Reason, BlockedBy: adminActor(r)}
+		if err := s.blockTenant(entry); err != nil {
+			log.Printf("⚠️  Failed to block tenant %s: %v", tenantID, err)
+			writeJSONError(w, http.StatusInternalServerError, "could not persist blocklist")
+			return
+		}
+		entry, _ = s.blocklist.Get(tenantID)
+		writeJSON(w, http.StatusOK, entry)
+
+	case http.MethodDelete:
+		removed, err := s.unblockTenant(tenantID, adminActor(r))
+		if err != nil {
+			log.Printf("⚠️  Failed to unblock tenant %s: %v", tenantID, err)
+			writeJSONError(w, http.StatusInternalServerError, "could not persist blocklist")
+			return
+		}
+		if !removed {
+			writeJSONError(w, http.StatusNotFound, "tenant not blocked")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"tenantId": tenantID,
+			"blocked":  false,
+		})
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleHISBlock serves POST /his/tenants/{id}/block {"reason": "..."} and
+// DELETE /his/tenants/{id}/block, so HIS can block a tenant when it
+// offboards the clinic
+func (s *RelayServer) handleHISBlock(w http.ResponseWriter, r *http.Request, tenantID string) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	body, ok := s.verifyHISCall(w, r)
+	if !ok {
+		return
+	}
+
+	var err error
+	blocked := r.Method == http.MethodPost
+	if blocked {
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, &req); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+		}
+		err = s.blockTenant(TenantBlock{TenantID: tenantID, Reason: req.Reason, BlockedBy: "his"})
+	} else {
+		_, err = s.unblockTenant(tenantID, "his")
+	}
+	if err != nil {
+		log.Printf("⚠️  HIS blocklist change for tenant %s failed: %v", tenantID, err)
+		writeJSONError(w, http.StatusInternalServerError, "could not persist blocklist")
+		return
+	}
+
+	s.audit.Record(AuditRecord{
+		Time:       clock.BaseNow(),
+		Principal:  "his",
+		AuthMethod: "signature",
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		TenantID:   tenantID,
+		Status:     http.StatusOK,
+		RemoteAddr: r.RemoteAddr,
+	})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tenantId": tenantID,
+		"blocked":  blocked,
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// baselineCohort is the cohort of tenants no canary policy matched
+const baselineCohort = "baseline"
+
+// defaultKeepaliveInterval is how often the control stream is pinged
+const defaultKeepaliveInterval = 30 * time.Second
+
+// CanaryPolicy applies experimental settings to tenants whose labels match
+// the selector. Policies are evaluated in order and the first match wins.
+type CanaryPolicy struct {
+	Name                 string            `json:"name"`
+	Selector             map[string]string `json:"selector"`
+	KeepaliveIntervalSec int               `json:"keepaliveIntervalSeconds"`
+	StreamOpenTimeoutSec int               `json:"streamOpenTimeoutSeconds"`
+	// AgentFeatures are passed to the agent on registration, e.g.
+	// {"compression": "zstd", "protocolVersion": "2"}
+	AgentFeatures map[string]string `json:"agentFeatures"`
+}
+
+// validateCanaryPolicies rejects unnamed, duplicate or catch-all policies
+func validateCanaryPolicies(policies []CanaryPolicy) error {
+	seen := make(map[string]bool, len(policies))
+	for i, p := range policies {
+		if p.Name == "" {
+			return fmt.Errorf("canary policy %d has no name", i)
+		}
+		if p.Name == baselineCohort || seen[p.Name] {
+			return fmt.Errorf("canary policy name %q is reserved or duplicated", p.Name)
+		}
+		seen[p.Name] = true
+		if len(p.Selector) == 0 {
+			return fmt.Errorf("canary policy %q needs a label selector", p.Name)
+		}
+		if p.KeepaliveIntervalSec < 0 || p.StreamOpenTimeoutSec < 0 {
+			return fmt.Errorf("canary policy %q has a negative interval", p.Name)
+		}
+	}
+	return nil
+}
+
+// canaryFor returns the first policy matching the labels, or nil
+func (s *RelayServer) canaryFor(labels map[string]string) *CanaryPolicy {
+	for i := range s.canaries {
+		if matchesLabels(labels, s.canaries[i].Selector) {
+			return &s.canaries[i]
+		}
+	}
+	return nil
+}
+
+// assignCohort places a newly registered tenant in a canary cohort by its
+// labels and applies the cohort's settings
+func (s *RelayServer) assignCohort(tenant *Tenant) {
+	tenant.Cohort = baselineCohort
+
+	policy := s.canaryFor(s.tenantLabels(tenant.ID))
+	if policy == nil {
+		return
+	}
+	tenant.Cohort = policy.Name
+	tenant.canary = policy
+	if policy.KeepaliveIntervalSec > 0 {
+		tenant.keepaliveInterval = time.Duration(policy.KeepaliveIntervalSec) * time.Second
+	}
+	if policy.StreamOpenTimeoutSec > 0 {
+		tenant.streamOpenTimeout = time.Duration(policy.StreamOpenTimeoutSec) * time.Second
+	}
+}
+
+// cohortMetrics aggregates tenant health per cohort so canaries can be
+// compared with the baseline; callers hold s.mu
+func (s *RelayServer) cohortMetrics() map[string]interface{} {
+	type cohortStats struct {
+		Tenants            int            `json:"tenants"`
+		ActiveConns        int            `json:"activeConns"`
+		StreamsOpened      int            `json:"streamsOpened"`
+		StreamOpenFailures int            `json:"streamOpenFailures"`
+		FailureRate        float64        `json:"streamOpenFailureRate"`
+		Degraded           int            `json:"degraded"`
+		Departures         map[string]int `json:"departures"`
+	}
+
+	stats := map[string]*cohortStats{baselineCohort: {Departures: map[string]int{}}}
+	for _, p := range s.canaries {
+		stats[p.Name] = &cohortStats{Departures: map[string]int{}}
+	}
+
+	for _, tenant := range s.tenants {
+		tenant.mu.Lock()
+		if st, ok := stats[tenant.Cohort]; ok {
+			st.Tenants++
+			st.ActiveConns += tenant.ActiveConns
+			st.StreamsOpened += tenant.StreamsOpened
+			st.StreamOpenFailures += tenant.StreamOpenFailures
+			if tenant.Degraded {
+				st.Degraded++
+			}
+		}
+		tenant.mu.Unlock()
+	}
+	for _, d := range s.departures.Recent("") {
+		if st, ok := stats[d.Cohort]; ok {
+			st.Departures[d.Reason]++
+		}
+	}
+
+	metrics := make(map[string]interface{}, len(stats))
+	for name, st := range stats {
+		if attempts := st.StreamsOpened + st.StreamOpenFailures; attempts > 0 {
+			st.FailureRate = float64(st.StreamOpenFailures) / float64(attempts)
+		}
+		metrics[name] = st
+	}
+	return metrics
+}
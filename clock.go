@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock is the time source of the relay's timing logic: heartbeats, grace
+// periods, schedules and TTLs. Network deadlines always use the wall clock.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) *Ticker
+	NewTimer(d time.Duration) *Timer
+	AfterFunc(d time.Duration, f func()) *Timer
+	Sleep(d time.Duration)
+}
+
+// Ticker delivers ticks on C like time.Ticker
+type Ticker struct {
+	C     <-chan time.Time
+	stop  func()
+	reset func(d time.Duration)
+}
+
+// Stop turns off the ticker
+func (t *Ticker) Stop() { t.stop() }
+
+// Reset changes the ticker's period
+func (t *Ticker) Reset(d time.Duration) { t.reset(d) }
+
+// Timer fires once on C, or runs a function, like time.Timer
+type Timer struct {
+	C     <-chan time.Time
+	stop  func() bool
+	reset func(d time.Duration) bool
+}
+
+// Stop prevents the timer from firing, reporting whether it was pending
+func (t *Timer) Stop() bool { return t.stop() }
+
+// Reset makes the timer fire after d, reporting whether it was pending
+func (t *Timer) Reset(d time.Duration) bool { return t.reset(d) }
+
+// systemClock is the wall clock
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTicker(d time.Duration) *Ticker {
+	t := time.NewTicker(d)
+	return &Ticker{C: t.C, stop: t.Stop, reset: t.Reset}
+}
+
+func (systemClock) NewTimer(d time.Duration) *Timer {
+	t := time.NewTimer(d)
+	return &Timer{C: t.C, stop: t.Stop, reset: t.Reset}
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) *Timer {
+	t := time.AfterFunc(d, f)
+	return &Timer{stop: t.Stop, reset: t.Reset}
+}
+
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// relayClock is the clock all timing logic reads. It delegates to a
+// replaceable base clock and shifts Now by an offset operators can set at
+// runtime, e.g. to walk a tenant through the end of an access freeze.
+// Durations are not affected by the offset. Stored and audited timestamps,
+// and checks against other systems' clocks such as token expiry, read
+// BaseNow instead, so a shift never rewrites or prunes history.
+type relayClock struct {
+	base   atomic.Value // clockHolder
+	offset int64        // nanoseconds, atomic
+}
+
+// clockHolder keeps atomic.Value stores to one concrete type
+type clockHolder struct{ Clock }
+
+// clock is the relay's time source; see SetClock and /admin/clock
+var clock = newRelayClock()
+
+func newRelayClock() *relayClock {
+	c := &relayClock{}
+	c.base.Store(clockHolder{systemClock{}})
+	return c
+}
+
+// SetClock replaces the time source, e.g. with a ManualClock in tests
+func SetClock(c Clock) {
+	clock.base.Store(clockHolder{c})
+}
+
+func (c *relayClock) get() Clock { return c.base.Load().(clockHolder).Clock }
+
+// Offset returns how far Now is shifted from the base clock
+func (c *relayClock) Offset() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.offset))
+}
+
+// SetOffset shifts Now by d from the base clock
+func (c *relayClock) SetOffset(d time.Duration) {
+	atomic.StoreInt64(&c.offset, int64(d))
+}
+
+func (c *relayClock) Now() time.Time { return c.get().Now().Add(c.Offset()) }
+
+// BaseNow is the base clock's time without the offset, for port history, the
+// journal, recordings, the compliance ledger, quotas, audit records and
+// tokens
+func (c *relayClock) BaseNow() time.Time { return c.get().Now() }
+
+// Since is time.Since on the relay clock
+func (c *relayClock) Since(t time.Time) time.Duration { return c.Now().Sub(t) }
+
+// Until is time.Until on the relay clock
+func (c *relayClock) Until(t time.Time) time.Duration { return t.Sub(c.Now()) }
+
+func (c *relayClock) NewTicker(d time.Duration) *Ticker { return c.get().NewTicker(d) }
+
+func (c *relayClock) NewTimer(d time.Duration) *Timer { return c.get().NewTimer(d) }
+
+func (c *relayClock) AfterFunc(d time.Duration, f func()) *Timer { return c.get().AfterFunc(d, f) }
+
+// After is time.After on the relay clock
+func (c *relayClock) After(d time.Duration) <-chan time.Time { return c.get().NewTimer(d).C }
+
+func (c *relayClock) Sleep(d time.Duration) { c.get().Sleep(d) }
+
+// clockTick ticks on the relay clock, for the Forwarder's idle check
+func clockTick(d time.Duration) (<-chan time.Time, func()) {
+	ticker := clock.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+// ManualClock only moves when advanced, so tests can step through grace
+// periods, TTLs and schedules deterministically. Timers and tickers fire, in
+// order, as Advance passes their deadlines.
+type ManualClock struct {
+	now     time.Time
+	waiters []*manualWaiter
+	mu      sync.Mutex
+}
+
+// manualWaiter is a pending timer or ticker of a ManualClock
+type manualWaiter struct {
+	at     time.Time
+	period time.Duration // tickers only
+	c      chan time.Time
+	f      func() // AfterFunc timers
+}
+
+// NewManualClock creates a clock stopped at start
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+// Now returns the clock's time
+func (m *ManualClock) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+// Advance moves the clock forward by d, firing every timer and tick due on
+// the way
+func (m *ManualClock) Advance(d time.Duration) {
+	m.mu.Lock()
+	end := m.now.Add(d)
+	for {
+		sort.SliceStable(m.waiters, func(i, j int) bool { return m.waiters[i].at.Before(m.waiters[j].at) })
+		if len(m.waiters) == 0 || m.waiters[0].at.After(end) {
+			break
+		}
+		w := m.waiters[0]
+		m.now = w.at
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			m.waiters = m.waiters[1:]
+		}
+		if w.f != nil {
+			go w.f()
+			continue
+		}
+		select {
+		case w.c <- m.now:
+		default: // like time.Ticker, drop ticks nobody reads
+		}
+	}
+	m.now = end
+	m.mu.Unlock()
+}
+
+func (m *ManualClock) add(w *manualWaiter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.waiters = append(m.waiters, w)
+}
+
+// remove drops w, reporting whether it was pending
+func (m *ManualClock) remove(w *manualWaiter) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, pending := range m.waiters {
+		if pending == w {
+			m.waiters = append(m.waiters[:i], m.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// schedule returns a stop and reset pair for w
+func (m *ManualClock) schedule(w *manualWaiter) (func() bool, func(time.Duration) bool) {
+	stop := func() bool { return m.remove(w) }
+	reset := func(d time.Duration) bool {
+		pending := m.remove(w)
+		m.mu.Lock()
+		w.at = m.now.Add(d)
+		if w.period > 0 {
+			w.period = d
+		}
+		m.waiters = append(m.waiters, w)
+		m.mu.Unlock()
+		return pending
+	}
+	return stop, reset
+}
+
+// NewTicker ticks every d of advanced time
+func (m *ManualClock) NewTicker(d time.Duration) *Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	c := make(chan time.Time, 1)
+	w := &manualWaiter{at: m.Now().Add(d), period: d, c: c}
+	m.add(w)
+	stop, reset := m.schedule(w)
+	return &Ticker{C: c, stop: func() { stop() }, reset: func(d time.Duration) { reset(d) }}
+}
+
+// NewTimer fires once d of time has been advanced
+func (m *ManualClock) NewTimer(d time.Duration) *Timer {
+	c := make(chan time.Time, 1)
+	w := &manualWaiter{at: m.Now().Add(d), c: c}
+	m.add(w)
+	stop, reset := m.schedule(w)
+	return &Timer{C: c, stop: stop, reset: reset}
+}
+
+// AfterFunc runs f in its own goroutine once d of time has been advanced
+func (m *ManualClock) AfterFunc(d time.Duration, f func()) *Timer {
+	w := &manualWaiter{at: m.Now().Add(d), f: f}
+	m.add(w)
+	stop, reset := m.schedule(w)
+	return &Timer{stop: stop, reset: reset}
+}
+
+// Sleep blocks until d of time has been advanced
+func (m *ManualClock) Sleep(d time.Duration) {
+	<-m.NewTimer(d).C
+}
+
+// handleAdminClock shows (GET), shifts (PUT {"offsetSeconds": n}) or resets
+// (DELETE) the relay clock. The shift moves schedules, grace periods and TTLs
+// for debugging but not stored records; it is process-wide, shared by
+// virtual instances, and lost on restart.
+func (s *RelayServer) handleAdminClock(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPut:
+		var req struct {
+			OffsetSeconds int64 `json:"offsetSeconds"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		offset := time.Duration(req.OffsetSeconds) * time.Second
+		clock.SetOffset(offset)
+		msg := fmt.Sprintf("relay clock shifted by %v (by %s)", offset, adminActor(r))
+		log.Printf("⚠️  %s", msg)
+		s.events.Emit("clock_offset_changed", "", msg)
+
+	case http.MethodDelete:
+		clock.SetOffset(0)
+		msg := fmt.Sprintf("relay clock reset to the system clock (by %s)", adminActor(r))
+		log.Printf("🔄 %s", msg)
+		s.events.Emit("clock_offset_changed", "", msg)
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"now":           clock.Now().Format(time.RFC3339Nano),
+		"systemNow":     clock.BaseNow().Format(time.RFC3339Nano),
+		"offsetSeconds": int64(clock.Offset() / time.Second),
+	})
+}
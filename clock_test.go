@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tatbeeb/tatbeeb-link/common"
+)
+
+// useManualClock replaces the relay clock's base with a ManualClock for the
+// test, clearing any offset afterwards
+func useManualClock(t *testing.T) *ManualClock {
+	t.Helper()
+	manual := NewManualClock(time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC))
+	SetClock(manual)
+	t.Cleanup(func() {
+		clock.SetOffset(0)
+		SetClock(systemClock{})
+	})
+	return manual
+}
+
+func newClockTestServer() *RelayServer {
+	return NewRelayServer(&common.RelayConfig{TenantPortStart: 50000, TenantPortEnd: 50009}, NewMemoryHIS(), nil)
+}
+
+func TestManualClockFiresTimersInOrder(t *testing.T) {
+	manual := useManualClock(t)
+	start := manual.Now()
+
+	late := clock.NewTimer(2 * time.Minute)
+	early := clock.NewTimer(time.Minute)
+	ticker := clock.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	manual.Advance(59 * time.Second)
+	select {
+	case <-early.C:
+		t.Fatal("timer fired before its deadline")
+	default:
+	}
+	if at := <-ticker.C; !at.Equal(start.Add(30 * time.Second)) {
+		t.Fatalf("tick at %v, want %v", at, start.Add(30*time.Second))
+	}
+
+	manual.Advance(2 * time.Minute)
+	if at := <-early.C; !at.Equal(start.Add(time.Minute)) {
+		t.Fatalf("early timer fired at %v, want %v", at, start.Add(time.Minute))
+	}
+	if at := <-late.C; !at.Equal(start.Add(2 * time.Minute)) {
+		t.Fatalf("late timer fired at %v, want %v", at, start.Add(2*time.Minute))
+	}
+}
+
+func TestAccessFreezeFollowsRelayClock(t *testing.T) {
+	manual := useManualClock(t)
+	s := newClockTestServer()
+
+	now := clock.Now()
+	if _, err := s.setAccessFreeze("clinic-1", AccessFreeze{Start: now.Add(time.Hour), End: now.Add(2 * time.Hour)}); err != nil {
+		t.Fatalf("setAccessFreeze: %v", err)
+	}
+	if _, frozen := s.activeFreeze("clinic-1"); frozen {
+		t.Fatal("freeze active before its window")
+	}
+
+	manual.Advance(time.Hour)
+	if _, frozen := s.activeFreeze("clinic-1"); !frozen {
+		t.Fatal("freeze not active once its window opened")
+	}
+
+	// The runtime offset walks the tenant through the end of the window
+	clock.SetOffset(time.Hour)
+	if _, frozen := s.activeFreeze("clinic-1"); frozen {
+		t.Fatal("freeze still active after the shifted end")
+	}
+	clock.SetOffset(0)
+
+	manual.Advance(time.Hour)
+	waitFor(t, "the freeze to end", func() bool {
+		_, scheduled := s.accessFreeze("clinic-1")
+		return !scheduled
+	})
+}
+
+func TestParkedHoldExpiresAfterGrace(t *testing.T) {
+	manual := useManualClock(t)
+	p := &parkedPort{tenantID: "clinic-1", hold: 30 * time.Second}
+
+	client, relaySide := net.Pipe()
+	defer client.Close()
+	p.holdOrClose(relaySide)
+
+	manual.Advance(29 * time.Second)
+	p.mu.Lock()
+	held := len(p.held)
+	p.mu.Unlock()
+	if held != 1 {
+		t.Fatalf("%d connections held before the hold expired, want 1", held)
+	}
+
+	manual.Advance(time.Second)
+	client.SetReadDeadline(time.Now().Add(testWait))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after the hold expired = %v, want EOF", err)
+	}
+}
+
+func TestNonceTTLIgnoresOffset(t *testing.T) {
+	manual := useManualClock(t)
+	nonces, err := NewNonceStore("")
+	if err != nil {
+		t.Fatalf("NewNonceStore: %v", err)
+	}
+
+	expires := clock.BaseNow().Add(time.Minute)
+	if fresh, _ := nonces.Use(nonceNamespaceJTI, "token-1", expires); !fresh {
+		t.Fatal("first use not fresh")
+	}
+
+	clock.SetOffset(time.Hour)
+	if fresh, _ := nonces.Use(nonceNamespaceJTI, "token-1", expires); fresh {
+		t.Fatal("a clock offset let a token be replayed")
+	}
+
+	manual.Advance(time.Minute)
+	if fresh, _ := nonces.Use(nonceNamespaceJTI, "token-1", expires.Add(time.Minute)); !fresh {
+		t.Fatal("nonce not released after its TTL")
+	}
+}
+
+func TestClockOffsetKeepsPortHistory(t *testing.T) {
+	manual := useManualClock(t)
+	path := filepath.Join(t.TempDir(), "port-history.jsonl")
+	history, err := OpenPortHistory(PortHistoryConfig{File: path, RetentionDays: 1})
+	if err != nil {
+		t.Fatalf("OpenPortHistory: %v", err)
+	}
+
+	assignedAt := manual.Now()
+	history.Assigned("clinic-1", 50001)
+	manual.Advance(time.Hour)
+	history.Released("clinic-1", 50001)
+
+	// A shift past the retention window must not prune or restamp anything
+	clock.SetOffset(48 * time.Hour)
+	history.mu.Lock()
+	err = history.compactLocked()
+	history.mu.Unlock()
+	if err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+
+	intervals := history.Query(50001, "", assignedAt, manual.Now())
+	if len(intervals) != 1 {
+		t.Fatalf("%d intervals after compaction, want 1", len(intervals))
+	}
+	if !intervals[0].Start.Equal(assignedAt) {
+		t.Fatalf("interval starts at %v, want the unshifted %v", intervals[0].Start, assignedAt)
+	}
+
+	// Past the real retention window it is pruned
+	manual.Advance(48 * time.Hour)
+	clock.SetOffset(0)
+	history.mu.Lock()
+	history.pruneLocked()
+	history.mu.Unlock()
+	if intervals := history.Query(50001, "", assignedAt, manual.Now()); len(intervals) != 0 {
+		t.Fatalf("%d intervals past retention, want 0", len(intervals))
+	}
+}
+
+func TestKillBlockLeavesAccessFreeze(t *testing.T) {
+	manual := useManualClock(t)
+	s := newClockTestServer()
+
+	now := clock.Now()
+	if _, err := s.setAccessFreeze("clinic-1", AccessFreeze{End: now.Add(48 * time.Hour), Source: "his"}); err != nil {
+		t.Fatalf("setAccessFreeze: %v", err)
+	}
+	s.setKillBlock("clinic-1", now.Add(time.Hour), "test")
+
+	manual.Advance(2 * time.Hour)
+	if _, killed := s.killedUntil("clinic-1"); killed {
+		t.Fatal("kill block still in effect after its end")
+	}
+	if _, frozen := s.activeFreeze("clinic-1"); !frozen {
+		t.Fatal("the kill block's end lifted the 48h freeze")
+	}
+
+	// A freeze set during a kill block doesn't lift it
+	s.setKillBlock("clinic-2", clock.Now().Add(time.Hour), "test")
+	if _, err := s.setAccessFreeze("clinic-2", AccessFreeze{End: clock.Now().Add(time.Minute)}); err != nil {
+		t.Fatalf("setAccessFreeze: %v", err)
+	}
+	manual.Advance(30 * time.Minute)
+	if _, killed := s.killedUntil("clinic-2"); !killed {
+		t.Fatal("a freeze ended the kill block")
+	}
+}
+
+func TestForwarderIdleTimeoutFollowsRelayClock(t *testing.T) {
+	manual := useManualClock(t)
+	client, clientEnd := net.Pipe()
+	stream, agentEnd := net.Pipe()
+	defer clientEnd.Close()
+	defer agentEnd.Close()
+	go io.Copy(agentEnd, agentEnd)
+
+	ticking := make(chan struct{})
+	forwarder := &Forwarder{
+		Opener:      pipeOpener{stream: stream},
+		Policy:      passPolicy{},
+		IdleTimeout: time.Minute,
+		Tick: func(d time.Duration) (<-chan time.Time, func()) {
+			defer close(ticking)
+			return clockTick(d)
+		},
+	}
+	result := make(chan error, 1)
+	go func() { result <- forwarder.Forward(client, &ForwardStats{Now: clock.BaseNow}) }()
+	<-ticking
+
+	manual.Advance(59 * time.Second)
+	select {
+	case err := <-result:
+		t.Fatalf("closed after 59s idle: %v", err)
+	default:
+	}
+
+	manual.Advance(time.Second)
+	select {
+	case err := <-result:
+		if !errors.Is(err, errIdleTimeout) {
+			t.Fatalf("Forward = %v, want errIdleTimeout", err)
+		}
+	case <-time.After(testWait):
+		t.Fatal("connection not closed after a minute idle")
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ledgerMonthFormat    = "2006-01"
+	defaultComplianceDir = "/var/lib/tatbeeb-link/compliance"
+)
+
+// ComplianceConfig configures the per-organization access ledger
+type ComplianceConfig struct {
+	Dir      string `json:"dir"`
+	Timezone string `json:"timezone"` // IANA zone for months and business hours; defaults to server.quotaTimezone
+	// Business hours are [BusinessHoursStart, BusinessHoursEnd) on BusinessDays;
+	// sessions starting outside them count as out-of-hours access
+	BusinessHoursStart int      `json:"businessHoursStart"`
+	BusinessHoursEnd   int      `json:"businessHoursEnd"`
+	BusinessDays       []string `json:"businessDays"` // e.g. ["Sun", "Mon", "Tue", "Wed", "Thu"]
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// validateComplianceConfig checks business hours and day names
+func validateComplianceConfig(cfg ComplianceConfig) error {
+	if cfg.BusinessHoursStart < 0 || cfg.BusinessHoursEnd > 24 || cfg.BusinessHoursStart > cfg.BusinessHoursEnd {
+		return fmt.Errorf("business hours %d-%d must satisfy 0 <= start <= end <= 24", cfg.BusinessHoursStart, cfg.BusinessHoursEnd)
+	}
+	for _, day := range cfg.BusinessDays {
+		if _, ok := weekdayNames[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("unknown business day %q (use Sun, Mon, ...)", day)
+		}
+	}
+	if cfg.Timezone != "" {
+		if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+			return fmt.Errorf("timezone %q: %w", cfg.Timezone, err)
+		}
+	}
+	return nil
+}
+
+// LedgerSession is one forwarded connection as recorded in the ledger
+type LedgerSession struct {
+	OrganizationID string    `json:"organizationId"`
+	TenantID       string    `json:"tenantId"`
+	SourceIP       string    `json:"sourceIp"`
+	StartedAt      time.Time `json:"startedAt"`
+	DurationMs     int64     `json:"durationMs"`
+	Bytes          int64     `json:"bytes"`
+	OutOfHours     bool      `json:"outOfHours"`
+}
+
+// OrgAccessReport summarizes one organization's access for a month
+type OrgAccessReport struct {
+	OrganizationID     string `json:"organizationId"`
+	Month              string `json:"month"`
+	Sessions           int    `json:"sessions"`
+	DistinctSourceIPs  int    `json:"distinctSourceIps"`
+	TotalBytes         int64  `json:"totalBytes"`
+	OutOfHoursSessions int    `json:"outOfHoursSessions"`
+}
+
+// ComplianceLedger records forwarded sessions to one JSON lines file per month
+// for per-organization compliance reports
+type ComplianceLedger struct {
+	dir        string
+	location   *time.Location
+	hoursStart int
+	hoursEnd   int
+	days       map[time.Weekday]bool
+	mu         sync.Mutex
+}
+
+// NewComplianceLedger creates a ledger writing to cfg.Dir; location is used
+// when cfg.Timezone is empty
+func NewComplianceLedger(cfg ComplianceConfig, location *time.Location) (*ComplianceLedger, error) {
+	if cfg.Dir == "" {
+		cfg.Dir = defaultComplianceDir
+	}
+	if cfg.BusinessHoursStart == 0 && cfg.BusinessHoursEnd == 0 {
+		cfg.BusinessHoursStart, cfg.BusinessHoursEnd = 8, 17
+	}
+	if len(cfg.BusinessDays) == 0 {
+		cfg.BusinessDays = []string{"Sun", "Mon", "Tue", "Wed", "Thu"}
+	}
+	if err := validateComplianceConfig(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Timezone != "" {
+		location, _ = time.LoadLocation(cfg.Timezone)
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create compliance dir: %w", err)
+	}
+
+	days := make(map[time.Weekday]bool, len(cfg.BusinessDays))
+	for _, day := range cfg.BusinessDays {
+		days[weekdayNames[strings.ToLower(day)]] = true
+	}
+	return &ComplianceLedger{
+		dir:        cfg.Dir,
+		location:   location,
+		hoursStart: cfg.BusinessHoursStart,
+		hoursEnd:   cfg.BusinessHoursEnd,
+		days:       days,
+	}, nil
+}
+
+func (l *ComplianceLedger) path(month string) string {
+	return filepath.Join(l.dir, "sessions-"+month+".jsonl")
+}
+
+// outOfHours reports whether t falls outside business hours
+func (l *ComplianceLedger) outOfHours(t time.Time) bool {
+	local := t.In(l.location)
+	return !l.days[local.Weekday()] || local.Hour() < l.hoursStart || local.Hour() >= l.hoursEnd
+}
+
+// Record appends a finished connection to its month's file
+func (l *ComplianceLedger) Record(tenant *Tenant, clientAddr string, startedAt time.Time, bytes int64) {
+	sourceIP, _, err := net.SplitHostPort(clientAddr)
+	if err != nil {
+		sourceIP = clientAddr
+	}
+	session := LedgerSession{
+		OrganizationID: tenant.OrganizationID,
+		TenantID:       tenant.ID,
+		SourceIP:       sourceIP,
+		StartedAt:      startedAt.UTC(),
+		DurationMs:     clock.BaseNow().Sub(startedAt).Milliseconds(),
+		Bytes:          bytes,
+		OutOfHours:     l.outOfHours(startedAt),
+	}
+	line, _ := json.Marshal(session)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	file, err := os.OpenFile(l.path(startedAt.In(l.location).Format(ledgerMonthFormat)), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("⚠️  Failed to open compliance ledger: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		log.Printf("⚠️  Failed to write compliance ledger: %v", err)
+	}
+}
+
+// Report aggregates a month (YYYY-MM) per organization, optionally for one
+// organization only
+func (l *ComplianceLedger) Report(month, organizationID string) ([]OrgAccessReport, error) {
+	if _, err := time.Parse(ledgerMonthFormat, month); err != nil {
+		return nil, fmt.Errorf("month must be YYYY-MM")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	file, err := os.Open(l.path(month))
+	if os.IsNotExist(err) {
+		return []OrgAccessReport{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ledger: %w", err)
+	}
+	defer file.Close()
+
+	reports := make(map[string]*OrgAccessReport)
+	sourceIPs := make(map[string]map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var session LedgerSession
+		if err := json.Unmarshal(scanner.Bytes(), &session); err != nil {
+			continue // a torn final line after a crash
+		}
+		if organizationID != "" && session.OrganizationID != organizationID {
+			continue
+		}
+
+		report, ok := reports[session.OrganizationID]
+		if !ok {
+			report = &OrgAccessReport{OrganizationID: session.OrganizationID, Month: month}
+			reports[session.OrganizationID] = report
+			sourceIPs[session.OrganizationID] = make(map[string]bool)
+		}
+		report.Sessions++
+		report.TotalBytes += session.Bytes
+		if session.OutOfHours {
+			report.OutOfHoursSessions++
+		}
+		sourceIPs[session.OrganizationID][session.SourceIP] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ledger: %w", err)
+	}
+
+	rows := make([]OrgAccessReport, 0, len(reports))
+	for org, report := range reports {
+		report.DistinctSourceIPs = len(sourceIPs[org])
+		rows = append(rows, *report)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].OrganizationID < rows[j].OrganizationID })
+	return rows, nil
+}
+
+// currentMonth is the ledger month containing now
+func (l *ComplianceLedger) currentMonth() string {
+	return clock.BaseNow().In(l.location).Format(ledgerMonthFormat)
+}
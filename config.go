@@ -0,0 +1,626 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultHealthCheckPort serves /health, /metrics, the status endpoints and
+// the admin API unless server.healthCheckPort is set
+const defaultHealthCheckPort = 9090
+
+// RelayFileConfig is the JSON config file of the full relay
+type RelayFileConfig struct {
+	Server               ServerConfig                     `json:"server"`
+	TLS                  TLSMaterialConfig                `json:"tls"`
+	JWT                  JWTConfig                        `json:"jwt"`
+	SNI                  SNIConfig                        `json:"sni"`
+	Admission            AdmissionConfig                  `json:"admission"`
+	StreamBudget         StreamBudgetConfig               `json:"streamBudget"`
+	IPReputation         IPReputationConfig               `json:"ipReputation"`
+	SplitHorizon         SplitHorizonConfig               `json:"splitHorizon"`
+	ProgressLog          ProgressLogConfig                `json:"progressLog"`
+	LocalControl         LocalControlConfig               `json:"localControl"`
+	TLSResumption        TLSResumptionConfig              `json:"tlsResumption"`
+	Forwarding           ForwardingConfig                 `json:"forwarding"`
+	LoadShedding         LoadSheddingConfig               `json:"loadShedding"`
+	Tiers                map[string]TierConfig            `json:"tiers"`
+	TimeSeries           TimeSeriesConfig                 `json:"timeSeries"`
+	Cluster              ClusterConfig                    `json:"cluster"`
+	Listeners            ListenersConfig                  `json:"listeners"`
+	CredentialRotation   CredentialRotationConfig         `json:"credentialRotation"`
+	CredentialPolicies   CredentialPoliciesConfig         `json:"credentialPolicies"`
+	SourceIPs            SourceIPConfig                   `json:"sourceIPs"`
+	InstanceRegistration InstanceRegistrationConfig       `json:"instanceRegistration"`
+	Deregistration       DeregistrationConfig             `json:"deregistration"`
+	PortHistory          PortHistoryConfig                `json:"portHistory"`
+	PortForecast         PortForecastConfig               `json:"portForecast"`
+	Federation           FederationConfig                 `json:"federation"`
+	LatencyInjection     LatencyInjectionConfig           `json:"latencyInjection"`
+	SLO                  SLOConfig                        `json:"slo"`
+	FlowControl          FlowControlConfig                `json:"flowControl"`
+	SIEM                 SIEMConfig                       `json:"siem"`
+	Canaries             []CanaryPolicy                   `json:"canaries"`
+	Recording            RecordingConfig                  `json:"recording"`
+	Compliance           ComplianceConfig                 `json:"compliance"`
+	Features             map[string]bool                  `json:"features"`
+	ConnectionStrings    map[string]string                `json:"connectionStrings"`
+	ServiceEndpoints     map[string]ServiceEndpointConfig `json:"serviceEndpoints"`
+	Admin                AdminConfig                      `json:"admin"`
+	HIS                  HISConfig                        `json:"his"`
+
+	// Relays to run side by side in this process, each overlaid on the
+	// settings above
+	VirtualInstances map[string]json.RawMessage `json:"virtualInstances"`
+	instances        []VirtualInstance
+
+	// Accepted for compatibility with existing config files; not used by this relay
+	Monitoring struct {
+		EnableMetrics          bool `json:"enableMetrics"`
+		MetricsPort            int  `json:"metricsPort"`
+		HealthCheckIntervalSec int  `json:"healthCheckIntervalSeconds"`
+	} `json:"monitoring"`
+	Logging struct {
+		Level  string `json:"level"`
+		Format string `json:"format"`
+	} `json:"logging"`
+}
+
+// ServerConfig holds listener, limit and tenant lifecycle settings
+type ServerConfig struct {
+	ControlPort             int            `json:"controlPort"`
+	HealthCheckPort         int            `json:"healthCheckPort"`
+	TenantPortStart         int            `json:"tenantPortStart"`
+	TenantPortEnd           int            `json:"tenantPortEnd"`
+	MaxConnectionsPerTenant int            `json:"maxConnectionsPerTenant"`
+	Region                  string         `json:"region"`
+	PublicHost              string         `json:"publicHost"`
+	FallbackEndpoints       []string       `json:"fallbackEndpoints"`
+	ControlBacklog          int            `json:"controlBacklog"`
+	TenantBacklog           int            `json:"tenantBacklog"`
+	HandshakeTimeoutSec     int            `json:"handshakeTimeoutSeconds"`
+	PreloginTimeoutSec      int            `json:"preloginTimeoutSeconds"`
+	StreamOpenTimeoutSec    int            `json:"streamOpenTimeoutSeconds"`
+	DegradedAfterFailures   int            `json:"degradedAfterFailures"`
+	TDSFriendlyErrors       bool           `json:"tdsFriendlyErrors"`
+	ProtocolGuard           bool           `json:"protocolGuard"`
+	QuotaTimezone           string         `json:"quotaTimezone"`
+	MaxRegistrationsPerHour int            `json:"maxRegistrationsPerHour"`
+	ReservedPorts           map[string]int `json:"reservedPorts"`
+	ParkedHoldSeconds       int            `json:"parkedHoldSeconds"`
+	PortJournal             string         `json:"portJournal"`
+	PortAllocation          string         `json:"portAllocation"` // sequential (default) or hash
+	TenantBlocklist         string         `json:"tenantBlocklist"`
+	HoldUntilHISAck         bool           `json:"holdUntilHisAck"`
+	HISAckTimeoutSec        int            `json:"hisAckTimeoutSeconds"`
+	MaxControlMessageBytes  int            `json:"maxControlMessageBytes"`
+
+	// Accepted for compatibility with existing config files; not used by this relay
+	ConnectionTimeoutSec int `json:"connectionTimeoutSeconds"`
+}
+
+// TLSMaterialConfig holds the control port certificate and key, each as a
+// file path or inline PEM (which may be a secret reference)
+type TLSMaterialConfig struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	CertPEM  string `json:"certPem"`
+	KeyPEM   string `json:"keyPem"`
+	// NextPins are the SPKI pins of the key the certificate will move to,
+	// advertised to agents ahead of the change
+	NextPins []string `json:"nextPins"`
+}
+
+// JWTConfig configures registration token verification. The single-issuer
+// secret/issuer/audience keys are used when issuers is empty.
+type JWTConfig struct {
+	Secret               string            `json:"secret"`
+	Issuer               string            `json:"issuer"`
+	Audience             string            `json:"audience"`
+	Issuers              []JWTIssuerConfig `json:"issuers"`
+	RejectReplayedTokens bool              `json:"rejectReplayedTokens"`
+	NonceDir             string            `json:"nonceDir"`
+	VerifyCacheSize      int               `json:"verifyCacheSize"` // cached verification outcomes; default 4096
+	// PreviousSecrets keep tokens signed before a rotation of secret valid
+	PreviousSecrets []string `json:"previousSecrets"`
+}
+
+// AdminConfig enables the admin API. Token is a single caller named
+// "admin"; principals give each operator or system its own token so audit
+// records name who made a change.
+type AdminConfig struct {
+	Token      string                 `json:"token"`
+	Principals []AdminPrincipalConfig `json:"principals"`
+	AuditLog   string                 `json:"auditLog"` // JSON lines file of mutating calls; empty keeps them in memory only
+	OIDC       OIDCConfig             `json:"oidc"`
+}
+
+// HISConfig configures HIS notifications. The single backendUrl and
+// relaySharedSecret pair is used when targets is empty.
+type HISConfig struct {
+	BackendURL        string            `json:"backendUrl"`
+	RelaySharedSecret string            `json:"relaySharedSecret"`
+	SpoolDir          string            `json:"spoolDir"`
+	Targets           []HISTargetConfig `json:"targets"`
+	Network           HISNetworkConfig  `json:"network"`
+	// How far a signed HIS webhook's timestamp may be from the relay clock
+	WebhookToleranceSec int `json:"webhookToleranceSeconds"`
+
+	// Accepted for compatibility with existing config files; not used by this relay
+	RegisterPortEndpoint string `json:"registerPortEndpoint"`
+	HeartbeatEndpoint    string `json:"heartbeatEndpoint"`
+	HeartbeatIntervalSec int    `json:"heartbeatIntervalSeconds"`
+}
+
+// configErrors collects every problem found in a config file
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return fmt.Sprintf("%d problem(s):\n  - %s", len(e), strings.Join(e, "\n  - "))
+}
+
+// LoadConfig reads, defaults and validates the config file at path, reporting
+// unknown keys and invalid values together
+func LoadConfig(path string) (*RelayFileConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	cfg := &RelayFileConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	problems := unknownConfigKeys(raw, reflect.TypeOf(cfg), "")
+	resolver := newSecretResolver(os.Stdin)
+
+	// With virtual instances the top level only holds shared settings, so
+	// only the instances built from it are validated
+	if obj, ok := raw.(map[string]interface{}); ok && len(cfg.VirtualInstances) > 0 {
+		cfg.applyDefaults()
+		instances, instanceProblems := loadVirtualInstances(obj, cfg, resolver)
+		cfg.instances = instances
+		problems = append(problems, instanceProblems...)
+	} else {
+		problems = append(problems, cfg.resolveSecrets(resolver)...)
+		cfg.applyDefaults()
+		problems = append(problems, cfg.validate()...)
+	}
+	if len(problems) > 0 {
+		return cfg, configErrors(problems)
+	}
+	return cfg, nil
+}
+
+// applyDefaults fills in settings that were left out
+func (c *RelayFileConfig) applyDefaults() {
+	if c.Server.ControlPort == 0 {
+		c.Server.ControlPort = 8443
+	}
+	if c.Server.HealthCheckPort == 0 {
+		c.Server.HealthCheckPort = defaultHealthCheckPort
+	}
+	if c.Server.TenantPortStart == 0 && c.Server.TenantPortEnd == 0 {
+		c.Server.TenantPortStart = 50000
+		c.Server.TenantPortEnd = 50100
+	}
+	if c.Server.MaxConnectionsPerTenant == 0 {
+		c.Server.MaxConnectionsPerTenant = 10
+	}
+	if c.Server.PublicHost == "" {
+		c.Server.PublicHost = defaultPublicHost
+	}
+	if c.Server.PortJournal == "" {
+		c.Server.PortJournal = "/var/lib/tatbeeb-link/ports.journal"
+	}
+
+	// Single-issuer settings remain supported; jwt.issuers takes precedence
+	if len(c.JWT.Issuers) == 0 {
+		issuer := c.JWT.Issuer
+		if issuer == "" {
+			issuer = "his.tatbeeb.sa"
+		}
+		audience := c.JWT.Audience
+		if audience == "" {
+			audience = "tatbeeb-link.tatbeeb.sa"
+		}
+		c.JWT.Issuers = []JWTIssuerConfig{{
+			Issuer:          issuer,
+			Audiences:       []string{audience},
+			Secret:          c.JWT.Secret,
+			PreviousSecrets: c.JWT.PreviousSecrets,
+		}}
+	}
+	if c.JWT.NonceDir == "" {
+		c.JWT.NonceDir = "/var/lib/tatbeeb-link/nonces"
+	}
+
+	// his.targets enables dual-writing to several HIS backends; otherwise the
+	// single backendUrl/relaySharedSecret pair is the primary target
+	if len(c.HIS.Targets) == 0 {
+		c.HIS.Targets = []HISTargetConfig{{
+			Name:              "primary",
+			BackendURL:        c.HIS.BackendURL,
+			RelaySharedSecret: c.HIS.RelaySharedSecret,
+			Primary:           true,
+		}}
+	}
+	if c.Server.TenantBlocklist == "" {
+		c.Server.TenantBlocklist = "/var/lib/tatbeeb-link/tenant-blocklist.json"
+	}
+	if c.HIS.SpoolDir == "" {
+		c.HIS.SpoolDir = "/var/lib/tatbeeb-link/his-spool"
+	}
+
+	if c.Admission.RetryAfterSeconds <= 0 {
+		c.Admission.RetryAfterSeconds = 30
+	}
+	if c.StreamBudget.PerTenant == 0 {
+		c.StreamBudget.PerTenant = defaultStreamsPerTenant
+	}
+}
+
+// validate returns every invalid setting, phrased with the key to change
+func (c *RelayFileConfig) validate() []string {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// Ports
+	srv := c.Server
+	if srv.ControlPort < 1 || srv.ControlPort > 65535 {
+		addf("server.controlPort %d is not a valid port", srv.ControlPort)
+	}
+	if srv.HealthCheckPort < 1 || srv.HealthCheckPort > 65535 {
+		addf("server.healthCheckPort %d is not a valid port", srv.HealthCheckPort)
+	}
+	if srv.ControlPort == srv.HealthCheckPort {
+		addf("server.controlPort %d clashes with the health check port", srv.ControlPort)
+	}
+	if srv.TenantPortStart < 1 || srv.TenantPortEnd > 65535 {
+		addf("server.tenantPortStart-tenantPortEnd %d-%d is outside 1-65535", srv.TenantPortStart, srv.TenantPortEnd)
+	}
+	if srv.TenantPortStart >= srv.TenantPortEnd {
+		addf("server.tenantPortStart (%d) must be less than server.tenantPortEnd (%d)", srv.TenantPortStart, srv.TenantPortEnd)
+	}
+	inTenantRange := func(port int) bool {
+		return port >= srv.TenantPortStart && port <= srv.TenantPortEnd
+	}
+	if inTenantRange(srv.ControlPort) {
+		addf("server.controlPort %d overlaps the tenant port range %d-%d", srv.ControlPort, srv.TenantPortStart, srv.TenantPortEnd)
+	}
+	if inTenantRange(srv.HealthCheckPort) {
+		addf("server.healthCheckPort %d overlaps the tenant port range %d-%d", srv.HealthCheckPort, srv.TenantPortStart, srv.TenantPortEnd)
+	}
+	if err := validateReservedPorts(srv.ReservedPorts, srv.TenantPortStart, srv.TenantPortEnd); err != nil {
+		addf("server.reservedPorts: %v", err)
+	}
+	if err := validatePortAllocation(srv.PortAllocation); err != nil {
+		addf("server.portAllocation: %v", err)
+	}
+
+	// Limits and timeouts
+	if srv.MaxConnectionsPerTenant < 1 {
+		addf("server.maxConnectionsPerTenant must be at least 1")
+	}
+	for _, setting := range []struct {
+		key   string
+		value int
+	}{
+		{"server.controlBacklog", srv.ControlBacklog},
+		{"server.tenantBacklog", srv.TenantBacklog},
+		{"server.handshakeTimeoutSeconds", srv.HandshakeTimeoutSec},
+		{"server.preloginTimeoutSeconds", srv.PreloginTimeoutSec},
+		{"server.streamOpenTimeoutSeconds", srv.StreamOpenTimeoutSec},
+		{"server.degradedAfterFailures", srv.DegradedAfterFailures},
+		{"server.parkedHoldSeconds", srv.ParkedHoldSeconds},
+		{"server.hisAckTimeoutSeconds", srv.HISAckTimeoutSec},
+		{"server.maxControlMessageBytes", srv.MaxControlMessageBytes},
+		{"streamBudget.perTenant", c.StreamBudget.PerTenant},
+		{"streamBudget.total", c.StreamBudget.Total},
+		{"ipReputation.refreshSeconds", c.IPReputation.RefreshSeconds},
+		{"progressLog.intervalMinutes", c.ProgressLog.IntervalMinutes},
+		{"progressLog.everyMegabytes", c.ProgressLog.EveryMegabytes},
+		{"jwt.verifyCacheSize", c.JWT.VerifyCacheSize},
+		{"his.webhookToleranceSeconds", c.HIS.WebhookToleranceSec},
+		{"portHistory.retentionDays", c.PortHistory.RetentionDays},
+		{"portForecast.windowDays", c.PortForecast.WindowDays},
+		{"portForecast.warnDays", c.PortForecast.WarnDays},
+		{"portForecast.criticalDays", c.PortForecast.CriticalDays},
+		{"portForecast.warnUtilizationPercent", c.PortForecast.WarnUtilizationPercent},
+		{"credentialRotation.intervalHours", c.CredentialRotation.IntervalHours},
+		{"credentialRotation.overlapMinutes", c.CredentialRotation.OverlapMinutes},
+		{"credentialRotation.confirmTimeoutSeconds", c.CredentialRotation.ConfirmTimeoutSec},
+		{"admission.registrationBurst", c.Admission.RegistrationBurst},
+	} {
+		if setting.value < 0 {
+			addf("%s must not be negative", setting.key)
+		}
+	}
+	if c.Admission.RegistrationsPerSecond < 0 {
+		addf("admission.registrationsPerSecond must not be negative")
+	}
+	if srv.QuotaTimezone != "" {
+		if _, err := time.LoadLocation(srv.QuotaTimezone); err != nil {
+			addf("server.quotaTimezone %q is not an IANA time zone: %v", srv.QuotaTimezone, err)
+		}
+	}
+
+	// TLS and tokens
+	switch {
+	case c.TLS.CertFile == "" && c.TLS.CertPEM == "":
+		addf("TLS certificate required (set tls.certFile or tls.certPem)")
+	case c.TLS.CertFile != "" && c.TLS.CertPEM != "":
+		addf("set only one of tls.certFile and tls.certPem")
+	}
+	switch {
+	case c.TLS.KeyFile == "" && c.TLS.KeyPEM == "":
+		addf("TLS key required (set tls.keyFile or tls.keyPem)")
+	case c.TLS.KeyFile != "" && c.TLS.KeyPEM != "":
+		addf("set only one of tls.keyFile and tls.keyPem")
+	}
+	if err := validatePins(c.TLS.NextPins); err != nil {
+		addf("tls.nextPins: %v", err)
+	}
+	for i, issuer := range c.JWT.Issuers {
+		if issuer.Issuer == "" {
+			addf("JWT issuer name required (set jwt.issuers[%d].issuer)", i)
+		}
+		if len(issuer.Audiences) == 0 {
+			addf("JWT audience required for issuer %s (set jwt.issuers[%d].audiences)", issuer.Issuer, i)
+		}
+		if issuer.Secret == "" {
+			addf("JWT secret required for issuer %s (set jwt.secret or jwt.issuers[%d].secret)", issuer.Issuer, i)
+		}
+		for j, previous := range issuer.PreviousSecrets {
+			if previous == "" || previous == issuer.Secret {
+				addf("jwt.issuers[%d].previousSecrets[%d] must be set and differ from the current secret", i, j)
+			}
+		}
+	}
+
+	// SNI
+	if c.SNI.Enabled {
+		switch {
+		case c.SNI.Port == 0:
+			addf("SNI port required (set sni.port)")
+		case c.SNI.Port == srv.ControlPort || c.SNI.Port == srv.HealthCheckPort:
+			addf("sni.port %d clashes with the control or health check port", c.SNI.Port)
+		case inTenantRange(c.SNI.Port):
+			addf("sni.port %d overlaps the tenant port range %d-%d", c.SNI.Port, srv.TenantPortStart, srv.TenantPortEnd)
+		}
+		if !strings.HasPrefix(c.SNI.HostSuffix, ".") {
+			addf("SNI host suffix must start with a dot (set sni.hostSuffix, e.g. \".db.link.tatbeeb.sa\")")
+		}
+	}
+
+	// HIS
+	for i, target := range c.HIS.Targets {
+		if target.BackendURL == "" {
+			addf("HIS backend URL required (set his.backendUrl or his.targets[%d].backendUrl)", i)
+		}
+		if target.RelaySharedSecret == "" {
+			addf("Relay shared secret required (set his.relaySharedSecret or his.targets[%d].relaySharedSecret)", i)
+		}
+	}
+
+	// Features, canaries and templates
+	names := make([]string, 0, len(c.Features))
+	for name := range c.Features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := featureDescriptions[name]; !ok {
+			addf("features.%s: unknown feature flag%s", name, suggestion(name, featureNames()))
+		}
+	}
+	if err := validateComplianceConfig(c.Compliance); err != nil {
+		addf("compliance: %v", err)
+	}
+	if err := validateListeners(c.Listeners); err != nil {
+		addf("listeners: %v", err)
+	}
+	if err := validateSLO(c.SLO); err != nil {
+		addf("slo: %v", err)
+	}
+	if err := validateFlowControl(c.FlowControl); err != nil {
+		addf("flowControl: %v", err)
+	}
+	if err := validatePortForecast(c.PortForecast); err != nil {
+		addf("portForecast: %v", err)
+	}
+	if err := validateFederation(c.Federation); err != nil {
+		addf("federation: %v", err)
+	}
+	if err := validateCredentialPolicies(c.CredentialPolicies); err != nil {
+		addf("credentialPolicies: %v", err)
+	}
+	if err := validateSourceIPs(c.SourceIPs); err != nil {
+		addf("sourceIPs: %v", err)
+	}
+	if err := validateInstanceRegistration(c.InstanceRegistration); err != nil {
+		addf("instanceRegistration: %v", err)
+	}
+	if err := validateDeregistration(c.Deregistration); err != nil {
+		addf("deregistration: %v", err)
+	}
+	if err := validateSIEM(c.SIEM); err != nil {
+		addf("siem: %v", err)
+	}
+	if err := validateLocalControl(c.LocalControl, srv); err != nil {
+		addf("localControl: %v", err)
+	}
+	if err := validateAdminConfig(c.Admin); err != nil {
+		addf("admin: %v", err)
+	}
+	if err := validateTLSResumption(c.TLSResumption); err != nil {
+		addf("tlsResumption: %v", err)
+	}
+	if err := validateForwarding(c.Forwarding); err != nil {
+		addf("forwarding: %v", err)
+	}
+	if err := validateHISNetwork(c.HIS.Network); err != nil {
+		addf("his.network: %v", err)
+	}
+	if err := validateCluster(c.Cluster); err != nil {
+		addf("cluster: %v", err)
+	}
+	if err := validateLoadShedding(c.LoadShedding); err != nil {
+		addf("loadShedding: %v", err)
+	}
+	if err := validateTiers(c.Tiers); err != nil {
+		addf("tiers: %v", err)
+	}
+	if _, err := newSplitHorizon(c.SplitHorizon, srv.TenantPortStart, srv.TenantPortEnd); err != nil {
+		addf("splitHorizon: %v", err)
+	}
+	if err := validateIPReputationConfig(c.IPReputation); err != nil {
+		addf("ipReputation: %v", err)
+	}
+	if err := validateCanaryPolicies(c.Canaries); err != nil {
+		addf("canaries: %v", err)
+	}
+	if _, err := parseConnectionStringTemplates(c.ConnectionStrings); err != nil {
+		addf("connectionStrings: %v", err)
+	}
+	if _, err := parseServiceEndpoints(c.ServiceEndpoints); err != nil {
+		addf("serviceEndpoints: %v", err)
+	}
+
+	return problems
+}
+
+// unknownConfigKeys walks decoded JSON alongside the config type and reports
+// keys that don't match any field
+func unknownConfigKeys(value interface{}, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var problems []string
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := jsonFields(t)
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			fieldType, ok := fields[key]
+			if !ok {
+				known := make([]string, 0, len(fields))
+				for name := range fields {
+					known = append(known, name)
+				}
+				problems = append(problems, fmt.Sprintf("%s: unknown key%s", keyPath, suggestion(key, known)))
+				continue
+			}
+			problems = append(problems, unknownConfigKeys(obj[key], fieldType, keyPath)...)
+		}
+
+	case reflect.Slice:
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, item := range items {
+			problems = append(problems, unknownConfigKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return problems
+}
+
+// jsonFields maps a struct's JSON keys to their field types
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			for key, fieldType := range jsonFields(field.Type) {
+				fields[key] = fieldType
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// suggestion returns ` (did you mean "x"?)` for the closest known name, or ""
+func suggestion(name string, known []string) string {
+	best, bestDistance := "", 3
+	sort.Strings(known)
+	for _, candidate := range known {
+		if strings.EqualFold(candidate, name) {
+			return fmt.Sprintf(" (did you mean %q?)", candidate)
+		}
+		if d := editDistance(strings.ToLower(name), strings.ToLower(candidate)); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (did you mean %q?)", best)
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = curr[j-1] + 1
+			if prev[j]+1 < curr[j] {
+				curr[j] = prev[j] + 1
+			}
+			if prev[j-1]+cost < curr[j] {
+				curr[j] = prev[j-1] + cost
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
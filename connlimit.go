@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// Where a tenant's connection limit came from, highest precedence first
+const (
+	connLimitAdmin   = "admin"
+	connLimitHIS     = "his"
+	connLimitToken   = "token"
+	connLimitTier    = "tier"
+	connLimitDefault = "default"
+)
+
+// maxConnLimit bounds per-tenant overrides so a typo can't exhaust file descriptors
+const maxConnLimit = 10000
+
+// applyConnLimitLocked recomputes a tenant's effective connection limit from
+// the admin override, the HIS value, the registration token, the tenant's
+// tier and the relay default, in that order. Lowering it doesn't close open connections; new ones
+// are refused until the count drops. Caller holds s.mu.
+func (s *RelayServer) applyConnLimitLocked(tenant *Tenant) {
+	tenant.mu.Lock()
+	defer tenant.mu.Unlock()
+
+	limit, source := s.config.MaxConnectionsPerTenant, connLimitDefault
+	switch {
+	case s.connLimits[tenant.ID] > 0:
+		limit, source = s.connLimits[tenant.ID], connLimitAdmin
+	case tenant.hisMaxConns > 0:
+		limit, source = tenant.hisMaxConns, connLimitHIS
+	case tenant.tokenMaxConns > 0:
+		limit, source = tenant.tokenMaxConns, connLimitToken
+	case s.tiers[tenant.Tier].MaxConnections > 0:
+		limit, source = s.tiers[tenant.Tier].MaxConnections, connLimitTier
+	}
+	if limit != tenant.MaxConns && tenant.MaxConnsSource != "" {
+		log.Printf("Tenant %s connection limit %d -> %d (%s)", tenant.ID, tenant.MaxConns, limit, source)
+	}
+	tenant.MaxConns = limit
+	tenant.MaxConnsSource = source
+}
+
+// setConnLimitOverride sets (or, with 0, clears) the admin connection limit
+// for a tenant. Overrides are kept while the tenant is away and apply when it
+// registers again. It returns the effective limit, or 0 if not registered.
+func (s *RelayServer) setConnLimitOverride(tenantID string, limit int) (int, error) {
+	if limit < 0 || limit > maxConnLimit {
+		return 0, fmt.Errorf("maxConnections must be between 0 and %d", maxConnLimit)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if limit == 0 {
+		delete(s.connLimits, tenantID)
+	} else {
+		s.connLimits[tenantID] = limit
+	}
+
+	tenant, ok := s.tenants[tenantID]
+	if !ok {
+		return 0, nil
+	}
+	s.applyConnLimitLocked(tenant)
+	return tenant.MaxConns, nil
+}
+
+// setHISConnLimit applies the connection limit HIS returned for a tenant; 0
+// leaves the decision to the token and relay default
+func (s *RelayServer) setHISConnLimit(tenant *Tenant, limit int) {
+	if limit < 0 || limit > maxConnLimit {
+		log.Printf("⚠️  Ignoring HIS connection limit %d for tenant %s", limit, tenant.ID)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenant.mu.Lock()
+	tenant.hisMaxConns = limit
+	tenant.mu.Unlock()
+	s.applyConnLimitLocked(tenant)
+}
+
+// connLimitMetrics reports each registered tenant's effective limit and its
+// source. Callers hold s.mu.
+func (s *RelayServer) connLimitMetrics() map[string]interface{} {
+	tenants := make(map[string]interface{}, len(s.tenants))
+	for id, tenant := range s.tenants {
+		tenant.mu.Lock()
+		tenants[id] = map[string]interface{}{
+			"limit":  tenant.MaxConns,
+			"source": tenant.MaxConnsSource,
+			"active": tenant.ActiveConns,
+		}
+		tenant.mu.Unlock()
+	}
+	return map[string]interface{}{
+		"default":   s.config.MaxConnectionsPerTenant,
+		"overrides": len(s.connLimits),
+		"tenants":   tenants,
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+const (
+	// defaultPublicHost is the hostname SQL clients use to reach tenant ports
+	defaultPublicHost = "link.tatbeeb.sa"
+	// connectionStringADONet is the variant also sent as the legacy ConnectionString
+	connectionStringADONet = "adoNet"
+)
+
+// defaultConnectionStringTemplates are used for variants not set in config
+var defaultConnectionStringTemplates = map[string]string{
+	connectionStringADONet: "Server={{.Host}},{{.Port}};Encrypt=True;TrustServerCertificate=False;User Id={{ado .User}};Password={{ado .Password}};",
+	"jdbc":                 "jdbc:sqlserver://{{.Host}}:{{.Port}};encrypt=true;trustServerCertificate=false;user={{jdbc .User}};password={{jdbc .Password}};",
+	"odbc":                 "Driver={ODBC Driver 18 for SQL Server};Server=tcp:{{.Host}},{{.Port}};Encrypt=yes;TrustServerCertificate=no;Uid={{odbc .User}};Pwd={{odbc .Password}};",
+}
+
+// connectionStringFuncs quote values per driver syntax so passwords with
+// separators can't break the string
+var connectionStringFuncs = template.FuncMap{
+	"ado": func(v string) string {
+		if strings.ContainsAny(v, ";'\"") || strings.TrimSpace(v) != v {
+			return `"` + strings.ReplaceAll(v, `"`, `""`) + `"`
+		}
+		return v
+	},
+	"jdbc": func(v string) string {
+		if strings.ContainsAny(v, ";{}") {
+			return "{" + strings.ReplaceAll(v, "}", "}}") + "}"
+		}
+		return v
+	},
+	"odbc": func(v string) string {
+		if strings.ContainsAny(v, ";{}") {
+			return "{" + strings.ReplaceAll(v, "}", "}}") + "}"
+		}
+		return v
+	},
+}
+
+// connectionStringData is what connection string templates can reference
+type connectionStringData struct {
+	TenantID string
+	Host     string
+	Port     int
+	User     string
+	Password string
+}
+
+// parseConnectionStringTemplates merges configured templates over the
+// defaults; an empty template removes a default variant
+func parseConnectionStringTemplates(configured map[string]string) (map[string]*template.Template, error) {
+	sources := make(map[string]string, len(defaultConnectionStringTemplates))
+	for name, text := range defaultConnectionStringTemplates {
+		sources[name] = text
+	}
+	for name, text := range configured {
+		sources[name] = text
+	}
+	if sources[connectionStringADONet] == "" {
+		return nil, fmt.Errorf("connection string template %q is required", connectionStringADONet)
+	}
+
+	templates := make(map[string]*template.Template, len(sources))
+	for name, text := range sources {
+		if text == "" {
+			continue
+		}
+		tmpl, err := template.New(name).Funcs(connectionStringFuncs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("connection string template %q: %w", name, err)
+		}
+		templates[name] = tmpl
+	}
+	return templates, nil
+}
+
+// connectionStringsFor renders the variants for a given host and port
+func (s *RelayServer) connectionStringsFor(tenant *Tenant, host string, port int) map[string]string {
+	data := connectionStringData{
+		TenantID: tenant.ID,
+		Host:     host,
+		Port:     port,
+		User:     tenant.SQLUser,
+		Password: tenant.SQLPassword,
+	}
+
+	names := make([]string, 0, len(s.connStringTemplates))
+	for name := range s.connStringTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rendered := make(map[string]string, len(names))
+	for _, name := range names {
+		var b strings.Builder
+		if err := s.connStringTemplates[name].Execute(&b, data); err != nil {
+			continue
+		}
+		rendered[name] = b.String()
+	}
+	return rendered
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// trackedConn is a live SQL client connection being forwarded to an agent
+type trackedConn struct {
+	id         uint64
+	tenantID   string
+	clientAddr string
+	startedAt  time.Time
+	stats      *ForwardStats
+	progress   connProgress
+	closer     io.Closer
+}
+
+// bytes returns the bytes forwarded so far in each direction
+func (c *trackedConn) bytes() (clientToAgent, agentToClient int64) {
+	return c.stats.Bytes()
+}
+
+// ConnInfo is one row of the connection table, with human-readable
+// timestamps and byte counts for support tickets
+type ConnInfo struct {
+	ID                 uint64 `json:"id"`
+	TenantID           string `json:"tenantId"`
+	ClientAddr         string `json:"clientAddr"`
+	StartedAt          string `json:"startedAt"`
+	Duration           string `json:"duration"`
+	BytesClientToAgent int64  `json:"bytesClientToAgent"`
+	BytesAgentToClient int64  `json:"bytesAgentToClient"`
+	ClientToAgent      string `json:"clientToAgent"`
+	AgentToClient      string `json:"agentToClient"`
+	// Per-direction states show which side of a hung session stalled
+	ClientToAgentState ConnDirection `json:"clientToAgentState"`
+	AgentToClientState ConnDirection `json:"agentToClientState"`
+}
+
+// ConnDirection is the state of one direction of a connection: open,
+// stalled on a receiver that isn't reading, half-closed by its sender, or
+// ended by an error
+type ConnDirection struct {
+	State          string `json:"state"`
+	LastByteAt     string `json:"lastByteAt,omitempty"`
+	IdleSeconds    int64  `json:"idleSeconds"` // since the last byte, or the start
+	StalledSeconds int64  `json:"stalledSeconds,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// connDirection renders a direction's state against the stats' own time
+// source, which the relay sets to the base clock startedAt comes from
+func connDirection(c *trackedConn, upstream bool) ConnDirection {
+	now := c.stats.now()
+	state := c.stats.Direction(upstream, now)
+	direction := ConnDirection{
+		State:          state.State,
+		StalledSeconds: int64(state.StalledFor / time.Second),
+		Error:          state.Error,
+	}
+	if state.LastByteAt.IsZero() {
+		direction.IdleSeconds = int64(now.Sub(c.startedAt) / time.Second)
+	} else {
+		direction.LastByteAt = state.LastByteAt.Format("2006-01-02 15:04:05 MST")
+		direction.IdleSeconds = int64(now.Sub(state.LastByteAt) / time.Second)
+	}
+	return direction
+}
+
+// ConnTable tracks live client connections across all tenants
+type ConnTable struct {
+	nextID uint64
+	conns  map[uint64]*trackedConn
+	mu     sync.Mutex
+}
+
+// NewConnTable creates an empty connection table
+func NewConnTable() *ConnTable {
+	return &ConnTable{conns: make(map[uint64]*trackedConn)}
+}
+
+// Add starts tracking a connection; callers must Remove it when it closes.
+// closer ends the connection for CloseTenant; stats counts its bytes.
+func (t *ConnTable) Add(tenantID, clientAddr string, closer io.Closer, stats *ForwardStats) *trackedConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nextID++
+	conn := &trackedConn{
+		id:         t.nextID,
+		tenantID:   tenantID,
+		clientAddr: clientAddr,
+		startedAt:  clock.BaseNow(),
+		closer:     closer,
+		stats:      stats,
+	}
+	t.conns[conn.id] = conn
+	return conn
+}
+
+// Remove stops tracking a connection
+func (t *ConnTable) Remove(conn *trackedConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, conn.id)
+}
+
+// CloseTenant closes every live connection of a tenant and returns how many
+func (t *ConnTable) CloseTenant(tenantID string) int {
+	t.mu.Lock()
+	var closers []io.Closer
+	for _, c := range t.conns {
+		if c.tenantID == tenantID {
+			closers = append(closers, c.closer)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, closer := range closers {
+		closer.Close()
+	}
+	return len(closers)
+}
+
+// Snapshot returns live connections, oldest first, optionally for one tenant
+func (t *ConnTable) Snapshot(tenantID string) []ConnInfo {
+	t.mu.Lock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for _, c := range t.conns {
+		if tenantID == "" || c.tenantID == tenantID {
+			conns = append(conns, c)
+		}
+	}
+	t.mu.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+
+	now := clock.BaseNow()
+	rows := make([]ConnInfo, 0, len(conns))
+	for _, c := range conns {
+		up, down := c.bytes()
+		rows = append(rows, ConnInfo{
+			ID:                 c.id,
+			TenantID:           c.tenantID,
+			ClientAddr:         c.clientAddr,
+			StartedAt:          c.startedAt.Format("2006-01-02 15:04:05 MST"),
+			Duration:           now.Sub(c.startedAt).Round(time.Second).String(),
+			BytesClientToAgent: up,
+			BytesAgentToClient: down,
+			ClientToAgent:      formatBytes(up),
+			AgentToClient:      formatBytes(down),
+			ClientToAgentState: connDirection(c, true),
+			AgentToClientState: connDirection(c, false),
+		})
+	}
+	return rows
+}
+
+// formatBytes renders a byte count as e.g. "1.5 MiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// maxDeregistrationGrace bounds how long a tenant without a control
+	// session keeps its port
+	maxDeregistrationGrace = time.Hour
+	// drainCheckInterval is how often a draining tenant's open connections
+	// are counted
+	drainCheckInterval = time.Second
+)
+
+// DeregistrationConfig delays unregistering a tenant whose agent stopped
+// answering pings. Its yamux session may still carry SQL sessions that are
+// flowing, so for graceSeconds those keep running while new connections are
+// refused; the tenant is unregistered once they finish or the grace is over.
+// An agent whose session closed is unregistered at once, as its streams are
+// gone. 0 (the default) unregisters at once.
+type DeregistrationConfig struct {
+	GraceSeconds int `json:"graceSeconds"`
+}
+
+// grace returns how long open connections may outlive the control session
+func (c DeregistrationConfig) grace() time.Duration {
+	return time.Duration(c.GraceSeconds) * time.Second
+}
+
+// validateDeregistration checks the grace stays within bounds
+func validateDeregistration(cfg DeregistrationConfig) error {
+	if cfg.GraceSeconds < 0 || cfg.grace() > maxDeregistrationGrace {
+		return fmt.Errorf("graceSeconds must be between 0 and %d", int(maxDeregistrationGrace/time.Second))
+	}
+	return nil
+}
+
+// errControlLost refuses clients of a tenant draining after its control
+// session was lost
+var errControlLost = errors.New("agent control session lost")
+
+// controlLost reports whether the tenant is draining after losing its
+// control session
+func (t *Tenant) controlLost() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.controlLostAt.IsZero()
+}
+
+// drainAfterControlLoss keeps the tenant's open connections running for the
+// deregistration grace after a failed ping, refusing new ones, then
+// unregisters it with reason
+func (s *RelayServer) drainAfterControlLoss(tenant *Tenant, reason, detail string) {
+	grace := s.deregistration.grace()
+
+	tenant.mu.Lock()
+	tenant.controlLostAt = clock.Now()
+	active := tenant.ActiveConns
+	tenant.mu.Unlock()
+	if active == 0 {
+		s.unregisterTenant(tenant, reason, detail)
+		return
+	}
+
+	log.Printf("⚠️  Tenant %s lost its control session; %d open connections may finish within %v, new ones are refused",
+		tenant.ID, active, grace)
+	s.setTenantState(tenant.ID, tenantStateDraining, "control session lost", servingStates...)
+
+	deadline := clock.NewTimer(grace)
+	defer deadline.Stop()
+	ticker := clock.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-tenant.ControlSession.CloseChan():
+			s.unregisterTenant(tenant, closeReasonAgentDisconnected, detail)
+			return
+		case <-deadline.C:
+			tenant.mu.Lock()
+			active = tenant.ActiveConns
+			tenant.mu.Unlock()
+			log.Printf("Tenant %s grace after control session loss over, closing %d connections", tenant.ID, active)
+			s.unregisterTenant(tenant, reason, fmt.Sprintf("%s; %d connections closed after %v grace", detail, active, grace))
+			return
+		case <-ticker.C:
+		}
+
+		tenant.mu.Lock()
+		active = tenant.ActiveConns
+		tenant.mu.Unlock()
+		if active == 0 {
+			log.Printf("Tenant %s connections finished after control session loss", tenant.ID)
+			s.unregisterTenant(tenant, reason, detail)
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/tatbeeb/tatbeeb-link/common"
+)
+
+// defaultMaxControlMessageBytes bounds one control message from an agent.
+// Registrations are small today, but capability lists and multi-service
+// definitions will not fit the single 4 KiB read agents used to rely on.
+const defaultMaxControlMessageBytes = 64 << 10
+
+var (
+	errControlMessageTooLarge  = errors.New("control message too large")
+	errControlMessageMalformed = errors.New("malformed control message")
+)
+
+// readAgentControl reads the messages an agent sends on its control stream
+// after registration until the stream closes
+func (s *RelayServer) readAgentControl(tenant *Tenant, control io.Reader) {
+	decoder := json.NewDecoder(control)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				s.counters.inc(&s.counters.controlMsgMalformed)
+				log.Printf("⚠️  Tenant %s sent a malformed control message: %v", tenant.ID, err)
+			}
+			return
+		}
+		if len(raw) > s.maxControlMsg {
+			s.counters.inc(&s.counters.controlMsgOversized)
+			continue
+		}
+		msg, err := common.DecodeMessage(raw)
+		if err != nil {
+			s.counters.inc(&s.counters.controlMsgMalformed)
+			continue
+		}
+
+		switch msg.Type {
+		case msgTypeCredentialProvisioned:
+			var ack CredentialProvisioned
+			if err := common.DecodePayload(msg, &ack); err != nil {
+				s.counters.inc(&s.counters.controlMsgMalformed)
+				continue
+			}
+			tenant.credentialProvisioned(ack)
+		case msgTypeFlowTelemetry:
+			var report AgentFlowTelemetry
+			if err := common.DecodePayload(msg, &report); err != nil {
+				s.counters.inc(&s.counters.controlMsgMalformed)
+				continue
+			}
+			tenant.agentFlowReported(report)
+		}
+	}
+}
+
+// readControlMessage decodes one JSON control message from r, however it is
+// split across reads, reading at most max bytes
+func readControlMessage(r io.Reader, max int) (*common.Message, error) {
+	limited := &io.LimitedReader{R: r, N: int64(max) + 1}
+	var raw json.RawMessage
+	if err := json.NewDecoder(limited).Decode(&raw); err != nil {
+		var syntaxErr *json.SyntaxError
+		switch {
+		case limited.N <= 0:
+			return nil, fmt.Errorf("%w: over %d bytes", errControlMessageTooLarge, max)
+		case errors.As(err, &syntaxErr):
+			return nil, fmt.Errorf("%w: %v", errControlMessageMalformed, err)
+		}
+		return nil, err
+	}
+
+	msg, err := common.DecodeMessage(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errControlMessageMalformed, err)
+	}
+	return msg, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Forwarding concurrency models
+const (
+	// concurrencyGoroutines copies each direction of a connection on its own
+	// goroutine; lowest latency, two goroutines per connection
+	concurrencyGoroutines = "goroutine"
+	// concurrencyPool services every connection from a fixed pool of copy
+	// workers, trading some latency for a bounded goroutine count
+	concurrencyPool = "pool"
+
+	defaultCopyWorkers    = 64
+	defaultCopyPollMillis = 10
+)
+
+// copyTierSchedule weights how often each tier's queue is served when
+// several have work: gold four times as often as bronze
+var copyTierSchedule = []string{tierGold, tierGold, tierGold, tierGold, tierSilver, tierSilver, tierBronze}
+
+// ForwardingConfig selects how forwarded connections are scheduled
+type ForwardingConfig struct {
+	Concurrency string `json:"concurrency"` // "goroutine" (default) or "pool"
+	Workers     int    `json:"workers"`     // pool size
+	PollMillis  int    `json:"pollMillis"`  // how long a worker waits on one idle connection
+	// Closes client connections with no bytes either way for this long; 0 never does
+	IdleTimeoutSec int `json:"idleTimeoutSeconds"`
+}
+
+// validateForwarding checks the concurrency model and pool settings
+func validateForwarding(cfg ForwardingConfig) error {
+	switch cfg.Concurrency {
+	case "", concurrencyGoroutines, concurrencyPool:
+	default:
+		return fmt.Errorf("concurrency must be %q or %q", concurrencyGoroutines, concurrencyPool)
+	}
+	if cfg.Workers < 0 || cfg.PollMillis < 0 || cfg.IdleTimeoutSec < 0 {
+		return fmt.Errorf("workers, pollMillis and idleTimeoutSeconds must not be negative")
+	}
+	return nil
+}
+
+// copyTask is one direction of a forwarded connection
+type copyTask struct {
+	dst       io.Writer
+	src       io.Reader
+	deadlines readDeadliner
+	done      chan<- error
+	tier      string
+	queuedAt  time.Time
+}
+
+// CopyPool forwards connections with a fixed set of workers instead of two
+// goroutines per connection. A worker takes the next queued direction, reads
+// whatever arrives within the poll interval, writes it out and queues the
+// direction again, so an idle connection holds a worker for at most one poll.
+// Idle directions are still polled in turn, so their CPU cost and the queue
+// wait of busy ones grow with the number of open connections. Writes to a
+// slow or throttled peer block the worker that made them. Each tier has its
+// own queue, served by copyTierSchedule.
+type CopyPool struct {
+	workers int
+	poll    time.Duration
+
+	queues   map[string][]*copyTask
+	queued   int
+	schedule int // position in copyTierSchedule
+	cond     *sync.Cond
+	mu       sync.Mutex
+
+	tasks     int64 // directions being forwarded, atomic
+	reads     int64 // reads that moved data, atomic
+	idlePolls int64 // reads that timed out without data, atomic
+	waitTotal map[string]time.Duration
+	waits     map[string]int64
+	waitMax   time.Duration
+}
+
+// NewCopyPool creates a worker pool from the forwarding config
+func NewCopyPool(cfg ForwardingConfig) *CopyPool {
+	workers := cfg.Workers
+	if workers == 0 {
+		workers = defaultCopyWorkers
+	}
+	pollMillis := cfg.PollMillis
+	if pollMillis == 0 {
+		pollMillis = defaultCopyPollMillis
+	}
+	p := &CopyPool{
+		workers:   workers,
+		poll:      time.Duration(pollMillis) * time.Millisecond,
+		queues:    make(map[string][]*copyTask, len(tiersInOrder)),
+		waitTotal: make(map[string]time.Duration, len(tiersInOrder)),
+		waits:     make(map[string]int64, len(tiersInOrder)),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// Start runs the workers until the process exits
+func (p *CopyPool) Start(watchdog *GoroutineWatchdog) {
+	for i := 0; i < p.workers; i++ {
+		go p.work(watchdog)
+	}
+	log.Printf("🔀 Forwarding with a pool of %d copy workers (poll %v)", p.workers, p.poll)
+}
+
+// Submit queues one direction of a connection of a tenant in tier; its
+// result is sent to done like a copy goroutine's would be
+func (p *CopyPool) Submit(tier string, dst io.Writer, src io.Reader, deadlines readDeadliner, done chan<- error) {
+	if !validTier(tier) {
+		tier = defaultTier
+	}
+	atomic.AddInt64(&p.tasks, 1)
+	p.enqueue(&copyTask{dst: dst, src: src, deadlines: deadlines, done: done, tier: tier})
+}
+
+func (p *CopyPool) enqueue(task *copyTask) {
+	task.queuedAt = clock.Now()
+	p.mu.Lock()
+	p.queues[task.tier] = append(p.queues[task.tier], task)
+	p.queued++
+	p.mu.Unlock()
+	p.cond.Signal()
+}
+
+// next blocks until a task is queued, takes one from the tier the schedule
+// favours and records how long it waited
+func (p *CopyPool) next() *copyTask {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.queued == 0 {
+		p.cond.Wait()
+	}
+	var task *copyTask
+	for task == nil {
+		tier := copyTierSchedule[p.schedule]
+		p.schedule = (p.schedule + 1) % len(copyTierSchedule)
+		if queue := p.queues[tier]; len(queue) > 0 {
+			task = queue[0]
+			queue[0] = nil
+			p.queues[tier] = queue[1:]
+		}
+	}
+	p.queued--
+
+	wait := clock.Since(task.queuedAt)
+	p.waitTotal[task.tier] += wait
+	p.waits[task.tier]++
+	if wait > p.waitMax {
+		p.waitMax = wait
+	}
+	return task
+}
+
+func (p *CopyPool) work(watchdog *GoroutineWatchdog) {
+	defer watchdog.track(goroutineCopy)()
+
+	buf := make([]byte, copyBufferSize)
+	for {
+		task := p.next()
+		if err := p.step(task, buf); err != nil {
+			p.finish(task, err)
+			continue
+		}
+		p.enqueue(task)
+	}
+}
+
+// step moves whatever the task's source delivers within one poll. It returns
+// io.EOF or another error once the direction is finished.
+func (p *CopyPool) step(task *copyTask, buf []byte) error {
+	task.deadlines.SetReadDeadline(time.Now().Add(p.poll))
+	n, err := task.src.Read(buf)
+	if n > 0 {
+		atomic.AddInt64(&p.reads, 1)
+		if _, werr := task.dst.Write(buf[:n]); werr != nil {
+			return werr
+		}
+	}
+	if err != nil && isTimeoutError(err) {
+		if n == 0 {
+			atomic.AddInt64(&p.idlePolls, 1)
+		}
+		return nil
+	}
+	return err
+}
+
+// finish reports a direction's result, with EOF as success like io.Copy
+func (p *CopyPool) finish(task *copyTask, err error) {
+	atomic.AddInt64(&p.tasks, -1)
+	task.deadlines.SetReadDeadline(time.Time{})
+	if err == io.EOF {
+		err = nil
+	}
+	task.done <- err
+}
+
+// avgWaitMs is how long a tier's directions waited for a worker on average
+func (p *CopyPool) avgWaitMs(tier string) float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.waits[tier] == 0 {
+		return 0
+	}
+	return float64((p.waitTotal[tier] / time.Duration(p.waits[tier])).Microseconds()) / 1000
+}
+
+// Metrics reports pool size, load and how long directions waited for a worker
+func (p *CopyPool) Metrics() map[string]interface{} {
+	p.mu.Lock()
+	queued := p.queued
+	var waitTotal time.Duration
+	var waits int64
+	for tier, total := range p.waitTotal {
+		waitTotal += total
+		waits += p.waits[tier]
+	}
+	var avgWait time.Duration
+	if waits > 0 {
+		avgWait = waitTotal / time.Duration(waits)
+	}
+	maxWait := p.waitMax
+	p.mu.Unlock()
+
+	return map[string]interface{}{
+		"workers":        p.workers,
+		"pollMillis":     p.poll.Milliseconds(),
+		"directions":     atomic.LoadInt64(&p.tasks),
+		"queued":         queued,
+		"reads":          atomic.LoadInt64(&p.reads),
+		"idlePolls":      atomic.LoadInt64(&p.idlePolls),
+		"avgQueueWaitMs": float64(avgWait.Microseconds()) / 1000,
+		"maxQueueWaitMs": float64(maxWait.Microseconds()) / 1000,
+	}
+}
+
+// isTimeoutError reports whether err is a read deadline expiring, on a TCP
+// connection or a yamux stream
+func isTimeoutError(err error) bool {
+	if errors.Is(err, yamux.ErrTimeout) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// startCopy forwards one direction of a connection and sends its result to
+// done: on its own goroutine, or as a task of the copy worker pool
+func (s *RelayServer) startCopy(tier string, dst io.Writer, src io.Reader, deadlines readDeadliner, done chan<- error) {
+	if s.copyPool != nil {
+		s.copyPool.Submit(tier, dst, src, deadlines, done)
+		return
+	}
+	go func() {
+		defer s.watchdog.track(goroutineCopy)()
+		_, err := bufferedCopy(dst, src)
+		done <- err
+	}()
+}
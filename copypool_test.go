@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+const (
+	benchActiveConns = 16
+	benchPayload     = 512
+)
+
+// benchIdleConns are the idle connections forwarded next to the active ones
+var benchIdleConns = []int{0, 1000}
+
+// pipeOpener hands the Forwarder one end of an in-memory agent stream
+type pipeOpener struct{ stream net.Conn }
+
+func (o pipeOpener) OpenStream() (net.Conn, error) { return o.stream, nil }
+
+// passPolicy forwards every client unchanged
+type passPolicy struct{}
+
+func (passPolicy) Admit(client net.Conn) (io.Reader, error) { return client, nil }
+
+func (passPolicy) Opened(client, stream net.Conn, stats *ForwardStats) (up, down io.Writer) {
+	return stream, client
+}
+
+func (passPolicy) Finished(client net.Conn, stats *ForwardStats, err error) {}
+
+// forwardEcho forwards an in-memory client connection to an echoing agent
+// with s's concurrency model, returning the client's end
+func forwardEcho(s *RelayServer) net.Conn {
+	client, clientEnd := net.Pipe()
+	stream, agentEnd := net.Pipe()
+	go io.Copy(agentEnd, agentEnd)
+
+	forwarder := &Forwarder{
+		Opener: pipeOpener{stream: stream},
+		Policy: passPolicy{},
+		Start: func(dst io.Writer, src io.Reader, deadlines readDeadliner, done chan<- error) {
+			s.startCopy(defaultTier, dst, src, deadlines, done)
+		},
+	}
+	go func() {
+		forwarder.Forward(client, &ForwardStats{})
+		client.Close()
+		agentEnd.Close()
+	}()
+	return clientEnd
+}
+
+// benchmarkForward measures echo round trips on benchActiveConns connections
+// while idle others are forwarded alongside
+func benchmarkForward(b *testing.B, s *RelayServer, idle int) {
+	conns := make([]net.Conn, 0, idle+benchActiveConns)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < idle; i++ {
+		conns = append(conns, forwardEcho(s))
+	}
+	active := make([]net.Conn, benchActiveConns)
+	for i := range active {
+		active[i] = forwardEcho(s)
+		conns = append(conns, active[i])
+	}
+
+	b.SetBytes(2 * benchPayload)
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for i, conn := range active {
+		rounds := b.N / benchActiveConns
+		if i < b.N%benchActiveConns {
+			rounds++
+		}
+		wg.Add(1)
+		go func(conn net.Conn, rounds int) {
+			defer wg.Done()
+			out := make([]byte, benchPayload)
+			in := make([]byte, benchPayload)
+			for r := 0; r < rounds; r++ {
+				if _, err := conn.Write(out); err != nil {
+					b.Error(err)
+					return
+				}
+				if _, err := io.ReadFull(conn, in); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(conn, rounds)
+	}
+	wg.Wait()
+}
+
+func BenchmarkForwardGoroutine(b *testing.B) {
+	s := &RelayServer{watchdog: NewGoroutineWatchdog()}
+	for _, idle := range benchIdleConns {
+		b.Run(fmt.Sprintf("idle=%d", idle), func(b *testing.B) {
+			benchmarkForward(b, s, idle)
+		})
+	}
+}
+
+func BenchmarkForwardPool(b *testing.B) {
+	s := &RelayServer{watchdog: NewGoroutineWatchdog(), copyPool: NewCopyPool(ForwardingConfig{})}
+	s.copyPool.Start(s.watchdog)
+	for _, idle := range benchIdleConns {
+		b.Run(fmt.Sprintf("idle=%d", idle), func(b *testing.B) {
+			benchmarkForward(b, s, idle)
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import "sync/atomic"
+
+// relayCounters are process-wide event counters exported in /metrics
+type relayCounters struct {
+	yamuxSessionFailures       int64
+	controlAcceptFailures      int64
+	handshakeTimeouts          int64
+	registrationsBusy          int64
+	bytesClientToAgent         int64
+	bytesAgentToClient         int64
+	protocolRejects            int64
+	preloginTimeouts           int64
+	streamBudgetRejects        int64
+	idleCloses                 int64
+	hisAckTimeouts             int64
+	alpnNone                   int64
+	alpnControl                int64
+	alpnSQL                    int64
+	alpnRefused                int64
+	freezeRejects              int64
+	killRejects                int64
+	controlMsgOversized        int64
+	controlMsgMalformed        int64
+	webhookBadSignature        int64
+	webhookStale               int64
+	webhookReplayed            int64
+	credentialRotations        int64
+	credentialRotationFailures int64
+	registrationsRateLimited   int64
+	registrationsBlocked       int64
+}
+
+func (c *relayCounters) inc(counter *int64) {
+	atomic.AddInt64(counter, 1)
+}
+
+func (c *relayCounters) snapshot() map[string]int64 {
+	return map[string]int64{
+		"yamux_session_failures":         atomic.LoadInt64(&c.yamuxSessionFailures),
+		"control_stream_accept_failures": atomic.LoadInt64(&c.controlAcceptFailures),
+		"control_handshake_timeouts":     atomic.LoadInt64(&c.handshakeTimeouts),
+		"registrations_rejected_busy":    atomic.LoadInt64(&c.registrationsBusy),
+		"bytes_client_to_agent":          atomic.LoadInt64(&c.bytesClientToAgent),
+		"bytes_agent_to_client":          atomic.LoadInt64(&c.bytesAgentToClient),
+		"client_protocol_rejects":        atomic.LoadInt64(&c.protocolRejects),
+		"client_prelogin_timeouts":       atomic.LoadInt64(&c.preloginTimeouts),
+		"stream_budget_rejects":          atomic.LoadInt64(&c.streamBudgetRejects),
+		"idle_connections_closed":        atomic.LoadInt64(&c.idleCloses),
+		"his_ack_timeouts":               atomic.LoadInt64(&c.hisAckTimeouts),
+		"control_alpn_none":              atomic.LoadInt64(&c.alpnNone),
+		"control_alpn_yamux":             atomic.LoadInt64(&c.alpnControl),
+		"control_alpn_sql":               atomic.LoadInt64(&c.alpnSQL),
+		"control_alpn_refused":           atomic.LoadInt64(&c.alpnRefused),
+		"access_freeze_rejects":          atomic.LoadInt64(&c.freezeRejects),
+		"kill_switch_rejects":            atomic.LoadInt64(&c.killRejects),
+		"control_messages_oversized":     atomic.LoadInt64(&c.controlMsgOversized),
+		"control_messages_malformed":     atomic.LoadInt64(&c.controlMsgMalformed),
+		"his_webhook_bad_signature":      atomic.LoadInt64(&c.webhookBadSignature),
+		"his_webhook_stale":              atomic.LoadInt64(&c.webhookStale),
+		"his_webhook_replayed":           atomic.LoadInt64(&c.webhookReplayed),
+		"credential_rotations":           atomic.LoadInt64(&c.credentialRotations),
+		"credential_rotation_failures":   atomic.LoadInt64(&c.credentialRotationFailures),
+		"registrations_rate_limited":     atomic.LoadInt64(&c.registrationsRateLimited),
+		"registrations_rejected_blocked": atomic.LoadInt64(&c.registrationsBlocked),
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/tatbeeb/tatbeeb-link/common"
+)
+
+// Control messages of a credential rotation
+const (
+	// msgTypeRotateCredential asks the agent to provision a new SQL login
+	msgTypeRotateCredential = "rotate_credential"
+	// msgTypeCredentialProvisioned is the agent's answer, sent on the control
+	// stream with the rotation ID
+	msgTypeCredentialProvisioned = "credential_provisioned"
+	// msgTypeRetireCredential tells the agent to drop the previous login once
+	// its overlap window is over
+	msgTypeRetireCredential = "retire_credential"
+)
+
+const (
+	defaultCredentialOverlap        = time.Hour
+	defaultCredentialConfirmTimeout = 30 * time.Second
+	credentialCheckInterval         = time.Minute
+)
+
+var (
+	errRotationInProgress = errors.New("a credential rotation is in progress until its previous login is retired")
+	errRotationTimedOut   = errors.New("agent did not confirm the new credential in time")
+)
+
+// CredentialRotationConfig schedules automatic rotation of each tenant's SQL
+// credential. The agent provisions the new login, HIS is sent it, and the
+// previous login keeps working for the overlap so open pools can drain.
+type CredentialRotationConfig struct {
+	IntervalHours     int `json:"intervalHours"`         // 0 disables scheduled rotation
+	OverlapMinutes    int `json:"overlapMinutes"`        // default 60
+	ConfirmTimeoutSec int `json:"confirmTimeoutSeconds"` // default 30
+}
+
+func (c CredentialRotationConfig) interval() time.Duration {
+	return time.Duration(c.IntervalHours) * time.Hour
+}
+
+func (c CredentialRotationConfig) overlap() time.Duration {
+	if c.OverlapMinutes > 0 {
+		return time.Duration(c.OverlapMinutes) * time.Minute
+	}
+	return defaultCredentialOverlap
+}
+
+func (c CredentialRotationConfig) confirmTimeout() time.Duration {
+	if c.ConfirmTimeoutSec > 0 {
+		return time.Duration(c.ConfirmTimeoutSec) * time.Second
+	}
+	return defaultCredentialConfirmTimeout
+}
+
+// CredentialRotation is the payload of a rotate_credential message
+type CredentialRotation struct {
+	RotationID         string    `json:"rotationId"`
+	SQLUser            string    `json:"sqlUser"`
+	SQLPassword        string    `json:"sqlPassword"`
+	PreviousSQLUser    string    `json:"previousSqlUser"`
+	PreviousValidUntil time.Time `json:"previousValidUntil"`
+}
+
+// CredentialProvisioned is the payload of a credential_provisioned message;
+// Error is set when the agent could not create the login
+type CredentialProvisioned struct {
+	RotationID string `json:"rotationId"`
+	Error      string `json:"error,omitempty"`
+}
+
+// CredentialRetirement is the payload of a retire_credential message
+type CredentialRetirement struct {
+	SQLUser string `json:"sqlUser"`
+}
+
+// credentialRotation is a rotation waiting for the agent's confirmation
+type credentialRotation struct {
+	id        string
+	confirmed chan CredentialProvisioned
+}
+
+// sqlUserFor names a tenant's SQL login; each rotation gets a new name so
+// the previous login can stay provisioned alongside it
+func sqlUserFor(tenantID string, generation int) string {
+	if generation == 0 {
+		return fmt.Sprintf("tatbeeb_%s", tenantID[:6])
+	}
+	return fmt.Sprintf("tatbeeb_%s_r%d", tenantID[:6], generation)
+}
+
+func newRotationID() string {
+	raw := make([]byte, 8)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// rotationPendingLocked reports whether a rotation is running or its previous
+// login is not yet retired. A new rotation would lose track of that login, so
+// it waits. The caller holds t.mu.
+func (t *Tenant) rotationPendingLocked() bool {
+	return t.rotation != nil || t.previousSQLUser != "" || t.credentialHISPending != nil
+}
+
+// credentialProvisioned hands the agent's answer to the rotation waiting for it
+func (t *Tenant) credentialProvisioned(ack CredentialProvisioned) {
+	t.mu.Lock()
+	rotation := t.rotation
+	t.mu.Unlock()
+
+	if rotation == nil || rotation.id != ack.RotationID {
+		log.Printf("⚠️  Tenant %s confirmed unknown credential rotation %q", t.ID, ack.RotationID)
+		return
+	}
+	select {
+	case rotation.confirmed <- ack:
+	default:
+	}
+}
+
+// rotateCredential replaces a tenant's SQL credential: the agent provisions
+// the new login and confirms, the relay switches to it and notifies HIS, and
+// the previous login is retired once the overlap is over. Each step is
+// recorded as an event.
+func (s *RelayServer) rotateCredential(tenant *Tenant, reason string) error {
+	rotation := &credentialRotation{id: newRotationID(), confirmed: make(chan CredentialProvisioned, 1)}
+	overlap := s.credentialRotation.overlap()
+
+	// The organization's policy in force now applies to the new password
+	password, policy, err := s.generatePassword(tenant.OrganizationID)
+	if err != nil {
+		s.counters.inc(&s.counters.credentialRotationFailures)
+		s.events.Emit("credential_rotation_failed", tenant.ID,
+			fmt.Sprintf("rotation %s failed at generate under policy %s: %v", rotation.id, policy, err))
+		return fmt.Errorf("generate: %w", err)
+	}
+
+	tenant.mu.Lock()
+	if tenant.rotationPendingLocked() {
+		tenant.mu.Unlock()
+		return errRotationInProgress
+	}
+	tenant.rotation = rotation
+	push := CredentialRotation{
+		RotationID:         rotation.id,
+		SQLUser:            sqlUserFor(tenant.ID, tenant.credentialGeneration+1),
+		SQLPassword:        password,
+		PreviousSQLUser:    tenant.SQLUser,
+		PreviousValidUntil: clock.Now().Add(s.credentialRotation.confirmTimeout() + overlap),
+	}
+	tenant.mu.Unlock()
+	defer func() {
+		tenant.mu.Lock()
+		tenant.rotation = nil
+		tenant.mu.Unlock()
+	}()
+
+	fail := func(step string, err error) error {
+		s.counters.inc(&s.counters.credentialRotationFailures)
+		s.events.Emit("credential_rotation_failed", tenant.ID,
+			fmt.Sprintf("rotation %s failed at %s, keeping %s: %v", rotation.id, step, push.PreviousSQLUser, err))
+		return fmt.Errorf("%s: %w", step, err)
+	}
+
+	s.events.Emit("credential_rotation_started", tenant.ID,
+		fmt.Sprintf("rotation %s (%s): %s replaces %s, policy %s", rotation.id, reason, push.SQLUser, push.PreviousSQLUser, policy))
+
+	data, err := common.EncodeMessage(msgTypeRotateCredential, push)
+	if err != nil {
+		return fail("push", err)
+	}
+	if err := tenant.writeControl(data); err != nil {
+		return fail("push", err)
+	}
+	s.events.Emit("credential_pushed", tenant.ID, fmt.Sprintf("rotation %s sent to the agent", rotation.id))
+
+	timer := clock.NewTimer(s.credentialRotation.confirmTimeout())
+	defer timer.Stop()
+	select {
+	case ack := <-rotation.confirmed:
+		if ack.Error != "" {
+			return fail("provision", errors.New(ack.Error))
+		}
+	case <-timer.C:
+		return fail("provision", errRotationTimedOut)
+	case <-tenant.ControlSession.CloseChan():
+		return fail("provision", errors.New("agent disconnected"))
+	}
+	s.events.Emit("credential_provisioned", tenant.ID, fmt.Sprintf("rotation %s confirmed by the agent", rotation.id))
+
+	// The new login exists on the clinic's server, so switch to it; the
+	// previous one stays until the overlap is over and HIS has the new one
+	now := clock.Now()
+	tenant.mu.Lock()
+	tenant.previousSQLUser = tenant.SQLUser
+	tenant.previousCredentialUntil = now.Add(overlap)
+	tenant.SQLUser = push.SQLUser
+	tenant.SQLPassword = push.SQLPassword
+	tenant.credentialPolicy = policy
+	tenant.credentialGeneration++
+	tenant.credentialRotatedAt = now
+	tenant.credentialHISPending = &CredentialRotatedRequest{
+		TenantID:           tenant.ID,
+		RotationID:         rotation.id,
+		SQLUser:            push.SQLUser,
+		SQLPassword:        push.SQLPassword,
+		PreviousSQLUser:    tenant.previousSQLUser,
+		PreviousValidUntil: tenant.previousCredentialUntil,
+	}
+	tenant.mu.Unlock()
+
+	s.counters.inc(&s.counters.credentialRotations)
+	s.notifyCredentialRotated(tenant)
+	return nil
+}
+
+// notifyCredentialRotated sends HIS the tenant's pending credential. A failure
+// is retried by the rotation loop; until HIS has it the previous login is not
+// retired.
+func (s *RelayServer) notifyCredentialRotated(tenant *Tenant) {
+	tenant.mu.Lock()
+	pending := tenant.credentialHISPending
+	tenant.mu.Unlock()
+	if pending == nil {
+		return
+	}
+
+	if err := s.hisClient.ReportCredentialRotated(*pending); err != nil {
+		s.events.Emit("credential_rotation_failed", tenant.ID,
+			fmt.Sprintf("rotation %s failed at his, will retry, keeping %s: %v", pending.RotationID, pending.PreviousSQLUser, err))
+		return
+	}
+
+	tenant.mu.Lock()
+	if tenant.credentialHISPending == pending {
+		tenant.credentialHISPending = nil
+	}
+	tenant.mu.Unlock()
+	s.events.Emit("credential_his_notified", tenant.ID,
+		fmt.Sprintf("rotation %s: HIS has %s, %s valid until %s", pending.RotationID, pending.SQLUser,
+			pending.PreviousSQLUser, pending.PreviousValidUntil.UTC().Format(time.RFC3339)))
+}
+
+// retireCredential tells the agent to drop the previous login once its
+// overlap is over and HIS has the current one
+func (s *RelayServer) retireCredential(tenant *Tenant, now time.Time) {
+	tenant.mu.Lock()
+	previous := tenant.previousSQLUser
+	if previous == "" || tenant.credentialHISPending != nil || now.Before(tenant.previousCredentialUntil) {
+		tenant.mu.Unlock()
+		return
+	}
+	tenant.mu.Unlock()
+
+	data, err := common.EncodeMessage(msgTypeRetireCredential, CredentialRetirement{SQLUser: previous})
+	if err != nil {
+		log.Printf("Failed to encode credential retirement for tenant %s: %v", tenant.ID, err)
+		return
+	}
+	if err := tenant.writeControl(data); err != nil {
+		log.Printf("⚠️  Failed to retire credential %s of tenant %s, will retry: %v", previous, tenant.ID, err)
+		return
+	}
+
+	tenant.mu.Lock()
+	if tenant.previousSQLUser == previous {
+		tenant.previousSQLUser = ""
+	}
+	tenant.mu.Unlock()
+	s.events.Emit("credential_retired", tenant.ID, fmt.Sprintf("%s retired after its overlap", previous))
+}
+
+// runCredentialRotation rotates each tenant's credential once it is older than
+// its organization's interval, retries HIS notifications and retires previous
+// logins
+func (s *RelayServer) runCredentialRotation() {
+	if interval := s.credentialRotation.interval(); interval > 0 {
+		log.Printf("🔑 Rotating tenant SQL credentials every %v (overlap %v)", interval, s.credentialRotation.overlap())
+	}
+
+	ticker := clock.NewTicker(credentialCheckInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		s.mu.RLock()
+		tenants := make([]*Tenant, 0, len(s.tenants))
+		for _, tenant := range s.tenants {
+			tenants = append(tenants, tenant)
+		}
+		s.mu.RUnlock()
+
+		for _, tenant := range tenants {
+			s.notifyCredentialRotated(tenant)
+			s.retireCredential(tenant, now)
+
+			interval := s.rotationInterval(tenant.OrganizationID)
+			tenant.mu.Lock()
+			due := !tenant.rotationPendingLocked() && interval > 0 && now.Sub(tenant.credentialRotatedAt) >= interval
+			tenant.mu.Unlock()
+			if due {
+				go s.rotateCredential(tenant, "scheduled")
+			}
+		}
+	}
+}
+
+// handleAdminTenantCredentials (POST) rotates a tenant's credential now
+func (s *RelayServer) handleAdminTenantCredentials(w http.ResponseWriter, r *http.Request, tenantID string) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	s.mu.RLock()
+	tenant, ok := s.tenants[tenantID]
+	s.mu.RUnlock()
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "tenant not registered")
+		return
+	}
+
+	log.Printf("🔑 Credential rotation requested for tenant %s (by %s)", tenantID, adminActor(r))
+	auditCredentialPolicy(w, s.credentialPolicies.For(tenant.OrganizationID).Name)
+	if err := s.rotateCredential(tenant, "requested by "+adminActor(r)); err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, errRotationInProgress) {
+			status = http.StatusConflict
+		}
+		writeJSONError(w, status, err.Error())
+		return
+	}
+
+	tenant.mu.Lock()
+	resp := map[string]interface{}{
+		"tenantId":           tenantID,
+		"sqlUser":            tenant.SQLUser,
+		"previousSqlUser":    tenant.previousSQLUser,
+		"previousValidUntil": tenant.previousCredentialUntil.UTC().Format(time.RFC3339),
+		"hisNotified":        tenant.credentialHISPending == nil,
+		"credentialPolicy":   tenant.credentialPolicy,
+	}
+	tenant.mu.Unlock()
+	writeJSON(w, http.StatusOK, resp)
+}
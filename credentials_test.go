@@ -0,0 +1,18 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRotationWaitsForPreviousLoginRetirement(t *testing.T) {
+	s := newClockTestServer()
+	tenant := &Tenant{ID: "clinic-1", SQLUser: "tatbeeb_clinic_r2", previousSQLUser: "tatbeeb_clinic_r1"}
+
+	if err := s.rotateCredential(tenant, "test"); !errors.Is(err, errRotationInProgress) {
+		t.Fatalf("rotation before retirement = %v, want errRotationInProgress", err)
+	}
+	if tenant.previousSQLUser != "tatbeeb_clinic_r1" {
+		t.Fatalf("previous login = %q, want it still tracked for retirement", tenant.previousSQLUser)
+	}
+}
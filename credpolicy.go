@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCredentialPolicyName = "default"
+	defaultPasswordLength       = 32
+	minPasswordLength           = 12
+	maxPasswordLength           = 128
+	// defaultPasswordSymbols are safe inside ADO.NET, ODBC and JDBC
+	// connection strings without quoting
+	defaultPasswordSymbols = "!#$%*+-.?@^_~"
+)
+
+// Character classes a credential policy can require
+const (
+	charClassLower  = "lower"
+	charClassUpper  = "upper"
+	charClassDigit  = "digit"
+	charClassSymbol = "symbol"
+)
+
+var charClassSets = map[string]string{
+	charClassLower: "abcdefghijklmnopqrstuvwxyz",
+	charClassUpper: "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	charClassDigit: "0123456789",
+}
+
+// CredentialPolicy is what a hospital group mandates for the SQL passwords
+// of its clinics. Passwords use letters and digits, plus Symbols when set or
+// required, minus ExcludeChars.
+type CredentialPolicy struct {
+	Name         string   `json:"name,omitempty"`
+	Length       int      `json:"length"`            // default 32
+	Require      []string `json:"require,omitempty"` // lower, upper, digit, symbol
+	Symbols      string   `json:"symbols,omitempty"` // default set when symbol is required
+	ExcludeChars string   `json:"excludeChars,omitempty"`
+	// RotationDays overrides credentialRotation.intervalHours for the
+	// organization; 0 keeps the relay's interval
+	RotationDays int `json:"rotationDays,omitempty"`
+}
+
+// CredentialPoliciesConfig sets the default policy and per-organization
+// overrides, keyed by the organization ID in agent tokens. HIS may send a
+// policy for an organization in register-port responses, which wins.
+type CredentialPoliciesConfig struct {
+	Default       *CredentialPolicy           `json:"default"`
+	Organizations map[string]CredentialPolicy `json:"organizations"`
+}
+
+// withDefaults fills in the length and the symbols a required symbol class
+// draws from
+func (p CredentialPolicy) withDefaults() CredentialPolicy {
+	if p.Length == 0 {
+		p.Length = defaultPasswordLength
+	}
+	if p.Symbols == "" && p.requires(charClassSymbol) {
+		p.Symbols = defaultPasswordSymbols
+	}
+	return p
+}
+
+func (p CredentialPolicy) requires(class string) bool {
+	for _, required := range p.Require {
+		if required == class {
+			return true
+		}
+	}
+	return false
+}
+
+// classChars returns the allowed characters of a class
+func (p CredentialPolicy) classChars(class string) string {
+	set := charClassSets[class]
+	if class == charClassSymbol {
+		set = p.Symbols
+	}
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(p.ExcludeChars, r) {
+			return -1
+		}
+		return r
+	}, set)
+}
+
+// alphabet returns every character a password may contain
+func (p CredentialPolicy) alphabet() string {
+	return p.classChars(charClassLower) + p.classChars(charClassUpper) + p.classChars(charClassDigit) + p.classChars(charClassSymbol)
+}
+
+// validate checks the policy can be met; callers apply withDefaults first
+func (p CredentialPolicy) validate() error {
+	if p.Length < minPasswordLength || p.Length > maxPasswordLength {
+		return fmt.Errorf("length must be between %d and %d", minPasswordLength, maxPasswordLength)
+	}
+	if p.RotationDays < 0 {
+		return errors.New("rotationDays must not be negative")
+	}
+	for _, r := range p.Symbols {
+		if r > 0x7e || r < 0x21 || strings.ContainsRune(charClassSets[charClassLower]+charClassSets[charClassUpper]+charClassSets[charClassDigit], r) {
+			return fmt.Errorf("symbols must be printable ASCII punctuation, not %q", r)
+		}
+		if strings.ContainsRune(`;'"{}`, r) {
+			return fmt.Errorf("symbol %q breaks connection strings", r)
+		}
+	}
+	for _, class := range p.Require {
+		if _, ok := charClassSets[class]; !ok && class != charClassSymbol {
+			return fmt.Errorf("unknown character class %q (want lower, upper, digit or symbol)", class)
+		}
+		if p.classChars(class) == "" {
+			return fmt.Errorf("required class %s has no characters left after excludeChars", class)
+		}
+	}
+	if len(p.Require) > p.Length {
+		return errors.New("length is shorter than the required classes")
+	}
+	if len(p.alphabet()) < 16 {
+		return errors.New("fewer than 16 characters are allowed")
+	}
+	return nil
+}
+
+// check verifies a generated password against the policy
+func (p CredentialPolicy) check(password string) error {
+	if len(password) != p.Length {
+		return fmt.Errorf("length %d, policy wants %d", len(password), p.Length)
+	}
+	alphabet := p.alphabet()
+	for _, r := range password {
+		if !strings.ContainsRune(alphabet, r) {
+			return fmt.Errorf("character %q is not allowed", r)
+		}
+	}
+	for _, class := range p.Require {
+		if !strings.ContainsAny(password, p.classChars(class)) {
+			return fmt.Errorf("no %s character", class)
+		}
+	}
+	return nil
+}
+
+// generate creates a password meeting the policy: one character of each
+// required class, the rest from the whole alphabet, shuffled
+func (p CredentialPolicy) generate() (string, error) {
+	pick := func(set string) (byte, error) {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(set))))
+		if err != nil {
+			return 0, err
+		}
+		return set[n.Int64()], nil
+	}
+
+	password := make([]byte, 0, p.Length)
+	for _, class := range p.Require {
+		c, err := pick(p.classChars(class))
+		if err != nil {
+			return "", err
+		}
+		password = append(password, c)
+	}
+	alphabet := p.alphabet()
+	for len(password) < p.Length {
+		c, err := pick(alphabet)
+		if err != nil {
+			return "", err
+		}
+		password = append(password, c)
+	}
+	for i := len(password) - 1; i > 0; i-- {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		j := n.Int64()
+		password[i], password[j] = password[j], password[i]
+	}
+
+	if err := p.check(string(password)); err != nil {
+		return "", fmt.Errorf("generated password violates policy %s: %w", p.Name, err)
+	}
+	return string(password), nil
+}
+
+// validateCredentialPolicies checks the default and per-organization policies
+func validateCredentialPolicies(cfg CredentialPoliciesConfig) error {
+	if cfg.Default != nil {
+		if err := cfg.Default.withDefaults().validate(); err != nil {
+			return fmt.Errorf("default: %w", err)
+		}
+	}
+	for org, policy := range cfg.Organizations {
+		if err := policy.withDefaults().validate(); err != nil {
+			return fmt.Errorf("organizations.%s: %w", org, err)
+		}
+	}
+	return nil
+}
+
+// CredentialPolicies resolves the policy of an organization: HIS's, then the
+// config's, then the default
+type CredentialPolicies struct {
+	defaultPolicy CredentialPolicy
+	configured    map[string]CredentialPolicy
+	fromHIS       map[string]CredentialPolicy
+	mu            sync.Mutex
+}
+
+// NewCredentialPolicies applies defaults and names to the configured policies
+func NewCredentialPolicies(cfg CredentialPoliciesConfig) *CredentialPolicies {
+	p := &CredentialPolicies{
+		// Without a configured default, passwords keep the URL-safe base64
+		// alphabet they always had
+		defaultPolicy: CredentialPolicy{Symbols: "-_"},
+		configured:    make(map[string]CredentialPolicy, len(cfg.Organizations)),
+		fromHIS:       make(map[string]CredentialPolicy),
+	}
+	if cfg.Default != nil {
+		p.defaultPolicy = *cfg.Default
+	}
+	p.defaultPolicy = p.defaultPolicy.withDefaults()
+	if p.defaultPolicy.Name == "" {
+		p.defaultPolicy.Name = defaultCredentialPolicyName
+	}
+	for org, policy := range cfg.Organizations {
+		policy = policy.withDefaults()
+		if policy.Name == "" {
+			policy.Name = "org:" + org
+		}
+		p.configured[org] = policy
+	}
+	return p
+}
+
+// For returns the organization's policy
+func (p *CredentialPolicies) For(organizationID string) CredentialPolicy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if policy, ok := p.fromHIS[organizationID]; ok && organizationID != "" {
+		return policy
+	}
+	if policy, ok := p.configured[organizationID]; ok && organizationID != "" {
+		return policy
+	}
+	return p.defaultPolicy
+}
+
+// SetFromHIS stores a policy HIS sent for an organization, reporting whether
+// it changed
+func (p *CredentialPolicies) SetFromHIS(organizationID string, policy CredentialPolicy) (bool, error) {
+	policy = policy.withDefaults()
+	if policy.Name == "" {
+		policy.Name = "his:" + organizationID
+	}
+	if err := policy.validate(); err != nil {
+		return false, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	previous, ok := p.fromHIS[organizationID]
+	p.fromHIS[organizationID] = policy
+	return !ok || !reflect.DeepEqual(previous, policy), nil
+}
+
+// generatePassword creates a SQL password under the organization's policy,
+// returning the policy's name
+func (s *RelayServer) generatePassword(organizationID string) (string, string, error) {
+	policy := s.credentialPolicies.For(organizationID)
+	password, err := policy.generate()
+	if err != nil {
+		return "", policy.Name, err
+	}
+	return password, policy.Name, nil
+}
+
+// rotationInterval returns how often the tenant's credential is rotated: its
+// organization's rotationDays, or the relay's interval. Zero means never.
+func (s *RelayServer) rotationInterval(organizationID string) time.Duration {
+	if days := s.credentialPolicies.For(organizationID).RotationDays; days > 0 {
+		return time.Duration(days) * 24 * time.Hour
+	}
+	return s.credentialRotation.interval()
+}
+
+// applyHISCredentialPolicy stores the policy HIS mandates for the tenant's
+// organization. It applies from the next password generated.
+func (s *RelayServer) applyHISCredentialPolicy(tenant *Tenant, policy *CredentialPolicy) {
+	if policy == nil {
+		return
+	}
+	tenant.mu.Lock()
+	organizationID := tenant.OrganizationID
+	tenant.mu.Unlock()
+	if organizationID == "" {
+		log.Printf("⚠️  Ignoring HIS credential policy for tenant %s: it has no organization", tenant.ID)
+		return
+	}
+
+	changed, err := s.credentialPolicies.SetFromHIS(organizationID, *policy)
+	if err != nil {
+		log.Printf("⚠️  Ignoring HIS credential policy for organization %s: %v", organizationID, err)
+		return
+	}
+	if changed {
+		active := s.credentialPolicies.For(organizationID)
+		msg := fmt.Sprintf("HIS credential policy %s for organization %s: length %d, require %v, rotation every %d days",
+			active.Name, organizationID, active.Length, active.Require, active.RotationDays)
+		log.Printf("🔑 %s", msg)
+		s.events.Emit("credential_policy_changed", tenant.ID, msg)
+	}
+}
+
+// auditCredentialPolicy notes on the admin call's audit record which policy
+// the credential it issued follows
+func auditCredentialPolicy(w http.ResponseWriter, policy string) {
+	if recorder, ok := w.(*statusRecorder); ok {
+		recorder.credentialPolicy = policy
+	}
+}
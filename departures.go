@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxDepartedTenants bounds the departure history served by the admin API
+const maxDepartedTenants = 200
+
+// Reasons a tenant was removed from the relay
+const (
+	closeReasonAgentDisconnected  = "agent_disconnected"  // the agent closed its yamux session
+	closeReasonKeepaliveTimeout   = "keepalive_timeout"   // the agent stopped answering pings
+	closeReasonReplaced           = "replaced"            // the agent registered again on a new session
+	closeReasonListenerError      = "listener_error"      // the tenant port stopped accepting
+	closeReasonRegistrationFailed = "registration_failed" // the registered response could not be sent
+	closeReasonRelayStopped       = "relay_stopped"       // the relay server was stopped
+	closeReasonBlocked            = "blocked"             // the tenant ID was added to the blocklist
+)
+
+// DepartedTenant records why and when a tenant left the relay
+type DepartedTenant struct {
+	TenantID     string    `json:"tenantId"`
+	Port         int       `json:"port"`
+	Reason       string    `json:"reason"`
+	Detail       string    `json:"detail,omitempty"`
+	Cohort       string    `json:"cohort,omitempty"`
+	RegisteredAt time.Time `json:"registeredAt"`
+	ClosedAt     time.Time `json:"closedAt"`
+}
+
+// DepartureLog keeps the most recently departed tenants
+type DepartureLog struct {
+	departures []DepartedTenant
+	mu         sync.Mutex
+}
+
+// NewDepartureLog creates an empty departure log
+func NewDepartureLog() *DepartureLog {
+	return &DepartureLog{}
+}
+
+// Record adds a departure, dropping the oldest once the log is full
+func (l *DepartureLog) Record(d DepartedTenant) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.departures = append(l.departures, d)
+	if len(l.departures) > maxDepartedTenants {
+		l.departures = l.departures[len(l.departures)-maxDepartedTenants:]
+	}
+}
+
+// Recent returns recorded departures, newest last, optionally for one tenant
+func (l *DepartureLog) Recent(tenantID string) []DepartedTenant {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	departures := make([]DepartedTenant, 0, len(l.departures))
+	for _, d := range l.departures {
+		if tenantID == "" || d.TenantID == tenantID {
+			departures = append(departures, d)
+		}
+	}
+	return departures
+}
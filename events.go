@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// maxRecentEvents bounds the in-memory event history served by the admin API
+const maxRecentEvents = 500
+
+// Event is a notable relay occurrence operators should be able to see
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	TenantID string    `json:"tenantId,omitempty"`
+	Message  string    `json:"message"`
+	// Labels are the tenant's labels when the event fired, for alert routing
+	Labels map[string]string `json:"labels,omitempty"`
+	// VirtualInstance names the relay in a process running several
+	VirtualInstance string `json:"virtualInstance,omitempty"`
+}
+
+// EventLog keeps the most recent events and writes each one to the log
+type EventLog struct {
+	events          []Event
+	labelsFor       func(tenantID string) map[string]string
+	export          func(Event) // e.g. the SIEM exporter; must not block
+	virtualInstance string
+	mu              sync.Mutex
+}
+
+// NewEventLog creates an empty event log
+func NewEventLog() *EventLog {
+	return &EventLog{}
+}
+
+// Emit records an event
+func (l *EventLog) Emit(eventType, tenantID, message string) {
+	event := Event{
+		Time:     clock.BaseNow(),
+		Type:     eventType,
+		TenantID: tenantID,
+		Message:  message,
+
+		VirtualInstance: l.virtualInstance,
+	}
+	if tenantID != "" && l.labelsFor != nil {
+		if labels := l.labelsFor(tenantID); len(labels) > 0 {
+			event.Labels = labels
+		}
+	}
+
+	tag := eventType
+	if l.virtualInstance != "" {
+		tag = l.virtualInstance + "/" + eventType
+	}
+	if len(event.Labels) > 0 {
+		log.Printf("📣 [%s] tenant=%s %s %s", tag, tenantID, formatLabels(event.Labels), message)
+	} else {
+		log.Printf("📣 [%s] tenant=%s %s", tag, tenantID, message)
+	}
+	if l.export != nil {
+		l.export(event)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.events = append(l.events, event)
+	if len(l.events) > maxRecentEvents {
+		l.events = l.events[len(l.events)-maxRecentEvents:]
+	}
+}
+
+// Recent returns recorded events, newest last
+func (l *EventLog) Recent() []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	events := make([]Event, len(l.events))
+	copy(events, l.events)
+	return events
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Known feature flags. Each flag's default comes from config and can be
+// overridden by environment, then globally and per tenant via the admin API.
+const (
+	featureProtocolGuard     = "protocolGuard"
+	featureTDSFriendlyErrors = "tdsFriendlyErrors"
+)
+
+// featureDescriptions lists every flag the relay understands
+var featureDescriptions = map[string]string{
+	featureProtocolGuard:     "Check client first bytes look like TDS before opening an agent stream",
+	featureTDSFriendlyErrors: "Send TDS error packets to SQL clients when rejecting them",
+}
+
+// FeatureFlags resolves feature state. Precedence, highest first: per-tenant
+// admin override, global admin override, TATBEEB_FEATURE_<NAME> environment
+// variable, config.
+type FeatureFlags struct {
+	defaults map[string]bool
+	env      map[string]bool
+	global   map[string]bool
+	tenants  map[string]map[string]bool
+	mu       sync.RWMutex
+}
+
+// NewFeatureFlags creates flags with config defaults and reads environment
+// overrides
+func NewFeatureFlags(defaults map[string]bool) (*FeatureFlags, error) {
+	f := newFeatureFlags()
+	for name, enabled := range defaults {
+		if _, ok := featureDescriptions[name]; !ok {
+			return nil, fmt.Errorf("unknown feature flag %q", name)
+		}
+		f.defaults[name] = enabled
+	}
+
+	for name := range featureDescriptions {
+		value, ok := os.LookupEnv(featureEnvVar(name))
+		if !ok {
+			continue
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", featureEnvVar(name), err)
+		}
+		f.env[name] = enabled
+	}
+	return f, nil
+}
+
+// newFeatureFlags creates flags with every feature off and no overrides
+func newFeatureFlags() *FeatureFlags {
+	return &FeatureFlags{
+		defaults: make(map[string]bool),
+		env:      make(map[string]bool),
+		global:   make(map[string]bool),
+		tenants:  make(map[string]map[string]bool),
+	}
+}
+
+// featureEnvVar maps e.g. protocolGuard to TATBEEB_FEATURE_PROTOCOL_GUARD
+func featureEnvVar(name string) string {
+	var b strings.Builder
+	b.WriteString("TATBEEB_FEATURE_")
+	for i, r := range name {
+		if unicode.IsUpper(r) && i > 0 && !unicode.IsUpper(rune(name[i-1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// Enabled reports whether a feature is on for the tenant; an empty tenant ID
+// gives the global state
+func (f *FeatureFlags) Enabled(name, tenantID string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if enabled, ok := f.tenants[tenantID][name]; ok {
+		return enabled
+	}
+	return f.globalLocked(name)
+}
+
+func (f *FeatureFlags) globalLocked(name string) bool {
+	if enabled, ok := f.global[name]; ok {
+		return enabled
+	}
+	if enabled, ok := f.env[name]; ok {
+		return enabled
+	}
+	return f.defaults[name]
+}
+
+// Set overrides a flag globally, or for one tenant when tenantID is set
+func (f *FeatureFlags) Set(name, tenantID string, enabled bool) error {
+	if _, ok := featureDescriptions[name]; !ok {
+		return fmt.Errorf("unknown feature flag %q", name)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if tenantID == "" {
+		f.global[name] = enabled
+		return nil
+	}
+	if f.tenants[tenantID] == nil {
+		f.tenants[tenantID] = make(map[string]bool)
+	}
+	f.tenants[tenantID][name] = enabled
+	return nil
+}
+
+// Clear removes a global or per-tenant override
+func (f *FeatureFlags) Clear(name, tenantID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if tenantID == "" {
+		delete(f.global, name)
+		return
+	}
+	delete(f.tenants[tenantID], name)
+	if len(f.tenants[tenantID]) == 0 {
+		delete(f.tenants, tenantID)
+	}
+}
+
+// featureNames returns the known flag names in order
+func featureNames() []string {
+	names := make([]string, 0, len(featureDescriptions))
+	for name := range featureDescriptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// State returns global flag states for /health
+func (f *FeatureFlags) State() map[string]bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	state := make(map[string]bool, len(featureDescriptions))
+	for name := range featureDescriptions {
+		state[name] = f.globalLocked(name)
+	}
+	return state
+}
+
+// Describe returns each flag with its resolved state, where that state came
+// from and the tenants overriding it, for the admin API
+func (f *FeatureFlags) Describe() []map[string]interface{} {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	names := featureNames()
+	flags := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		source := "config"
+		if _, ok := f.global[name]; ok {
+			source = "admin"
+		} else if _, ok := f.env[name]; ok {
+			source = "env"
+		}
+
+		overrides := make(map[string]bool)
+		for tenantID, tenantFlags := range f.tenants {
+			if enabled, ok := tenantFlags[name]; ok {
+				overrides[tenantID] = enabled
+			}
+		}
+
+		flags = append(flags, map[string]interface{}{
+			"name":            name,
+			"description":     featureDescriptions[name],
+			"enabled":         f.globalLocked(name),
+			"source":          source,
+			"envVar":          featureEnvVar(name),
+			"tenantOverrides": overrides,
+		})
+	}
+	return flags
+}
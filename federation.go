@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Federation label modes
+const (
+	federationLabelKeep = "keep" // exported as is
+	federationLabelHash = "hash" // replaced by a stable keyed hash
+	federationLabelDrop = "drop" // left out
+)
+
+// federationLabelPrefix prefixes tenant labels such as tier=gold, exported as
+// label_tier
+const federationLabelPrefix = "label_"
+
+// federationDefaultLabels are the modes of labels the config leaves unset.
+// Tenant labels not listed here are dropped, since they may name the clinic.
+var federationDefaultLabels = map[string]string{
+	"tenant":       federationLabelHash,
+	"organization": federationLabelHash,
+	"region":       federationLabelKeep,
+	"tier":         federationLabelKeep,
+	"cohort":       federationLabelKeep,
+	// virtual_instance is set on every series when the relay runs several
+	"virtual_instance": federationLabelKeep,
+}
+
+var federationLabelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// FederationConfig enables GET /federate on the health port: the relay's
+// series in Prometheus text format, for partners who must not learn which
+// clinics are behind them
+type FederationConfig struct {
+	Enabled bool `json:"enabled"`
+	// HashSecret keys the anonymizing hash, so tenant IDs can't be recovered
+	// by hashing guesses; keep it to keep hashes stable across restarts
+	HashSecret string `json:"hashSecret"`
+	// Labels sets keep, hash or drop per exported label, e.g.
+	// {"region": "drop", "label_tier": "keep"}
+	Labels map[string]string `json:"labels"`
+}
+
+// validateFederation checks the secret and label modes
+func validateFederation(cfg FederationConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if len(cfg.HashSecret) < 16 {
+		return errors.New("hashSecret of at least 16 characters is required")
+	}
+	for name, mode := range cfg.Labels {
+		if !federationLabelNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		switch mode {
+		case federationLabelKeep, federationLabelHash, federationLabelDrop:
+		default:
+			return fmt.Errorf("label %s: mode must be keep, hash or drop", name)
+		}
+	}
+	return nil
+}
+
+// labelMode returns how a label is exported
+func (c FederationConfig) labelMode(name string) string {
+	if mode, ok := c.Labels[name]; ok {
+		return mode
+	}
+	if mode, ok := federationDefaultLabels[name]; ok {
+		return mode
+	}
+	return federationLabelDrop
+}
+
+// anonymize hashes a label value with the secret. The label name is part of
+// the input, so equal tenant and organization IDs don't share a hash.
+func (c FederationConfig) anonymize(name, value string) string {
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(c.HashSecret))
+	mac.Write([]byte(name + "\x00" + value))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// promLabel is one label of a series, before anonymization
+type promLabel struct {
+	name, value string
+}
+
+// promFamily is a metric and its series
+type promFamily struct {
+	name, help, kind string
+	series           []string
+}
+
+// promWriter collects series by family in the Prometheus text format,
+// applying the federation label modes
+type promWriter struct {
+	cfg      FederationConfig
+	base     []promLabel // added to every series
+	families []*promFamily
+	byName   map[string]*promFamily
+}
+
+func newPromWriter(cfg FederationConfig, base []promLabel) *promWriter {
+	return &promWriter{cfg: cfg, base: base, byName: make(map[string]*promFamily)}
+}
+
+// add appends a sample to the family name, declaring it on first use
+func (p *promWriter) add(name, kind, help string, value float64, labels ...promLabel) {
+	family, ok := p.byName[name]
+	if !ok {
+		family = &promFamily{name: name, help: help, kind: kind}
+		p.byName[name] = family
+		p.families = append(p.families, family)
+	}
+
+	var rendered []string
+	for _, label := range append(append([]promLabel(nil), p.base...), labels...) {
+		value := label.value
+		switch p.cfg.labelMode(label.name) {
+		case federationLabelDrop:
+			continue
+		case federationLabelHash:
+			value = p.cfg.anonymize(label.name, value)
+		}
+		rendered = append(rendered, fmt.Sprintf(`%s="%s"`, label.name, promEscape(value)))
+	}
+	line := name
+	if len(rendered) > 0 {
+		line += "{" + strings.Join(rendered, ",") + "}"
+	}
+	family.series = append(family.series, fmt.Sprintf("%s %v", line, value))
+}
+
+// promEscape escapes a label value
+func promEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// promBool converts a flag to a sample value
+func promBool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (p *promWriter) bytes() []byte {
+	var buf bytes.Buffer
+	for _, family := range p.families {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		for _, series := range family.series {
+			buf.WriteString(series)
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+// federationMetricsLocked renders the relay-wide and per-tenant series.
+// Caller holds s.mu.
+func (s *RelayServer) federationMetricsLocked() []byte {
+	var base []promLabel
+	if s.virtualInstance != "" {
+		base = append(base, promLabel{"virtual_instance", s.virtualInstance})
+	}
+	p := newPromWriter(s.federation, base)
+
+	p.add("tatbeeb_relay_active_tenants", "gauge", "Registered tenants.", float64(len(s.tenants)))
+	p.add("tatbeeb_relay_available_ports", "gauge", "Tenant ports a new tenant could still be given.", float64(s.availablePortsLocked()))
+	p.add("tatbeeb_relay_connections", "gauge", "Open client connections.", float64(s.getTotalConnections()))
+	p.add("tatbeeb_relay_his_spool_pending", "gauge", "HIS notifications waiting to be retried.", float64(s.hisSpool.Pending()))
+
+	forecast := s.portForecastLocked()
+	p.add("tatbeeb_relay_port_pool_capacity", "gauge", "Tenant ports the pool can hand out.", float64(forecast.Capacity))
+	p.add("tatbeeb_relay_port_pool_rate_per_day", "gauge", "Projected tenant port consumption per day.", forecast.RatePerDay)
+	if forecast.DaysUntilExhausted != nil {
+		p.add("tatbeeb_relay_port_pool_days_until_exhausted", "gauge", "Days until the tenant port pool is projected to run out.", *forecast.DaysUntilExhausted)
+	}
+
+	counters := s.counters.snapshot()
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p.add("tatbeeb_relay_"+name+"_total", "counter", "Relay counter "+name+".", float64(counters[name]))
+	}
+
+	// Tenants are left unsorted, as their order by ID would hint at the IDs
+	for _, tenant := range s.tenants {
+		tenantLabels := s.tenantLabels(tenant.ID)
+		usedToday := s.quotas.Used(tenant.ID)
+
+		tenant.mu.Lock()
+		labels := []promLabel{
+			{"tenant", tenant.ID},
+			{"organization", tenant.OrganizationID},
+			{"region", tenant.Region},
+			{"tier", tenant.Tier},
+			{"cohort", tenant.Cohort},
+		}
+		keys := make([]string, 0, len(tenantLabels))
+		for key := range tenantLabels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			name := federationLabelPrefix + promLabelName(key)
+			labels = append(labels, promLabel{name, tenantLabels[key]})
+		}
+
+		bp := tenant.backpressureLocked(s.flowControl)
+		p.add("tatbeeb_relay_tenant_up", "gauge", "1 for each registered tenant.", 1, labels...)
+		p.add("tatbeeb_relay_tenant_connections", "gauge", "Open client connections of the tenant.", float64(tenant.ActiveConns), labels...)
+		p.add("tatbeeb_relay_tenant_max_connections", "gauge", "Connection limit of the tenant.", float64(tenant.MaxConns), labels...)
+		p.add("tatbeeb_relay_tenant_streams", "gauge", "Open yamux streams of the tenant.", float64(tenant.ControlSession.NumStreams()), labels...)
+		p.add("tatbeeb_relay_tenant_streams_opened_total", "counter", "Streams opened to the tenant's agent.", float64(tenant.StreamsOpened), labels...)
+		p.add("tatbeeb_relay_tenant_stream_open_failures_total", "counter", "Streams that failed to open to the tenant's agent.", float64(tenant.StreamOpenFailures), labels...)
+		p.add("tatbeeb_relay_tenant_degraded", "gauge", "1 while the tenant is degraded by stream open failures.", promBool(tenant.Degraded), labels...)
+		p.add("tatbeeb_relay_tenant_bytes_today", "gauge", "Bytes the tenant forwarded today.", float64(usedToday), labels...)
+		p.add("tatbeeb_relay_tenant_pending_bytes", "gauge", "Bytes waiting on the tenant's agent to accept them.", float64(bp.RelayPendingBytes), labels...)
+		tenant.mu.Unlock()
+	}
+	return p.bytes()
+}
+
+// promLabelName turns a tenant label key into a valid Prometheus label name
+func promLabelName(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// handleFederate serves GET /federate, the relay's series with tenant
+// identities anonymized per federation.labels
+func (s *RelayServer) handleFederate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	s.mu.RLock()
+	body := s.federationMetricsLocked()
+	s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(body)
+}
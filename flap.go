@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	flapWindow         = time.Hour
+	flapInitialBackoff = 30 * time.Second
+	flapMaxBackoff     = 30 * time.Minute
+)
+
+// registrationHistory is one tenant's recent registration attempts
+type registrationHistory struct {
+	attempts     []time.Time
+	backoff      time.Duration
+	blockedUntil time.Time
+	flapping     bool
+}
+
+// RegistrationTracker suppresses flapping agents: once a tenant registers more
+// than maxPerHour times within an hour, further registrations are refused for
+// an exponentially growing period
+type RegistrationTracker struct {
+	maxPerHour int
+	events     *EventLog
+	history    map[string]*registrationHistory
+	mu         sync.Mutex
+}
+
+// NewRegistrationTracker creates a tracker; maxPerHour <= 0 disables it
+func NewRegistrationTracker(maxPerHour int, events *EventLog) *RegistrationTracker {
+	return &RegistrationTracker{
+		maxPerHour: maxPerHour,
+		events:     events,
+		history:    make(map[string]*registrationHistory),
+	}
+}
+
+// Allow records a registration attempt and reports whether it may proceed,
+// and if not, how long the agent must wait
+func (t *RegistrationTracker) Allow(tenantID string) (bool, time.Duration) {
+	if t.maxPerHour <= 0 {
+		return true, 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := clock.Now()
+	h, ok := t.history[tenantID]
+	if !ok {
+		h = &registrationHistory{}
+		t.history[tenantID] = h
+	}
+
+	if now.Before(h.blockedUntil) {
+		return false, h.blockedUntil.Sub(now)
+	}
+
+	h.attempts = append(pruneBefore(h.attempts, now.Add(-flapWindow)), now)
+
+	if len(h.attempts) > t.maxPerHour {
+		if h.backoff == 0 {
+			h.backoff = flapInitialBackoff
+		} else if h.backoff < flapMaxBackoff {
+			h.backoff *= 2
+			if h.backoff > flapMaxBackoff {
+				h.backoff = flapMaxBackoff
+			}
+		}
+		h.blockedUntil = now.Add(h.backoff)
+
+		if !h.flapping {
+			h.flapping = true
+			t.events.Emit("tenant_flapping", tenantID,
+				fmt.Sprintf("%d registrations in the last hour, re-registration backoff %v", len(h.attempts), h.backoff))
+		}
+		return false, h.backoff
+	}
+
+	// Calm down once the tenant is comfortably under the limit again
+	if h.flapping && len(h.attempts) <= t.maxPerHour/2 {
+		h.flapping = false
+		h.backoff = 0
+		t.events.Emit("tenant_flapping_resolved", tenantID, "registration rate back to normal")
+	}
+	return true, 0
+}
+
+// Flapping returns the tenants currently considered flapping
+func (t *RegistrationTracker) Flapping() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tenants := make([]string, 0)
+	for id, h := range t.history {
+		if h.flapping {
+			tenants = append(tenants, id)
+		}
+	}
+	return tenants
+}
+
+// Run periodically forgets tenants that stopped registering
+func (t *RegistrationTracker) Run() {
+	ticker := clock.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		t.prune()
+	}
+}
+
+func (t *RegistrationTracker) prune() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cutoff := clock.Now().Add(-flapWindow)
+	for id, h := range t.history {
+		h.attempts = pruneBefore(h.attempts, cutoff)
+		if len(h.attempts) == 0 && clock.Now().After(h.blockedUntil) {
+			delete(t.history, id)
+		}
+	}
+}
+
+func pruneBefore(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
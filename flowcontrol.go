@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/tatbeeb/tatbeeb-link/common"
+)
+
+// msgTypeFlowTelemetry carries backpressure telemetry over the control
+// stream, from the agent to the relay and back
+const msgTypeFlowTelemetry = "flow_telemetry"
+
+const (
+	defaultBackpressureElevatedBytes  = 1 << 20
+	defaultBackpressureSaturatedBytes = 8 << 20
+	defaultFlowReportInterval         = 10 * time.Second
+	// flowStallThreshold is how long a write to the agent may block before it
+	// counts as a stall
+	flowStallThreshold = 100 * time.Millisecond
+	// agentFlowReportsKept is how many report intervals an agent's telemetry
+	// counts for before it is considered stale
+	agentFlowReportsKept = 3
+)
+
+// Backpressure levels of a tenant
+const (
+	backpressureNone      = "none"
+	backpressureElevated  = "elevated"
+	backpressureSaturated = "saturated"
+)
+
+// FlowControlConfig sets the backpressure thresholds, in bytes waiting to
+// reach the clinic's SQL Server, and how often telemetry is exchanged
+type FlowControlConfig struct {
+	ElevatedBytes         int64 `json:"elevatedBytes"`  // default 1 MiB
+	SaturatedBytes        int64 `json:"saturatedBytes"` // default 8 MiB
+	ReportIntervalSeconds int   `json:"reportIntervalSeconds"`
+}
+
+// validateFlowControl checks the thresholds are ordered
+func validateFlowControl(cfg FlowControlConfig) error {
+	if cfg.ElevatedBytes < 0 || cfg.SaturatedBytes < 0 || cfg.ReportIntervalSeconds < 0 {
+		return errors.New("elevatedBytes, saturatedBytes and reportIntervalSeconds must not be negative")
+	}
+	if cfg.ElevatedBytes > 0 && cfg.SaturatedBytes > 0 && cfg.SaturatedBytes < cfg.ElevatedBytes {
+		return errors.New("saturatedBytes must not be below elevatedBytes")
+	}
+	return nil
+}
+
+// withDefaults fills in unset thresholds and the interval
+func (c FlowControlConfig) withDefaults() FlowControlConfig {
+	if c.ElevatedBytes == 0 {
+		c.ElevatedBytes = defaultBackpressureElevatedBytes
+	}
+	if c.SaturatedBytes == 0 {
+		c.SaturatedBytes = defaultBackpressureSaturatedBytes
+	}
+	if c.ReportIntervalSeconds == 0 {
+		c.ReportIntervalSeconds = int(defaultFlowReportInterval / time.Second)
+	}
+	return c
+}
+
+// AgentFlowTelemetry is what an agent reports about its side of the flow:
+// bytes it received but hasn't yet written to SQL Server, and how long those
+// writes take
+type AgentFlowTelemetry struct {
+	Streams           int     `json:"streams"`
+	BacklogBytes      int64   `json:"backlogBytes"`
+	WindowBytes       int64   `json:"windowBytes,omitempty"` // receive window it grants per stream
+	SQLWriteLatencyMs float64 `json:"sqlWriteLatencyMs,omitempty"`
+}
+
+// RelayFlowTelemetry is what the relay reports to the agent: bytes held in
+// writes its streams haven't accepted, so the agent can tell a slow SQL
+// Server from a slow uplink
+type RelayFlowTelemetry struct {
+	PendingBytes  int64  `json:"pendingBytes"`
+	BlockedWrites int64  `json:"blockedWrites"`
+	Stalls        int64  `json:"stalls"` // since the previous report
+	Level         string `json:"level"`
+}
+
+// flowGauge tracks writes from clients to a tenant's agent that haven't
+// returned, i.e. bytes the agent's receive window is holding back
+type flowGauge struct {
+	pendingBytes  int64 // atomic
+	blockedWrites int64 // atomic
+	stalls        int64 // writes blocked past flowStallThreshold, atomic
+}
+
+// flowWriter accounts the writes to an agent stream in a flowGauge
+type flowWriter struct {
+	w     io.Writer
+	gauge *flowGauge
+}
+
+func (f *flowWriter) Write(p []byte) (int, error) {
+	atomic.AddInt64(&f.gauge.pendingBytes, int64(len(p)))
+	atomic.AddInt64(&f.gauge.blockedWrites, 1)
+	started := clock.Now()
+
+	n, err := f.w.Write(p)
+
+	if clock.Since(started) >= flowStallThreshold {
+		atomic.AddInt64(&f.gauge.stalls, 1)
+	}
+	atomic.AddInt64(&f.gauge.blockedWrites, -1)
+	atomic.AddInt64(&f.gauge.pendingBytes, -int64(len(p)))
+	return n, err
+}
+
+// TenantBackpressure is a tenant's backpressure gauges
+type TenantBackpressure struct {
+	TenantID          string              `json:"tenantId"`
+	Level             string              `json:"level"`
+	RelayPendingBytes int64               `json:"relayPendingBytes"`
+	BlockedWrites     int64               `json:"blockedWrites"`
+	Stalls            int64               `json:"stalls"`
+	Agent             *AgentFlowTelemetry `json:"agent,omitempty"`
+	AgentReportedAt   *time.Time          `json:"agentReportedAt,omitempty"`
+}
+
+// agentFlowReported stores telemetry sent by the tenant's agent
+func (t *Tenant) agentFlowReported(report AgentFlowTelemetry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.agentFlow = &report
+	t.agentFlowAt = clock.Now()
+}
+
+// backpressure reads the tenant's gauges. Agent telemetry older than a few
+// report intervals is left out, as is its backlog from the level.
+func (t *Tenant) backpressure(cfg FlowControlConfig) TenantBackpressure {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.backpressureLocked(cfg)
+}
+
+// backpressureLocked is backpressure for callers holding t.mu
+func (t *Tenant) backpressureLocked(cfg FlowControlConfig) TenantBackpressure {
+	bp := TenantBackpressure{
+		TenantID:          t.ID,
+		RelayPendingBytes: atomic.LoadInt64(&t.flow.pendingBytes),
+		BlockedWrites:     atomic.LoadInt64(&t.flow.blockedWrites),
+		Stalls:            atomic.LoadInt64(&t.flow.stalls),
+	}
+
+	fresh := time.Duration(agentFlowReportsKept*cfg.ReportIntervalSeconds) * time.Second
+	if t.agentFlow != nil && clock.Since(t.agentFlowAt) < fresh {
+		report, at := *t.agentFlow, t.agentFlowAt
+		bp.Agent, bp.AgentReportedAt = &report, &at
+	}
+
+	waiting := bp.RelayPendingBytes
+	if bp.Agent != nil {
+		waiting += bp.Agent.BacklogBytes
+	}
+	switch {
+	case waiting >= cfg.SaturatedBytes:
+		bp.Level = backpressureSaturated
+	case waiting >= cfg.ElevatedBytes:
+		bp.Level = backpressureElevated
+	default:
+		bp.Level = backpressureNone
+	}
+	return bp
+}
+
+// backpressureSaturated reports whether the tenant's last evaluated level is
+// saturated
+func (t *Tenant) backpressureSaturated() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.backpressureLevel == backpressureSaturated
+}
+
+// totalPendingBytes sums the bytes held in writes to every agent
+func (s *RelayServer) totalPendingBytes() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var total int64
+	for _, tenant := range s.tenants {
+		total += atomic.LoadInt64(&tenant.flow.pendingBytes)
+	}
+	return total
+}
+
+// runFlowTelemetry evaluates every tenant's backpressure each report
+// interval, sends the relay's side to its agent and emits an event when the
+// level changes, until the process exits
+func (s *RelayServer) runFlowTelemetry() {
+	interval := time.Duration(s.flowControl.ReportIntervalSeconds) * time.Second
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastStalls := map[*Tenant]int64{}
+	for {
+		<-ticker.C
+
+		s.mu.RLock()
+		tenants := make([]*Tenant, 0, len(s.tenants))
+		for _, tenant := range s.tenants {
+			tenants = append(tenants, tenant)
+		}
+		s.mu.RUnlock()
+
+		seen := make(map[*Tenant]int64, len(tenants))
+		for _, tenant := range tenants {
+			bp := tenant.backpressure(s.flowControl)
+			seen[tenant] = bp.Stalls
+			s.sendFlowTelemetry(tenant, RelayFlowTelemetry{
+				PendingBytes:  bp.RelayPendingBytes,
+				BlockedWrites: bp.BlockedWrites,
+				Stalls:        bp.Stalls - lastStalls[tenant],
+				Level:         bp.Level,
+			})
+
+			tenant.mu.Lock()
+			previous := tenant.backpressureLevel
+			tenant.backpressureLevel = bp.Level
+			tenant.mu.Unlock()
+			if previous == "" {
+				previous = backpressureNone
+			}
+			if bp.Level != previous {
+				s.backpressureChanged(bp, previous)
+			}
+		}
+		lastStalls = seen
+	}
+}
+
+// backpressureChanged logs and emits a tenant's move between levels
+func (s *RelayServer) backpressureChanged(bp TenantBackpressure, previous string) {
+	msg := fmt.Sprintf("backpressure %s -> %s: %d bytes pending at the relay", previous, bp.Level, bp.RelayPendingBytes)
+	if bp.Agent != nil {
+		msg += fmt.Sprintf(", %d at the agent", bp.Agent.BacklogBytes)
+	}
+	if bp.Level == backpressureNone {
+		log.Printf("✅ Tenant %s %s", bp.TenantID, msg)
+		s.events.Emit("backpressure_cleared", bp.TenantID, msg)
+		return
+	}
+	log.Printf("⚠️  Tenant %s %s", bp.TenantID, msg)
+	s.events.Emit("backpressure_"+bp.Level, bp.TenantID, msg)
+}
+
+// sendFlowTelemetry pushes the relay's side of the flow to the agent
+func (s *RelayServer) sendFlowTelemetry(tenant *Tenant, report RelayFlowTelemetry) {
+	tenant.mu.Lock()
+	control := tenant.control
+	tenant.mu.Unlock()
+	if control == nil {
+		return
+	}
+
+	data, err := common.EncodeMessage(msgTypeFlowTelemetry, report)
+	if err != nil {
+		return
+	}
+	if err := tenant.writeControl(data); err != nil {
+		log.Printf("Failed to send flow telemetry to tenant %s: %v", tenant.ID, err)
+	}
+}
+
+// backpressureMetrics reports relay-wide totals and the tenants under
+// backpressure
+func (s *RelayServer) backpressureMetrics() map[string]interface{} {
+	s.mu.RLock()
+	tenants := make([]*Tenant, 0, len(s.tenants))
+	for _, tenant := range s.tenants {
+		tenants = append(tenants, tenant)
+	}
+	s.mu.RUnlock()
+
+	var pending, blocked int64
+	levels := map[string]int{backpressureNone: 0, backpressureElevated: 0, backpressureSaturated: 0}
+	pressured := []TenantBackpressure{}
+	for _, tenant := range tenants {
+		bp := tenant.backpressure(s.flowControl)
+		pending += bp.RelayPendingBytes
+		blocked += bp.BlockedWrites
+		levels[bp.Level]++
+		if bp.Level != backpressureNone {
+			pressured = append(pressured, bp)
+		}
+	}
+	return map[string]interface{}{
+		"pending_bytes":  pending,
+		"blocked_writes": blocked,
+		"levels":         levels,
+		"tenants":        pressured,
+	}
+}
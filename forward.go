@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// copyBufferSize matches the 32 KiB io.Copy uses
+const copyBufferSize = 32 << 10
+
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// bufferedCopy copies through a pooled userspace buffer, so busy tenants
+// don't allocate a buffer per connection direction
+func bufferedCopy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// forwardMetrics reports the concurrency model, with the copy pool's load
+// when there is one
+func forwardMetrics(pool *CopyPool) map[string]interface{} {
+	metrics := map[string]interface{}{
+		"concurrency": concurrencyGoroutines,
+	}
+	if pool != nil {
+		metrics["concurrency"] = concurrencyPool
+		metrics["pool"] = pool.Metrics()
+	}
+	return metrics
+}
+
+// errClientRefused is returned by a tenant's forward policy when a client
+// isn't admitted; the client has already been told why
+var errClientRefused = errors.New("client refused")
+
+// agentOpener opens streams to a tenant's agent for the Forwarder
+type agentOpener struct {
+	s      *RelayServer
+	tenant *Tenant
+	tier   string
+}
+
+func (o *agentOpener) OpenStream() (net.Conn, error) {
+	started := clock.Now()
+	stream, err := o.s.openAgentStream(o.tenant)
+	o.s.tierStats.StreamOpen(o.tier, clock.Since(started), err)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// tenantForward is the forward policy of one client connection of a tenant:
+// access freezes, byte caps, the protocol guard and stream budget on admission,
+// then bandwidth limits, mirroring, recording and the connection table
+type tenantForward struct {
+	s      *RelayServer
+	tenant *Tenant
+	tier   string
+
+	tracked   *trackedConn
+	recording *tenantRecording
+	trace     *packetTrace
+	mirror    *trafficMirror
+	connBytes int64 // towards the per-connection byte cap, atomic
+}
+
+func (f *tenantForward) Admit(clientConn net.Conn) (io.Reader, error) {
+	s, tenant := f.s, f.tenant
+
+	if until, killed := s.killedUntil(tenant.ID); killed {
+		s.counters.inc(&s.counters.killRejects)
+		log.Printf("Tenant %s blocked by the kill switch, rejecting client %s", tenant.ID, clientConn.RemoteAddr())
+		s.rejectClient(clientConn, tenant.ID, fmt.Sprintf("External access to the clinic's database is paused until %s UTC",
+			until.UTC().Format("2006-01-02 15:04")))
+		return nil, errClientRefused
+	}
+
+	if freeze, frozen := s.activeFreeze(tenant.ID); frozen {
+		s.counters.inc(&s.counters.freezeRejects)
+		log.Printf("Tenant %s access frozen, rejecting client %s", tenant.ID, clientConn.RemoteAddr())
+		s.rejectClient(clientConn, tenant.ID, fmt.Sprintf("External access to the clinic's database is paused until %s UTC",
+			freeze.End.UTC().Format("2006-01-02 15:04")))
+		return nil, errClientRefused
+	}
+
+	if limit := tenant.MaxBytesPerDay; limit > 0 {
+		if used := s.quotas.Used(tenant.ID); used >= limit {
+			log.Printf("Tenant %s daily byte cap reached, rejecting client %s", tenant.ID, clientConn.RemoteAddr())
+			s.byteCapExceeded(tenant, quotaKindDaily, limit, used)
+			s.rejectClient(clientConn, tenant.ID, "The clinic's daily data transfer limit has been reached")
+			return nil, errClientRefused
+		}
+	}
+
+	// Keep browsers and scanners from reaching the clinic network
+	var clientReader io.Reader = clientConn
+	if s.features.Enabled(featureProtocolGuard, tenant.ID) {
+		reader, err := sniffClient(clientConn, serviceSQL, s.preloginTimeout)
+		if errors.Is(err, errPreloginTimeout) {
+			s.counters.inc(&s.counters.preloginTimeouts)
+			log.Printf("Tenant %s dropped idle client %s: %v", tenant.ID, clientConn.RemoteAddr(), err)
+			return nil, errClientRefused
+		}
+		if err != nil {
+			s.counters.inc(&s.counters.protocolRejects)
+			log.Printf("Tenant %s rejected client %s: %v", tenant.ID, clientConn.RemoteAddr(), err)
+			s.siem.Record(siemProtocolRejected, tenant.ID, clientConn.RemoteAddr().String(), err.Error())
+			return nil, errClientRefused
+		}
+		clientReader = reader
+	}
+
+	// Refuse clearly rather than let OpenStream fail against a full session
+	if reason := s.streamBudgetExceeded(tenant); reason != "" {
+		s.counters.inc(&s.counters.streamBudgetRejects)
+		log.Printf("Tenant %s rejected client %s: %s", tenant.ID, clientConn.RemoteAddr(), reason)
+		s.rejectClient(clientConn, tenant.ID, "The clinic's connection is at capacity, please try again shortly")
+		return nil, errClientRefused
+	}
+	return clientReader, nil
+}
+
+func (f *tenantForward) Opened(clientConn, stream net.Conn, stats *ForwardStats) (up, down io.Writer) {
+	s, tenant := f.s, f.tenant
+	log.Printf("Forwarding connection for tenant %s", tenant.ID)
+
+	f.tracked = s.conns.Add(tenant.ID, clientConn.RemoteAddr().String(), clientConn, stats)
+	if s.recorder != nil {
+		f.recording = s.recorder.For(tenant.ID)
+	}
+	if f.recording != nil {
+		f.recording.Record(RecordingEntry{Time: clock.BaseNow(), Kind: "connection_open", ConnID: f.tracked.id, ClientAddr: f.tracked.clientAddr})
+	}
+	f.trace = s.packetTraces.For(tenant.ID)
+	if f.trace != nil {
+		f.trace.add(PacketTraceRecord{Time: clock.Now(), Kind: "open", ConnID: f.tracked.id})
+	}
+
+	upstream := limitWriter(&flowWriter{w: stream, gauge: &tenant.flow}, tenant.upLimiter)
+	if s.latency != nil {
+		upstream = s.latency.writer(upstream, tenant.ID, true)
+	}
+
+	// Duplicate client->agent traffic when an admin enabled mirroring
+	s.mu.RLock()
+	mirrorTarget := s.mirrors[tenant.ID]
+	s.mu.RUnlock()
+	if mirrorTarget != "" {
+		f.mirror = startMirror(tenant.ID, mirrorTarget)
+		upstream = io.MultiWriter(upstream, f.mirror)
+	}
+	if f.recording != nil {
+		upstream = io.MultiWriter(upstream, f.recording.observer(f.tracked.id, true))
+	}
+	if f.trace != nil {
+		upstream = io.MultiWriter(upstream, f.trace.observer(f.tracked.id, traceDirectionClientToAgent))
+	}
+	upstream = &countingWriter{w: upstream, counter: &s.counters.bytesClientToAgent}
+
+	downstream := limitWriter(clientConn, tenant.downLimiter)
+	if s.latency != nil {
+		downstream = s.latency.writer(downstream, tenant.ID, false)
+	}
+	if f.recording != nil {
+		downstream = io.MultiWriter(downstream, f.recording.observer(f.tracked.id, false))
+	}
+	if f.trace != nil {
+		downstream = io.MultiWriter(downstream, f.trace.observer(f.tracked.id, traceDirectionAgentToClient))
+	}
+	downstream = &countingWriter{w: downstream, counter: &s.counters.bytesAgentToClient}
+
+	return &capWriter{w: upstream, quotas: s.quotas, tenant: tenant, connBytes: &f.connBytes},
+		&capWriter{w: downstream, quotas: s.quotas, tenant: tenant, connBytes: &f.connBytes}
+}
+
+func (f *tenantForward) Finished(clientConn net.Conn, stats *ForwardStats, err error) {
+	s, tenant := f.s, f.tenant
+
+	switch {
+	case errors.Is(err, errConnectionByteCap):
+		log.Printf("Tenant %s connection from %s closed at its byte cap", tenant.ID, clientConn.RemoteAddr())
+		s.byteCapExceeded(tenant, quotaKindConnection, tenant.MaxBytesPerConnection, atomic.LoadInt64(&f.connBytes))
+	case errors.Is(err, errDailyByteCap):
+		log.Printf("Tenant %s connection from %s closed at the daily byte cap", tenant.ID, clientConn.RemoteAddr())
+		s.byteCapExceeded(tenant, quotaKindDaily, tenant.MaxBytesPerDay, s.quotas.Used(tenant.ID))
+	}
+
+	up, down := stats.Bytes()
+	tenant.recordStreamResult(up, down)
+	if f.mirror != nil {
+		f.mirror.Close()
+	}
+	if f.recording != nil {
+		f.recording.Record(RecordingEntry{
+			Time:               clock.BaseNow(),
+			Kind:               "connection_close",
+			ConnID:             f.tracked.id,
+			BytesClientToAgent: up,
+			BytesAgentToClient: down,
+		})
+	}
+	if f.trace != nil {
+		f.trace.add(PacketTraceRecord{Time: clock.Now(), Kind: "close", ConnID: f.tracked.id})
+	}
+	if s.ledger != nil {
+		s.ledger.Record(tenant, f.tracked.clientAddr, f.tracked.startedAt, up+down)
+	}
+	s.tierStats.Connection(f.tier, up+down)
+	s.conns.Remove(f.tracked)
+}
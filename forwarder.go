@@ -0,0 +1,320 @@
+package main
+
+// This file is shared by the full and the simple relay, so it may only use
+// the standard library and must not reference anything defined elsewhere.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Why Forward gave up on a client connection
+var (
+	errOpenStream  = errors.New("failed to open stream to agent")
+	errIdleTimeout = errors.New("connection idle")
+)
+
+// StreamOpener opens the stream to the agent a client connection is forwarded
+// over, e.g. a yamux session. Closing a stream must only end writes to the
+// agent, as with yamux, so Forward half-closes streams by closing them.
+type StreamOpener interface {
+	OpenStream() (net.Conn, error)
+}
+
+// ForwardPolicy decides which client connections are forwarded and shapes
+// what flows. One policy value may serve a single connection or many.
+type ForwardPolicy interface {
+	// Admit runs before the stream is opened. It returns the reader to forward
+	// from, the client itself or a wrapper around it, or an error to refuse
+	// the client, which it is responsible for telling.
+	Admit(client net.Conn) (io.Reader, error)
+	// Opened returns the writers towards the agent and the client, which may
+	// wrap the stream and client with caps, rate limits or observers
+	Opened(client, stream net.Conn, stats *ForwardStats) (up, down io.Writer)
+	// Finished runs once an opened connection is done, with the error that
+	// ended it, nil for a clean close
+	Finished(client net.Conn, stats *ForwardStats, err error)
+}
+
+// ForwardStats counts a forwarded connection's bytes as they flow
+type ForwardStats struct {
+	// Now is the time source of the stats' timestamps; time.Now when nil
+	Now func() time.Time
+
+	clientToAgent int64 // atomic
+	agentToClient int64 // atomic
+	lastActive    int64 // unix nanos of the last write, atomic
+
+	up, down directionStats
+}
+
+func (f *ForwardStats) now() time.Time {
+	if f.Now != nil {
+		return f.Now()
+	}
+	return time.Now()
+}
+
+// Bytes returns the bytes forwarded so far in each direction
+func (f *ForwardStats) Bytes() (clientToAgent, agentToClient int64) {
+	return atomic.LoadInt64(&f.clientToAgent), atomic.LoadInt64(&f.agentToClient)
+}
+
+// States of one direction of a forwarded connection
+const (
+	directionOpen       = "open"
+	directionStalled    = "stalled"     // a write is blocked: the receiving side isn't reading
+	directionHalfClosed = "half_closed" // the sending side closed its end
+	directionError      = "error"
+)
+
+// directionStallAfter is how long a write must block before its direction
+// counts as stalled
+const directionStallAfter = 5 * time.Second
+
+// directionStats tracks one direction of a forwarded connection: when it last
+// carried a byte, any write blocked on the receiving side, and how it ended
+type directionStats struct {
+	lastByte     int64 // unix nanos, atomic
+	writePending int64 // unix nanos the blocked write started, 0 for none, atomic
+
+	mu    sync.Mutex
+	ended string // directionHalfClosed or directionError once the copy stopped
+	err   string
+}
+
+func (d *directionStats) end(state string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ended == "" {
+		d.ended = state
+		if err != nil {
+			d.err = err.Error()
+		}
+	}
+}
+
+// DirectionState is one direction of a forwarded connection at a moment.
+// Times come from the stats' time source.
+type DirectionState struct {
+	State      string        // direction*
+	LastByteAt time.Time     // zero before the first byte
+	StalledFor time.Duration // how long the pending write has blocked
+	Error      string        // what ended the direction, for directionError
+}
+
+// Direction returns the state of the client to agent direction (upstream)
+// or the agent to client one
+func (f *ForwardStats) Direction(upstream bool, now time.Time) DirectionState {
+	d := &f.down
+	if upstream {
+		d = &f.up
+	}
+
+	var state DirectionState
+	if nanos := atomic.LoadInt64(&d.lastByte); nanos > 0 {
+		state.LastByteAt = time.Unix(0, nanos)
+	}
+	d.mu.Lock()
+	state.State, state.Error = d.ended, d.err
+	d.mu.Unlock()
+	if state.State != "" {
+		return state
+	}
+
+	state.State = directionOpen
+	if since := atomic.LoadInt64(&d.writePending); since > 0 {
+		if blocked := now.Sub(time.Unix(0, since)); blocked >= directionStallAfter {
+			state.State, state.StalledFor = directionStalled, blocked
+		}
+	}
+	return state
+}
+
+// readDeadliner is the connection behind a copy's reader, which may be
+// wrapped, e.g. by the protocol guard
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// Forwarder joins client connections to streams opened to an agent, counting
+// bytes and closing connections that sit idle
+type Forwarder struct {
+	Opener      StreamOpener
+	Policy      ForwardPolicy
+	IdleTimeout time.Duration // closes connections idle in both directions; 0 disables
+	// Start runs one direction and sends its result to done; it is the copy
+	// strategy of the forwarding mode. The default copies on a goroutine of
+	// its own.
+	Start func(dst io.Writer, src io.Reader, deadlines readDeadliner, done chan<- error)
+	// Tick returns a channel ticking every d, and its stop function, for the
+	// idle check. The default is a time.Ticker.
+	Tick func(d time.Duration) (ticks <-chan time.Time, stop func())
+}
+
+// Forward serves one client connection until both sides have closed,
+// recording its bytes in stats. Errors from Admit are returned as is,
+// failures to open the stream wrap errOpenStream. The caller closes the
+// client.
+func (f *Forwarder) Forward(client net.Conn, stats *ForwardStats) error {
+	reader, err := f.Policy.Admit(client)
+	if err != nil {
+		return err
+	}
+
+	stream, err := f.Opener.OpenStream()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errOpenStream, err)
+	}
+	defer stream.Close()
+
+	up, down := f.Policy.Opened(client, stream, stats)
+	atomic.StoreInt64(&stats.lastActive, stats.now().UnixNano())
+
+	var idled int32
+	if f.IdleTimeout > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go f.closeWhenIdle(stats, &idled, stop, client, stream)
+	}
+
+	start := f.Start
+	if start == nil {
+		start = copyOnGoroutine
+	}
+	upDone, downDone := make(chan error, 1), make(chan error, 1)
+	start(&statsWriter{w: up, counter: &stats.clientToAgent, stats: stats, dir: &stats.up}, &endReader{r: reader, dir: &stats.up}, client, upDone)
+	start(&statsWriter{w: down, counter: &stats.agentToClient, stats: stats, dir: &stats.down}, &endReader{r: stream, dir: &stats.down}, stream, downDone)
+
+	// A direction reaching EOF half-closes the side it writes to and the
+	// other keeps running. An error, or a client that can't half-close,
+	// ends both.
+	ended := false
+	for upDone != nil || downDone != nil {
+		var copyErr error
+		select {
+		case copyErr = <-upDone:
+			upDone = nil
+			if copyErr == nil {
+				stream.Close()
+				continue
+			}
+			stats.up.end(directionError, fmt.Errorf("read: %w", copyErr))
+		case copyErr = <-downDone:
+			downDone = nil
+			if copyErr != nil {
+				stats.down.end(directionError, fmt.Errorf("read: %w", copyErr))
+			} else if closeWrite(client) {
+				continue
+			}
+		}
+		if !ended {
+			ended, err = true, copyErr
+			client.Close()
+			stream.Close()
+		}
+	}
+	if atomic.LoadInt32(&idled) == 1 {
+		err = errIdleTimeout
+	}
+	f.Policy.Finished(client, stats, err)
+	return err
+}
+
+// closeWhenIdle closes both sides once nothing was written for the idle
+// timeout, which ends the copies
+func (f *Forwarder) closeWhenIdle(stats *ForwardStats, idled *int32, stop <-chan struct{}, conns ...io.Closer) {
+	interval := f.IdleTimeout / 4
+	if interval <= 0 {
+		interval = f.IdleTimeout
+	}
+	tick := f.Tick
+	if tick == nil {
+		tick = systemTick
+	}
+	ticks, stopTicks := tick(interval)
+	defer stopTicks()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticks:
+		}
+		lastActive := time.Unix(0, atomic.LoadInt64(&stats.lastActive))
+		if stats.now().Sub(lastActive) < f.IdleTimeout {
+			continue
+		}
+		atomic.StoreInt32(idled, 1)
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return
+	}
+}
+
+func systemTick(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+// closeWrite half-closes conn, reporting false if it can't
+func closeWrite(conn net.Conn) bool {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite() == nil
+	}
+	return false
+}
+
+func copyOnGoroutine(dst io.Writer, src io.Reader, _ readDeadliner, done chan<- error) {
+	go func() {
+		_, err := io.Copy(dst, src)
+		done <- err
+	}()
+}
+
+// statsWriter counts the bytes written in one direction and when, noting
+// writes that block
+type statsWriter struct {
+	w       io.Writer
+	counter *int64
+	stats   *ForwardStats
+	dir     *directionStats
+}
+
+func (c *statsWriter) Write(p []byte) (int, error) {
+	atomic.StoreInt64(&c.dir.writePending, c.stats.now().UnixNano())
+	n, err := c.w.Write(p)
+	atomic.StoreInt64(&c.dir.writePending, 0)
+	if n > 0 {
+		now := c.stats.now().UnixNano()
+		atomic.AddInt64(c.counter, int64(n))
+		atomic.StoreInt64(&c.stats.lastActive, now)
+		atomic.StoreInt64(&c.dir.lastByte, now)
+	}
+	if err != nil {
+		c.dir.end(directionError, fmt.Errorf("write: %w", err))
+	}
+	return n, err
+}
+
+// endReader records a clean EOF from the source of one direction as a
+// half-close. Other read errors are recorded from the copy's result, as a
+// copy pool's polls time out reads that don't end the direction.
+type endReader struct {
+	r   io.Reader
+	dir *directionStats
+}
+
+func (e *endReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == io.EOF {
+		e.dir.end(directionHalfClosed, nil)
+	}
+	return n, err
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// maxFreezeDuration bounds an access freeze so a bad end time can't lock a
+// clinic out indefinitely
+const maxFreezeDuration = 7 * 24 * time.Hour
+
+// AccessFreeze blocks external database access to a tenant for a window,
+// e.g. while HIS closes the clinic's billing period. New connections are
+// refused during the window; CloseExisting also ends connections that are
+// open when it starts.
+type AccessFreeze struct {
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	CloseExisting bool      `json:"closeExisting,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+	Source        string    `json:"source,omitempty"` // "his" or "admin", set by the relay
+}
+
+// activeAt reports whether the freeze window covers t
+func (f AccessFreeze) activeAt(t time.Time) bool {
+	return !t.Before(f.Start) && t.Before(f.End)
+}
+
+// accessFreeze is a scheduled freeze with the timers that start and end it
+type accessFreeze struct {
+	AccessFreeze
+	startTimer *Timer
+	endTimer   *Timer
+}
+
+func (f *accessFreeze) stop() {
+	f.startTimer.Stop()
+	f.endTimer.Stop()
+}
+
+// setAccessFreeze schedules a freeze for a tenant, replacing any earlier one.
+// A zero start means now. Freezes are kept by tenant ID, so they also apply
+// to a tenant that registers during the window.
+func (s *RelayServer) setAccessFreeze(tenantID string, freeze AccessFreeze) (AccessFreeze, error) {
+	now := clock.Now()
+	if freeze.Start.IsZero() || freeze.Start.Before(now) {
+		freeze.Start = now
+	}
+	switch {
+	case !freeze.End.After(freeze.Start):
+		return freeze, fmt.Errorf("end must be after start and in the future")
+	case freeze.End.Sub(freeze.Start) > maxFreezeDuration:
+		return freeze, fmt.Errorf("freeze may last at most %v", maxFreezeDuration)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if previous, ok := s.freezes[tenantID]; ok {
+		previous.stop()
+	}
+	entry := &accessFreeze{AccessFreeze: freeze}
+	entry.startTimer = clock.AfterFunc(freeze.Start.Sub(now), func() { s.startAccessFreeze(tenantID, entry) })
+	entry.endTimer = clock.AfterFunc(freeze.End.Sub(now), func() { s.endAccessFreeze(tenantID, entry) })
+	s.freezes[tenantID] = entry
+
+	log.Printf("🧊 Access to tenant %s frozen %s - %s by %s (%s)", tenantID,
+		freeze.Start.UTC().Format(time.RFC3339), freeze.End.UTC().Format(time.RFC3339), freeze.Source, freeze.Reason)
+	return freeze, nil
+}
+
+// liftAccessFreeze removes a tenant's freeze, reporting whether one was set
+func (s *RelayServer) liftAccessFreeze(tenantID string) bool {
+	s.mu.Lock()
+	entry, ok := s.freezes[tenantID]
+	if ok {
+		entry.stop()
+		delete(s.freezes, tenantID)
+	}
+	s.mu.Unlock()
+
+	if ok {
+		log.Printf("🧊 Access freeze of tenant %s lifted", tenantID)
+		s.events.Emit("access_freeze_lifted", tenantID, "access freeze lifted early")
+		s.settleTenantState(tenantID, "access freeze lifted")
+	}
+	return ok
+}
+
+// startAccessFreeze runs when a freeze window opens
+func (s *RelayServer) startAccessFreeze(tenantID string, entry *accessFreeze) {
+	s.mu.RLock()
+	current := s.freezes[tenantID] == entry
+	s.mu.RUnlock()
+	if !current {
+		return
+	}
+
+	msg := fmt.Sprintf("external access frozen until %s: %s", entry.End.UTC().Format(time.RFC3339), entry.Reason)
+	if entry.CloseExisting {
+		closed := s.conns.CloseTenant(tenantID)
+		msg += fmt.Sprintf(" (%d open connections closed)", closed)
+	}
+	log.Printf("🧊 Tenant %s %s", tenantID, msg)
+	s.events.Emit("access_freeze_started", tenantID, msg)
+	s.settleTenantState(tenantID, "access freeze started")
+}
+
+// endAccessFreeze runs when a freeze window closes
+func (s *RelayServer) endAccessFreeze(tenantID string, entry *accessFreeze) {
+	s.mu.Lock()
+	current := s.freezes[tenantID] == entry
+	if current {
+		delete(s.freezes, tenantID)
+	}
+	s.mu.Unlock()
+
+	if current {
+		log.Printf("🧊 Access freeze of tenant %s ended", tenantID)
+		s.events.Emit("access_freeze_ended", tenantID, "external access restored")
+		s.settleTenantState(tenantID, "access freeze ended")
+	}
+}
+
+// activeFreeze returns the tenant's freeze if its window covers now
+func (s *RelayServer) activeFreeze(tenantID string) (AccessFreeze, bool) {
+	s.mu.RLock()
+	entry, ok := s.freezes[tenantID]
+	s.mu.RUnlock()
+	if !ok || !entry.activeAt(clock.Now()) {
+		return AccessFreeze{}, false
+	}
+	return entry.AccessFreeze, true
+}
+
+// accessFreeze returns the tenant's scheduled or active freeze
+func (s *RelayServer) accessFreeze(tenantID string) (AccessFreeze, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.freezes[tenantID]
+	if !ok {
+		return AccessFreeze{}, false
+	}
+	return entry.AccessFreeze, true
+}
+
+// applyHISFreeze applies a freeze pushed by HIS in a register-port response
+func (s *RelayServer) applyHISFreeze(tenant *Tenant, freeze *AccessFreeze) {
+	if freeze == nil {
+		return
+	}
+	freeze.Source = "his"
+	if _, err := s.setAccessFreeze(tenant.ID, *freeze); err != nil {
+		log.Printf("⚠️  Ignoring HIS access freeze for tenant %s: %v", tenant.ID, err)
+	}
+}
+
+// freezeMetrics lists scheduled and active freezes. Callers hold s.mu.
+func (s *RelayServer) freezeMetrics() map[string]interface{} {
+	now := clock.Now()
+	tenants := make(map[string]interface{}, len(s.freezes))
+	for id, entry := range s.freezes {
+		tenants[id] = map[string]interface{}{
+			"start":  entry.Start.UTC().Format(time.RFC3339),
+			"end":    entry.End.UTC().Format(time.RFC3339),
+			"active": entry.activeAt(now),
+			"source": entry.Source,
+		}
+	}
+	return tenants
+}
@@ -0,0 +1,12 @@
+module github.com/azizhamoud35/tatbeeblink-relay
+
+go 1.21
+
+require (
+	github.com/hashicorp/yamux v0.1.2
+	github.com/tatbeeb/tatbeeb-link/common v0.0.0
+)
+
+// The agent protocol package is not published; check out the tatbeeb-link
+// repository next to this one
+replace github.com/tatbeeb/tatbeeb-link/common => ../tatbeeb-link/common
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+var errRelayStopped = errors.New("relay stopped")
+
+// listenTenantPort is the default tenant port opener: all interfaces
+func listenTenantPort(port int, tuning ListenerTuning) (net.Listener, error) {
+	return listenTCP(fmt.Sprintf(":%d", port), tuning)
+}
+
+// Stop closes the control listeners served by Serve, unregisters every tenant
+// (closing its port and agent session) and releases parked ports. Tasks
+// started by Start, such as the health server, keep running; Stop is meant
+// for embedding the relay in tests.
+func (s *RelayServer) Stop() {
+	s.mu.Lock()
+	s.stopped = true
+	for listener := range s.controlListeners {
+		listener.Close()
+	}
+	tenants := make([]*Tenant, 0, len(s.tenants))
+	for _, tenant := range s.tenants {
+		tenants = append(tenants, tenant)
+	}
+	s.mu.Unlock()
+
+	for _, tenant := range tenants {
+		s.setTenantState(tenant.ID, tenantStateDraining, "relay stopping", servingStates...)
+	}
+	for _, tenant := range tenants {
+		s.unregisterTenant(tenant, closeReasonRelayStopped, "")
+		tenant.ControlSession.Close()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for tenantID := range s.parked {
+		s.setTenantState(tenantID, tenantStateEvicted, closeReasonRelayStopped)
+		listener, held := s.unparkLocked(tenantID)
+		if listener != nil {
+			listener.Close()
+		}
+		for _, conn := range held {
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/azizhamoud35/tatbeeblink-relay/testutil"
+	"github.com/tatbeeb/tatbeeb-link/common"
+)
+
+const (
+	testIssuer = "tatbeeb-his-test"
+	testSecret = "test-secret-with-enough-entropy"
+	testWait   = 5 * time.Second
+)
+
+// startTestRelay runs a relay with an in-memory HIS, a plaintext control
+// listener and tenant ports on loopback, applying configure before it serves.
+// It returns the control address and a channel receiving the address of each
+// tenant port opened.
+func startTestRelay(t *testing.T, configure ...func(*RelayServer)) (*RelayServer, *MemoryHIS, string, <-chan string) {
+	t.Helper()
+
+	his := NewMemoryHIS()
+	server := NewRelayServer(&common.RelayConfig{
+		TenantPortStart:         50000,
+		TenantPortEnd:           50009,
+		MaxConnectionsPerTenant: 5,
+	}, his, []JWTIssuerConfig{{
+		Issuer:    testIssuer,
+		Audiences: []string{testIssuer},
+		Secret:    testSecret,
+	}})
+
+	tenantAddrs := make(chan string, 10)
+	server.listenTenantPort = func(port int, tuning ListenerTuning) (net.Listener, error) {
+		listener, err := listenTCP("127.0.0.1:0", tuning)
+		if err == nil {
+			tenantAddrs <- listener.Addr().String()
+		}
+		return listener, err
+	}
+
+	for _, apply := range configure {
+		apply(server)
+	}
+
+	control, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to open control listener: %v", err)
+	}
+	go server.Serve(control)
+	t.Cleanup(server.Stop)
+	return server, his, control.Addr().String(), tenantAddrs
+}
+
+// connectTestAgent registers tenantID with a fake agent serving handler
+func connectTestAgent(t *testing.T, controlAddr, tenantID string, handler func(net.Conn)) *testutil.FakeAgent {
+	t.Helper()
+
+	token, err := testutil.SignToken(testutil.TokenClaims{Sub: tenantID, Iss: testIssuer, Aud: testIssuer}, testSecret)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	conn, err := net.Dial("tcp", controlAddr)
+	if err != nil {
+		t.Fatalf("failed to dial control listener: %v", err)
+	}
+	agent, err := testutil.ConnectAgent(conn, tenantID, token, handler)
+	if err != nil {
+		t.Fatalf("agent registration failed: %v", err)
+	}
+	t.Cleanup(func() { agent.Close() })
+	return agent
+}
+
+// waitFor polls cond until it holds or testWait passes
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testWait)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRelayForwardsThroughRegisteredAgent(t *testing.T) {
+	_, his, controlAddr, tenantAddrs := startTestRelay(t)
+	agent := connectTestAgent(t, controlAddr, "clinic-42", testutil.EchoHandler)
+
+	if agent.Registration.TenantID != "clinic-42" {
+		t.Fatalf("registered tenant = %q, want clinic-42", agent.Registration.TenantID)
+	}
+	waitFor(t, "HIS register-port", func() bool {
+		for _, req := range his.Registrations() {
+			if req.TenantID == "clinic-42" && req.Port == agent.Registration.AssignedPort {
+				return true
+			}
+		}
+		return false
+	})
+
+	var tenantAddr string
+	select {
+	case tenantAddr = <-tenantAddrs:
+	case <-time.After(testWait):
+		t.Fatal("tenant port was not opened")
+	}
+
+	client, err := net.Dial("tcp", tenantAddr)
+	if err != nil {
+		t.Fatalf("failed to dial tenant port: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(testWait))
+
+	// A TDS pre-login header, as a SQL client sends first
+	payload := append([]byte{0x12, 0x01, 0x00, 0x10, 0x00, 0x00, 0x01, 0x00}, []byte("tatbeeb!")...)
+	if _, err := client.Write(payload); err != nil {
+		t.Fatalf("failed to write to tenant port: %v", err)
+	}
+	echoed := make([]byte, len(payload))
+	if _, err := io.ReadFull(client, echoed); err != nil {
+		t.Fatalf("failed to read echo: %v", err)
+	}
+	if !bytes.Equal(echoed, payload) {
+		t.Fatalf("echo = %x, want %x", echoed, payload)
+	}
+}
+
+func TestRelayPassesClientHalfClose(t *testing.T) {
+	server, _, controlAddr, tenantAddrs := startTestRelay(t)
+	testHalfClose(t, server, controlAddr, tenantAddrs, nil)
+}
+
+func TestRelayPoolPassesClientHalfClose(t *testing.T) {
+	server, _, controlAddr, tenantAddrs := startTestRelay(t, func(s *RelayServer) {
+		s.copyPool = NewCopyPool(ForwardingConfig{Concurrency: concurrencyPool, Workers: 4})
+		s.copyPool.Start(s.watchdog)
+	})
+	// Polls that time out while the agent is quiet must not end its direction
+	testHalfClose(t, server, controlAddr, tenantAddrs, func() {
+		idlePolls := atomic.LoadInt64(&server.copyPool.idlePolls)
+		waitFor(t, "idle polls", func() bool {
+			return atomic.LoadInt64(&server.copyPool.idlePolls) > idlePolls+2
+		})
+	})
+}
+
+// testHalfClose half-closes a client and checks the agent's reply still
+// reaches it, calling idle while the agent holds the reply back
+func testHalfClose(t *testing.T, server *RelayServer, controlAddr string, tenantAddrs <-chan string, idle func()) {
+	t.Helper()
+	requested, release := make(chan []byte, 1), make(chan struct{})
+	connectTestAgent(t, controlAddr, "clinic-9", func(conn net.Conn) {
+		request, _ := io.ReadAll(conn)
+		requested <- request
+		<-release
+		conn.Write([]byte("reply to " + string(request)))
+	})
+
+	var tenantAddr string
+	select {
+	case tenantAddr = <-tenantAddrs:
+	case <-time.After(testWait):
+		t.Fatal("tenant port was not opened")
+	}
+	client, err := net.Dial("tcp", tenantAddr)
+	if err != nil {
+		t.Fatalf("failed to dial tenant port: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(testWait))
+
+	if _, err := client.Write([]byte("query")); err != nil {
+		t.Fatalf("failed to write to tenant port: %v", err)
+	}
+	client.(*net.TCPConn).CloseWrite()
+
+	// The agent sees EOF while the connection stays open for its reply
+	select {
+	case request := <-requested:
+		if string(request) != "query" {
+			t.Fatalf("agent read %q, want query", request)
+		}
+	case <-time.After(testWait):
+		t.Fatal("agent never saw the client's half-close")
+	}
+	waitFor(t, "a half_closed upstream", func() bool {
+		conns := server.conns.Snapshot("clinic-9")
+		return len(conns) == 1 && conns[0].ClientToAgentState.State == directionHalfClosed
+	})
+	if idle != nil {
+		idle()
+	}
+	if conns := server.conns.Snapshot("clinic-9"); len(conns) != 1 || conns[0].AgentToClientState.State != directionOpen {
+		t.Fatalf("agent to client = %+v, want one open connection", conns)
+	}
+
+	close(release)
+	reply, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if string(reply) != "reply to query" {
+		t.Fatalf("reply = %q, want %q", reply, "reply to query")
+	}
+	waitFor(t, "the connection to close", func() bool {
+		return len(server.conns.Snapshot("clinic-9")) == 0
+	})
+}
+
+func TestRelayUnregistersDepartedAgent(t *testing.T) {
+	_, his, controlAddr, _ := startTestRelay(t)
+	agent := connectTestAgent(t, controlAddr, "clinic-7", testutil.EchoHandler)
+
+	agent.Close()
+	waitFor(t, "HIS unregister-port", func() bool {
+		for _, req := range his.Unregistrations() {
+			if req.TenantID == "clinic-7" && req.Reason == closeReasonAgentDisconnected {
+				return true
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// syncConcurrency bounds parallel HIS calls during an admin sync of all tenants
+const syncConcurrency = 8
+
+// Heartbeat causes tell HIS which side of the tunnel is at fault
+const (
+	heartbeatCauseHealthy          = "healthy"
+	heartbeatCauseRelayDegraded    = "relay_degraded"     // relay overloaded, not the clinic's fault
+	heartbeatCauseAgentSessionDown = "agent_session_down" // agent disconnected or not answering stream opens
+	heartbeatCauseAgentBackendDown = "agent_backend_down" // agent is up but its SQL Server isn't answering
+)
+
+// recordStreamResult tracks forwarded connections the agent closed without
+// sending anything back, which means it could not reach its SQL Server
+func (t *Tenant) recordStreamResult(clientToAgent, agentToClient int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if agentToClient > 0 {
+		t.ConsecutiveEmptyStreams = 0
+		return
+	}
+	if clientToAgent > 0 {
+		t.ConsecutiveEmptyStreams++
+		t.LastEmptyStreamAt = clock.Now()
+	}
+}
+
+// heartbeatStatus classifies the tenant's current reachability for HIS
+func (s *RelayServer) heartbeatStatus(tenant *Tenant) HeartbeatRequest {
+	req := HeartbeatRequest{
+		TenantID:     tenant.ID,
+		Cause:        heartbeatCauseHealthy,
+		State:        s.tenantStates.State(tenant.ID),
+		SourceIPs:    s.sourceIPs.Addresses(tenant.ID),
+		MaxSourceIPs: s.maxSourceIPs(tenant),
+	}
+
+	if reason := s.admissionBlocked(); reason != "" {
+		req.Cause = heartbeatCauseRelayDegraded
+		req.Detail = reason
+		return req
+	}
+
+	if tenant.ControlSession.IsClosed() {
+		req.Cause = heartbeatCauseAgentSessionDown
+		req.Detail = "agent session closed"
+		return req
+	}
+
+	tenant.mu.Lock()
+	defer tenant.mu.Unlock()
+
+	switch {
+	case !tenant.controlLostAt.IsZero():
+		req.Cause = heartbeatCauseAgentSessionDown
+		req.Detail = fmt.Sprintf("agent stopped answering pings %v ago; %d connections finishing, new ones refused",
+			clock.Since(tenant.controlLostAt).Round(time.Second), tenant.ActiveConns)
+	case tenant.Degraded:
+		req.Cause = heartbeatCauseAgentSessionDown
+		req.Detail = fmt.Sprintf("%d consecutive stream open failures: %s", tenant.ConsecutiveOpenFailures, tenant.LastStreamError)
+	case tenant.ConsecutiveEmptyStreams >= s.degradedAfterFailures:
+		req.Cause = heartbeatCauseAgentBackendDown
+		req.Detail = fmt.Sprintf("%d consecutive connections closed by the agent without a response", tenant.ConsecutiveEmptyStreams)
+	}
+	return req
+}
+
+// registerPortRequest describes a tenant's port, where and how clients reach
+// it and the relay instance and build serving it
+func (s *RelayServer) registerPortRequest(tenant *Tenant) RegisterPortRequest {
+	build := relayBuild()
+	endpoints := s.serviceEndpoints(tenant)
+	req := RegisterPortRequest{
+		TenantID:     tenant.ID,
+		Port:         tenant.AssignedPort,
+		PreviousPort: tenant.PreviousPort,
+		Region:       s.region,
+		PublicHost:   endpoints[serviceSQL].Host,
+		AgentRegion:  tenant.Region,
+		RelayVersion: build.Version,
+		RelayCommit:  build.GitCommit,
+
+		RelayInstanceID:  s.instanceID,
+		ServiceType:      serviceSQL,
+		ServiceEndpoints: endpoints,
+		TLSMode:          tlsModePassthrough,
+	}
+	if s.sni.Enabled {
+		req.SNIHost = s.sniHostname(tenant.ID)
+		req.SNIPort = s.sni.Port
+		req.SNITLSMode = tlsModeTerminated
+	}
+	if internal := s.internalEndpoint(tenant); internal != nil {
+		req.InternalHost = internal.Host
+		req.InternalPort = internal.Port
+	}
+	return req
+}
+
+// applyRegisterPortResponse merges HIS labels, fallback endpoints, the
+// connection limit, the source IP cap, any access freeze and the credential
+// policy from a register-port response
+func (s *RelayServer) applyRegisterPortResponse(tenant *Tenant, resp *RegisterPortResponse) {
+	if len(resp.Labels) > 0 {
+		if err := s.setTenantLabels(tenant.ID, resp.Labels, true); err != nil {
+			log.Printf("⚠️  Ignoring HIS labels for tenant %s: %v", tenant.ID, err)
+		} else {
+			s.refreshTenantTier(tenant.ID)
+		}
+	}
+
+	if len(resp.FallbackEndpoints) > 0 {
+		s.mu.Lock()
+		s.hisFallbacks = resp.FallbackEndpoints
+		s.mu.Unlock()
+	}
+
+	s.setHISConnLimit(tenant, resp.MaxConnections)
+	s.applyHISFreeze(tenant, resp.Freeze)
+	s.applyHISCredentialPolicy(tenant, resp.CredentialPolicy)
+	s.setHISMaxSourceIPs(tenant, resp.MaxSourceIPs)
+}
+
+// syncResult is the outcome of an on-demand HIS sync for one tenant
+type syncResult struct {
+	TenantID   string `json:"tenantId"`
+	Registered bool   `json:"registered"`
+	Heartbeat  bool   `json:"heartbeat"`
+	Cause      string `json:"cause,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// syncTenant re-sends a tenant's port registration and an immediate heartbeat
+// to HIS, e.g. after HIS-side data fixes
+func (s *RelayServer) syncTenant(tenant *Tenant) syncResult {
+	result := syncResult{TenantID: tenant.ID}
+
+	req := s.registerPortRequest(tenant)
+	resp, err := s.hisClient.RegisterPort(req)
+	if err != nil {
+		s.hisSpool.Enqueue(spoolKindRegisterPort, tenant.ID, req, err)
+		result.Error = fmt.Sprintf("register port: %v", err)
+		return result
+	}
+	result.Registered = true
+	s.hisSpool.Discard(spoolKindRegisterPort, tenant.ID)
+	tenant.markHISAcked()
+	s.applyRegisterPortResponse(tenant, resp)
+
+	heartbeat := s.heartbeatStatus(tenant)
+	result.Cause = heartbeat.Cause
+	if err := s.hisClient.SendHeartbeat(heartbeat); err != nil {
+		result.Error = fmt.Sprintf("heartbeat: %v", err)
+		return result
+	}
+	result.Heartbeat = true
+	return result
+}
+
+// syncTenants syncs several tenants with HIS, a few at a time
+func (s *RelayServer) syncTenants(tenants []*Tenant) []syncResult {
+	results := make([]syncResult, len(tenants))
+	sem := make(chan struct{}, syncConcurrency)
+	var wg sync.WaitGroup
+	for i, tenant := range tenants {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, tenant *Tenant) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = s.syncTenant(tenant)
+		}(i, tenant)
+	}
+	wg.Wait()
+	return results
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,9 +12,11 @@ import (
 
 // HISClient handles communication with HIS backend
 type HISClient struct {
-	baseURL     string
-	relaySecret string
-	httpClient  *http.Client
+	baseURL      string
+	relaySecret  string
+	httpClient   *http.Client
+	userAgent    string
+	callTimeouts map[string]time.Duration // per endpoint, within httpClient.Timeout
 }
 
 // NewHISClient creates a new HIS client
@@ -22,121 +25,249 @@ func NewHISClient(baseURL, relaySecret string) *HISClient {
 		baseURL:     baseURL,
 		relaySecret: relaySecret,
 		httpClient: &http.Client{
-			Timeout: 10 * time.Second,
+			Timeout: defaultHISRequestTimeout,
 		},
+		userAgent: hisUserAgent(HISNetworkConfig{}, relayInstanceID(ClusterConfig{})),
 	}
 }
 
+// callContext bounds one call to an endpoint by its configured timeout
+func (c *HISClient) callContext(endpoint string) (context.Context, context.CancelFunc) {
+	if timeout, ok := c.callTimeouts[endpoint]; ok {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
 // RegisterPortRequest represents port registration request
 type RegisterPortRequest struct {
-	TenantID string `json:"tenantId"`
-	Port     int    `json:"port"`
+	TenantID     string `json:"tenantId"`
+	Port         int    `json:"port"`
+	PreviousPort int    `json:"previousPort,omitempty"` // set after an admin remap; stored connection strings should move to Port
+	Region       string `json:"region,omitempty"`       // Region of this relay
+	PublicHost   string `json:"publicHost,omitempty"`
+	InternalHost string `json:"internalHost,omitempty"` // set with split-horizon, for on-prem HIS nodes
+	InternalPort int    `json:"internalPort,omitempty"`
+	AgentRegion  string `json:"agentRegion,omitempty"` // Region reported by the agent
+
+	// Relay build that serves the tenant, for fleet debugging
+	RelayVersion string `json:"relayVersion,omitempty"`
+	RelayCommit  string `json:"relayCommit,omitempty"`
+
+	// How clients reach the tenant, so HIS can build connection details when
+	// several relays serve the fleet
+	RelayInstanceID string `json:"relayInstanceId,omitempty"`
+	ServiceType     string `json:"serviceType,omitempty"` // forwarded protocol, "sql"
+	// ServiceEndpoints is where clients reach each service type the tenant
+	// registered, rendered from the serviceEndpoints templates
+	ServiceEndpoints map[string]AdvertisedEndpoint `json:"serviceEndpoints,omitempty"`
+	TLSMode          string                        `json:"tlsMode,omitempty"` // TLS on Port, see tlsModePassthrough
+	SNIHost          string                        `json:"sniHost,omitempty"` // set with SNI routing
+	SNIPort          int                           `json:"sniPort,omitempty"`
+	SNITLSMode       string                        `json:"sniTlsMode,omitempty"`
 }
 
+// TLS modes of a tenant endpoint
+const (
+	// tlsModePassthrough forwards bytes untouched, so any TLS is negotiated
+	// inside TDS between the SQL client and the clinic's server
+	tlsModePassthrough = "passthrough"
+	// tlsModeTerminated means clients speak TLS to the relay, which forwards
+	// the decrypted TDS stream
+	tlsModeTerminated = "terminated"
+)
+
 // RegisterPortResponse represents port registration response
 type RegisterPortResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	Steer   *SteerDirective `json:"steer,omitempty"`
+	// FallbackEndpoints, when set, replaces the configured list handed to agents
+	FallbackEndpoints []string `json:"fallbackEndpoints,omitempty"`
+	// Labels are merged into the tenant's labels
+	Labels map[string]string `json:"labels,omitempty"`
+	// MaxConnections overrides the token and relay connection limit; 0 clears it
+	MaxConnections int `json:"maxConnections,omitempty"`
+	// MaxSourceIPs caps the distinct source IPs the tenant accepts within the
+	// relay's window; 0 leaves the relay's cap
+	MaxSourceIPs int `json:"maxSourceIps,omitempty"`
+	// Freeze schedules an access freeze window for the tenant
+	Freeze *AccessFreeze `json:"freeze,omitempty"`
+	// CredentialPolicy is the SQL password policy the tenant's organization
+	// mandates; it applies from the next password generated
+	CredentialPolicy *CredentialPolicy `json:"credentialPolicy,omitempty"`
+}
+
+// SteerDirective asks an agent to reconnect to a different relay, e.g. one in
+// a closer or less loaded region
+type SteerDirective struct {
+	Endpoint string `json:"endpoint"`
+	Region   string `json:"region,omitempty"`
+	Reason   string `json:"reason,omitempty"`
 }
 
 // RegisterPort registers an assigned port with HIS backend
-func (c *HISClient) RegisterPort(tenantID string, port int) error {
-	url := fmt.Sprintf("%s/api/v2/tatbeeb-link/register-port", c.baseURL)
+func (c *HISClient) RegisterPort(reqBody RegisterPortRequest) (*RegisterPortResponse, error) {
+	body, err := c.post("register-port", "port registration", reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	var regResp RegisterPortResponse
+	if err := json.Unmarshal(body, &regResp); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
 
-	reqBody := RegisterPortRequest{
-		TenantID: tenantID,
-		Port:     port,
+	if !regResp.Success {
+		return nil, fmt.Errorf("port registration %w: %s", errHISRejected, regResp.Message)
 	}
 
+	return &regResp, nil
+}
+
+// post sends reqBody as JSON to the HIS endpoint path and returns the
+// response body. A status other than 200 is a HISStatusError for op.
+func (c *HISClient) post(path, op string, reqBody interface{}) ([]byte, error) {
+	url := fmt.Sprintf("%s/api/v2/tatbeeb-link/%s", c.baseURL, path)
+	ctx, cancel := c.callContext(path)
+	defer cancel()
+
 	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
-		return fmt.Errorf("failed to marshal request: %w", err)
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	// Add headers
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("X-Relay-Secret", c.relaySecret)
+	req.Header.Set("User-Agent", c.userAgent)
 
 	// Send request
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	// Read response
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("failed to read response: %w", err)
+		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
 
 	// Check status code
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("port registration failed (status %d): %s", resp.StatusCode, string(body))
+		return nil, &HISStatusError{Op: op, StatusCode: resp.StatusCode, Body: string(body)}
 	}
+	return body, nil
+}
 
-	// Parse response
-	var regResp RegisterPortResponse
-	if err := json.Unmarshal(body, &regResp); err != nil {
-		return fmt.Errorf("failed to parse response: %w", err)
-	}
+// UnregisterPortRequest tells HIS a tenant's port is no longer served
+type UnregisterPortRequest struct {
+	TenantID string    `json:"tenantId"`
+	Port     int       `json:"port"`
+	Reason   string    `json:"reason"`
+	Detail   string    `json:"detail,omitempty"`
+	ClosedAt time.Time `json:"closedAt"`
+}
 
-	if !regResp.Success {
-		return fmt.Errorf("port registration failed: %s", regResp.Message)
-	}
+// UnregisterPort notifies HIS backend that a tenant left the relay
+func (c *HISClient) UnregisterPort(reqBody UnregisterPortRequest) error {
+	_, err := c.post("unregister-port", "port unregistration", reqBody)
+	return err
+}
 
-	return nil
+// InstanceRegistrationRequest announces a relay instance to HIS: online at
+// startup and periodically after, offline on a graceful shutdown
+type InstanceRegistrationRequest struct {
+	InstanceID      string           `json:"instanceId"`
+	VirtualInstance string           `json:"virtualInstance,omitempty"`
+	Status          string           `json:"status"` // instanceStatus*
+	Version         string           `json:"version"`
+	Commit          string           `json:"commit"`
+	Region          string           `json:"region"`
+	ControlEndpoint string           `json:"controlEndpoint"` // host:port agents dial
+	StartedAt       time.Time        `json:"startedAt"`
+	Capacity        InstanceCapacity `json:"capacity"`
 }
 
-// HeartbeatRequest represents heartbeat request
-type HeartbeatRequest struct {
-	TenantID string `json:"tenantId"`
+// InstanceCapacity is how many more tenants a relay instance can take
+type InstanceCapacity struct {
+	TenantPorts             int    `json:"tenantPorts"`
+	PortsAvailable          int    `json:"portsAvailable"`
+	TenantsRegistered       int    `json:"tenantsRegistered"`
+	MaxConnectionsPerTenant int    `json:"maxConnectionsPerTenant"`
+	AdmissionBlocked        string `json:"admissionBlocked,omitempty"` // why new agents are refused, if they are
 }
 
-// HeartbeatResponse represents heartbeat response
-type HeartbeatResponse struct {
-	Success bool `json:"success"`
+// RegisterInstance reports the relay instance and its status to HIS
+func (c *HISClient) RegisterInstance(reqBody InstanceRegistrationRequest) error {
+	_, err := c.post("relay-instances", "instance registration", reqBody)
+	return err
 }
 
-// SendHeartbeat sends a heartbeat to HIS backend
-func (c *HISClient) SendHeartbeat(tenantID string) error {
-	url := fmt.Sprintf("%s/api/v2/tatbeeb-link/heartbeat", c.baseURL)
+// Reconcile pushes the relay's tenant snapshot to HIS after an outage
+func (c *HISClient) Reconcile(reqBody ReconcileRequest) error {
+	_, err := c.post("reconcile", "reconciliation", reqBody)
+	return err
+}
 
-	reqBody := HeartbeatRequest{
-		TenantID: tenantID,
-	}
+// QuotaExceededRequest tells HIS a tenant hit a contractual byte cap
+type QuotaExceededRequest struct {
+	TenantID   string    `json:"tenantId"`
+	Kind       string    `json:"kind"` // connection or daily
+	LimitBytes int64     `json:"limitBytes"`
+	UsedBytes  int64     `json:"usedBytes"`
+	At         time.Time `json:"at"`
+}
 
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return fmt.Errorf("failed to marshal request: %w", err)
-	}
+// ReportQuotaExceeded notifies HIS backend that a byte cap was reached
+func (c *HISClient) ReportQuotaExceeded(reqBody QuotaExceededRequest) error {
+	_, err := c.post("quota-exceeded", "quota report", reqBody)
+	return err
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
+// CredentialRotatedRequest tells HIS a tenant's SQL credential was replaced.
+// The previous one keeps working until PreviousValidUntil.
+type CredentialRotatedRequest struct {
+	TenantID           string    `json:"tenantId"`
+	RotationID         string    `json:"rotationId"`
+	SQLUser            string    `json:"sqlUser"`
+	SQLPassword        string    `json:"sqlPassword"`
+	PreviousSQLUser    string    `json:"previousSqlUser"`
+	PreviousValidUntil time.Time `json:"previousValidUntil"`
+}
 
-	// Add headers
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Relay-Secret", c.relaySecret)
+// ReportCredentialRotated sends HIS a tenant's new SQL credential
+func (c *HISClient) ReportCredentialRotated(reqBody CredentialRotatedRequest) error {
+	_, err := c.post("credential-rotated", "credential rotation", reqBody)
+	return err
+}
 
-	// Send request
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
-	}
-	defer resp.Body.Close()
+// HeartbeatRequest represents heartbeat request
+type HeartbeatRequest struct {
+	TenantID string `json:"tenantId"`
+	Cause    string `json:"cause"`            // heartbeatCause*: which side of the tunnel is failing
+	Detail   string `json:"detail,omitempty"` // human-readable explanation for support screens
+	State    string `json:"state,omitempty"`  // tenantState*: the tenant's lifecycle state on the relay
+	// SourceIPs are the addresses that connected to the tenant within the
+	// relay's source IP window, with the cap in force (0 for none)
+	SourceIPs    []string `json:"sourceIps"`
+	MaxSourceIPs int      `json:"maxSourceIps"`
+}
 
-	// Check status code
-	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("heartbeat failed (status %d): %s", resp.StatusCode, string(body))
-	}
+// HeartbeatResponse represents heartbeat response
+type HeartbeatResponse struct {
+	Success bool `json:"success"`
+}
 
-	return nil
+// SendHeartbeat sends a heartbeat to HIS backend
+func (c *HISClient) SendHeartbeat(reqBody HeartbeatRequest) error {
+	_, err := c.post("heartbeat", "heartbeat", reqBody)
+	return err
 }
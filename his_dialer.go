@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHISDNSCacheTTL   = 30 * time.Second
+	defaultHISFallbackDelay = 300 * time.Millisecond
+	defaultHISDialTimeout   = 5 * time.Second
+
+	// Go keeps only 2 idle connections per host by default, so bursts of
+	// notifications open and close connections to HIS over and over
+	defaultHISMaxIdleConnsPerHost = 16
+	defaultHISIdleConnTimeout     = 90 * time.Second
+	defaultHISRequestTimeout      = 10 * time.Second
+)
+
+// HISNetworkConfig tunes how the relay resolves and connects to HIS backends
+type HISNetworkConfig struct {
+	// Resolver is a DNS server (host:port) to use instead of the system resolver
+	Resolver string `json:"resolver"`
+	// DNSCacheTTLSeconds bounds how long resolved addresses are reused
+	DNSCacheTTLSeconds int `json:"dnsCacheTtlSeconds"`
+	// FallbackDelayMs is how long to wait on the preferred address family
+	// before racing the other one (Happy Eyeballs)
+	FallbackDelayMs       int `json:"fallbackDelayMs"`
+	ConnectTimeoutSeconds int `json:"connectTimeoutSeconds"`
+
+	// Connection pooling: idle connections kept per HIS host, a cap on all
+	// connections per host (0 for none) and how long idle ones are kept
+	MaxIdleConnsPerHost    int `json:"maxIdleConnsPerHost"`
+	MaxConnsPerHost        int `json:"maxConnsPerHost"`
+	IdleConnTimeoutSeconds int `json:"idleConnTimeoutSeconds"`
+	// RequestTimeoutSeconds bounds every call; CallTimeoutSeconds overrides it
+	// per endpoint, e.g. {"heartbeat": 3}
+	RequestTimeoutSeconds int            `json:"requestTimeoutSeconds"`
+	CallTimeoutSeconds    map[string]int `json:"callTimeoutSeconds"`
+	// UserAgent replaces the default tatbeeb-link-relay/<version> (<instance>)
+	UserAgent string `json:"userAgent"`
+}
+
+// hisEndpoints are the HIS calls CallTimeoutSeconds may name
+var hisEndpoints = []string{"register-port", "unregister-port", "heartbeat", "quota-exceeded", "credential-rotated", "relay-instances", "reconcile"}
+
+// validateHISNetwork checks pooling and timeout settings
+func validateHISNetwork(cfg HISNetworkConfig) error {
+	if cfg.MaxIdleConnsPerHost < 0 || cfg.MaxConnsPerHost < 0 || cfg.IdleConnTimeoutSeconds < 0 || cfg.RequestTimeoutSeconds < 0 {
+		return fmt.Errorf("pool sizes and timeouts must not be negative")
+	}
+	for endpoint, seconds := range cfg.CallTimeoutSeconds {
+		if !containsString(hisEndpoints, endpoint) {
+			return fmt.Errorf("callTimeoutSeconds: unknown endpoint %q", endpoint)
+		}
+		if seconds <= 0 {
+			return fmt.Errorf("callTimeoutSeconds.%s must be positive", endpoint)
+		}
+	}
+	return nil
+}
+
+// hisUserAgent identifies the relay build and instance to HIS
+func hisUserAgent(cfg HISNetworkConfig, instanceID string) string {
+	if cfg.UserAgent != "" {
+		return cfg.UserAgent
+	}
+	return fmt.Sprintf("tatbeeb-link-relay/%s (%s)", relayBuild().Version, instanceID)
+}
+
+// dnsEntry is a cached lookup result
+type dnsEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+// hisDialer resolves through an optional custom resolver with a small cache
+// and connects with Happy Eyeballs, so a broken address family costs the
+// fallback delay rather than the whole request timeout
+type hisDialer struct {
+	resolver      *net.Resolver
+	cacheTTL      time.Duration
+	fallbackDelay time.Duration
+	dialer        net.Dialer
+	cache         map[string]dnsEntry
+	mu            sync.Mutex
+}
+
+func newHISDialer(cfg HISNetworkConfig) *hisDialer {
+	d := &hisDialer{
+		resolver:      net.DefaultResolver,
+		cacheTTL:      defaultHISDNSCacheTTL,
+		fallbackDelay: defaultHISFallbackDelay,
+		dialer:        net.Dialer{Timeout: defaultHISDialTimeout, KeepAlive: 30 * time.Second},
+		cache:         make(map[string]dnsEntry),
+	}
+	if cfg.Resolver != "" {
+		server := cfg.Resolver
+		d.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+	if cfg.DNSCacheTTLSeconds > 0 {
+		d.cacheTTL = time.Duration(cfg.DNSCacheTTLSeconds) * time.Second
+	}
+	if cfg.FallbackDelayMs > 0 {
+		d.fallbackDelay = time.Duration(cfg.FallbackDelayMs) * time.Millisecond
+	}
+	if cfg.ConnectTimeoutSeconds > 0 {
+		d.dialer.Timeout = time.Duration(cfg.ConnectTimeoutSeconds) * time.Second
+	}
+	return d
+}
+
+// newHISTransport creates the HTTP transport shared by all HIS clients
+func newHISTransport(cfg HISNetworkConfig) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = newHISDialer(cfg).DialContext
+	transport.MaxIdleConnsPerHost = defaultHISMaxIdleConnsPerHost
+	if cfg.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	if transport.MaxIdleConns < transport.MaxIdleConnsPerHost {
+		transport.MaxIdleConns = transport.MaxIdleConnsPerHost
+	}
+	transport.MaxConnsPerHost = cfg.MaxConnsPerHost
+	transport.IdleConnTimeout = defaultHISIdleConnTimeout
+	if cfg.IdleConnTimeoutSeconds > 0 {
+		transport.IdleConnTimeout = time.Duration(cfg.IdleConnTimeoutSeconds) * time.Second
+	}
+	return transport
+}
+
+// lookup resolves host, serving cached addresses until they expire and stale
+// ones if the resolver fails
+func (d *hisDialer) lookup(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+
+	d.mu.Lock()
+	entry, cached := d.cache[host]
+	d.mu.Unlock()
+	if cached && clock.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		if cached {
+			return entry.addrs, nil
+		}
+		return nil, err
+	}
+
+	d.mu.Lock()
+	d.cache[host] = dnsEntry{addrs: addrs, expires: clock.Now().Add(d.cacheTTL)}
+	d.mu.Unlock()
+	return addrs, nil
+}
+
+// DialContext connects to addr, racing IPv6 and IPv4 addresses per RFC 8305
+func (d *hisDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+
+	// The resolver's first address picks the preferred family
+	var primary, fallback []net.IPAddr
+	preferV4 := addrs[0].IP.To4() != nil
+	for _, a := range addrs {
+		if (a.IP.To4() != nil) == preferV4 {
+			primary = append(primary, a)
+		} else {
+			fallback = append(fallback, a)
+		}
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, 2)
+	race := func(candidates []net.IPAddr) {
+		var lastErr error
+		for _, a := range candidates {
+			conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(a.IP.String(), port))
+			if err == nil {
+				results <- dialResult{conn: conn}
+				return
+			}
+			lastErr = err
+		}
+		results <- dialResult{err: lastErr}
+	}
+
+	go race(primary)
+	racers := 1
+
+	fallbackTimer := clock.NewTimer(d.fallbackDelay)
+	defer fallbackTimer.Stop()
+	startFallback := func() {
+		if len(fallback) > 0 {
+			go race(fallback)
+			racers++
+			fallback = nil
+		}
+	}
+
+	var firstErr error
+	for finished := 0; finished < racers; {
+		select {
+		case <-fallbackTimer.C:
+			startFallback()
+		case res := <-results:
+			finished++
+			if res.err == nil {
+				// Close a connection the losing racer may still establish
+				if remaining := racers - finished; remaining > 0 {
+					go func() {
+						for i := 0; i < remaining; i++ {
+							if late := <-results; late.conn != nil {
+								late.conn.Close()
+							}
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			// Don't wait out the delay once the preferred family failed
+			fallbackTimer.Stop()
+			startFallback()
+		}
+	}
+	if firstErr == nil {
+		firstErr = errors.New("no addresses to dial")
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// hisBreakerThreshold consecutive outage failures open a target's breaker
+	hisBreakerThreshold = 5
+	// hisBreakerCooldown is how long an open breaker fails calls fast before
+	// letting a single probe through
+	hisBreakerCooldown = 30 * time.Second
+)
+
+// Breaker states of a HIS target
+const (
+	hisBreakerClosed   = "closed"
+	hisBreakerOpen     = "open"
+	hisBreakerHalfOpen = "half_open"
+)
+
+// Failure causes besides HTTP status codes
+const (
+	hisFailureTransport   = "transport"    // connection, TLS or timeout error
+	hisFailureRejected    = "rejected"     // HTTP 200 with success=false
+	hisFailureBreakerOpen = "breaker_open" // not sent, the target's breaker was open
+)
+
+var (
+	errHISBreakerOpen = errors.New("HIS circuit breaker open")
+	errHISRejected    = errors.New("rejected by HIS")
+)
+
+// HISStatusError is a non-200 response from a HIS endpoint
+type HISStatusError struct {
+	Op         string
+	StatusCode int
+	Body       string
+}
+
+func (e *HISStatusError) Error() string {
+	return fmt.Sprintf("%s failed (status %d): %s", e.Op, e.StatusCode, e.Body)
+}
+
+// hisFailureCause classifies a failed HIS call for metrics
+func hisFailureCause(err error) string {
+	var statusErr *HISStatusError
+	switch {
+	case errors.Is(err, errHISBreakerOpen):
+		return hisFailureBreakerOpen
+	case errors.As(err, &statusErr):
+		return strconv.Itoa(statusErr.StatusCode)
+	case errors.Is(err, errHISRejected):
+		return hisFailureRejected
+	}
+	return hisFailureTransport
+}
+
+// countsAsOutage reports whether a failure says HIS is down rather than that
+// it refused this particular request
+func countsAsOutage(cause string) bool {
+	if cause == hisFailureTransport {
+		return true
+	}
+	status, err := strconv.Atoi(cause)
+	return err == nil && (status >= http.StatusInternalServerError || status == http.StatusTooManyRequests)
+}
+
+// hisEndpointStats tracks one endpoint of one HIS target
+type hisEndpointStats struct {
+	successes   int64
+	failures    map[string]int64 // cause -> count
+	calls       int64            // calls that reached HIS, for the average latency
+	latencyLast time.Duration
+	latencyMax  time.Duration
+	latencySum  time.Duration
+	lastSuccess time.Time
+}
+
+// hisBreaker stops calls to a HIS target that keeps failing, so requests
+// don't each wait for a timeout during an outage
+type hisBreaker struct {
+	state               string
+	consecutiveFailures int
+	openUntil           time.Time
+	probing             bool
+	mu                  sync.Mutex
+}
+
+// allow reports whether a call may be sent. After the cooldown one probe is
+// let through; its result closes or re-opens the breaker.
+func (b *hisBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case hisBreakerOpen:
+		if clock.Now().Before(b.openUntil) {
+			return false
+		}
+		b.state = hisBreakerHalfOpen
+		b.probing = true
+		return true
+	case hisBreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// record updates the breaker with a call result, reporting whether it closed
+// an open breaker
+func (b *hisBreaker) record(target string, outage bool) (recovered bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if !outage {
+		if b.state != hisBreakerClosed {
+			log.Printf("✅ HIS target %s recovered, circuit breaker closed", target)
+			recovered = true
+		}
+		b.state = hisBreakerClosed
+		b.consecutiveFailures = 0
+		return recovered
+	}
+
+	b.consecutiveFailures++
+	if b.state == hisBreakerHalfOpen || b.consecutiveFailures >= hisBreakerThreshold {
+		if b.state != hisBreakerOpen {
+			log.Printf("⚠️  HIS target %s failing (%d consecutive failures), circuit breaker open for %v",
+				target, b.consecutiveFailures, hisBreakerCooldown)
+		}
+		b.state = hisBreakerOpen
+		b.openUntil = clock.Now().Add(hisBreakerCooldown)
+	}
+	return false
+}
+
+func (b *hisBreaker) metrics() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	metrics := map[string]interface{}{
+		"state":               b.state,
+		"consecutiveFailures": b.consecutiveFailures,
+	}
+	if b.state == hisBreakerOpen {
+		metrics["openUntil"] = b.openUntil.Format(time.RFC3339)
+	}
+	return metrics
+}
+
+// endpointMetrics reports per-endpoint statistics. Callers hold t.mu.
+func (t *hisTarget) endpointMetrics() map[string]interface{} {
+	endpoints := make(map[string]interface{}, len(t.endpoints))
+	for op, stats := range t.endpoints {
+		failures := make(map[string]int64, len(stats.failures))
+		for cause, n := range stats.failures {
+			failures[cause] = n
+		}
+		latency := map[string]interface{}{
+			"last": stats.latencyLast.Milliseconds(),
+			"max":  stats.latencyMax.Milliseconds(),
+		}
+		if stats.calls > 0 {
+			latency["avg"] = (stats.latencySum / time.Duration(stats.calls)).Milliseconds()
+		}
+		entry := map[string]interface{}{
+			"successes":  stats.successes,
+			"failures":   failures,
+			"latency_ms": latency,
+		}
+		if !stats.lastSuccess.IsZero() {
+			entry["lastSuccess"] = stats.lastSuccess.Format(time.RFC3339)
+			entry["secondsSinceLastSuccess"] = int64(clock.Since(stats.lastSuccess).Seconds())
+		}
+		endpoints[op] = entry
+	}
+	return endpoints
+}
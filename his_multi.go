@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// HISNotifier delivers relay notifications to HIS
+type HISNotifier interface {
+	RegisterPort(req RegisterPortRequest) (*RegisterPortResponse, error)
+	UnregisterPort(req UnregisterPortRequest) error
+	ReportQuotaExceeded(req QuotaExceededRequest) error
+	SendHeartbeat(req HeartbeatRequest) error
+	ReportCredentialRotated(req CredentialRotatedRequest) error
+	RegisterInstance(req InstanceRegistrationRequest) error
+	// Reconcile sends the relay's tenant snapshot to the named target
+	Reconcile(target string, req ReconcileRequest) error
+}
+
+// HISBackend is what the relay server talks to: MultiHISClient in production,
+// MemoryHIS in tests
+type HISBackend interface {
+	HISNotifier
+	Metrics() []map[string]interface{}
+}
+
+// HISTargetConfig describes one HIS backend the relay notifies
+type HISTargetConfig struct {
+	Name              string `json:"name"`
+	BackendURL        string `json:"backendUrl"`
+	RelaySharedSecret string `json:"relaySharedSecret"`
+	Primary           bool   `json:"primary"`
+}
+
+// hisTarget is a configured HIS backend with its delivery statistics
+type hisTarget struct {
+	name        string
+	client      *HISClient
+	primary     bool
+	breaker     hisBreaker
+	endpoints   map[string]*hisEndpointStats // op -> stats
+	lastSuccess time.Time
+	lastError   string
+	recovered   func(target string) // called when the target's breaker closes
+	mu          sync.Mutex
+}
+
+// call sends op through the target's breaker and records the outcome
+func (t *hisTarget) call(op string, send func(c *HISClient) error) error {
+	if !t.breaker.allow() {
+		t.record(op, errHISBreakerOpen, 0)
+		return fmt.Errorf("%s to %s: %w", op, t.name, errHISBreakerOpen)
+	}
+
+	start := clock.Now()
+	err := send(t.client)
+	t.record(op, err, clock.Since(start))
+	return err
+}
+
+func (t *hisTarget) record(op string, err error, latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.endpoints[op]
+	if !ok {
+		stats = &hisEndpointStats{failures: make(map[string]int64)}
+		t.endpoints[op] = stats
+	}
+
+	if err != nil {
+		cause := hisFailureCause(err)
+		stats.failures[cause]++
+		// Keep the error that opened the breaker visible
+		if cause == hisFailureBreakerOpen {
+			return
+		}
+		t.lastError = err.Error()
+		if t.breaker.record(t.name, countsAsOutage(cause)) {
+			t.recovered(t.name)
+		}
+	} else {
+		stats.successes++
+		stats.lastSuccess = clock.Now()
+		t.lastSuccess = stats.lastSuccess
+		if t.breaker.record(t.name, false) {
+			t.recovered(t.name)
+		}
+	}
+
+	stats.calls++
+	stats.latencySum += latency
+	stats.latencyLast = latency
+	if latency > stats.latencyMax {
+		stats.latencyMax = latency
+	}
+}
+
+// MultiHISClient notifies several HIS backends, e.g. old and new APIs during a
+// migration. The primary target is called synchronously and decides the
+// outcome; the others are written to in the background.
+type MultiHISClient struct {
+	targets []*hisTarget
+
+	// onRecovered, when set, is called in the background when a target's
+	// circuit breaker closes after an outage
+	onRecovered func(target string)
+}
+
+// NewMultiHISClient creates a client for the given targets. If none is marked
+// primary the first target is used. All targets share one transport.
+func NewMultiHISClient(configs []HISTargetConfig, network HISNetworkConfig, instanceID string) (*MultiHISClient, error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("at least one HIS target is required")
+	}
+
+	primaries := 0
+	for _, cfg := range configs {
+		if cfg.Primary {
+			primaries++
+		}
+	}
+	if primaries > 1 {
+		return nil, fmt.Errorf("only one HIS target may be primary, got %d", primaries)
+	}
+
+	transport := newHISTransport(network)
+	userAgent := hisUserAgent(network, instanceID)
+	requestTimeout := defaultHISRequestTimeout
+	if network.RequestTimeoutSeconds > 0 {
+		requestTimeout = time.Duration(network.RequestTimeoutSeconds) * time.Second
+	}
+	callTimeouts := make(map[string]time.Duration, len(network.CallTimeoutSeconds))
+	for endpoint, seconds := range network.CallTimeoutSeconds {
+		callTimeouts[endpoint] = time.Duration(seconds) * time.Second
+	}
+
+	m := &MultiHISClient{}
+	for i, cfg := range configs {
+		name := cfg.Name
+		if name == "" {
+			name = fmt.Sprintf("target-%d", i)
+		}
+		client := NewHISClient(cfg.BackendURL, cfg.RelaySharedSecret)
+		client.httpClient.Transport = transport
+		client.httpClient.Timeout = requestTimeout
+		client.userAgent = userAgent
+		client.callTimeouts = callTimeouts
+		m.targets = append(m.targets, &hisTarget{
+			name:      name,
+			client:    client,
+			primary:   cfg.Primary || (primaries == 0 && i == 0),
+			breaker:   hisBreaker{state: hisBreakerClosed},
+			endpoints: make(map[string]*hisEndpointStats),
+			recovered: m.targetRecovered,
+		})
+	}
+	return m, nil
+}
+
+// RegisterPort registers the port with every target, returning the primary's result
+func (m *MultiHISClient) RegisterPort(req RegisterPortRequest) (*RegisterPortResponse, error) {
+	var primaryResp *RegisterPortResponse
+	err := m.fanOut("register-port", func(c *HISClient, primary bool) error {
+		resp, err := c.RegisterPort(req)
+		if primary {
+			primaryResp = resp
+		}
+		return err
+	})
+	return primaryResp, err
+}
+
+// UnregisterPort reports a departed tenant to every target, returning the primary's result
+func (m *MultiHISClient) UnregisterPort(req UnregisterPortRequest) error {
+	return m.fanOut("unregister-port", func(c *HISClient, primary bool) error {
+		return c.UnregisterPort(req)
+	})
+}
+
+// ReportCredentialRotated sends a new credential to every target, returning the primary's result
+func (m *MultiHISClient) ReportCredentialRotated(req CredentialRotatedRequest) error {
+	return m.fanOut("credential-rotated", func(c *HISClient, primary bool) error {
+		return c.ReportCredentialRotated(req)
+	})
+}
+
+// ReportQuotaExceeded reports a byte cap to every target, returning the primary's result
+func (m *MultiHISClient) ReportQuotaExceeded(req QuotaExceededRequest) error {
+	return m.fanOut("quota-exceeded", func(c *HISClient, primary bool) error {
+		return c.ReportQuotaExceeded(req)
+	})
+}
+
+// SendHeartbeat sends a heartbeat to every target, returning the primary's result
+func (m *MultiHISClient) SendHeartbeat(req HeartbeatRequest) error {
+	return m.fanOut("heartbeat", func(c *HISClient, primary bool) error {
+		return c.SendHeartbeat(req)
+	})
+}
+
+// RegisterInstance reports the relay instance to every target, returning the primary's result
+func (m *MultiHISClient) RegisterInstance(req InstanceRegistrationRequest) error {
+	return m.fanOut("relay-instances", func(c *HISClient, primary bool) error {
+		return c.RegisterInstance(req)
+	})
+}
+
+// Reconcile sends a tenant snapshot to the named target only; the others
+// never missed what it carries
+func (m *MultiHISClient) Reconcile(target string, req ReconcileRequest) error {
+	for _, t := range m.targets {
+		if t.name == target {
+			return t.call("reconcile", func(c *HISClient) error { return c.Reconcile(req) })
+		}
+	}
+	return fmt.Errorf("unknown HIS target %q", target)
+}
+
+// targetRecovered hands a recovered target to onRecovered
+func (m *MultiHISClient) targetRecovered(target string) {
+	if m.onRecovered != nil {
+		go m.onRecovered(target)
+	}
+}
+
+func (m *MultiHISClient) fanOut(op string, call func(c *HISClient, primary bool) error) error {
+	var primaryErr error
+	for _, target := range m.targets {
+		if target.primary {
+			primaryErr = target.call(op, func(c *HISClient) error { return call(c, true) })
+			continue
+		}
+
+		go func(t *hisTarget) {
+			err := t.call(op, func(c *HISClient) error { return call(c, false) })
+			if err != nil {
+				log.Printf("⚠️  Secondary HIS target %s %s failed: %v", t.name, op, err)
+			}
+		}(target)
+	}
+	return primaryErr
+}
+
+// Metrics returns per-target delivery statistics
+func (m *MultiHISClient) Metrics() []map[string]interface{} {
+	metrics := make([]map[string]interface{}, 0, len(m.targets))
+	for _, t := range m.targets {
+		t.mu.Lock()
+		successes := make(map[string]int64, len(t.endpoints))
+		failures := make(map[string]int64, len(t.endpoints))
+		for op, stats := range t.endpoints {
+			successes[op] = stats.successes
+			for _, n := range stats.failures {
+				failures[op] += n
+			}
+		}
+		entry := map[string]interface{}{
+			"name":      t.name,
+			"primary":   t.primary,
+			"successes": successes,
+			"failures":  failures,
+			"endpoints": t.endpointMetrics(),
+			"breaker":   t.breaker.metrics(),
+			"lastError": t.lastError,
+		}
+		if !t.lastSuccess.IsZero() {
+			entry["lastSuccess"] = t.lastSuccess.Format(time.RFC3339)
+			entry["secondsSinceLastSuccess"] = int64(clock.Since(t.lastSuccess).Seconds())
+		}
+		t.mu.Unlock()
+		metrics = append(metrics, entry)
+	}
+	return metrics
+}
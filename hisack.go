@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+const defaultHISAckTimeout = 10 * time.Second
+
+// markHISAcked records that HIS confirmed the tenant's port registration
+func (t *Tenant) markHISAcked() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.hisAcked == nil {
+		return
+	}
+	select {
+	case <-t.hisAcked:
+	default:
+		close(t.hisAcked)
+	}
+}
+
+// spooledDelivered acks a tenant whose port registration went through on a
+// spool replay
+func (s *RelayServer) spooledDelivered(kind, tenantID string) {
+	if kind != spoolKindRegisterPort {
+		return
+	}
+	s.mu.RLock()
+	tenant, ok := s.tenants[tenantID]
+	s.mu.RUnlock()
+	if ok {
+		tenant.markHISAcked()
+	}
+}
+
+// awaitHISAck blocks until HIS confirms the tenant's port or the ack timeout
+// passes. Until then clients wait in the listener backlog, so none reaches a
+// port that HIS may still map to a previous tenant.
+func (s *RelayServer) awaitHISAck(tenant *Tenant) {
+	if tenant.hisAcked == nil {
+		return
+	}
+
+	timer := clock.NewTimer(s.hisAckTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-tenant.hisAcked:
+	case <-timer.C:
+		s.counters.inc(&s.counters.hisAckTimeouts)
+		log.Printf("⚠️  HIS did not confirm port %d for tenant %s within %v, accepting connections anyway",
+			tenant.AssignedPort, tenant.ID, s.hisAckTimeout)
+	}
+}
+
+// serveTenantPort starts forwarding for a newly registered tenant, first
+// waiting for HIS when holdUntilHISAck is enabled
+func (s *RelayServer) serveTenantPort(tenant *Tenant, listener net.Listener, held []net.Conn) {
+	s.awaitHISAck(tenant)
+	s.activateTenant(tenant)
+	s.dispatchHeld(tenant, held)
+	s.acceptTenantConnections(tenant, listener)
+}
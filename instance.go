@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInstanceRegistrationInterval = time.Minute
+
+	// Statuses a relay instance reports to HIS
+	instanceStatusOnline  = "online"
+	instanceStatusOffline = "offline"
+)
+
+// InstanceRegistrationConfig announces the relay instance itself to HIS, so
+// HIS knows which relays are alive when several serve it. The instance
+// registers at startup and every intervalSeconds, and reports itself offline
+// on a graceful shutdown.
+type InstanceRegistrationConfig struct {
+	Disabled        bool `json:"disabled"`
+	IntervalSeconds int  `json:"intervalSeconds"` // default 60
+	// ControlEndpoint is the host:port agents dial; publicHost and the
+	// control port by default
+	ControlEndpoint string `json:"controlEndpoint"`
+}
+
+// interval returns how often the instance re-registers
+func (c InstanceRegistrationConfig) interval() time.Duration {
+	if c.IntervalSeconds > 0 {
+		return time.Duration(c.IntervalSeconds) * time.Second
+	}
+	return defaultInstanceRegistrationInterval
+}
+
+// validateInstanceRegistration checks the interval and endpoint
+func validateInstanceRegistration(cfg InstanceRegistrationConfig) error {
+	if cfg.IntervalSeconds < 0 {
+		return fmt.Errorf("intervalSeconds must not be negative")
+	}
+	if cfg.ControlEndpoint != "" {
+		if _, port, err := net.SplitHostPort(cfg.ControlEndpoint); err != nil || port == "" {
+			return fmt.Errorf("controlEndpoint %q must be host:port", cfg.ControlEndpoint)
+		}
+	}
+	return nil
+}
+
+// instanceRegistrationState is the outcome of the latest instance
+// registration, for /metrics
+type instanceRegistrationState struct {
+	registrations int64
+	failures      int64
+	lastSuccess   time.Time
+	lastError     string
+	mu            sync.Mutex
+}
+
+// controlEndpoint returns the address agents dial to reach this instance
+func (s *RelayServer) controlEndpoint() string {
+	if s.instanceRegistration.ControlEndpoint != "" {
+		return s.instanceRegistration.ControlEndpoint
+	}
+	return net.JoinHostPort(s.publicHost, strconv.Itoa(s.config.ControlPort))
+}
+
+// instanceRegistrationRequest describes this instance and its spare capacity
+func (s *RelayServer) instanceRegistrationRequest(status string) InstanceRegistrationRequest {
+	build := relayBuild()
+	s.mu.RLock()
+	capacity := InstanceCapacity{
+		TenantPorts:             s.portCapacityLocked(),
+		PortsAvailable:          s.availablePortsLocked(),
+		TenantsRegistered:       len(s.tenants),
+		MaxConnectionsPerTenant: s.config.MaxConnectionsPerTenant,
+	}
+	s.mu.RUnlock()
+	capacity.AdmissionBlocked = s.admissionBlocked()
+
+	return InstanceRegistrationRequest{
+		InstanceID:      s.instanceID,
+		VirtualInstance: s.virtualInstance,
+		Status:          status,
+		Version:         build.Version,
+		Commit:          build.GitCommit,
+		Region:          s.region,
+		ControlEndpoint: s.controlEndpoint(),
+		StartedAt:       s.startedAt.UTC(),
+		Capacity:        capacity,
+	}
+}
+
+// registerInstance reports the instance to HIS with status
+func (s *RelayServer) registerInstance(status string) error {
+	err := s.hisClient.RegisterInstance(s.instanceRegistrationRequest(status))
+
+	state := &s.instanceRegistrationState
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if err != nil {
+		state.failures++
+		state.lastError = err.Error()
+		return err
+	}
+	state.registrations++
+	state.lastSuccess = clock.Now()
+	state.lastError = ""
+	return nil
+}
+
+// runInstanceRegistration registers the instance with HIS now and every
+// interval after, until the process exits
+func (s *RelayServer) runInstanceRegistration() {
+	interval := s.instanceRegistration.interval()
+	log.Printf("📣 Registering relay instance %s (%s) with HIS every %v", s.instanceID, s.controlEndpoint(), interval)
+
+	failing := false
+	register := func() {
+		err := s.registerInstance(instanceStatusOnline)
+		switch {
+		case err != nil && !failing:
+			log.Printf("⚠️  Relay instance registration with HIS failed: %v", err)
+		case err == nil && failing:
+			log.Printf("✅ Relay instance registered with HIS again")
+		}
+		failing = err != nil
+	}
+
+	register()
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		register()
+	}
+}
+
+// deregisterInstance tells HIS the instance is going offline, on a graceful
+// shutdown
+func (s *RelayServer) deregisterInstance() {
+	if s.instanceRegistration.Disabled {
+		return
+	}
+	if err := s.registerInstance(instanceStatusOffline); err != nil {
+		log.Printf("⚠️  Could not mark relay instance %s offline with HIS: %v", s.instanceID, err)
+		return
+	}
+	log.Printf("📣 Relay instance %s marked offline with HIS", s.instanceID)
+}
+
+// instanceRegistrationMetrics reports the instance's registrations with HIS
+func (s *RelayServer) instanceRegistrationMetrics() map[string]interface{} {
+	state := &s.instanceRegistrationState
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	metrics := map[string]interface{}{
+		"instance_id":      s.instanceID,
+		"control_endpoint": s.controlEndpoint(),
+		"registrations":    state.registrations,
+		"failures":         state.failures,
+		"last_error":       state.lastError,
+	}
+	if !state.lastSuccess.IsZero() {
+		metrics["last_success"] = state.lastSuccess.UTC().Format(time.RFC3339)
+	}
+	return metrics
+}
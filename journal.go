@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	journalAssign  = "assign"
+	journalRelease = "release"
+)
+
+// JournalRecord is one line of the port journal
+type JournalRecord struct {
+	Op       string    `json:"op"`
+	TenantID string    `json:"tenantId"`
+	Port     int       `json:"port"`
+	At       time.Time `json:"at"`
+}
+
+// PortJournal is an append-only log of port assignments and releases. Each
+// record is fsynced before the agent is told its port, so after a crash the
+// relay knows which ports HIS may still map to which tenant.
+type PortJournal struct {
+	path    string
+	file    *os.File
+	appends int64
+	mu      sync.Mutex
+}
+
+// OpenPortJournal replays the journal at path, compacts it to the ports still
+// assigned and opens it for appending. It returns tenant ID -> port.
+func OpenPortJournal(path string) (*PortJournal, map[string]int, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, nil, fmt.Errorf("failed to create journal dir: %w", err)
+	}
+
+	assigned, err := replayPortJournal(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := compactPortJournal(path, assigned); err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	return &PortJournal{path: path, file: file}, assigned, nil
+}
+
+// replayPortJournal folds the journal into the latest assignment per tenant
+func replayPortJournal(path string) (map[string]int, error) {
+	assigned := make(map[string]int)
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return assigned, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record JournalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue // a torn final line after a crash
+		}
+		switch record.Op {
+		case journalAssign:
+			assigned[record.TenantID] = record.Port
+		case journalRelease:
+			if assigned[record.TenantID] == record.Port {
+				delete(assigned, record.TenantID)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+	return assigned, nil
+}
+
+// compactPortJournal atomically rewrites the journal with one assign record
+// per tenant
+func compactPortJournal(path string, assigned map[string]int) error {
+	tenantIDs := make([]string, 0, len(assigned))
+	for tenantID := range assigned {
+		tenantIDs = append(tenantIDs, tenantID)
+	}
+	sort.Strings(tenantIDs)
+
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to compact journal: %w", err)
+	}
+	writer := bufio.NewWriter(file)
+	now := clock.BaseNow().UTC()
+	for _, tenantID := range tenantIDs {
+		line, _ := json.Marshal(JournalRecord{Op: journalAssign, TenantID: tenantID, Port: assigned[tenantID], At: now})
+		writer.Write(append(line, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to compact journal: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to compact journal: %w", err)
+	}
+	file.Close()
+	return os.Rename(tmp, path)
+}
+
+// Append writes a record and fsyncs it
+func (j *PortJournal) Append(op, tenantID string, port int) error {
+	line, err := json.Marshal(JournalRecord{Op: op, TenantID: tenantID, Port: port, At: clock.BaseNow().UTC()})
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	j.appends++
+	return nil
+}
+
+// journalMetrics reports the journal and how many restored assignments are
+// still waiting for their tenant. Callers hold s.mu.
+func (s *RelayServer) journalMetrics() map[string]interface{} {
+	if s.journal == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+
+	s.journal.mu.Lock()
+	defer s.journal.mu.Unlock()
+
+	return map[string]interface{}{
+		"enabled":          true,
+		"path":             s.journal.path,
+		"appends":          s.journal.appends,
+		"pending_restores": len(s.journaledPorts),
+	}
+}
+
+// restoreJournaledPorts remembers ports assigned before a restart. Each
+// tenant gets its old port back when it reconnects, and the pool hands those
+// ports to other tenants only after every fresh port is used.
+func (s *RelayServer) restoreJournaledPorts(assigned map[string]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	held := make(map[int]bool, len(assigned))
+	for tenantID, port := range assigned {
+		if _, reserved := s.reservedPorts[tenantID]; reserved {
+			continue
+		}
+		held[port] = true
+	}
+
+	fresh := make([]int, 0, len(s.portPool))
+	var last []int
+	for _, port := range s.portPool {
+		if held[port] {
+			last = append(last, port)
+		} else {
+			fresh = append(fresh, port)
+		}
+	}
+	s.portPool = append(fresh, last...)
+	s.journaledPorts = assigned
+}
+
+// journalPortLocked records an assignment or release. Caller holds s.mu.
+func (s *RelayServer) journalPortLocked(op, tenantID string, port int) error {
+	if s.journal == nil {
+		return nil
+	}
+	return s.journal.Append(op, tenantID, port)
+}
+
+// takeJournaledPortLocked returns the tenant's port from before a restart if
+// it is still free. Caller holds s.mu.
+func (s *RelayServer) takeJournaledPortLocked(tenantID string) (int, bool) {
+	port, ok := s.journaledPorts[tenantID]
+	if !ok {
+		return 0, false
+	}
+	delete(s.journaledPorts, tenantID)
+	if s.portAllocation == portAllocationHash {
+		return port, !s.portsTakenLocked()[port]
+	}
+	return port, s.takePoolPortLocked(port)
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -20,6 +21,88 @@ type JWTClaims struct {
 	OrganizationID string `json:"organizationId"`
 	UserID         string `json:"userId"`
 	Role           string `json:"role"`
+	Scope          string `json:"scope,omitempty"` // e.g. statusTokenScope for read-only status tokens
+	Jti            string `json:"jti,omitempty"`   // Token ID, single use when replay protection is on
+
+	// Optional per-tenant limits; zero or empty means the relay default applies
+	MaxConnections   int      `json:"max_connections,omitempty"`
+	MaxBandwidthKbps int      `json:"max_bandwidth_kbps,omitempty"`
+	AllowedServices  []string `json:"allowed_services,omitempty"`
+	Tier             string   `json:"tier,omitempty"` // gold, silver or bronze
+
+	// Optional contractual transfer caps in bytes; zero means unlimited
+	MaxBytesPerConnection int64 `json:"max_bytes_per_connection,omitempty"`
+	MaxBytesPerDay        int64 `json:"max_bytes_per_day,omitempty"`
+
+	// verifiedWith names the issuer secret that verified the token
+	verifiedWith string
+}
+
+// JWTIssuerConfig describes a trusted token issuer and the secret it signs with.
+// PreviousSecrets still verify tokens during a secret rotation, until every
+// agent holds a token signed with Secret.
+type JWTIssuerConfig struct {
+	Issuer          string   `json:"issuer"`
+	Audiences       []string `json:"audiences"`
+	Secret          string   `json:"secret"`
+	PreviousSecrets []string `json:"previousSecrets,omitempty"`
+}
+
+var errInvalidSignature = errors.New("invalid signature")
+
+// secretLabel names an issuer secret in metrics: "current" or "previous[i]"
+func secretLabel(index int) string {
+	if index == 0 {
+		return "current"
+	}
+	return fmt.Sprintf("previous[%d]", index-1)
+}
+
+// VerifyJWTForIssuers verifies a JWT against a set of trusted issuers, selecting
+// the signing secret by the token's iss claim
+func VerifyJWTForIssuers(tokenString string, issuers []JWTIssuerConfig) (*JWTClaims, error) {
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid JWT format: expected 3 parts, got %d", len(parts))
+	}
+
+	// Peek at the unverified issuer to pick the secret; the claims are only
+	// trusted once VerifyJWT has checked the signature
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode payload: %w", err)
+	}
+
+	var unverified JWTClaims
+	if err := json.Unmarshal(payloadBytes, &unverified); err != nil {
+		return nil, fmt.Errorf("failed to parse claims: %w", err)
+	}
+
+	for _, issuer := range issuers {
+		if issuer.Issuer != unverified.Iss {
+			continue
+		}
+		for _, audience := range issuer.Audiences {
+			if audience != unverified.Aud {
+				continue
+			}
+			secrets := append([]string{issuer.Secret}, issuer.PreviousSecrets...)
+			for i, secret := range secrets {
+				claims, err := VerifyJWT(tokenString, secret, issuer.Issuer, audience)
+				if errors.Is(err, errInvalidSignature) {
+					continue
+				}
+				if claims != nil {
+					claims.verifiedWith = secretLabel(i)
+				}
+				return claims, err
+			}
+			return nil, errInvalidSignature
+		}
+		return nil, fmt.Errorf("invalid audience for issuer %s: %s", issuer.Issuer, unverified.Aud)
+	}
+
+	return nil, fmt.Errorf("untrusted issuer: %s", unverified.Iss)
 }
 
 // VerifyJWT verifies and decodes a JWT token
@@ -41,7 +124,7 @@ func VerifyJWT(tokenString, secret, expectedIssuer, expectedAudience string) (*J
 	}
 
 	if signature != expectedSig {
-		return nil, fmt.Errorf("invalid signature")
+		return nil, errInvalidSignature
 	}
 
 	// Decode payload
@@ -66,7 +149,7 @@ func VerifyJWT(tokenString, secret, expectedIssuer, expectedAudience string) (*J
 	}
 
 	// Check expiration
-	now := time.Now().Unix()
+	now := clock.BaseNow().Unix()
 	if claims.Exp > 0 && claims.Exp < now {
 		return nil, fmt.Errorf("token expired at %s", time.Unix(claims.Exp, 0).Format(time.RFC3339))
 	}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// jwtFreeFailures are answered at once, so an agent with one stale
+	// token is never slowed down
+	jwtFreeFailures = 3
+	jwtBaseDelay    = time.Second
+	jwtMaxDelay     = 30 * time.Second
+	// jwtFailureMemory forgets a source after this long without failures
+	jwtFailureMemory = 15 * time.Minute
+	// maxJWTFailureSources bounds the tracker against address-spraying
+	maxJWTFailureSources = 10000
+	// maxJWTDelayed bounds connections held open while delayed; beyond it
+	// further failures are dropped without an answer
+	maxJWTDelayed = 256
+)
+
+// jwtFailureSource is the invalid-token history of one source IP
+type jwtFailureSource struct {
+	failures int
+	last     time.Time
+}
+
+// JWTFailureTracker answers repeated invalid tokens from the same source
+// with growing delays, making token brute-forcing impractical
+type JWTFailureTracker struct {
+	sources map[string]*jwtFailureSource
+	delayed int
+	total   int64
+	slowed  int64
+	dropped int64
+	mu      sync.Mutex
+}
+
+// NewJWTFailureTracker creates an empty tracker
+func NewJWTFailureTracker() *JWTFailureTracker {
+	return &JWTFailureTracker{sources: make(map[string]*jwtFailureSource)}
+}
+
+func sourceIP(remoteAddr string) string {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return ip
+}
+
+// Failure records an invalid token from remoteAddr and returns how long to
+// wait before answering. drop is set when too many answers are already
+// being delayed; the caller should close without answering.
+func (t *JWTFailureTracker) Failure(remoteAddr string) (delay time.Duration, drop bool) {
+	ip := sourceIP(remoteAddr)
+	now := clock.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.total++
+	src, ok := t.sources[ip]
+	if !ok || now.Sub(src.last) > jwtFailureMemory {
+		if !ok && len(t.sources) >= maxJWTFailureSources {
+			t.pruneLocked(now)
+		}
+		src = &jwtFailureSource{}
+		t.sources[ip] = src
+	}
+	src.failures++
+	src.last = now
+
+	if src.failures <= jwtFreeFailures {
+		return 0, false
+	}
+	if t.delayed >= maxJWTDelayed {
+		t.dropped++
+		return 0, true
+	}
+
+	delay = jwtMaxDelay
+	if shift := src.failures - jwtFreeFailures - 1; shift < 5 {
+		delay = jwtBaseDelay << uint(shift)
+	}
+	t.slowed++
+	t.delayed++
+	return delay, false
+}
+
+// Done releases a delayed answer counted by Failure
+func (t *JWTFailureTracker) Done(delay time.Duration) {
+	if delay == 0 {
+		return
+	}
+	t.mu.Lock()
+	t.delayed--
+	t.mu.Unlock()
+}
+
+// Success forgets a source once it presents a valid token
+func (t *JWTFailureTracker) Success(remoteAddr string) {
+	ip := sourceIP(remoteAddr)
+	t.mu.Lock()
+	delete(t.sources, ip)
+	t.mu.Unlock()
+}
+
+// pruneLocked drops sources not seen within jwtFailureMemory
+func (t *JWTFailureTracker) pruneLocked(now time.Time) {
+	for ip, src := range t.sources {
+		if now.Sub(src.last) > jwtFailureMemory {
+			delete(t.sources, ip)
+		}
+	}
+}
+
+// Metrics reports invalid-token totals and the sources being slowed down
+func (t *JWTFailureTracker) Metrics() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := clock.Now()
+	t.pruneLocked(now)
+	repeat := 0
+	for _, src := range t.sources {
+		if src.failures > jwtFreeFailures {
+			repeat++
+		}
+	}
+	return map[string]interface{}{
+		"total":           t.total,
+		"delayed":         t.slowed,
+		"dropped":         t.dropped,
+		"delayedInFlight": t.delayed,
+		"sources":         len(t.sources),
+		"repeatSources":   repeat,
+	}
+}
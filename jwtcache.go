@@ -0,0 +1,120 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJWTCacheSize = 4096
+	// jwtCacheTTL bounds how long a verified token is trusted without
+	// re-checking; entries never outlive the token's exp claim
+	jwtCacheTTL = 10 * time.Minute
+	// jwtNegativeTTL is how long a failed verification is remembered
+	jwtNegativeTTL = time.Minute
+)
+
+// jwtCacheEntry is one cached verification outcome
+type jwtCacheEntry struct {
+	key     [sha256.Size]byte
+	claims  JWTClaims
+	err     error
+	expires time.Time
+}
+
+// JWTCache is an LRU cache of token verification outcomes keyed by the
+// token's SHA-256, so flapping agents don't re-run signature checks for the
+// same token. Tokens themselves are never stored.
+type JWTCache struct {
+	size    int
+	entries map[[sha256.Size]byte]*list.Element
+	order   *list.List // front is most recently used
+	hits    int64
+	misses  int64
+	evicted int64
+	mu      sync.Mutex
+}
+
+// NewJWTCache creates a cache holding up to size outcomes
+func NewJWTCache(size int) *JWTCache {
+	if size <= 0 {
+		size = defaultJWTCacheSize
+	}
+	return &JWTCache{
+		size:    size,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Verify returns the cached outcome for token or verifies it against issuers.
+// Callers get their own copy of the claims.
+func (c *JWTCache) Verify(token string, issuers []JWTIssuerConfig) (*JWTClaims, error) {
+	key := sha256.Sum256([]byte(token))
+	now := clock.BaseNow()
+
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*jwtCacheEntry)
+		if now.Before(entry.expires) {
+			c.hits++
+			c.order.MoveToFront(elem)
+			c.mu.Unlock()
+			if entry.err != nil {
+				return nil, entry.err
+			}
+			claims := entry.claims
+			return &claims, nil
+		}
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	claims, err := VerifyJWTForIssuers(token, issuers)
+
+	entry := &jwtCacheEntry{key: key, err: err, expires: now.Add(jwtNegativeTTL)}
+	if err == nil {
+		entry.claims = *claims
+		entry.expires = now.Add(jwtCacheTTL)
+		if claims.Exp > 0 {
+			if exp := time.Unix(claims.Exp, 0); exp.Before(entry.expires) {
+				entry.expires = exp
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = c.order.PushFront(entry)
+		for c.order.Len() > c.size {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*jwtCacheEntry).key)
+			c.evicted++
+		}
+	}
+	return claims, err
+}
+
+// Metrics reports cache effectiveness for /metrics
+func (c *JWTCache) Metrics() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	metrics := map[string]interface{}{
+		"size":     c.order.Len(),
+		"capacity": c.size,
+		"hits":     c.hits,
+		"misses":   c.misses,
+		"evicted":  c.evicted,
+	}
+	if lookups := c.hits + c.misses; lookups > 0 {
+		metrics["hitRate"] = float64(c.hits) / float64(lookups)
+	}
+	return metrics
+}
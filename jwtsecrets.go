@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// jwtSecretUse counts registrations verified by one issuer secret
+type jwtSecretUse struct {
+	count    int64
+	lastUsed time.Time
+}
+
+// JWTSecretStats tracks which issuer secrets verify registration tokens, so
+// operators can tell when a previous secret is no longer used and can be
+// removed after a rotation
+type JWTSecretStats struct {
+	uses map[string]map[string]*jwtSecretUse // issuer -> secret label -> use
+	mu   sync.Mutex
+}
+
+// NewJWTSecretStats creates stats listing every configured secret, so unused
+// ones show up with a zero count
+func NewJWTSecretStats(issuers []JWTIssuerConfig) *JWTSecretStats {
+	stats := &JWTSecretStats{uses: make(map[string]map[string]*jwtSecretUse)}
+	for _, issuer := range issuers {
+		labels := make(map[string]*jwtSecretUse)
+		for i := 0; i <= len(issuer.PreviousSecrets); i++ {
+			labels[secretLabel(i)] = &jwtSecretUse{}
+		}
+		stats.uses[issuer.Issuer] = labels
+	}
+	return stats
+}
+
+// Record counts a token verified with claims.verifiedWith
+func (s *JWTSecretStats) Record(claims *JWTClaims) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	use, ok := s.uses[claims.Iss][claims.verifiedWith]
+	if !ok {
+		return
+	}
+	use.count++
+	use.lastUsed = clock.Now()
+}
+
+// Metrics reports per-secret counts for /metrics
+func (s *JWTSecretStats) Metrics() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	issuers := make(map[string]interface{}, len(s.uses))
+	for issuer, labels := range s.uses {
+		secrets := make(map[string]interface{}, len(labels))
+		for label, use := range labels {
+			entry := map[string]interface{}{"verified": use.count}
+			if !use.lastUsed.IsZero() {
+				entry["lastUsed"] = use.lastUsed.Format(time.RFC3339)
+			}
+			secrets[label] = entry
+		}
+		issuers[issuer] = secrets
+	}
+	return issuers
+}
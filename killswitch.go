@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultKillBlockMinutes = 60
+	maxKillBlockMinutes     = 24 * 60
+)
+
+// killBlock refuses a killed tenant's new clients until it ends. It is kept
+// apart from access freezes so a kill and a freeze never replace each other.
+type killBlock struct {
+	until  time.Time
+	reason string
+	timer  *Timer
+}
+
+// setKillBlock blocks a tenant's new clients until until, replacing an
+// earlier kill block
+func (s *RelayServer) setKillBlock(tenantID string, until time.Time, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if previous, ok := s.kills[tenantID]; ok {
+		previous.timer.Stop()
+	}
+	block := &killBlock{until: until, reason: reason}
+	block.timer = clock.AfterFunc(until.Sub(clock.Now()), func() { s.endKillBlock(tenantID, block) })
+	s.kills[tenantID] = block
+}
+
+// endKillBlock runs when a kill block is over
+func (s *RelayServer) endKillBlock(tenantID string, block *killBlock) {
+	s.mu.Lock()
+	current := s.kills[tenantID] == block
+	if current {
+		delete(s.kills, tenantID)
+	}
+	s.mu.Unlock()
+
+	if current {
+		log.Printf("🛑 Kill switch block of tenant %s ended", tenantID)
+		s.events.Emit("tenant_kill_ended", tenantID, "external access restored after the kill switch block")
+		s.settleTenantState(tenantID, "kill switch block ended")
+	}
+}
+
+// liftKillBlock removes a tenant's kill block, reporting whether one was set
+func (s *RelayServer) liftKillBlock(tenantID string) bool {
+	s.mu.Lock()
+	block, ok := s.kills[tenantID]
+	if ok {
+		block.timer.Stop()
+		delete(s.kills, tenantID)
+	}
+	s.mu.Unlock()
+
+	if ok {
+		log.Printf("🛑 Kill switch block of tenant %s lifted", tenantID)
+		s.events.Emit("tenant_kill_lifted", tenantID, "kill switch block lifted early")
+		s.settleTenantState(tenantID, "kill switch block lifted")
+	}
+	return ok
+}
+
+// killedUntil returns when the tenant's kill block ends, if one is in effect
+func (s *RelayServer) killedUntil(tenantID string) (time.Time, bool) {
+	s.mu.RLock()
+	block, ok := s.kills[tenantID]
+	s.mu.RUnlock()
+	if !ok || !clock.Now().Before(block.until) {
+		return time.Time{}, false
+	}
+	return block.until, true
+}
+
+// registerHISRoutes mounts the narrowly scoped API HIS may call, signed with
+// the relay shared secret (see verifyHISWebhook). Unlike the admin API it can
+// only read tenant load or cut a single tenant off.
+func (s *RelayServer) registerHISRoutes(mux *http.ServeMux) {
+	if len(s.hisSecrets) == 0 {
+		return
+	}
+	mux.HandleFunc("/his/load", s.handleHISLoad)
+	mux.HandleFunc("/his/tenants/", s.handleHISTenant)
+}
+
+// handleHISTenant routes /his/tenants/{id}/{action}
+func (s *RelayServer) handleHISTenant(w http.ResponseWriter, r *http.Request) {
+	tenantID, action, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/his/tenants/"), "/")
+	if !ok || tenantID == "" {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	switch action {
+	case "kill":
+		s.handleHISKill(w, r, tenantID)
+	case "load":
+		s.handleHISTenantLoad(w, r, tenantID)
+	case "block":
+		s.handleHISBlock(w, r, tenantID)
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// verifyHISCall authenticates a call to the HIS API and returns its body,
+// answering the caller itself when the call is rejected
+func (s *RelayServer) verifyHISCall(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := s.verifyHISWebhook(r)
+	if err != nil {
+		s.countWebhookRejection(err)
+		log.Printf("⚠️  HIS call %s %s from %s rejected: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+		if isWebhookAuthError(err) {
+			s.siem.Record(siemHISAuthFailed, "", r.RemoteAddr, fmt.Sprintf("%s %s: %v", r.Method, r.URL.Path, err))
+			writeJSONError(w, http.StatusUnauthorized, err.Error())
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "could not verify request")
+		}
+		return nil, false
+	}
+	return body, true
+}
+
+// handleHISKill serves POST /his/tenants/{id}/kill {"blockMinutes": n,
+// "reason": "..."}: the break-glass action that severs every client
+// connection of the tenant at once and refuses new ones for n minutes
+// (default 60, at most a day). The block leaves access freezes as they are.
+func (s *RelayServer) handleHISKill(w http.ResponseWriter, r *http.Request, tenantID string) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	body, ok := s.verifyHISCall(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		BlockMinutes int    `json:"blockMinutes"`
+		Reason       string `json:"reason"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.BlockMinutes == 0 {
+		req.BlockMinutes = defaultKillBlockMinutes
+	}
+	if req.BlockMinutes < 0 || req.BlockMinutes > maxKillBlockMinutes {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("blockMinutes must be between 1 and %d", maxKillBlockMinutes))
+		return
+	}
+
+	// Block first so no connection slips in between closing and blocking
+	until := clock.Now().Add(time.Duration(req.BlockMinutes) * time.Minute)
+	s.setKillBlock(tenantID, until, req.Reason)
+	closed := s.conns.CloseTenant(tenantID)
+	s.settleTenantState(tenantID, "kill switch")
+
+	msg := fmt.Sprintf("kill switch by HIS from %s: %d connections severed, blocked until %s: %s",
+		r.RemoteAddr, closed, until.UTC().Format(time.RFC3339), req.Reason)
+	log.Printf("🛑 Tenant %s %s", tenantID, msg)
+	s.events.Emit("tenant_killed", tenantID, msg)
+	s.audit.Record(AuditRecord{
+		Time:       clock.BaseNow(),
+		Principal:  "his",
+		AuthMethod: "signature",
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		TenantID:   tenantID,
+		Status:     http.StatusOK,
+		RemoteAddr: r.RemoteAddr,
+	})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tenantId":          tenantID,
+		"closedConnections": closed,
+		"blockedUntil":      until.UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	maxLabelKeyLength   = 63
+	maxLabelValueLength = 256
+	maxLabelsPerTenant  = 32
+)
+
+// validateLabels checks label keys are short lowercase identifiers and values
+// are bounded, so labels stay safe to use as metric and log fields
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxLabelsPerTenant {
+		return fmt.Errorf("at most %d labels allowed, got %d", maxLabelsPerTenant, len(labels))
+	}
+	for key, value := range labels {
+		if key == "" || len(key) > maxLabelKeyLength {
+			return fmt.Errorf("label key %q must be 1-%d characters", key, maxLabelKeyLength)
+		}
+		for _, c := range key {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+				return fmt.Errorf("label key %q may only contain a-z, 0-9, '_', '-' and '.'", key)
+			}
+		}
+		if len(value) > maxLabelValueLength {
+			return fmt.Errorf("label %q value longer than %d characters", key, maxLabelValueLength)
+		}
+		if key == tierLabel && !validTier(value) {
+			return fmt.Errorf("label %q must be %s, %s or %s", key, tierGold, tierSilver, tierBronze)
+		}
+	}
+	return nil
+}
+
+// parseLabelSelector parses key=value pairs, e.g. from repeated ?label= query
+// parameters
+func parseLabelSelector(pairs []string) (map[string]string, error) {
+	selector := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("label selector %q must be key=value", pair)
+		}
+		selector[key] = value
+	}
+	return selector, nil
+}
+
+// matchesLabels reports whether labels contain every key=value in selector
+func matchesLabels(labels, selector map[string]string) bool {
+	for key, value := range selector {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// formatLabels renders labels as sorted key=value pairs for log lines
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// tenantLabels returns a copy of the tenant's labels. Labels are kept per
+// tenant ID so they survive re-registration.
+func (s *RelayServer) tenantLabels(tenantID string) map[string]string {
+	s.labelsMu.RLock()
+	defer s.labelsMu.RUnlock()
+
+	labels := make(map[string]string, len(s.labels[tenantID]))
+	for key, value := range s.labels[tenantID] {
+		labels[key] = value
+	}
+	return labels
+}
+
+// setTenantLabels replaces the tenant's labels, or merges them into the
+// existing ones when merge is set
+func (s *RelayServer) setTenantLabels(tenantID string, labels map[string]string, merge bool) error {
+	s.labelsMu.Lock()
+	defer s.labelsMu.Unlock()
+
+	updated := make(map[string]string, len(labels))
+	if merge {
+		for key, value := range s.labels[tenantID] {
+			updated[key] = value
+		}
+	}
+	for key, value := range labels {
+		updated[key] = value
+	}
+	if err := validateLabels(updated); err != nil {
+		return err
+	}
+
+	if len(updated) == 0 {
+		delete(s.labels, tenantID)
+	} else {
+		s.labels[tenantID] = updated
+	}
+	return nil
+}
+
+// labelCounts counts registered tenants per key=value label for metrics;
+// callers hold s.mu
+func (s *RelayServer) labelCounts() map[string]int {
+	counts := make(map[string]int)
+	for id := range s.tenants {
+		for key, value := range s.tenantLabels(id) {
+			counts[key+"="+value]++
+		}
+	}
+	return counts
+}
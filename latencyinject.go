@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxInjectedDelay bounds the artificial delay plus jitter per write
+const maxInjectedDelay = time.Minute
+
+// LatencyInjectionConfig turns on the admin API that slows tenants down on
+// purpose, so QA can see how HIS copes with a slow clinic. Unset, it follows
+// the build: on in UAT builds (-tags uat), off otherwise.
+type LatencyInjectionConfig struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// enabled reports whether the relay accepts latency profiles
+func (c LatencyInjectionConfig) enabled() bool {
+	if c.Enabled != nil {
+		return *c.Enabled
+	}
+	return latencyInjectionBuildDefault
+}
+
+// LatencyProfile is the slowness injected into a tenant's forwarded traffic,
+// in both directions: a delay of DelayMs ± JitterMs before each write and a
+// bandwidth cap on top of the tenant's real one
+type LatencyProfile struct {
+	DelayMs       int       `json:"delayMs"`
+	JitterMs      int       `json:"jitterMs"`
+	BandwidthKbps int       `json:"bandwidthKbps"`
+	SetBy         string    `json:"setBy,omitempty"`
+	SetAt         time.Time `json:"setAt"`
+}
+
+// validate checks the profile stays within bounds
+func (p LatencyProfile) validate() error {
+	if p.DelayMs < 0 || p.JitterMs < 0 || p.BandwidthKbps < 0 {
+		return errors.New("delayMs, jitterMs and bandwidthKbps must not be negative")
+	}
+	if p.DelayMs == 0 && p.JitterMs == 0 && p.BandwidthKbps == 0 {
+		return errors.New("set delayMs, jitterMs or bandwidthKbps, or DELETE to clear")
+	}
+	if time.Duration(p.DelayMs+p.JitterMs)*time.Millisecond > maxInjectedDelay {
+		return fmt.Errorf("delayMs plus jitterMs must not exceed %v", maxInjectedDelay)
+	}
+	return nil
+}
+
+// injectedLatency is a tenant's profile with the limiter its connections share
+type injectedLatency struct {
+	profile LatencyProfile
+	up      *BandwidthLimiter
+	down    *BandwidthLimiter
+}
+
+// delay picks the wait before one write
+func (l *injectedLatency) delay() time.Duration {
+	ms := l.profile.DelayMs
+	if jitter := l.profile.JitterMs; jitter > 0 {
+		ms += rand.Intn(2*jitter+1) - jitter
+	}
+	if ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// LatencyInjector holds latency profiles by tenant ID, so they may be set
+// before an agent registers and survive re-registration. Profiles last until
+// cleared or the relay restarts.
+type LatencyInjector struct {
+	tenants map[string]*injectedLatency
+	mu      sync.Mutex
+}
+
+// NewLatencyInjector creates an injector without profiles
+func NewLatencyInjector() *LatencyInjector {
+	return &LatencyInjector{tenants: make(map[string]*injectedLatency)}
+}
+
+// Set replaces the tenant's profile; open connections follow it
+func (l *LatencyInjector) Set(tenantID string, profile LatencyProfile) error {
+	if err := profile.validate(); err != nil {
+		return err
+	}
+	injected := &injectedLatency{profile: profile}
+	if profile.BandwidthKbps > 0 {
+		injected.up = NewBandwidthLimiter(profile.BandwidthKbps)
+		injected.down = NewBandwidthLimiter(profile.BandwidthKbps)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tenants[tenantID] = injected
+	return nil
+}
+
+// Clear removes the tenant's profile, reporting whether it had one
+func (l *LatencyInjector) Clear(tenantID string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.tenants[tenantID]
+	delete(l.tenants, tenantID)
+	return ok
+}
+
+func (l *LatencyInjector) get(tenantID string) *injectedLatency {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.tenants[tenantID]
+}
+
+// Profile returns the tenant's profile, if it has one
+func (l *LatencyInjector) Profile(tenantID string) (LatencyProfile, bool) {
+	injected := l.get(tenantID)
+	if injected == nil {
+		return LatencyProfile{}, false
+	}
+	return injected.profile, true
+}
+
+// Metrics lists the profiles in force
+func (l *LatencyInjector) Metrics() map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	profiles := make(map[string]LatencyProfile, len(l.tenants))
+	for tenantID, injected := range l.tenants {
+		profiles[tenantID] = injected.profile
+	}
+	return map[string]interface{}{
+		"enabled": true,
+		"tenants": profiles,
+	}
+}
+
+// writer slows writes of one direction of a tenant's connection while the
+// tenant has a profile
+func (l *LatencyInjector) writer(w io.Writer, tenantID string, upstream bool) io.Writer {
+	return &latencyWriter{w: w, injector: l, tenantID: tenantID, upstream: upstream}
+}
+
+// latencyWriter looks the profile up on every write, so changes and clears
+// apply to open connections
+type latencyWriter struct {
+	w        io.Writer
+	injector *LatencyInjector
+	tenantID string
+	upstream bool
+}
+
+func (l *latencyWriter) Write(p []byte) (int, error) {
+	injected := l.injector.get(l.tenantID)
+	if injected == nil {
+		return l.w.Write(p)
+	}
+	if delay := injected.delay(); delay > 0 {
+		clock.Sleep(delay)
+	}
+	limiter := injected.down
+	if l.upstream {
+		limiter = injected.up
+	}
+	return limitWriter(l.w, limiter).Write(p)
+}
+
+// handleAdminTenantLatency shows (GET), sets (PUT {"delayMs": n, "jitterMs":
+// n, "bandwidthKbps": n}) or clears (DELETE) a tenant's injected latency
+func (s *RelayServer) handleAdminTenantLatency(w http.ResponseWriter, r *http.Request, tenantID string) {
+	if s.latency == nil {
+		writeJSONError(w, http.StatusNotFound, "latency injection is disabled on this relay")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPut:
+		var profile LatencyProfile
+		if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		profile.SetBy, profile.SetAt = adminActor(r), clock.Now().UTC()
+		if err := s.latency.Set(tenantID, profile); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		msg := fmt.Sprintf("latency injected: %dms ± %dms, %d kbps (by %s)", profile.DelayMs, profile.JitterMs, profile.BandwidthKbps, profile.SetBy)
+		log.Printf("⚠️  Tenant %s %s", tenantID, msg)
+		s.events.Emit("latency_injected", tenantID, msg)
+
+	case http.MethodDelete:
+		if !s.latency.Clear(tenantID) {
+			writeJSONError(w, http.StatusNotFound, "no latency injected for tenant")
+			return
+		}
+		msg := fmt.Sprintf("latency injection cleared (by %s)", adminActor(r))
+		log.Printf("✅ Tenant %s %s", tenantID, msg)
+		s.events.Emit("latency_injection_cleared", tenantID, msg)
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	response := map[string]interface{}{
+		"tenantId": tenantID,
+		"injected": false,
+	}
+	if profile, ok := s.latency.Profile(tenantID); ok {
+		response["injected"] = true
+		response["profile"] = profile
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,7 @@
+//go:build !uat
+
+package main
+
+// latencyInjectionBuildDefault keeps latency injection off in production
+// builds unless latencyInjection.enabled is set
+const latencyInjectionBuildDefault = false
@@ -0,0 +1,6 @@
+//go:build uat
+
+package main
+
+// latencyInjectionBuildDefault turns latency injection on in UAT builds
+const latencyInjectionBuildDefault = true
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	acceptInitialBackoff = 5 * time.Millisecond
+	acceptMaxBackoff     = 1 * time.Second
+
+	// fdWarnRatio is the share of the fd limit at which the monitor warns
+	fdWarnRatio = 0.8
+
+	// defaultFastOpenQueue bounds connections accepted with data in the SYN
+	// that have not finished the handshake yet
+	defaultFastOpenQueue = 256
+)
+
+// ListenerTuning holds the socket options of one class of listener
+type ListenerTuning struct {
+	// Backlog is the accept queue length; 0 keeps the system default
+	Backlog int `json:"backlog"`
+	// FastOpen lets returning clients send their first bytes in the SYN,
+	// saving a round trip; needs net.ipv4.tcp_fastopen with bit 2 set
+	FastOpen      bool `json:"fastOpen"`
+	FastOpenQueue int  `json:"fastOpenQueue"` // default 256
+	// DeferAcceptSeconds holds a connection in the kernel until the client
+	// sends data, for up to this long, so Accept never sees idle sockets
+	DeferAcceptSeconds int `json:"deferAcceptSeconds"`
+}
+
+// tuned reports whether any option needs setting before the socket listens
+func (t ListenerTuning) tuned() bool {
+	return t.FastOpen || t.DeferAcceptSeconds > 0
+}
+
+// ListenersConfig tunes each class of listener. Everything is off by default;
+// server.controlBacklog and server.tenantBacklog remain the default backlogs.
+type ListenersConfig struct {
+	Control ListenerTuning `json:"control"` // TLS and local control ports
+	Tenant  ListenerTuning `json:"tenant"`  // tenant ports
+	SNI     ListenerTuning `json:"sni"`     // the shared SNI port
+	Tunnel  ListenerTuning `json:"tunnel"`  // the relay tunnel port
+}
+
+// classes lists each listener class by name
+func (c *ListenersConfig) classes() []struct {
+	name   string
+	tuning *ListenerTuning
+} {
+	return []struct {
+		name   string
+		tuning *ListenerTuning
+	}{
+		{"control", &c.Control},
+		{"tenant", &c.Tenant},
+		{"sni", &c.SNI},
+		{"tunnel", &c.Tunnel},
+	}
+}
+
+// validateListeners checks that no option is negative
+func validateListeners(cfg ListenersConfig) error {
+	for _, class := range cfg.classes() {
+		t := class.tuning
+		if t.Backlog < 0 || t.FastOpenQueue < 0 || t.DeferAcceptSeconds < 0 {
+			return fmt.Errorf("%s: backlog, fastOpenQueue and deferAcceptSeconds must not be negative", class.name)
+		}
+	}
+	return nil
+}
+
+// listenerCapabilities records which listener options the host supports, and
+// why not when it doesn't
+type listenerCapabilities struct {
+	FastOpen          bool   `json:"fastOpen"`
+	FastOpenReason    string `json:"fastOpenReason,omitempty"`
+	DeferAccept       bool   `json:"deferAccept"`
+	DeferAcceptReason string `json:"deferAcceptReason,omitempty"`
+}
+
+// resolveListeners fills in the default backlogs and queue size and turns
+// off options the host can't honour, logging each so a config copied from
+// another host degrades instead of failing the boot
+func resolveListeners(cfg ListenersConfig, srv ServerConfig, caps listenerCapabilities) ListenersConfig {
+	defaultBacklogs := map[string]int{
+		"control": srv.ControlBacklog,
+		"tenant":  srv.TenantBacklog,
+		"sni":     srv.TenantBacklog,
+		"tunnel":  srv.TenantBacklog,
+	}
+	for _, class := range cfg.classes() {
+		t := class.tuning
+		if t.Backlog == 0 {
+			t.Backlog = defaultBacklogs[class.name]
+		}
+		if t.FastOpen && !caps.FastOpen {
+			log.Printf("⚠️  TCP Fast Open disabled for %s listeners: %s", class.name, caps.FastOpenReason)
+			t.FastOpen = false
+		}
+		if t.FastOpen && t.FastOpenQueue == 0 {
+			t.FastOpenQueue = defaultFastOpenQueue
+		}
+		if t.DeferAcceptSeconds > 0 && !caps.DeferAccept {
+			log.Printf("⚠️  Defer-accept disabled for %s listeners: %s", class.name, caps.DeferAcceptReason)
+			t.DeferAcceptSeconds = 0
+		}
+		if t.FastOpen || t.DeferAcceptSeconds > 0 {
+			log.Printf("🔧 %s listeners: fast open %v (queue %d), defer accept %ds, backlog %d",
+				class.name, t.FastOpen, t.FastOpenQueue, t.DeferAcceptSeconds, t.Backlog)
+		}
+	}
+	return cfg
+}
+
+// listenTCP opens a TCP listener with the tuning of its class. Options the
+// kernel refuses are logged and skipped rather than failing the listener.
+func listenTCP(addr string, tuning ListenerTuning) (net.Listener, error) {
+	var lc net.ListenConfig
+	var optErr error
+	if tuning.tuned() {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				optErr = setListenerOptions(fd, tuning)
+			})
+		}
+	}
+	listener, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if optErr != nil {
+		log.Printf("⚠️  Could not tune listener %s: %v", addr, optErr)
+	}
+
+	if tuning.Backlog > 0 {
+		if err := setListenBacklog(listener, tuning.Backlog); err != nil {
+			log.Printf("⚠️  Could not set accept backlog %d on %s: %v", tuning.Backlog, addr, err)
+		}
+	}
+	return listener, nil
+}
+
+// isTemporaryAcceptError reports whether an Accept error is worth retrying,
+// e.g. running out of file descriptors or a client aborting mid-handshake
+func isTemporaryAcceptError(err error) bool {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.ENOBUFS) ||
+		errors.Is(err, syscall.ENOMEM) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// acceptBackoff doubles the delay after each temporary accept failure
+func acceptBackoff(current time.Duration) time.Duration {
+	if current == 0 {
+		return acceptInitialBackoff
+	}
+	current *= 2
+	if current > acceptMaxBackoff {
+		current = acceptMaxBackoff
+	}
+	return current
+}
+
+// fdBaseline covers descriptors not tied to tenants: control and health
+// listeners, HIS connections, spool files, logs
+const fdBaseline = 64
+
+// requiredFileDescriptors estimates the descriptors needed with every port in
+// the pool assigned and every tenant at its connection limit: per tenant one
+// control connection and one listener, plus one socket per client connection
+// (agent streams are multiplexed over the control connection)
+func requiredFileDescriptors(tenantPorts, maxConnsPerTenant int) uint64 {
+	return uint64(tenantPorts)*uint64(2+maxConnsPerTenant) + fdBaseline
+}
+
+// fdMetrics returns file descriptor usage for the metrics endpoint
+func fdMetrics(required uint64) map[string]interface{} {
+	open, limit, err := fdUsage()
+	if err != nil {
+		return map[string]interface{}{"error": err.Error(), "required": required}
+	}
+	return map[string]interface{}{
+		"open":     open,
+		"limit":    limit,
+		"required": required,
+	}
+}
+
+// monitorFileDescriptors warns when fd usage approaches the process limit
+func monitorFileDescriptors(interval time.Duration) {
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+
+		open, limit, err := fdUsage()
+		if err != nil || limit == 0 {
+			return
+		}
+		if float64(open) >= float64(limit)*fdWarnRatio {
+			log.Printf("⚠️  File descriptor usage high: %d of %d (%.0f%%)",
+				open, limit, float64(open)/float64(limit)*100)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	loadSampleInterval = 5 * time.Second
+	// maxRegistrationRetry caps the retry hint given to agents queued behind
+	// a registration storm
+	maxRegistrationRetry = 10 * time.Minute
+)
+
+// AdmissionConfig sets the load thresholds above which new registrations are
+// refused; zero disables a threshold
+type AdmissionConfig struct {
+	MaxCPUPercent     float64 `json:"maxCpuPercent"`
+	MaxBandwidthMbps  float64 `json:"maxBandwidthMbps"`
+	MaxConnections    int     `json:"maxConnections"`
+	MaxTenants        int     `json:"maxTenants"`
+	AlternateEndpoint string  `json:"alternateEndpoint"`
+	RetryAfterSeconds int     `json:"retryAfterSeconds"`
+	// RegistrationsPerSecond paces registrations of every tenant, new or not,
+	// before their tokens are verified; zero disables the bucket
+	RegistrationsPerSecond float64 `json:"registrationsPerSecond"`
+	RegistrationBurst      int     `json:"registrationBurst"` // default 10s of the rate
+}
+
+// RegistrationBucket is a token bucket admitting registrations, so the agents
+// reconnecting after a restart don't all hit JWT verification and HIS at once.
+// Agents refused are each given a later slot, spread out at the bucket's rate
+// and jittered, so they don't return together.
+type RegistrationBucket struct {
+	rate     float64 // per second
+	burst    float64
+	tokens   float64
+	last     time.Time
+	nextSlot time.Time // when the last agent turned away was told to return
+	mu       sync.Mutex
+}
+
+// NewRegistrationBucket creates a full bucket; burst 0 holds ten seconds of
+// the rate
+func NewRegistrationBucket(perSecond float64, burst int) *RegistrationBucket {
+	b := float64(burst)
+	if b == 0 {
+		b = perSecond * 10
+	}
+	if b < 1 {
+		b = 1
+	}
+	return &RegistrationBucket{rate: perSecond, burst: b, tokens: b, last: clock.Now()}
+}
+
+// Allow takes a token, or returns how long the agent should wait before
+// retrying
+func (b *RegistrationBucket) Allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := clock.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	if b.nextSlot.Before(now) {
+		b.nextSlot = now
+	}
+	b.nextSlot = b.nextSlot.Add(time.Duration(float64(time.Second) / b.rate))
+	wait := b.nextSlot.Sub(now)
+	wait += time.Duration(rand.Int63n(int64(wait)/2 + 1))
+	if wait < time.Second {
+		wait = time.Second
+	}
+	if wait > maxRegistrationRetry {
+		wait = maxRegistrationRetry
+	}
+	return false, wait
+}
+
+// Metrics reports the bucket's settings, fill and how far ahead agents have
+// been told to return
+func (b *RegistrationBucket) Metrics() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tokens := b.tokens + clock.Since(b.last).Seconds()*b.rate
+	if tokens > b.burst {
+		tokens = b.burst
+	}
+	backlog := clock.Until(b.nextSlot)
+	if backlog < 0 {
+		backlog = 0
+	}
+	return map[string]interface{}{
+		"rate_per_second": b.rate,
+		"burst":           b.burst,
+		"tokens":          tokens,
+		"backlog_seconds": int(backlog.Seconds()),
+	}
+}
+
+// LoadMonitor samples process CPU usage and forwarded throughput
+type LoadMonitor struct {
+	counters *relayCounters
+
+	cpuPercent    float64
+	bandwidthMbps float64
+
+	lastSample time.Time
+	lastCPU    time.Duration
+	lastBytes  int64
+	mu         sync.RWMutex
+}
+
+// NewLoadMonitor creates a monitor reading byte totals from counters
+func NewLoadMonitor(counters *relayCounters) *LoadMonitor {
+	return &LoadMonitor{counters: counters}
+}
+
+// Run samples load until the process exits
+func (m *LoadMonitor) Run() {
+	m.sample()
+
+	ticker := clock.NewTicker(loadSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		m.sample()
+	}
+}
+
+func (m *LoadMonitor) sample() {
+	now := clock.Now()
+	cpu, cpuErr := processCPUTime()
+	bytes := atomic.LoadInt64(&m.counters.bytesClientToAgent) + atomic.LoadInt64(&m.counters.bytesAgentToClient)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.lastSample.IsZero() {
+		elapsed := now.Sub(m.lastSample).Seconds()
+		if cpuErr == nil {
+			// Percentage of total machine capacity, so 100 means every core is busy
+			m.cpuPercent = (cpu - m.lastCPU).Seconds() / elapsed / float64(runtime.NumCPU()) * 100
+		}
+		m.bandwidthMbps = float64(bytes-m.lastBytes) * 8 / elapsed / 1e6
+	}
+
+	m.lastSample = now
+	m.lastCPU = cpu
+	m.lastBytes = bytes
+}
+
+// Current returns the latest CPU percentage and throughput in Mbit/s
+func (m *LoadMonitor) Current() (cpuPercent, bandwidthMbps float64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cpuPercent, m.bandwidthMbps
+}
+
+// loadMetrics reports the latest load sample
+func (s *RelayServer) loadMetrics() map[string]interface{} {
+	cpu, bandwidth := s.load.Current()
+	metrics := map[string]interface{}{
+		"cpu_percent":    cpu,
+		"bandwidth_mbps": bandwidth,
+	}
+	if s.registrationBucket != nil {
+		metrics["registration_bucket"] = s.registrationBucket.Metrics()
+	}
+	return metrics
+}
+
+// admissionBlocked returns why the relay is too busy for a new tenant, or ""
+func (s *RelayServer) admissionBlocked() string {
+	cfg := s.admission
+	cpu, bandwidth := s.load.Current()
+
+	if cfg.MaxCPUPercent > 0 && cpu >= cfg.MaxCPUPercent {
+		return fmt.Sprintf("CPU at %.0f%%", cpu)
+	}
+	if cfg.MaxBandwidthMbps > 0 && bandwidth >= cfg.MaxBandwidthMbps {
+		return fmt.Sprintf("bandwidth at %.1f Mbps", bandwidth)
+	}
+
+	s.mu.RLock()
+	tenants := len(s.tenants)
+	connections := s.getTotalConnections()
+	s.mu.RUnlock()
+
+	if cfg.MaxTenants > 0 && tenants >= cfg.MaxTenants {
+		return fmt.Sprintf("%d tenants registered", tenants)
+	}
+	if cfg.MaxConnections > 0 && connections >= cfg.MaxConnections {
+		return fmt.Sprintf("%d active connections", connections)
+	}
+	return ""
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// LocalControlConfig adds control listeners without TLS for co-located test
+// agents and integration tests. Registration still requires a valid JWT.
+type LocalControlConfig struct {
+	UnixSocket    string `json:"unixSocket"`    // path of a Unix domain socket, mode 0600
+	PlaintextPort int    `json:"plaintextPort"` // plaintext TCP port bound to 127.0.0.1 only
+}
+
+// validateLocalControl checks the local listeners don't collide with the
+// relay's other ports
+func validateLocalControl(cfg LocalControlConfig, srv ServerConfig) error {
+	port := cfg.PlaintextPort
+	switch {
+	case port == 0:
+	case port < 0 || port > 65535:
+		return fmt.Errorf("plaintextPort %d is not a valid port", port)
+	case port == srv.ControlPort || port == srv.HealthCheckPort:
+		return fmt.Errorf("plaintextPort %d is already used by the relay", port)
+	case port >= srv.TenantPortStart && port <= srv.TenantPortEnd:
+		return fmt.Errorf("plaintextPort %d is inside the tenant port range", port)
+	}
+	if cfg.UnixSocket != "" && !filepath.IsAbs(cfg.UnixSocket) {
+		return fmt.Errorf("unixSocket must be an absolute path")
+	}
+	return nil
+}
+
+// startLocalControlListeners opens the configured local control listeners
+// and serves them with the same registration pipeline as the TLS port
+func (s *RelayServer) startLocalControlListeners() error {
+	if path := s.localControl.UnixSocket; path != "" {
+		// A socket left behind by a crash would make the bind fail
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stale control socket %s: %w", path, err)
+		}
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return fmt.Errorf("failed to start control socket %s: %w", path, err)
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to restrict control socket %s: %w", path, err)
+		}
+		log.Printf("   Control socket: %s (local, no TLS)", path)
+		go s.serveLocalControl(listener)
+	}
+
+	if port := s.localControl.PlaintextPort; port > 0 {
+		listener, err := listenTCP(fmt.Sprintf("127.0.0.1:%d", port), s.listeners.Control)
+		if err != nil {
+			return fmt.Errorf("failed to start local control listener: %w", err)
+		}
+		log.Printf("   Control port: 127.0.0.1:%d (local, no TLS)", port)
+		go s.serveLocalControl(listener)
+	}
+	return nil
+}
+
+func (s *RelayServer) serveLocalControl(listener net.Listener) {
+	if err := s.Serve(listener); err != nil {
+		log.Printf("⚠️  Local control listener %s stopped: %v", listener.Addr(), err)
+	}
+}
@@ -1,20 +1,146 @@
+//go:build ignore
+
+// The simple relay is a program of its own, built from this file and
+// forwarder.go: go build -o tatbeeb-link-relay main-simple.go forwarder.go
+
 package main
 
 import (
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/yamux"
 )
 
+const (
+	defaultHandshakeTimeout = 10 * time.Second
+	defaultMaxLineLength    = 1024
+)
+
+// errLineTooLong rejects a handshake line longer than the configured maximum
+var errLineTooLong = errors.New("line too long")
+
+// HandshakeConfig bounds how long and how much a connecting client may send
+// before it is registered
+type HandshakeConfig struct {
+	Timeout       time.Duration // for the whole handshake, not per read
+	MaxLineLength int
+	Banner        string // sent on connect when set, e.g. "TATBEEB-LINK 1"
+}
+
+// handshakeCounters count how control connections ended their handshake
+type handshakeCounters struct {
+	accepted     int64
+	timedOut     int64
+	tooLong      int64
+	unknown      int64
+	unauthorized int64
+	failed       int64 // closed or errored before a full line
+}
+
+// forwardingCounters count what the relay forwarded and refused
+type forwardingCounters struct {
+	bytesClientToAgent int64
+	bytesAgentToClient int64
+	refused            int64 // over the per-tenant connection limit
+	idleCloses         int64
+}
+
+// tenantNamePattern limits tenant names to what is safe in logs and URLs
+var tenantNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+// SimpleToken lets an agent register with "REGISTER <token>". With Tenant set
+// the agent is registered under that name; otherwise the agent may name
+// itself with "REGISTER <token> <name>".
+type SimpleToken struct {
+	Token  string `json:"token"`
+	Tenant string `json:"tenant"`
+}
+
+// SimpleAuthConfig is the provisioning file of the simple relay. Without one
+// anyone may register, which is only fit for a lab.
+type SimpleAuthConfig struct {
+	Tokens          []SimpleToken `json:"tokens"`
+	AllowedNetworks []string      `json:"allowedNetworks"` // CIDRs agents may register from; empty allows all
+
+	networks []*net.IPNet
+}
+
+// LoadSimpleAuth reads and validates a provisioning file
+func LoadSimpleAuth(path string) (*SimpleAuthConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read auth file: %w", err)
+	}
+	var auth SimpleAuthConfig
+	if err := json.Unmarshal(data, &auth); err != nil {
+		return nil, fmt.Errorf("failed to parse auth file: %w", err)
+	}
+	if len(auth.Tokens) == 0 {
+		return nil, fmt.Errorf("auth file %s has no tokens", path)
+	}
+	for i, token := range auth.Tokens {
+		if len(token.Token) < 16 || strings.ContainsAny(token.Token, " \t") {
+			return nil, fmt.Errorf("tokens[%d]: token must be at least 16 characters without spaces", i)
+		}
+		if token.Tenant != "" && !tenantNamePattern.MatchString(token.Tenant) {
+			return nil, fmt.Errorf("tokens[%d]: invalid tenant name %q", i, token.Tenant)
+		}
+	}
+	for _, cidr := range auth.AllowedNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("allowedNetworks: %w", err)
+		}
+		auth.networks = append(auth.networks, network)
+	}
+	return &auth, nil
+}
+
+// allowed reports whether an agent may register from addr
+func (a *SimpleAuthConfig) allowed(addr net.Addr) bool {
+	if len(a.networks) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range a.networks {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the entry for a presented token, comparing every entry in
+// constant time
+func (a *SimpleAuthConfig) lookup(presented string) (SimpleToken, bool) {
+	var match SimpleToken
+	found := false
+	for _, token := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token.Token)) == 1 {
+			match, found = token, true
+		}
+	}
+	return match, found
+}
+
 type SimpleTenant struct {
 	ID           string
 	AssignedPort int
@@ -28,18 +154,34 @@ type SimpleRelay struct {
 	tenants       map[string]*SimpleTenant
 	portPool      []int
 	nextPortIndex int
-	mu            sync.RWMutex
+	handshake     HandshakeConfig
+	auth          *SimpleAuthConfig // nil lets anyone register
+	counters      handshakeCounters
+	forwarding    forwardingCounters
+
+	maxConnsPerTenant int           // 0 for no limit
+	idleTimeout       time.Duration // 0 never closes idle connections
+	mu                sync.RWMutex
 }
 
-func NewSimpleRelay(startPort, endPort int) *SimpleRelay {
+func NewSimpleRelay(startPort, endPort int, handshake HandshakeConfig, auth *SimpleAuthConfig) *SimpleRelay {
+	if handshake.Timeout <= 0 {
+		handshake.Timeout = defaultHandshakeTimeout
+	}
+	if handshake.MaxLineLength <= 0 {
+		handshake.MaxLineLength = defaultMaxLineLength
+	}
+
 	portPool := make([]int, 0, endPort-startPort+1)
 	for p := startPort; p <= endPort; p++ {
 		portPool = append(portPool, p)
 	}
 
 	return &SimpleRelay{
-		tenants:  make(map[string]*SimpleTenant),
-		portPool: portPool,
+		tenants:   make(map[string]*SimpleTenant),
+		portPool:  portPool,
+		handshake: handshake,
+		auth:      auth,
 	}
 }
 
@@ -71,6 +213,12 @@ func (s *SimpleRelay) Start() error {
 	log.Printf("   Control port: 8443 (TLS)")
 	log.Printf("   Tenant ports: 50000-50999")
 	log.Printf("   Health check: http://localhost:9090/health")
+	log.Printf("   Handshake: %v timeout, %d byte lines", s.handshake.Timeout, s.handshake.MaxLineLength)
+	if s.auth != nil {
+		log.Printf("   Registration: %d tokens, %d allowed networks", len(s.auth.Tokens), len(s.auth.networks))
+	} else {
+		log.Printf("⚠️  Registration is open to anyone, use -auth outside a lab")
+	}
 
 	for {
 		conn, err := listener.Accept()
@@ -89,31 +237,51 @@ func (s *SimpleRelay) handleConnection(conn net.Conn) {
 	clientAddr := conn.RemoteAddr().String()
 	log.Printf("🔌 New connection from %s", clientAddr)
 
-	// Read simple text protocol: "REGISTER\n" byte-by-byte to avoid buffering
-	log.Printf("📖 [%s] Reading REGISTER command...", clientAddr)
-	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
-	var line strings.Builder
-	buf := make([]byte, 1)
-	for {
-		_, err := conn.Read(buf)
-		if err != nil {
-			log.Printf("❌ [%s] Failed to read command: %v", clientAddr, err)
+	// The whole handshake, banner included, must finish within the timeout
+	conn.SetDeadline(time.Now().Add(s.handshake.Timeout))
+	if s.handshake.Banner != "" {
+		if _, err := conn.Write([]byte(s.handshake.Banner + "\n")); err != nil {
+			atomic.AddInt64(&s.counters.failed, 1)
+			log.Printf("❌ [%s] Failed to send banner: %v", clientAddr, err)
 			return
 		}
-		if buf[0] == '\n' {
-			break
+	}
+
+	log.Printf("📖 [%s] Reading REGISTER command...", clientAddr)
+	line, err := s.readHandshakeLine(conn)
+	if err != nil {
+		var netErr net.Error
+		switch {
+		case errors.As(err, &netErr) && netErr.Timeout():
+			atomic.AddInt64(&s.counters.timedOut, 1)
+		case errors.Is(err, errLineTooLong):
+			atomic.AddInt64(&s.counters.tooLong, 1)
+			conn.Write([]byte("ERROR Line too long\n"))
+		default:
+			atomic.AddInt64(&s.counters.failed, 1)
 		}
-		line.WriteByte(buf[0])
+		log.Printf("❌ [%s] Failed to read command: %v", clientAddr, err)
+		return
 	}
-	conn.SetReadDeadline(time.Time{})
 
-	command := strings.TrimSpace(line.String())
-	log.Printf("📝 [%s] Received command: '%s'", clientAddr, command)
-	
-	if command != "REGISTER" {
-		log.Printf("❌ [%s] Unknown command: %s", clientAddr, command)
+	// Only the verb is logged, the rest may be a token
+	args := strings.Fields(line)
+	if len(args) == 0 || args[0] != "REGISTER" {
+		atomic.AddInt64(&s.counters.unknown, 1)
+		log.Printf("❌ [%s] Unknown command", clientAddr)
+		conn.Write([]byte("ERROR Unknown command\n"))
 		return
 	}
+	log.Printf("📝 [%s] Received command: '%s'", clientAddr, args[0])
+
+	name, reason := s.authorize(conn.RemoteAddr(), args[1:])
+	if reason != "" {
+		atomic.AddInt64(&s.counters.unauthorized, 1)
+		log.Printf("🔑 [%s] Registration refused: %s", clientAddr, reason)
+		conn.Write([]byte("ERROR " + reason + "\n"))
+		return
+	}
+	atomic.AddInt64(&s.counters.accepted, 1)
 
 	// Allocate port
 	log.Printf("🔢 [%s] Allocating port...", clientAddr)
@@ -124,10 +292,29 @@ func (s *SimpleRelay) handleConnection(conn net.Conn) {
 		conn.Write([]byte("ERROR No ports available\n"))
 		return
 	}
+	tenantID := name
+	if _, taken := s.tenants[tenantID]; taken && tenantID != "" {
+		s.mu.Unlock()
+		log.Printf("❌ [%s] Tenant %s is already registered", clientAddr, tenantID)
+		conn.Write([]byte("ERROR Tenant already registered\n"))
+		return
+	}
 	port := s.portPool[s.nextPortIndex]
 	s.nextPortIndex++
-	tenantID := fmt.Sprintf("tenant-%d", port)
+	if tenantID == "" {
+		tenantID = fmt.Sprintf("tenant-%d", port)
+	}
+	// Reserve the name until the tenant is set up
+	s.tenants[tenantID] = &SimpleTenant{ID: tenantID, AssignedPort: port}
 	s.mu.Unlock()
+	registered := false
+	defer func() {
+		if !registered {
+			s.mu.Lock()
+			delete(s.tenants, tenantID)
+			s.mu.Unlock()
+		}
+	}()
 
 	log.Printf("✅ [%s] Allocated port %d (tenant: %s)", clientAddr, port, tenantID)
 
@@ -140,6 +327,7 @@ func (s *SimpleRelay) handleConnection(conn net.Conn) {
 	}
 
 	log.Printf("✅ [%s] Response sent successfully", clientAddr)
+	conn.SetDeadline(time.Time{})
 
 	// Create yamux session
 	log.Printf("🔀 [%s] Creating yamux session...", clientAddr)
@@ -171,6 +359,7 @@ func (s *SimpleRelay) handleConnection(conn net.Conn) {
 	s.mu.Lock()
 	s.tenants[tenantID] = tenant
 	s.mu.Unlock()
+	registered = true
 
 	defer func() {
 		s.mu.Lock()
@@ -197,63 +386,145 @@ func (s *SimpleRelay) handleConnection(conn net.Conn) {
 	}
 }
 
+// authorize checks a REGISTER command's arguments and source against the
+// provisioning file, returning the tenant name to use ("" for one derived
+// from the port) or why registration is refused
+func (s *SimpleRelay) authorize(addr net.Addr, args []string) (name, reason string) {
+	if s.auth == nil {
+		if len(args) > 0 {
+			return "", "Tokens are not enabled"
+		}
+		return "", ""
+	}
+	if !s.auth.allowed(addr) {
+		return "", "Source not allowed"
+	}
+	if len(args) == 0 || len(args) > 2 {
+		return "", "Unauthorized"
+	}
+	token, ok := s.auth.lookup(args[0])
+	if !ok {
+		return "", "Unauthorized"
+	}
+	switch {
+	case len(args) == 1:
+		return token.Tenant, ""
+	case token.Tenant != "" && args[1] != token.Tenant:
+		return "", "Token is bound to another tenant"
+	case !tenantNamePattern.MatchString(args[1]):
+		return "", "Invalid tenant name"
+	}
+	return args[1], ""
+}
+
+// readHandshakeLine reads one command line byte-by-byte, so nothing the agent
+// sends after it is buffered away from yamux, and gives up once the line
+// exceeds the maximum length
+func (s *SimpleRelay) readHandshakeLine(conn net.Conn) (string, error) {
+	var line strings.Builder
+	buf := make([]byte, 1)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			return "", err
+		}
+		if buf[0] == '\n' {
+			return line.String(), nil
+		}
+		if line.Len() >= s.handshake.MaxLineLength {
+			return "", errLineTooLong
+		}
+		line.WriteByte(buf[0])
+	}
+}
+
 func (s *SimpleRelay) handleClientConnection(clientConn net.Conn, tenant *SimpleTenant, connNum int) {
 	defer clientConn.Close()
 
 	clientAddr := clientConn.RemoteAddr().String()
 	log.Printf("🔗 [Conn#%d] Client %s connected to port %d", connNum, clientAddr, tenant.AssignedPort)
 
-	// Open a new stream to the agent
-	log.Printf("📡 [Conn#%d] Opening yamux stream to agent...", connNum)
-	stream, err := tenant.YamuxSession.OpenStream()
-	if err != nil {
-		log.Printf("❌ [Conn#%d] Failed to open stream: %v", connNum, err)
-		return
+	policy := &simpleForward{relay: s, tenant: tenant, connNum: connNum}
+	forwarder := &Forwarder{
+		Opener:      sessionOpener{tenant.YamuxSession},
+		Policy:      policy,
+		IdleTimeout: s.idleTimeout,
 	}
-	defer stream.Close()
-	log.Printf("✅ [Conn#%d] Yamux stream opened", connNum)
-
-	tenant.mu.Lock()
-	tenant.ActiveConns++
-	activeConns := tenant.ActiveConns
-	tenant.mu.Unlock()
-	log.Printf("📊 [Conn#%d] Active connections: %d", connNum, activeConns)
-
-	defer func() {
+	err := forwarder.Forward(clientConn, &ForwardStats{})
+	if policy.admitted {
 		tenant.mu.Lock()
 		tenant.ActiveConns--
 		activeConns := tenant.ActiveConns
 		tenant.mu.Unlock()
 		log.Printf("📊 [Conn#%d] Connection closed. Remaining: %d", connNum, activeConns)
-	}()
+	}
+	switch {
+	case errors.Is(err, errIdleTimeout):
+		atomic.AddInt64(&s.forwarding.idleCloses, 1)
+		log.Printf("⏱️ [Conn#%d] Closed after %v idle", connNum, s.idleTimeout)
+	case err != nil:
+		log.Printf("⚠️ [Conn#%d] %v", connNum, err)
+	}
+	log.Printf("🔌 [Conn#%d] Connection finished (port %d)", connNum, tenant.AssignedPort)
+}
 
-	log.Printf("🔄 [Conn#%d] Starting bidirectional data forwarding...", connNum)
+// sessionOpener opens streams on an agent's yamux session
+type sessionOpener struct {
+	session *yamux.Session
+}
 
-	// Forward data bidirectionally
-	done := make(chan bool, 2)
+func (o sessionOpener) OpenStream() (net.Conn, error) {
+	stream, err := o.session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
 
-	// Client -> Agent
-	go func() {
-		n, err := io.Copy(stream, clientConn)
-		if err != nil {
-			log.Printf("⚠️ [Conn#%d] Client->Agent error: %v", connNum, err)
-		}
-		log.Printf("📤 [Conn#%d] Client->Agent: %d bytes", connNum, n)
-		done <- true
-	}()
+// simpleForward is the forward policy of one client connection: it enforces
+// the per-tenant connection limit and adds to the relay's byte counters
+type simpleForward struct {
+	relay    *SimpleRelay
+	tenant   *SimpleTenant
+	connNum  int
+	admitted bool // holds a connection slot
+}
 
-	// Agent -> Client
-	go func() {
-		n, err := io.Copy(clientConn, stream)
-		if err != nil {
-			log.Printf("⚠️ [Conn#%d] Agent->Client error: %v", connNum, err)
-		}
-		log.Printf("📥 [Conn#%d] Agent->Client: %d bytes", connNum, n)
-		done <- true
-	}()
+func (f *simpleForward) Admit(clientConn net.Conn) (io.Reader, error) {
+	f.tenant.mu.Lock()
+	defer f.tenant.mu.Unlock()
 
-	<-done
-	log.Printf("🔌 [Conn#%d] Connection finished (port %d)", connNum, tenant.AssignedPort)
+	if limit := f.relay.maxConnsPerTenant; limit > 0 && f.tenant.ActiveConns >= limit {
+		atomic.AddInt64(&f.relay.forwarding.refused, 1)
+		return nil, fmt.Errorf("tenant %s at its limit of %d connections", f.tenant.ID, limit)
+	}
+	f.tenant.ActiveConns++
+	f.admitted = true
+	log.Printf("📊 [Conn#%d] Active connections: %d", f.connNum, f.tenant.ActiveConns)
+	return clientConn, nil
+}
+
+func (f *simpleForward) Opened(clientConn, stream net.Conn, stats *ForwardStats) (up, down io.Writer) {
+	log.Printf("🔄 [Conn#%d] Yamux stream opened, forwarding...", f.connNum)
+	return &totalWriter{w: stream, total: &f.relay.forwarding.bytesClientToAgent},
+		&totalWriter{w: clientConn, total: &f.relay.forwarding.bytesAgentToClient}
+}
+
+func (f *simpleForward) Finished(clientConn net.Conn, stats *ForwardStats, err error) {
+	up, down := stats.Bytes()
+	log.Printf("📤 [Conn#%d] Client->Agent: %d bytes", f.connNum, up)
+	log.Printf("📥 [Conn#%d] Agent->Client: %d bytes", f.connNum, down)
+}
+
+// totalWriter adds the bytes written to a relay-wide counter
+type totalWriter struct {
+	w     io.Writer
+	total *int64
+}
+
+func (t *totalWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	atomic.AddInt64(t.total, int64(n))
+	return n, err
 }
 
 func (s *SimpleRelay) startHealthCheck() {
@@ -266,7 +537,21 @@ func (s *SimpleRelay) startHealthCheck() {
 			"status":        "ok",
 			"version":       "2.0.0-simple",
 			"activeTenants": activeTenants,
-			"timestamp":     time.Now().Format(time.RFC3339),
+			"handshakes": map[string]int64{
+				"accepted":     atomic.LoadInt64(&s.counters.accepted),
+				"timedOut":     atomic.LoadInt64(&s.counters.timedOut),
+				"tooLong":      atomic.LoadInt64(&s.counters.tooLong),
+				"unknown":      atomic.LoadInt64(&s.counters.unknown),
+				"unauthorized": atomic.LoadInt64(&s.counters.unauthorized),
+				"failed":       atomic.LoadInt64(&s.counters.failed),
+			},
+			"forwarding": map[string]int64{
+				"bytesClientToAgent": atomic.LoadInt64(&s.forwarding.bytesClientToAgent),
+				"bytesAgentToClient": atomic.LoadInt64(&s.forwarding.bytesAgentToClient),
+				"refused":            atomic.LoadInt64(&s.forwarding.refused),
+				"idleClosed":         atomic.LoadInt64(&s.forwarding.idleCloses),
+			},
+			"timestamp": time.Now().Format(time.RFC3339),
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -280,7 +565,26 @@ func (s *SimpleRelay) startHealthCheck() {
 }
 
 func main() {
-	relay := NewSimpleRelay(50000, 50999)
+	var handshake HandshakeConfig
+	flag.DurationVar(&handshake.Timeout, "handshake-timeout", defaultHandshakeTimeout, "Time allowed for a control connection's handshake")
+	flag.IntVar(&handshake.MaxLineLength, "max-line", defaultMaxLineLength, "Longest handshake line accepted, in bytes")
+	flag.StringVar(&handshake.Banner, "banner", "", "Protocol banner sent to each control connection (none by default)")
+	authFile := flag.String("auth", "", "Provisioning file with registration tokens and allowed networks")
+	maxConns := flag.Int("max-conns", 0, "Client connections allowed per tenant (0 for no limit)")
+	idleTimeout := flag.Duration("idle-timeout", 0, "Close client connections idle this long (0 never does)")
+	flag.Parse()
+
+	var auth *SimpleAuthConfig
+	if *authFile != "" {
+		var err error
+		if auth, err = LoadSimpleAuth(*authFile); err != nil {
+			log.Fatalf("Failed to load auth file: %v", err)
+		}
+	}
+
+	relay := NewSimpleRelay(50000, 50999, handshake, auth)
+	relay.maxConnsPerTenant = *maxConns
+	relay.idleTimeout = *idleTimeout
 	if err := relay.Start(); err != nil {
 		log.Fatalf("Failed to start relay: %v", err)
 	}
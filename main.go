@@ -3,107 +3,497 @@ package main
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
 	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/hashicorp/yamux"
 	"github.com/tatbeeb/tatbeeb-link/common"
 )
 
+// serviceSQL is the only service the relay currently forwards
+const serviceSQL = "sql"
+
+// msgTypeSteer tells an agent to reconnect to another relay
+const msgTypeSteer = "steer"
+
+// RegisterRequest is the agent's registration payload, extending the shared
+// protocol type with relay-specific fields
+type RegisterRequest struct {
+	common.RegisterPayload
+	Region string `json:"region,omitempty"`
+	// Services lists the service types the agent exposes, e.g. sql, hl7
+	Services []string `json:"services,omitempty"`
+}
+
+// ErrorResponse extends the shared error payload with retry hints for errors
+// the agent should retry later or elsewhere
+type ErrorResponse struct {
+	common.ErrorPayload
+	Retryable         bool   `json:"retryable,omitempty"`
+	RetryAfterSeconds int    `json:"retryAfterSeconds,omitempty"`
+	AlternateEndpoint string `json:"alternateEndpoint,omitempty"`
+}
+
+// RegisteredResponse is sent to the agent once its port is assigned
+type RegisteredResponse struct {
+	common.RegisteredPayload
+	Region string `json:"region,omitempty"`
+	// FallbackEndpoints lists relays to reconnect to, in order, if this one fails
+	FallbackEndpoints []string `json:"fallbackEndpoints,omitempty"`
+	// ConnectionStrings holds ready-made strings per driver, e.g. adoNet, jdbc, odbc
+	ConnectionStrings map[string]string `json:"connectionStrings,omitempty"`
+	// ServiceEndpoints is where clients reach each registered service type
+	ServiceEndpoints map[string]AdvertisedEndpoint `json:"serviceEndpoints,omitempty"`
+	// Cohort and Features tell the agent which canary settings apply to it
+	Cohort   string            `json:"cohort,omitempty"`
+	Features map[string]string `json:"features,omitempty"`
+	// Relay identifies the relay build that served the registration
+	Relay *BuildInfo `json:"relay,omitempty"`
+	// InternalEndpoint is set with split-horizon, for clients on the relay's private network
+	InternalEndpoint *AdvertisedEndpoint `json:"internalEndpoint,omitempty"`
+	// CertificatePins lets agents pin the control channel's key and its successor
+	CertificatePins *CertificatePins `json:"certificatePins,omitempty"`
+}
+
 type Tenant struct {
-	ID             string
-	AssignedPort   int
-	SQLUser        string
-	SQLPassword    string
-	ControlSession *yamux.Session
-	Listener       net.Listener
-	ActiveConns    int
-	mu             sync.Mutex
+	ID                      string
+	AssignedPort            int
+	SQLUser                 string
+	SQLPassword             string
+	ControlSession          *yamux.Session
+	Listener                net.Listener
+	PreviousPort            int          // port before the last admin remap
+	retiredListener         net.Listener // old port still accepting during a remap grace period
+	OrganizationID          string
+	RegisteredAt            time.Time
+	LastSeen                time.Time // last registration, successful ping or stream open
+	ActiveConns             int
+	MaxConns                int    // effective limit, see applyConnLimitLocked
+	MaxConnsSource          string // admin, his, token, tier or default
+	tokenMaxConns           int    // from the registration token
+	hisMaxConns             int    // from the latest HIS registration response
+	hisMaxSourceIPs         int    // from the latest HIS registration response
+	MaxBandwidthKbps        int
+	MaxBytesPerConnection   int64
+	MaxBytesPerDay          int64
+	AllowedServices         []string
+	Services                []string // service types advertised, see advertisedServices
+	Region                  string   // Region reported by the agent
+	Cohort                  string   // Canary cohort, or baselineCohort
+	Tier                    string   // gold, silver or bronze, see resolveTierLocked
+	TierSource              string   // label, token or default
+	tokenTier               string   // from the registration token
+	StreamsOpened           int
+	StreamOpenFailures      int
+	ConsecutiveOpenFailures int
+	Degraded                bool
+	LastStreamError         string
+	LastStreamErrorAt       time.Time
+	ConsecutiveEmptyStreams int // connections the agent closed without a response
+	LastEmptyStreamAt       time.Time
+	openLatency             time.Duration // moving average of successful stream opens
+	limitRejections         int           // clients refused at the limit in the current load window
+	limitWindowStart        time.Time
+	credentialGeneration    int       // rotations of SQLUser since registration
+	credentialRotatedAt     time.Time // when SQLUser and SQLPassword were issued
+	credentialPolicy        string    // name of the policy SQLPassword was generated under
+	previousSQLUser         string    // still provisioned until previousCredentialUntil
+	previousCredentialUntil time.Time
+	credentialHISPending    *CredentialRotatedRequest // rotated credential HIS hasn't acknowledged
+	flow                    flowGauge                 // writes to the agent not yet accepted
+	agentFlow               *AgentFlowTelemetry       // latest telemetry from the agent
+	agentFlowAt             time.Time
+	backpressureLevel       string              // as of the last flow telemetry tick
+	rotation                *credentialRotation // waiting for the agent's confirmation
+	upLimiter               *BandwidthLimiter   // client -> agent
+	downLimiter             *BandwidthLimiter   // agent -> client
+	canary                  *CanaryPolicy
+	keepaliveInterval       time.Duration // zero uses defaultKeepaliveInterval
+	controlLostAt           time.Time     // set while open connections drain after a failed ping
+	streamOpenTimeout       time.Duration // zero uses the relay default
+	heldConns               []net.Conn    // accepted while the port was parked, handed to serveTenantPort under mu
+	hisAcked                chan struct{} // closed once HIS confirms the port; nil unless holdUntilHISAck
+	control                 net.Conn      // control stream, written through writeControl
+	controlMu               sync.Mutex
+	mu                      sync.Mutex
 }
 
 type RelayServer struct {
-	config        *common.RelayConfig
-	tenants       map[string]*Tenant
-	portPool      []int
-	nextPortIndex int
-	mu            sync.RWMutex
-	hisClient     *HISClient
-	jwtSecret     string
-	jwtIssuer     string
-	jwtAudience   string
-}
-
-func NewRelayServer(config *common.RelayConfig, hisBackendURL, relaySecret, jwtSecret string) *RelayServer {
+	config                  *common.RelayConfig
+	tenants                 map[string]*Tenant
+	portPool                []int
+	portIndex               map[int]portIndexEntry // registered tenants by the ports they hold
+	portIndexViolations     []portIndexViolation   // latest failed invariant checks
+	portIndexViolationCount int
+	nextPortIndex           int
+	portAllocation          string // sequential or hash
+	mu                      sync.RWMutex
+	hisClient               HISBackend
+	hisSpool                *HISSpool
+	tlsMaterial             TLSMaterialConfig
+	jwtIssuers              []JWTIssuerConfig
+	adminAuth               *adminAuth
+	hisSecrets              []string // sign HIS calls to the HIS API (kill switch, load)
+	webhookTolerance        time.Duration
+	audit                   *AuditLog
+	listeners               ListenersConfig // socket options per listener class
+	listenerCaps            listenerCapabilities
+	credentialRotation      CredentialRotationConfig
+	credentialPolicies      *CredentialPolicies
+	sourceIPs               *SourceIPTracker
+
+	instanceRegistration      InstanceRegistrationConfig
+	instanceRegistrationState instanceRegistrationState
+	startedAt                 time.Time
+	hisReconcile              hisReconcileState
+	deregistration            DeregistrationConfig
+	portHistory               *PortHistory // which tenant held which port when
+	blocklist                 *TenantBlocklist
+	packetTraces              *PacketTracer
+	flowControl               FlowControlConfig
+	portForecast              *PortForecaster
+	federation                FederationConfig // GET /federate, when enabled
+	latency                   *LatencyInjector // nil unless latency injection is enabled
+	siem                      *SIEMExporter    // nil unless security events are exported
+	slo                       *SLOTracker
+	sni                       SNIConfig
+	region                    string
+	publicHost                string
+	instanceID                string // identifies this relay to HIS and cluster peers
+	virtualInstance           string // name in virtualInstances, empty when the process runs one relay
+	healthPort                int
+	connStringTemplates       map[string]*template.Template
+	serviceEndpointTemplates  map[string]*serviceEndpointTemplate
+	fallbacks                 []string // configured fallback relay endpoints
+	hisFallbacks              []string // latest fallback list from HIS, overrides fallbacks
+	admission                 AdmissionConfig
+	registrationBucket        *RegistrationBucket // nil unless registrations are paced
+	canaries                  []CanaryPolicy
+	load                      *LoadMonitor
+	counters                  relayCounters
+	mirrors                   map[string]string            // tenant ID -> mirror target, set via admin API
+	labels                    map[string]map[string]string // tenant ID -> labels, set via admin API or HIS
+	labelsMu                  sync.RWMutex
+	connLimits                map[string]int // tenant ID -> connection limit set via admin API
+	freezes                   map[string]*accessFreeze
+	kills                     map[string]*killBlock // tenant ID -> HIS kill switch block
+	events                    *EventLog
+	departures                *DepartureLog
+	tenantStates              *TenantStates
+	copyPool                  *CopyPool    // nil with the goroutine-per-connection model
+	tunnel                    *RelayTunnel // nil unless clustered
+	idleTimeout               time.Duration
+	shedder                   *LoadShedder // nil when load shedding is off
+	tiers                     map[string]TierConfig
+	tierStats                 *TierStats
+	timeSeries                *TimeSeries
+	conns                     *ConnTable
+	recorder                  *Recorder         // nil when the recording dir is unavailable
+	ledger                    *ComplianceLedger // nil when the compliance dir is unavailable
+	quotas                    *QuotaTracker
+	features                  *FeatureFlags
+	watchdog                  *GoroutineWatchdog
+	statusCache               publicStatusCache
+	nonces                    *NonceStore
+	rejectReplayedJTI         bool
+	registrations             *RegistrationTracker
+	tlsFailures               *TLSFailureTracker
+	jwtFailures               *JWTFailureTracker
+	jwtCache                  *JWTCache
+	jwtSecrets                *JWTSecretStats
+	streamBudget              StreamBudgetConfig
+	reputation                *IPReputation // nil without an ipReputation feed
+	horizon                   *splitHorizon // nil without an internal endpoint
+	holdUntilHISAck           bool
+	progressLog               ProgressLogConfig
+	localControl              LocalControlConfig
+	resumption                *tlsResumption
+	certPins                  *CertificatePins      // set by Start from the loaded certificate
+	controlListeners          map[net.Listener]bool // served by Serve, closed by Stop
+	stopped                   bool
+	// listenTenantPort opens tenant ports; tests may bind them elsewhere
+	listenTenantPort func(port int, tuning ListenerTuning) (net.Listener, error)
+	hisAckTimeout    time.Duration
+	maxControlMsg    int                    // bytes
+	reservedPorts    map[string]int         // tenant ID -> sticky port, excluded from portPool
+	parked           map[string]*parkedPort // reserved ports bound while their tenant is away
+	journal          *PortJournal           // nil when the journal is unavailable
+	journaledPorts   map[string]int         // tenant ID -> port assigned before the last restart
+	parkedHold       time.Duration          // how long parked ports hold connections; zero refuses them
+
+	handshakeTimeout      time.Duration
+	preloginTimeout       time.Duration
+	streamOpenTimeout     time.Duration
+	degradedAfterFailures int
+}
+
+func NewRelayServer(config *common.RelayConfig, hisClient HISBackend, jwtIssuers []JWTIssuerConfig) *RelayServer {
 	// Initialize port pool
 	portPool := make([]int, 0, config.TenantPortEnd-config.TenantPortStart+1)
 	for p := config.TenantPortStart; p <= config.TenantPortEnd; p++ {
 		portPool = append(portPool, p)
 	}
 
-	// Initialize HIS client
-	hisClient := NewHISClient(hisBackendURL, relaySecret)
-
-	return &RelayServer{
-		config:      config,
-		tenants:     make(map[string]*Tenant),
-		portPool:    portPool,
-		hisClient:   hisClient,
-		jwtSecret:   jwtSecret,
-		jwtIssuer:   "his.tatbeeb.sa",
-		jwtAudience: "tatbeeb-link.tatbeeb.sa",
+	connStringTemplates, _ := parseConnectionStringTemplates(nil)
+	serviceEndpointTemplates, _ := parseServiceEndpoints(nil)
+	nonces, _ := NewNonceStore("")
+	spool, _ := NewHISSpool("", hisClient)
+	portHistory, _ := OpenPortHistory(PortHistoryConfig{})
+	blocklist, _ := OpenTenantBlocklist("")
+	slo, _ := NewSLOTracker(SLOConfig{})
+
+	events := NewEventLog()
+	server := &RelayServer{
+		config:                   config,
+		tenants:                  make(map[string]*Tenant),
+		mirrors:                  make(map[string]string),
+		labels:                   make(map[string]map[string]string),
+		connLimits:               make(map[string]int),
+		freezes:                  make(map[string]*accessFreeze),
+		kills:                    make(map[string]*killBlock),
+		parked:                   make(map[string]*parkedPort),
+		portPool:                 portPool,
+		portIndex:                make(map[int]portIndexEntry),
+		tlsMaterial:              TLSMaterialConfig{CertFile: config.TLSCertFile, KeyFile: config.TLSKeyFile},
+		publicHost:               defaultPublicHost,
+		instanceID:               relayInstanceID(ClusterConfig{}),
+		connStringTemplates:      connStringTemplates,
+		serviceEndpointTemplates: serviceEndpointTemplates,
+		hisClient:                hisClient,
+		hisSpool:                 spool,
+		controlListeners:         make(map[net.Listener]bool),
+		resumption:               newTLSResumption(TLSResumptionConfig{}),
+		adminAuth:                &adminAuth{},
+		audit:                    &AuditLog{},
+		listenTenantPort:         listenTenantPort,
+		jwtIssuers:               jwtIssuers,
+		events:                   events,
+		departures:               NewDepartureLog(),
+		tenantStates:             NewTenantStates(),
+		tierStats:                NewTierStats(),
+		webhookTolerance:         defaultWebhookTolerance,
+		timeSeries:               &TimeSeries{},
+		conns:                    NewConnTable(),
+		quotas:                   NewQuotaTracker(time.UTC),
+		features:                 newFeatureFlags(),
+		watchdog:                 NewGoroutineWatchdog(),
+		nonces:                   nonces,
+		portHistory:              portHistory,
+		blocklist:                blocklist,
+		packetTraces:             NewPacketTracer(),
+		flowControl:              FlowControlConfig{}.withDefaults(),
+		portForecast:             NewPortForecaster(PortForecastConfig{}),
+		credentialPolicies:       NewCredentialPolicies(CredentialPoliciesConfig{}),
+		sourceIPs:                NewSourceIPTracker(SourceIPConfig{}),
+		startedAt:                clock.BaseNow(),
+		slo:                      slo,
+		registrations:            NewRegistrationTracker(20, events),
+		tlsFailures:              NewTLSFailureTracker(),
+		jwtFailures:              NewJWTFailureTracker(),
+		jwtCache:                 NewJWTCache(defaultJWTCacheSize),
+		jwtSecrets:               NewJWTSecretStats(jwtIssuers),
+		streamBudget:             StreamBudgetConfig{PerTenant: defaultStreamsPerTenant},
+		healthPort:               defaultHealthCheckPort,
+
+		handshakeTimeout:      10 * time.Second,
+		preloginTimeout:       defaultPreloginTimeout,
+		hisAckTimeout:         defaultHISAckTimeout,
+		maxControlMsg:         defaultMaxControlMessageBytes,
+		streamOpenTimeout:     5 * time.Second,
+		degradedAfterFailures: 3,
 	}
+	server.load = NewLoadMonitor(&server.counters)
+	events.labelsFor = server.tenantLabels
+	return server
 }
 
 func (s *RelayServer) Start() error {
 	// Start health check HTTP server
 	go s.startHealthCheckServer()
 
+	// Replay HIS notifications that failed earlier (including before a restart)
+	go s.hisSpool.Run()
+
+	if s.reputation != nil {
+		go s.reputation.Run()
+	}
+
+	if s.progressLog.enabled() {
+		go s.conns.RunProgressLog(s.progressLog)
+	}
+
+	go s.registrations.Run()
+
+	go s.load.Run()
+	go s.runTimeSeries()
+	if s.shedder != nil {
+		go s.runLoadShedding()
+	}
+
+	if s.recorder != nil {
+		go s.recorder.Run()
+	}
+
+	go s.nonces.Run()
+	go s.runSLOSampler()
+	go s.runFlowTelemetry()
+	go s.runPortForecast()
+	if s.siem != nil {
+		go s.siem.Run()
+	}
+
+	go s.runCredentialRotation()
+
+	if !s.instanceRegistration.Disabled {
+		go s.runInstanceRegistration()
+	}
+
+	// Catch goroutines that outlive the tenants and connections they serve
+	go s.runWatchdog()
+
+	// Bind reserved tenant ports now so conflicts fail the boot, not a registration
+	if err := s.parkReservedPorts(); err != nil {
+		return err
+	}
+
 	// Load TLS certificate
-	cert, err := tls.LoadX509KeyPair(s.config.TLSCertFile, s.config.TLSKeyFile)
+	cert, err := loadTLSCertificate(s.tlsMaterial)
 	if err != nil {
 		return fmt.Errorf("failed to load TLS certificate: %w", err)
 	}
+	pins, err := newCertificatePins(cert, s.tlsMaterial.NextPins)
+	if err != nil {
+		return fmt.Errorf("failed to pin TLS certificate: %w", err)
+	}
+	s.certPins = pins
 
 	tlsConfig := &tls.Config{
 		Certificates: []tls.Certificate{cert},
 		MinVersion:   tls.VersionTLS12,
+		NextProtos:   s.controlALPNProtocols(),
+	}
+	// Share session ticket keys with the other instances so reconnecting
+	// agents resume wherever the load balancer sends them
+	if s.resumption.shared() {
+		s.resumption.install(tlsConfig, clock.BaseNow())
+		go s.resumption.Run(tlsConfig)
+	}
+
+	// Hostname-based routing shares one TLS port across tenants; SQL clients
+	// may also reach it through the control port by ALPN
+	if s.sni.Enabled {
+		store, err := NewSNICertStore(s.sni.CertDir, &cert)
+		if err != nil {
+			return err
+		}
+		go store.reloadPeriodically()
+		tlsConfig.GetCertificate = store.GetCertificate
+
+		if err := s.startSNIListener(store); err != nil {
+			return err
+		}
+	}
+
+	// Peers proxy clients of tenants registered here over the relay tunnel
+	if s.tunnel != nil && s.tunnel.cfg.TunnelPort > 0 {
+		if err := s.startTunnelListener(cert); err != nil {
+			return err
+		}
 	}
 
 	// Start control listener
-	listener, err := tls.Listen("tcp", fmt.Sprintf(":%d", s.config.ControlPort), tlsConfig)
+	tcpListener, err := listenTCP(fmt.Sprintf(":%d", s.config.ControlPort), s.listeners.Control)
 	if err != nil {
 		return fmt.Errorf("failed to start control listener: %w", err)
 	}
+	listener := tls.NewListener(tcpListener, tlsConfig)
 
 	log.Printf("🚀 Tatbeeb Link Relay started")
-	log.Printf("   Control port: %d (TLS)", s.config.ControlPort)
+	log.Printf("   Control port: %d (TLS, SPKI pin %s)", s.config.ControlPort, s.certPins.Current[0])
+	if err := s.startLocalControlListeners(); err != nil {
+		listener.Close()
+		return err
+	}
 	log.Printf("   Tenant ports: %d-%d", s.config.TenantPortStart, s.config.TenantPortEnd)
-	log.Printf("   Health check: http://localhost:9090/health")
+	log.Printf("   Health check: http://localhost:%d/health", s.healthPort)
 
+	return s.Serve(listener)
+}
+
+// Serve accepts agent control connections on listener until it closes or
+// Stop is called. Start calls it for the TLS control port; tests can pass
+// any listener, TLS or not.
+func (s *RelayServer) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		listener.Close()
+		return errRelayStopped
+	}
+	s.controlListeners[listener] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.controlListeners, listener)
+		s.mu.Unlock()
+	}()
+
+	var backoff time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				s.mu.RLock()
+				stopped := s.stopped
+				s.mu.RUnlock()
+				if stopped {
+					return errRelayStopped
+				}
+				return fmt.Errorf("control listener closed: %w", err)
+			}
+			if isTemporaryAcceptError(err) {
+				backoff = acceptBackoff(backoff)
+				log.Printf("Error accepting connection: %v; retrying in %v", err, backoff)
+				clock.Sleep(backoff)
+				continue
+			}
 			log.Printf("Error accepting connection: %v", err)
 			continue
 		}
+		backoff = 0
 
 		go s.handleControlConnection(conn)
 	}
 }
 
 func (s *RelayServer) startHealthCheckServer() {
-	http.HandleFunc("/health", s.handleHealth)
-	http.HandleFunc("/metrics", s.handleMetrics)
+	// Each relay has its own mux so virtual instances can share the process
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/status/", s.handleTenantStatus)
+	mux.HandleFunc("/public/status", s.handlePublicStatus)
+	mux.HandleFunc("/version", s.handleVersion)
+	if s.federation.Enabled {
+		mux.HandleFunc("/federate", s.handleFederate)
+	}
+	s.registerAdminRoutes(mux)
+	s.registerHISRoutes(mux)
 
-	log.Printf("Health check server listening on :9090")
-	if err := http.ListenAndServe(":9090", nil); err != nil {
+	log.Printf("Health check server listening on :%d", s.healthPort)
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", s.healthPort), mux); err != nil {
 		log.Printf("Health check server error: %v", err)
 	}
 }
@@ -115,9 +505,17 @@ func (s *RelayServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 
 	health := map[string]interface{}{
 		"status":        "ok",
-		"version":       "1.0.0",
+		"version":       version,
+		"region":        s.region,
 		"activeTenants": activeTenants,
-		"timestamp":     time.Now().Format(time.RFC3339),
+		"features":      s.features.State(),
+		"timestamp":     clock.Now().Format(time.RFC3339),
+	}
+	if s.virtualInstance != "" {
+		health["virtualInstance"] = s.virtualInstance
+	}
+	if s.latency != nil {
+		health["latencyInjection"] = true
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -129,10 +527,68 @@ func (s *RelayServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	defer s.mu.RUnlock()
 
 	metrics := map[string]interface{}{
-		"active_tenants":    len(s.tenants),
-		"available_ports":   len(s.portPool) - s.nextPortIndex,
-		"total_connections": s.getTotalConnections(),
-		"tenants":           s.getTenantMetrics(),
+		"active_tenants":         len(s.tenants),
+		"available_ports":        s.availablePortsLocked(),
+		"port_forecast":          s.portForecastLocked(),
+		"port_index":             s.portIndexMetricsLocked(),
+		"total_connections":      s.getTotalConnections(),
+		"his_spool_pending":      s.hisSpool.Pending(),
+		"his_targets":            s.hisClient.Metrics(),
+		"his_retries":            s.hisSpool.Retries(),
+		"his_reconcile":          s.hisReconcileMetrics(),
+		"file_descriptors":       fdMetrics(requiredFileDescriptors(len(s.portPool), s.config.MaxConnectionsPerTenant)),
+		"counters":               s.counters.snapshot(),
+		"flapping_tenants":       s.registrations.Flapping(),
+		"load":                   s.loadMetrics(),
+		"tenants_by_label":       s.labelCounts(),
+		"cohorts":                s.cohortMetrics(),
+		"goroutines":             s.goroutineMetrics(),
+		"nonces_held":            s.nonces.Len(),
+		"parked_ports":           s.parkedMetrics(),
+		"tls_handshake_failures": s.tlsFailures.Metrics(),
+		"jwt_failures":           s.jwtFailures.Metrics(),
+		"jwt_cache":              s.jwtCache.Metrics(),
+		"jwt_secrets":            s.jwtSecrets.Metrics(),
+		"streams":                s.streamBudgetMetrics(),
+		"connection_limits":      s.connLimitMetrics(),
+		"port_journal":           s.journalMetrics(),
+		"tls_resumption":         s.resumption.Metrics(),
+		"access_freezes":         s.freezeMetrics(),
+		"tenant_states":          s.tenantStates.Metrics(),
+		"slo":                    s.slo.Metrics(),
+		"backpressure":           s.backpressureMetrics(),
+		"forwarding":             forwardMetrics(s.copyPool),
+		"tiers":                  s.tierMetrics(),
+		"tenants":                s.getTenantMetrics(),
+	}
+	if s.reputation != nil {
+		metrics["ip_reputation"] = s.reputation.Metrics()
+	}
+	metrics["source_ips"] = s.sourceIPs.Metrics()
+	if !s.instanceRegistration.Disabled {
+		metrics["instance_registration"] = s.instanceRegistrationMetrics()
+	}
+	if s.shedder != nil {
+		metrics["load_shedding"] = s.shedder.Metrics()
+	}
+	if s.tunnel != nil {
+		metrics["cluster"] = s.tunnel.Metrics()
+	}
+	if s.siem != nil {
+		metrics["siem"] = s.siem.Metrics()
+	}
+	if s.latency != nil {
+		metrics["latency_injection"] = s.latency.Metrics()
+	}
+	if s.virtualInstance != "" {
+		metrics["virtual_instance"] = s.virtualInstance
+	}
+	metrics["listeners"] = map[string]interface{}{
+		"capabilities": s.listenerCaps,
+		"control":      s.listeners.Control,
+		"tenant":       s.listeners.Tenant,
+		"sni":          s.listeners.SNI,
+		"tunnel":       s.listeners.Tunnel,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -152,23 +608,98 @@ func (s *RelayServer) getTotalConnections() int {
 func (s *RelayServer) getTenantMetrics() []map[string]interface{} {
 	metrics := make([]map[string]interface{}, 0, len(s.tenants))
 	for _, tenant := range s.tenants {
-		tenant.mu.Lock()
-		metrics = append(metrics, map[string]interface{}{
-			"tenantId":     tenant.ID,
-			"assignedPort": tenant.AssignedPort,
-			"activeConns":  tenant.ActiveConns,
-		})
-		tenant.mu.Unlock()
+		metrics = append(metrics, s.tenantSnapshot(tenant))
 	}
 	return metrics
 }
 
+// tenantSnapshot describes a tenant for metrics and the admin API; callers
+// hold s.mu
+func (s *RelayServer) tenantSnapshot(tenant *Tenant) map[string]interface{} {
+	tenant.mu.Lock()
+	defer tenant.mu.Unlock()
+
+	yamuxStats := map[string]interface{}{
+		"numStreams":              tenant.ControlSession.NumStreams(),
+		"streamBudget":            s.streamBudget.PerTenant,
+		"streamHeadroom":          s.streamBudget.PerTenant - streamsInUse(tenant),
+		"sessionClosed":           tenant.ControlSession.IsClosed(),
+		"streamsOpened":           tenant.StreamsOpened,
+		"streamOpenFailures":      tenant.StreamOpenFailures,
+		"consecutiveOpenFailures": tenant.ConsecutiveOpenFailures,
+		"lastStreamError":         tenant.LastStreamError,
+	}
+	if !tenant.LastStreamErrorAt.IsZero() {
+		yamuxStats["lastStreamErrorAt"] = tenant.LastStreamErrorAt.Format(time.RFC3339)
+	}
+
+	return map[string]interface{}{
+		"tenantId":         tenant.ID,
+		"organizationId":   tenant.OrganizationID,
+		"assignedPort":     tenant.AssignedPort,
+		"state":            tenant.state(),
+		"lifecycleState":   s.tenantStates.State(tenant.ID),
+		"registeredAt":     tenant.RegisteredAt.Format(time.RFC3339),
+		"lastSeen":         tenant.LastSeen.Format(time.RFC3339),
+		"region":           tenant.Region,
+		"cohort":           tenant.Cohort,
+		"tier":             tenant.Tier,
+		"tierSource":       tenant.TierSource,
+		"activeConns":      tenant.ActiveConns,
+		"maxConns":         tenant.MaxConns,
+		"maxConnsSource":   tenant.MaxConnsSource,
+		"maxBandwidthKbps": tenant.MaxBandwidthKbps,
+		"byteCaps": map[string]interface{}{
+			"perConnection": tenant.MaxBytesPerConnection,
+			"perDay":        tenant.MaxBytesPerDay,
+			"usedToday":     s.quotas.Used(tenant.ID),
+		},
+		"labels":           s.tenantLabels(tenant.ID),
+		"mirroring":        s.mirrors[tenant.ID] != "",
+		"latencyInjected":  s.latency != nil && s.latency.get(tenant.ID) != nil,
+		"credentialPolicy": tenant.credentialPolicy,
+		"sourceIps": map[string]interface{}{
+			"count": s.sourceIPs.Count(tenant.ID),
+			"max":   s.maxSourceIPsLocked(tenant),
+		},
+		"degraded":     tenant.Degraded,
+		"yamux":        yamuxStats,
+		"backpressure": tenant.backpressureLocked(s.flowControl),
+	}
+}
+
 func (s *RelayServer) handleControlConnection(conn net.Conn) {
 	defer conn.Close()
 
+	// Bound TLS handshake, session setup, stream accept and registration read
+	// so idle clients don't hold a goroutine and TLS session forever
+	handshakeTimer := clock.AfterFunc(s.handshakeTimeout, func() {
+		s.counters.inc(&s.counters.handshakeTimeouts)
+		log.Printf("Closing control connection from %s: registration not received within %v",
+			conn.RemoteAddr(), s.handshakeTimeout)
+		conn.Close()
+	})
+	defer handshakeTimer.Stop()
+
+	// Complete the TLS handshake up front so its failures are told apart from
+	// yamux errors
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			cause := classifyTLSError(err)
+			s.tlsFailures.Record(conn.RemoteAddr().String(), cause)
+			log.Printf("⚠️  TLS handshake from %s failed (%s): %v", conn.RemoteAddr(), cause, err)
+			return
+		}
+		s.resumption.observe(tlsConn.ConnectionState())
+		if s.dispatchALPN(tlsConn, handshakeTimer) {
+			return
+		}
+	}
+
 	// Create yamux session (server mode)
 	session, err := yamux.Server(conn, nil)
 	if err != nil {
+		s.counters.inc(&s.counters.yamuxSessionFailures)
 		log.Printf("Failed to create yamux session: %v", err)
 		return
 	}
@@ -177,222 +708,658 @@ func (s *RelayServer) handleControlConnection(conn net.Conn) {
 	// Accept control stream
 	stream, err := session.AcceptStream()
 	if err != nil {
+		s.counters.inc(&s.counters.controlAcceptFailures)
 		log.Printf("Failed to accept control stream: %v", err)
 		return
 	}
 	defer stream.Close()
 
 	// Read registration message
-	var buf [4096]byte
-	n, err := stream.Read(buf[:])
-	if err != nil {
-		log.Printf("Failed to read registration: %v", err)
+	msg, err := readControlMessage(stream, s.maxControlMsg)
+	if errors.Is(err, errControlMessageTooLarge) {
+		s.counters.inc(&s.counters.controlMsgOversized)
+		log.Printf("⚠️  Registration from %s rejected: %v", conn.RemoteAddr(), err)
+		s.sendError(stream, "MESSAGE_TOO_LARGE", fmt.Sprintf("Registration exceeds %d bytes", s.maxControlMsg))
 		return
 	}
-
-	msg, err := common.DecodeMessage(buf[:n])
 	if err != nil {
-		log.Printf("Failed to decode message: %v", err)
+		if errors.Is(err, errControlMessageMalformed) {
+			s.counters.inc(&s.counters.controlMsgMalformed)
+		}
+		log.Printf("Failed to read registration from %s: %v", conn.RemoteAddr(), err)
 		return
 	}
 
+	handshakeTimer.Stop()
+
 	if msg.Type != common.MsgTypeRegister {
 		log.Printf("Expected register message, got: %s", msg.Type)
 		return
 	}
 
-	var regPayload common.RegisterPayload
+	var regPayload RegisterRequest
 	if err := common.DecodePayload(msg, &regPayload); err != nil {
 		log.Printf("Failed to decode registration payload: %v", err)
 		return
 	}
 
+	// Pace registration storms, e.g. every agent reconnecting after a restart,
+	// before they reach JWT verification and HIS
+	if s.registrationBucket != nil {
+		if allowed, retryAfter := s.registrationBucket.Allow(); !allowed {
+			s.counters.inc(&s.counters.registrationsRateLimited)
+			retrySeconds := int(retryAfter.Seconds())
+			log.Printf("Tenant %s registration deferred by the registration bucket, retry after %ds", regPayload.TenantID, retrySeconds)
+			s.sendRetryableError(stream, "RELAY_BUSY",
+				fmt.Sprintf("Too many agents registering, retry after %d seconds", retrySeconds), retrySeconds, "")
+			return
+		}
+	}
+
 	// Verify JWT token
-	claims, err := VerifyJWT(regPayload.JWT, s.jwtSecret, s.jwtIssuer, s.jwtAudience)
+	claims, err := s.jwtCache.Verify(regPayload.JWT, s.jwtIssuers)
 	if err != nil {
-		log.Printf("JWT verification failed for tenant %s: %v", regPayload.TenantID, err)
+		log.Printf("JWT verification failed for tenant %s from %s: %v", regPayload.TenantID, conn.RemoteAddr(), err)
+		s.siem.Record(siemAgentAuthFailed, regPayload.TenantID, conn.RemoteAddr().String(), err.Error())
+		// Answer repeat offenders slowly so tokens can't be brute-forced
+		delay, drop := s.jwtFailures.Failure(conn.RemoteAddr().String())
+		if drop {
+			return
+		}
+		defer s.jwtFailures.Done(delay)
+		clock.Sleep(delay)
 		s.sendError(stream, "INVALID_JWT", fmt.Sprintf("JWT verification failed: %v", err))
 		return
 	}
+	s.jwtFailures.Success(conn.RemoteAddr().String())
+	s.jwtSecrets.Record(claims)
+	if claims.verifiedWith != secretLabel(0) {
+		log.Printf("Tenant %s registered with a token signed by %s secret of %s", regPayload.TenantID, claims.verifiedWith, claims.Iss)
+	}
+	if claims.Scope == statusTokenScope {
+		log.Printf("Status token used to register tenant %s", regPayload.TenantID)
+		s.sendError(stream, "INVALID_JWT", "Status tokens cannot register agents")
+		return
+	}
 
 	// Verify tenant ID matches JWT claims
 	if claims.Sub != regPayload.TenantID {
 		log.Printf("Tenant ID mismatch: expected %s, got %s", claims.Sub, regPayload.TenantID)
+		s.siem.Record(siemAgentAuthFailed, regPayload.TenantID, conn.RemoteAddr().String(),
+			fmt.Sprintf("token issued for tenant %s", claims.Sub))
 		s.sendError(stream, "TENANT_ID_MISMATCH", "Tenant ID does not match JWT claims")
 		return
 	}
 
-	log.Printf("✅ Agent authenticated: tenantId=%s, organization=%s, version=%s",
-		regPayload.TenantID, claims.OrganizationID, regPayload.Version)
+	// Offboarded tenants stay out even with a token that is still valid
+	if block, blocked := s.blocklist.Get(regPayload.TenantID); blocked {
+		s.counters.inc(&s.counters.registrationsBlocked)
+		log.Printf("⛔ Tenant %s registration refused, blocked by %s since %s", regPayload.TenantID, block.BlockedBy, block.BlockedAt.Format(time.RFC3339))
+		s.siem.Record(siemRegistrationBlocked, regPayload.TenantID, conn.RemoteAddr().String(),
+			fmt.Sprintf("blocked by %s: %s", block.BlockedBy, block.Reason))
+		s.sendError(stream, "TENANT_BLOCKED", "Tenant is blocked from registering")
+		return
+	}
+
+	// Refuse agents that keep re-registering, churning ports and HIS calls
+	if allowed, retryAfter := s.registrations.Allow(regPayload.TenantID); !allowed {
+		log.Printf("Tenant %s registration throttled, retry after %v", regPayload.TenantID, retryAfter.Round(time.Second))
+		retrySeconds := int(retryAfter.Seconds()) + 1
+		s.sendRetryableError(stream, "REGISTRATION_THROTTLED",
+			fmt.Sprintf("Too many registrations, retry after %d seconds", retrySeconds), retrySeconds, "")
+		return
+	}
+
+	// Refuse new tenants while the relay is near capacity; tenants that are
+	// re-registering already hold their share
+	s.mu.RLock()
+	_, known := s.tenants[regPayload.TenantID]
+	s.mu.RUnlock()
+	if !known {
+		if reason := s.admissionBlocked(); reason != "" {
+			s.counters.inc(&s.counters.registrationsBusy)
+			log.Printf("Tenant %s registration refused, relay busy: %s", regPayload.TenantID, reason)
+			message := "Relay busy"
+			if s.admission.AlternateEndpoint != "" {
+				message = fmt.Sprintf("Relay busy, try %s", s.admission.AlternateEndpoint)
+			}
+			s.sendRetryableError(stream, "RELAY_BUSY", message, s.admission.RetryAfterSeconds, s.admission.AlternateEndpoint)
+			return
+		}
+	}
+
+	log.Printf("✅ Agent authenticated: tenantId=%s, organization=%s, issuer=%s, version=%s, region=%s",
+		regPayload.TenantID, claims.OrganizationID, claims.Iss, regPayload.Version, regPayload.Region)
+
+	// Token-bound capabilities restrict which services the tenant may expose
+	if len(claims.AllowedServices) > 0 && !containsString(claims.AllowedServices, serviceSQL) {
+		log.Printf("Tenant %s is not allowed the %s service (allowed: %v)", regPayload.TenantID, serviceSQL, claims.AllowedServices)
+		s.sendError(stream, "SERVICE_NOT_ALLOWED", fmt.Sprintf("Token does not allow the %s service", serviceSQL))
+		return
+	}
+
+	// Tokens carrying a jti are single use when replay protection is on. The
+	// token is only spent once every other check passed, so an agent told to
+	// retry later can reuse it.
+	if s.rejectReplayedJTI && claims.Jti != "" {
+		expiresAt := clock.BaseNow().Add(nonceDefaultLifetime)
+		if claims.Exp > 0 {
+			expiresAt = time.Unix(claims.Exp, 0)
+		}
+		fresh, err := s.nonces.Use(nonceNamespaceJTI, claims.Jti, expiresAt)
+		if err != nil {
+			log.Printf("⚠️  Failed to persist token ID for tenant %s: %v", regPayload.TenantID, err)
+		}
+		if !fresh {
+			log.Printf("Replayed registration token %s for tenant %s", claims.Jti, regPayload.TenantID)
+			s.sendError(stream, "TOKEN_REPLAYED", "Registration token has already been used")
+			return
+		}
+	}
 
 	// Allocate port and create tenant
-	tenant := s.registerTenant(regPayload.TenantID, session)
+	tenant := s.registerTenant(regPayload.TenantID, session, claims)
 	if tenant == nil {
 		log.Printf("Failed to register tenant: %s", regPayload.TenantID)
 		s.sendError(stream, "REGISTRATION_FAILED", "Failed to allocate port")
 		return
 	}
+	tenant.mu.Lock()
+	tenant.Region = regPayload.Region
+	tenant.Services = s.advertisedServices(regPayload.Services, claims.AllowedServices)
+	tenant.control = stream
+	tenant.mu.Unlock()
 
 	// Send registration response
-	response := common.RegisteredPayload{
-		TenantID:     tenant.ID,
-		AssignedPort: tenant.AssignedPort,
-		SQLUser:      tenant.SQLUser,
-		SQLPassword:  tenant.SQLPassword,
-		PublicHost:   "link.tatbeeb.sa", // From config
-		ConnectionString: fmt.Sprintf(
-			"Server=link.tatbeeb.sa,%d;Encrypt=True;TrustServerCertificate=False;User Id=%s;Password=%s;",
-			tenant.AssignedPort,
-			tenant.SQLUser,
-			tenant.SQLPassword,
-		),
+	endpoints := s.serviceEndpoints(tenant)
+	connStrings := s.connectionStringsFor(tenant, endpoints[serviceSQL].Host, endpoints[serviceSQL].Port)
+	relayInfo := s.versionInfo()
+	response := RegisteredResponse{
+		RegisteredPayload: common.RegisteredPayload{
+			TenantID:         tenant.ID,
+			AssignedPort:     tenant.AssignedPort,
+			SQLUser:          tenant.SQLUser,
+			SQLPassword:      tenant.SQLPassword,
+			PublicHost:       endpoints[serviceSQL].Host,
+			ConnectionString: connStrings[connectionStringADONet],
+		},
+		ConnectionStrings: connStrings,
+		ServiceEndpoints:  endpoints,
+		Region:            s.region,
+		FallbackEndpoints: s.fallbackEndpoints(),
+		Cohort:            tenant.Cohort,
+		Relay:             &relayInfo,
+		InternalEndpoint:  s.internalEndpoint(tenant),
+		CertificatePins:   s.certPins,
+	}
+	if tenant.canary != nil {
+		response.Features = tenant.canary.AgentFeatures
 	}
 
 	respData, _ := common.EncodeMessage(common.MsgTypeRegistered, response)
 	if _, err := stream.Write(respData); err != nil {
 		log.Printf("Failed to send registration response: %v", err)
-		s.unregisterTenant(tenant.ID)
+		s.unregisterTenant(tenant, closeReasonRegistrationFailed, err.Error())
 		return
 	}
 
 	log.Printf("Tenant %s assigned port %d", tenant.ID, tenant.AssignedPort)
+	if s.sni.Enabled {
+		log.Printf("Tenant %s reachable at %s:%d", tenant.ID, s.sniHostname(tenant.ID), s.sni.Port)
+	}
 
 	// Notify HIS backend about assigned port
 	go func() {
-		if err := s.hisClient.RegisterPort(tenant.ID, tenant.AssignedPort); err != nil {
-			log.Printf("⚠️  Failed to register port with HIS for tenant %s: %v", tenant.ID, err)
-		} else {
-			log.Printf("✅ Port registered with HIS for tenant %s", tenant.ID)
+		req := s.registerPortRequest(tenant)
+		// A stale departure must not be replayed after this registration
+		s.hisSpool.Discard(spoolKindUnregisterPort, tenant.ID)
+
+		resp, err := s.hisClient.RegisterPort(req)
+		if err != nil {
+			log.Printf("⚠️  Failed to register port with HIS for tenant %s, spooling for retry: %v", tenant.ID, err)
+			s.hisSpool.Enqueue(spoolKindRegisterPort, tenant.ID, req, err)
+			return
+		}
+
+		log.Printf("✅ Port registered with HIS for tenant %s", tenant.ID)
+		tenant.markHISAcked()
+		s.hisSpool.Discard(spoolKindRegisterPort, tenant.ID)
+		s.applyRegisterPortResponse(tenant, resp)
+
+		// HIS policy may prefer another relay for this agent
+		if resp.Steer != nil && resp.Steer.Endpoint != "" {
+			s.steerAgent(tenant, resp.Steer)
 		}
 	}()
 
+	if tenant.MaxBandwidthKbps > 0 {
+		s.sendThrottleHint(tenant, "tenant bandwidth cap")
+	}
+
 	// Start accepting SQL connections for this tenant
-	go s.acceptTenantConnections(tenant)
+	tenant.mu.Lock()
+	heldConns := tenant.heldConns
+	tenant.heldConns = nil
+	tenant.mu.Unlock()
+	go s.serveTenantPort(tenant, tenant.Listener, heldConns)
 
 	// Start heartbeat to HIS
 	go s.sendHeartbeats(tenant)
 
+	// Agents answer some control messages, e.g. credential rotations
+	go s.readAgentControl(tenant, stream)
+
 	// Keep control stream alive with heartbeat
-	s.keepAlive(stream, tenant)
+	s.keepAlive(tenant)
 }
 
-func (s *RelayServer) registerTenant(tenantID string, session *yamux.Session) *Tenant {
+func (s *RelayServer) registerTenant(tenantID string, session *yamux.Session, claims *JWTClaims) *Tenant {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	// Checked again under s.mu so a tenant blocked during its registration is
+	// either refused here or found and evicted by blockTenant
+	if _, blocked := s.blocklist.Get(tenantID); blocked {
+		log.Printf("⛔ Tenant %s was blocked while registering", tenantID)
+		return nil
+	}
+
+	password, policy, err := s.generatePassword(claims.OrganizationID)
+	if err != nil {
+		log.Printf("⚠️  No SQL password for tenant %s under policy %s: %v", tenantID, policy, err)
+		return nil
+	}
+
 	// Check if already registered
+	// HIS is not told about the departure; the new registration replaces the port
 	if existing, ok := s.tenants[tenantID]; ok {
-		// Close old session
-		if existing.Listener != nil {
-			existing.Listener.Close()
-		}
 		log.Printf("Tenant %s re-registering", tenantID)
+		s.removeTenantLocked(existing, closeReasonReplaced, "")
 	}
 
-	// Allocate port
-	if s.nextPortIndex >= len(s.portPool) {
-		log.Printf("No ports available")
-		return nil
+	// Reserved tenants take over their parked listener; others get the next
+	// pool port, or the one hashed from their ID
+	port, reserved := s.reservedPorts[tenantID]
+	listener, heldConns := s.unparkLocked(tenantID)
+	if !reserved {
+		if journaled, ok := s.takeJournaledPortLocked(tenantID); ok {
+			port = journaled
+		} else if s.portAllocation == portAllocationHash {
+			hashed, ok := s.hashedPortLocked(tenantID)
+			if !ok {
+				log.Printf("No ports available")
+				return nil
+			}
+			port = hashed
+		} else {
+			if s.nextPortIndex >= len(s.portPool) {
+				log.Printf("No ports available")
+				return nil
+			}
+			port = s.portPool[s.nextPortIndex]
+			s.nextPortIndex++
+		}
+		if owner, held := s.portIndex[port]; held {
+			s.portIndexViolationLocked(fmt.Sprintf("port %d picked for tenant %s is held by tenant %s", port, tenantID, owner.TenantID))
+			return nil
+		}
 	}
 
-	port := s.portPool[s.nextPortIndex]
-	s.nextPortIndex++
-
 	// Start listener for this tenant
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		log.Printf("Failed to start listener on port %d: %v", port, err)
-		return nil
+	if listener == nil {
+		var err error
+		listener, err = s.listenTenantPort(port, s.listeners.Tenant)
+		if err != nil {
+			log.Printf("Failed to start listener on port %d: %v", port, err)
+			for _, conn := range heldConns {
+				conn.Close()
+			}
+			return nil
+		}
+	}
+
+	// The assignment must be durable before the agent, and then HIS, hears of it
+	if !reserved {
+		if err := s.journalPortLocked(journalAssign, tenantID, port); err != nil {
+			log.Printf("⚠️  Failed to journal port %d for tenant %s: %v", port, tenantID, err)
+			listener.Close()
+			for _, conn := range heldConns {
+				conn.Close()
+			}
+			return nil
+		}
 	}
 
 	tenant := &Tenant{
-		ID:             tenantID,
-		AssignedPort:   port,
-		SQLUser:        fmt.Sprintf("tatbeeb_%s", tenantID[:6]),
-		SQLPassword:    generatePassword(),
-		ControlSession: session,
-		Listener:       listener,
+		ID:                  tenantID,
+		AssignedPort:        port,
+		SQLUser:             sqlUserFor(tenantID, 0),
+		SQLPassword:         password,
+		credentialPolicy:    policy,
+		ControlSession:      session,
+		Listener:            listener,
+		OrganizationID:      claims.OrganizationID,
+		RegisteredAt:        clock.BaseNow(),
+		LastSeen:            clock.Now(),
+		tokenMaxConns:       claims.MaxConnections,
+		credentialRotatedAt: clock.Now(),
+		heldConns:           heldConns,
+	}
+	if s.holdUntilHISAck {
+		tenant.hisAcked = make(chan struct{})
 	}
 
+	tenant.tokenTier = claims.Tier
+	tenant.Tier, tenant.TierSource = s.resolveTierLocked(tenant)
+
+	// Limits embedded in the registration token override the tier's and the
+	// relay defaults
+	s.applyConnLimitLocked(tenant)
+	maxKbps := s.tiers[tenant.Tier].MaxBandwidthKbps
+	if claims.MaxBandwidthKbps > 0 {
+		maxKbps = claims.MaxBandwidthKbps
+	}
+	if maxKbps > 0 {
+		tenant.MaxBandwidthKbps = maxKbps
+		tenant.upLimiter = NewBandwidthLimiter(maxKbps)
+		tenant.downLimiter = NewBandwidthLimiter(maxKbps)
+	}
+	tenant.AllowedServices = claims.AllowedServices
+	tenant.MaxBytesPerConnection = claims.MaxBytesPerConnection
+	tenant.MaxBytesPerDay = claims.MaxBytesPerDay
+	s.assignCohort(tenant)
+
 	s.tenants[tenantID] = tenant
+	s.indexPortLocked(port, tenantID, false)
+	s.checkPortIndexLocked()
+	s.portHistory.Assigned(tenantID, port)
+	s.setTenantState(tenantID, tenantStateRegistering, "agent registered")
 	return tenant
 }
 
-func (s *RelayServer) unregisterTenant(tenantID string) {
+// unregisterTenant removes the tenant, records why and tells HIS. It does
+// nothing if the tenant was already removed or replaced by a re-registration.
+func (s *RelayServer) unregisterTenant(tenant *Tenant, reason, detail string) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	if s.tenants[tenant.ID] != tenant {
+		s.mu.Unlock()
+		return
+	}
+	departure := s.removeTenantLocked(tenant, reason, detail)
+	s.mu.Unlock()
+
+	go func() {
+		req := UnregisterPortRequest{
+			TenantID: departure.TenantID,
+			Port:     departure.Port,
+			Reason:   departure.Reason,
+			Detail:   departure.Detail,
+			ClosedAt: departure.ClosedAt,
+		}
+		s.hisSpool.Discard(spoolKindRegisterPort, tenant.ID)
+		if err := s.hisClient.UnregisterPort(req); err != nil {
+			log.Printf("⚠️  Failed to unregister port with HIS for tenant %s, spooling for retry: %v", tenant.ID, err)
+			s.hisSpool.Enqueue(spoolKindUnregisterPort, tenant.ID, req, err)
+		}
+	}()
+}
 
-	if tenant, ok := s.tenants[tenantID]; ok {
-		if tenant.Listener != nil {
-			tenant.Listener.Close()
+// removeTenantLocked closes the tenant's listener and records its departure;
+// callers hold s.mu
+func (s *RelayServer) removeTenantLocked(tenant *Tenant, reason, detail string) DepartedTenant {
+	if tenant.Listener != nil {
+		tenant.Listener.Close()
+	}
+	if tenant.retiredListener != nil {
+		tenant.retiredListener.Close()
+		tenant.retiredListener = nil
+		s.unindexPortLocked(tenant.PreviousPort, tenant.ID)
+		s.portHistory.Released(tenant.ID, tenant.PreviousPort)
+	}
+	delete(s.tenants, tenant.ID)
+	s.unindexPortLocked(tenant.AssignedPort, tenant.ID)
+	s.checkPortIndexLocked()
+	s.portHistory.Released(tenant.ID, tenant.AssignedPort)
+
+	if _, reserved := s.reservedPorts[tenant.ID]; !reserved {
+		if err := s.journalPortLocked(journalRelease, tenant.ID, tenant.AssignedPort); err != nil {
+			log.Printf("⚠️  Failed to journal release of port %d for tenant %s: %v", tenant.AssignedPort, tenant.ID, err)
 		}
-		delete(s.tenants, tenantID)
-		log.Printf("Tenant %s unregistered", tenantID)
 	}
+
+	// Keep a reserved port bound until the agent comes back
+	if err := s.parkLocked(tenant.ID); err != nil {
+		log.Printf("⚠️  Could not park reserved port for tenant %s: %v", tenant.ID, err)
+	}
+
+	if s.parked[tenant.ID] != nil {
+		s.setTenantState(tenant.ID, tenantStateGracePeriod, reason)
+	} else {
+		s.setTenantState(tenant.ID, tenantStateEvicted, reason)
+	}
+
+	departure := DepartedTenant{
+		TenantID:     tenant.ID,
+		Port:         tenant.AssignedPort,
+		Reason:       reason,
+		Detail:       detail,
+		Cohort:       tenant.Cohort,
+		RegisteredAt: tenant.RegisteredAt,
+		ClosedAt:     clock.BaseNow(),
+	}
+	s.departures.Record(departure)
+	log.Printf("Tenant %s unregistered: %s", tenant.ID, reason)
+	return departure
 }
 
-func (s *RelayServer) acceptTenantConnections(tenant *Tenant) {
-	defer s.unregisterTenant(tenant.ID)
+// acceptTenantConnections serves one of the tenant's listeners; a listener
+// retired by a port remap stops without unregistering the tenant
+func (s *RelayServer) acceptTenantConnections(tenant *Tenant, listener net.Listener) {
+	defer s.watchdog.track(goroutineAcceptLoop)()
 
+	var backoff time.Duration
 	for {
-		conn, err := tenant.Listener.Accept()
+		s.shedBeforeAccept(tenant)
+		conn, err := listener.Accept()
 		if err != nil {
+			// A transient error such as EMFILE must not tear down the tenant
+			if isTemporaryAcceptError(err) {
+				backoff = acceptBackoff(backoff)
+				log.Printf("Tenant %s accept error: %v; retrying in %v", tenant.ID, err, backoff)
+				clock.Sleep(backoff)
+				continue
+			}
+			s.mu.RLock()
+			current := tenant.Listener == listener
+			s.mu.RUnlock()
+			if !current {
+				return
+			}
 			log.Printf("Tenant %s listener error: %v", tenant.ID, err)
+			s.unregisterTenant(tenant, closeReasonListenerError, err.Error())
 			return
 		}
+		backoff = 0
+
+		// Known-malicious sources never reach the agent
+		if s.refusedByReputation(conn) {
+			continue
+		}
+
+		// Under load, low-priority tenants are turned away first
+		if s.shedAccepted(tenant, conn) {
+			continue
+		}
 
 		// Check connection limit
-		tenant.mu.Lock()
-		if tenant.ActiveConns >= s.config.MaxConnectionsPerTenant {
-			tenant.mu.Unlock()
-			log.Printf("Tenant %s connection limit reached", tenant.ID)
+		if !tenant.acquireConn() {
+			log.Printf("Tenant %s connection limit reached (%d)", tenant.ID, tenant.MaxConns)
 			conn.Close()
 			continue
 		}
-		tenant.ActiveConns++
-		tenant.mu.Unlock()
 
 		go s.handleTenantConnection(tenant, conn)
 	}
 }
 
-func (s *RelayServer) handleTenantConnection(tenant *Tenant, clientConn net.Conn) {
-	defer clientConn.Close()
+// openAgentStream opens a stream to the tenant's agent, giving up after the
+// configured deadline so a wedged agent can't leave SQL clients hanging. The
+// tenant is marked degraded after repeated consecutive failures.
+func (s *RelayServer) openAgentStream(tenant *Tenant) (*yamux.Stream, error) {
+	type result struct {
+		stream *yamux.Stream
+		err    error
+	}
+	started := clock.Now()
+	resultCh := make(chan result, 1)
+	go func() {
+		stream, err := tenant.ControlSession.OpenStream()
+		resultCh <- result{stream, err}
+	}()
+
+	var stream *yamux.Stream
+	var err error
+	timeout := s.streamOpenTimeout
+	if tenant.streamOpenTimeout > 0 {
+		timeout = tenant.streamOpenTimeout
+	}
+	timer := clock.NewTimer(timeout)
+	select {
+	case res := <-resultCh:
+		timer.Stop()
+		stream, err = res.stream, res.err
+	case <-timer.C:
+		err = fmt.Errorf("stream open timed out after %v", timeout)
+		// Release the stream if the agent answers after we gave up
+		go func() {
+			if res := <-resultCh; res.stream != nil {
+				res.stream.Close()
+			}
+		}()
+	}
+
+	// The state settles once tenant.mu is released
+	var stateReason string
 	defer func() {
-		tenant.mu.Lock()
-		tenant.ActiveConns--
-		tenant.mu.Unlock()
+		if stateReason != "" {
+			s.settleTenantState(tenant.ID, stateReason)
+		}
 	}()
 
-	// Open new stream to agent
-	stream, err := tenant.ControlSession.OpenStream()
+	tenant.mu.Lock()
+	defer tenant.mu.Unlock()
+
 	if err != nil {
-		log.Printf("Failed to open stream to agent: %v", err)
+		tenant.StreamOpenFailures++
+		tenant.ConsecutiveOpenFailures++
+		tenant.LastStreamError = err.Error()
+		tenant.LastStreamErrorAt = clock.Now()
+		if !tenant.Degraded && tenant.ConsecutiveOpenFailures >= s.degradedAfterFailures {
+			tenant.Degraded = true
+			log.Printf("⚠️  Tenant %s degraded after %d consecutive stream open failures",
+				tenant.ID, tenant.ConsecutiveOpenFailures)
+			stateReason = "stream open failures"
+		}
+		return nil, err
+	}
+
+	tenant.StreamsOpened++
+	tenant.ConsecutiveOpenFailures = 0
+	tenant.recordOpenLatencyLocked(clock.Since(started))
+	tenant.LastSeen = clock.Now()
+	if tenant.Degraded {
+		tenant.Degraded = false
+		log.Printf("✅ Tenant %s recovered, stream opened", tenant.ID)
+		stateReason = "stream opened"
+	}
+	return stream, nil
+}
+
+// rejectClient tells a SQL client why its connection is being closed, when
+// TDS-friendly errors are enabled for the tenant
+func (s *RelayServer) rejectClient(clientConn net.Conn, tenantID, message string) {
+	if !s.features.Enabled(featureTDSFriendlyErrors, tenantID) {
 		return
 	}
-	defer stream.Close()
+	clientConn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	clientConn.Write(tdsErrorPacket(message))
+}
 
-	log.Printf("Forwarding connection for tenant %s", tenant.ID)
+// writeControl sends a message on the tenant's control stream. Writes from the
+// keepalive loop, HIS callbacks and the admin API are serialized.
+func (t *Tenant) writeControl(data []byte) error {
+	t.controlMu.Lock()
+	defer t.controlMu.Unlock()
 
-	// Bidirectional copy
-	done := make(chan error, 2)
+	t.control.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := t.control.Write(data)
+	return err
+}
 
-	go func() {
-		_, err := io.Copy(stream, clientConn)
-		done <- err
-	}()
+// acquireConn reserves a connection slot, returning false at the tenant's limit
+func (t *Tenant) acquireConn() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	go func() {
-		_, err := io.Copy(clientConn, stream)
-		done <- err
+	if t.ActiveConns >= t.MaxConns {
+		t.recordLimitRejectionLocked()
+		return false
+	}
+	t.ActiveConns++
+	return true
+}
+
+// handleTenantConnection forwards a client connection whose slot was reserved
+// with acquireConn
+func (s *RelayServer) handleTenantConnection(tenant *Tenant, clientConn net.Conn) {
+	defer s.watchdog.track(goroutineConnHandler)()
+	defer clientConn.Close()
+	defer func() {
+		tenant.mu.Lock()
+		tenant.ActiveConns--
+		tenant.mu.Unlock()
 	}()
 
-	// Wait for either direction to complete
-	<-done
+	// Open connections of a tenant that lost its control session may
+	// finish, but no new ones start
+	if tenant.controlLost() {
+		log.Printf("Tenant %s refused connection from %s: %v", tenant.ID, clientConn.RemoteAddr(), errControlLost)
+		s.rejectClient(clientConn, tenant.ID, "The clinic's Tatbeeb Link agent is reconnecting")
+		return
+	}
+
+	// Clinics may accept only so many HIS nodes
+	if s.refusedBySourceIPCap(tenant, clientConn) {
+		return
+	}
+	defer s.sourceIPs.Release(tenant.ID, sourceIPOf(clientConn))
+
+	tier := tenant.tier()
+	forwarder := &Forwarder{
+		Opener:      &agentOpener{s: s, tenant: tenant, tier: tier},
+		Policy:      &tenantForward{s: s, tenant: tenant, tier: tier},
+		IdleTimeout: s.idleTimeout,
+		Tick:        clockTick,
+		Start: func(dst io.Writer, src io.Reader, deadlines readDeadliner, done chan<- error) {
+			s.startCopy(tier, dst, src, deadlines, done)
+		},
+	}
+	err := forwarder.Forward(clientConn, &ForwardStats{Now: clock.BaseNow})
+	switch {
+	case errors.Is(err, errOpenStream):
+		log.Printf("Failed to open stream to agent for tenant %s (%d streams open): %v",
+			tenant.ID, tenant.ControlSession.NumStreams(), err)
+		s.rejectClient(clientConn, tenant.ID, "The clinic's Tatbeeb Link agent is not responding")
+	case errors.Is(err, errIdleTimeout):
+		s.counters.inc(&s.counters.idleCloses)
+		log.Printf("Tenant %s connection from %s closed after %v idle", tenant.ID, clientConn.RemoteAddr(), s.idleTimeout)
+	}
 }
 
 func (s *RelayServer) sendHeartbeats(tenant *Tenant) {
-	ticker := time.NewTicker(60 * time.Second)
+	defer s.watchdog.track(goroutineHeartbeatLoop)()
+
+	ticker := clock.NewTicker(60 * time.Second)
 	defer ticker.Stop()
 
 	for {
@@ -400,39 +1367,109 @@ func (s *RelayServer) sendHeartbeats(tenant *Tenant) {
 
 		// Check if tenant still exists
 		s.mu.RLock()
-		_, exists := s.tenants[tenant.ID]
+		current, exists := s.tenants[tenant.ID]
 		s.mu.RUnlock()
 
-		if !exists {
+		if current != tenant {
 			log.Printf("Tenant %s no longer exists, stopping heartbeat", tenant.ID)
+			// A re-registration sends its own heartbeats; otherwise tell HIS the agent is gone
+			if !exists {
+				req := HeartbeatRequest{
+					TenantID: tenant.ID,
+					Cause:    heartbeatCauseAgentSessionDown,
+					Detail:   "agent unregistered",
+					State:    s.tenantStates.State(tenant.ID),
+				}
+				if err := s.hisClient.SendHeartbeat(req); err != nil {
+					log.Printf("⚠️  Failed to send final heartbeat to HIS for tenant %s: %v", tenant.ID, err)
+				}
+			}
 			return
 		}
 
-		// Send heartbeat to HIS
-		if err := s.hisClient.SendHeartbeat(tenant.ID); err != nil {
+		// Send heartbeat to HIS with the side at fault, if any
+		req := s.heartbeatStatus(tenant)
+		if req.Cause != heartbeatCauseHealthy {
+			log.Printf("⚠️  Tenant %s heartbeat cause %s: %s", tenant.ID, req.Cause, req.Detail)
+		}
+		if err := s.hisClient.SendHeartbeat(req); err != nil {
 			log.Printf("⚠️  Failed to send heartbeat to HIS for tenant %s: %v", tenant.ID, err)
 		}
 	}
 }
 
-func (s *RelayServer) keepAlive(stream net.Conn, tenant *Tenant) {
-	ticker := time.NewTicker(30 * time.Second)
+func (s *RelayServer) keepAlive(tenant *Tenant) {
+	defer s.watchdog.track(goroutineKeepaliveLoop)()
+
+	interval := defaultKeepaliveInterval
+	if tenant.keepaliveInterval > 0 {
+		interval = tenant.keepaliveInterval
+	}
+	ticker := clock.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
-		<-ticker.C
+		select {
+		case <-tenant.ControlSession.CloseChan():
+			log.Printf("Tenant %s agent disconnected", tenant.ID)
+			s.unregisterTenant(tenant, closeReasonAgentDisconnected, "")
+			return
+		case <-ticker.C:
+		}
 
 		// Send ping
 		pingData, _ := common.EncodeMessage(common.MsgTypePing, nil)
-		stream.SetWriteDeadline(time.Now().Add(5 * time.Second))
-		if _, err := stream.Write(pingData); err != nil {
+		if err := tenant.writeControl(pingData); err != nil {
 			log.Printf("Tenant %s ping failed: %v", tenant.ID, err)
-			s.unregisterTenant(tenant.ID)
+			if tenant.ControlSession.IsClosed() {
+				s.unregisterTenant(tenant, closeReasonAgentDisconnected, err.Error())
+				return
+			}
+			// Streams of the session may still be carrying SQL sessions
+			if s.deregistration.grace() > 0 {
+				s.drainAfterControlLoss(tenant, closeReasonKeepaliveTimeout, err.Error())
+				return
+			}
+			s.unregisterTenant(tenant, closeReasonKeepaliveTimeout, err.Error())
 			return
 		}
+
+		tenant.mu.Lock()
+		tenant.LastSeen = clock.Now()
+		tenant.mu.Unlock()
 	}
 }
 
+// steerAgent asks the agent to reconnect to another relay. The agent decides
+// when to move; the current tunnel keeps working until it does.
+func (s *RelayServer) steerAgent(tenant *Tenant, steer *SteerDirective) {
+	data, err := common.EncodeMessage(msgTypeSteer, steer)
+	if err != nil {
+		log.Printf("Failed to encode steer message for tenant %s: %v", tenant.ID, err)
+		return
+	}
+
+	if err := tenant.writeControl(data); err != nil {
+		log.Printf("Failed to steer tenant %s: %v", tenant.ID, err)
+		return
+	}
+
+	s.events.Emit("agent_steered", tenant.ID,
+		fmt.Sprintf("steered to %s (region %s): %s", steer.Endpoint, steer.Region, steer.Reason))
+}
+
+// fallbackEndpoints returns the relays agents should fail over to, preferring
+// the list last supplied by HIS over the configured one
+func (s *RelayServer) fallbackEndpoints() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.hisFallbacks) > 0 {
+		return s.hisFallbacks
+	}
+	return s.fallbacks
+}
+
 func (s *RelayServer) sendError(stream net.Conn, code, message string) {
 	errPayload := common.ErrorPayload{
 		Code:    code,
@@ -442,48 +1479,112 @@ func (s *RelayServer) sendError(stream net.Conn, code, message string) {
 	stream.Write(errData)
 }
 
-func generatePassword() string {
-	// TODO: Implement secure password generation
-	return fmt.Sprintf("pwd_%d", time.Now().Unix())
+// sendRetryableError reports an error the agent should retry after the given
+// delay, optionally at another endpoint
+func (s *RelayServer) sendRetryableError(stream net.Conn, code, message string, retryAfterSeconds int, alternateEndpoint string) {
+	errPayload := ErrorResponse{
+		ErrorPayload: common.ErrorPayload{
+			Code:    code,
+			Message: message,
+		},
+		Retryable:         true,
+		RetryAfterSeconds: retryAfterSeconds,
+		AlternateEndpoint: alternateEndpoint,
+	}
+	errData, _ := common.EncodeMessage(common.MsgTypeError, errPayload)
+	stream.Write(errData)
+}
+
+func containsString(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
 }
 
 func main() {
 	configFile := flag.String("config", "config.production.json", "Path to config file")
+	selfTest := flag.Bool("selftest", false, "Run an end-to-end round trip with an embedded agent and stub HIS, then exit non-zero on failure")
 	flag.Parse()
 
-	log.Printf("🟦 Tatbeeb Link Relay Server v1.0.0")
+	build := relayBuild()
+	log.Printf("🟦 Tatbeeb Link Relay Server v%s", build.Version)
+	log.Printf("   Commit: %s", build.GitCommit)
+	log.Printf("   Built: %s", build.BuildDate)
+	log.Printf("   Go: %s (%s/%s)", build.GoVersion, runtime.GOOS, runtime.GOARCH)
 	log.Printf("Loading configuration from: %s", *configFile)
 
-	// Load JSON configuration
-	configData, err := ioutil.ReadFile(*configFile)
+	// Load, default and validate the JSON configuration
+	fullConfig, err := LoadConfig(*configFile)
 	if err != nil {
-		log.Fatalf("Failed to read config file: %v", err)
+		log.Fatalf("Invalid configuration in %s: %v", *configFile, err)
 	}
 
-	var fullConfig struct {
-		Server struct {
-			ControlPort             int `json:"controlPort"`
-			TenantPortStart         int `json:"tenantPortStart"`
-			TenantPortEnd           int `json:"tenantPortEnd"`
-			MaxConnectionsPerTenant int `json:"maxConnectionsPerTenant"`
-		} `json:"server"`
-		TLS struct {
-			CertFile string `json:"certFile"`
-			KeyFile  string `json:"keyFile"`
-		} `json:"tls"`
-		JWT struct {
-			Secret string `json:"secret"`
-		} `json:"jwt"`
-		HIS struct {
-			BackendURL        string `json:"backendUrl"`
-			RelaySharedSecret string `json:"relaySharedSecret"`
-		} `json:"his"`
+	instances := fullConfig.Instances()
+	if *selfTest {
+		for _, instance := range instances {
+			if err := runSelfTest(instance.Config); err != nil {
+				log.Fatalf("❌ Self-test failed%s: %v", instance.logSuffix(), err)
+			}
+		}
+		log.Printf("✅ Self-test passed")
+		return
 	}
 
-	if err := json.Unmarshal(configData, &fullConfig); err != nil {
-		log.Fatalf("Failed to parse config file: %v", err)
+	// Make sure the process can hold every tenant of every instance at its
+	// connection limit
+	var fdRequired uint64
+	for _, instance := range instances {
+		srv := instance.Config.Server
+		fdRequired += requiredFileDescriptors(srv.TenantPortEnd-srv.TenantPortStart+1, srv.MaxConnectionsPerTenant)
+	}
+	fdLimit, err := raiseFDLimit()
+	if err != nil {
+		log.Printf("⚠️  Could not raise file descriptor limit: %v", err)
+	}
+	if fdLimit > 0 && fdLimit < fdRequired {
+		log.Printf("⚠️  File descriptor limit %d is below the %d needed for full port pools at their connection limits; raise LimitNOFILE",
+			fdLimit, fdRequired)
+	}
+	log.Printf("   File descriptors: limit %d, required %d", fdLimit, fdRequired)
+
+	// Warn before running out of file descriptors
+	go monitorFileDescriptors(30 * time.Second)
+
+	// Virtual instances run side by side with their own listeners and state;
+	// the first one to fail stops the process
+	failed := make(chan error, len(instances))
+	servers := make([]*RelayServer, 0, len(instances))
+	for _, instance := range instances {
+		server := newConfiguredRelayServer(instance)
+		servers = append(servers, server)
+		go func(server *RelayServer, instance VirtualInstance) {
+			err := server.Start()
+			failed <- fmt.Errorf("relay server%s: %w", instance.logSuffix(), err)
+		}(server, instance)
 	}
 
+	// A graceful shutdown tells HIS the instances are going offline
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-failed:
+		log.Fatalf("Failed to start %v", err)
+	case sig := <-stop:
+		log.Printf("🔄 Received %v, shutting down", sig)
+		for _, server := range servers {
+			server.deregisterInstance()
+		}
+	}
+}
+
+// newConfiguredRelayServer creates a relay from a virtual instance's config,
+// exiting on settings that only fail once used
+func newConfiguredRelayServer(instance VirtualInstance) *RelayServer {
+	fullConfig := instance.Config
+
 	// Create relay config
 	config := &common.RelayConfig{
 		ControlPort:             fullConfig.Server.ControlPort,
@@ -493,35 +1594,248 @@ func main() {
 		TLSCertFile:             fullConfig.TLS.CertFile,
 		TLSKeyFile:              fullConfig.TLS.KeyFile,
 	}
+	jwtIssuers := fullConfig.JWT.Issuers
 
-	// Validate configuration
-	if config.TLSCertFile == "" {
-		log.Fatal("TLS certificate file required (set tls.certFile in config)")
-	}
-	if config.TLSKeyFile == "" {
-		log.Fatal("TLS key file required (set tls.keyFile in config)")
-	}
-	if fullConfig.JWT.Secret == "" {
-		log.Fatal("JWT secret required (set jwt.secret in config)")
-	}
-	if fullConfig.HIS.RelaySharedSecret == "" {
-		log.Fatal("Relay shared secret required (set his.relaySharedSecret in config)")
+	hisClient, err := NewMultiHISClient(fullConfig.HIS.Targets, fullConfig.HIS.Network, relayInstanceID(fullConfig.Cluster))
+	if err != nil {
+		log.Fatalf("Invalid HIS configuration: %v", err)
 	}
 
-	log.Printf("✅ Configuration loaded successfully")
-	log.Printf("   HIS Backend: %s", fullConfig.HIS.BackendURL)
+	log.Printf("✅ Configuration loaded successfully%s", instance.logSuffix())
+	for _, target := range hisClient.targets {
+		role := "secondary"
+		if target.primary {
+			role = "primary"
+		}
+		log.Printf("   HIS Backend: %s (%s, %s)", target.client.baseURL, target.name, role)
+	}
+	log.Printf("   Region: %s", fullConfig.Server.Region)
 	log.Printf("   Control Port: %d", config.ControlPort)
 	log.Printf("   Tenant Ports: %d-%d", config.TenantPortStart, config.TenantPortEnd)
+	for _, issuer := range jwtIssuers {
+		log.Printf("   JWT Issuer: %s (audiences: %v, previous secrets: %d)", issuer.Issuer, issuer.Audiences, len(issuer.PreviousSecrets))
+	}
 
-	// Create and start server
+	// Create the server
 	server := NewRelayServer(
 		config,
-		fullConfig.HIS.BackendURL,
-		fullConfig.HIS.RelaySharedSecret,
-		fullConfig.JWT.Secret,
+		hisClient,
+		jwtIssuers,
 	)
 
-	if err := server.Start(); err != nil {
-		log.Fatalf("Failed to start relay server: %v", err)
+	// Failed HIS notifications are spooled to disk so they survive restarts
+	spoolDir := fullConfig.HIS.SpoolDir
+	spool, err := NewHISSpool(spoolDir, hisClient)
+	if err != nil {
+		log.Printf("⚠️  HIS spool unavailable at %s, failed notifications will not survive restarts: %v", spoolDir, err)
+		spool, _ = NewHISSpool("", hisClient)
+	}
+	spool.onDelivered = server.spooledDelivered
+	hisClient.onRecovered = server.reconcileHIS
+	server.hisSpool = spool
+
+	// Used token IDs survive restarts so a restart doesn't reopen a replay window
+	nonceDir := fullConfig.JWT.NonceDir
+	nonces, err := NewNonceStore(nonceDir)
+	if err != nil {
+		if fullConfig.JWT.RejectReplayedTokens {
+			log.Fatalf("Nonce store unavailable at %s: %v", nonceDir, err)
+		}
+		log.Printf("⚠️  Nonce store unavailable at %s: %v", nonceDir, err)
+		nonces, _ = NewNonceStore("")
+	}
+	server.nonces = nonces
+	server.rejectReplayedJTI = fullConfig.JWT.RejectReplayedTokens
+
+	recorder, err := NewRecorder(fullConfig.Recording)
+	if err != nil {
+		log.Printf("⚠️  Forensic recording unavailable: %v", err)
+	}
+	server.recorder = recorder
+	if fullConfig.TimeSeries.File != "" {
+		timeSeries, err := OpenTimeSeries(fullConfig.TimeSeries.File)
+		if err != nil {
+			log.Printf("⚠️  Metrics history kept in memory only: %v", err)
+		} else {
+			server.timeSeries = timeSeries
+		}
+	}
+	server.tlsMaterial = fullConfig.TLS
+	server.jwtCache = NewJWTCache(fullConfig.JWT.VerifyCacheSize)
+	server.adminAuth = newAdminAuth(fullConfig.Admin)
+	for _, target := range fullConfig.HIS.Targets {
+		server.hisSecrets = append(server.hisSecrets, target.RelaySharedSecret)
+	}
+	if fullConfig.HIS.WebhookToleranceSec > 0 {
+		server.webhookTolerance = time.Duration(fullConfig.HIS.WebhookToleranceSec) * time.Second
+	}
+	audit, err := NewAuditLog(fullConfig.Admin.AuditLog)
+	if err != nil {
+		log.Fatalf("Admin audit log: %v", err)
+	}
+	server.audit = audit
+	server.listenerCaps = detectListenerCapabilities()
+	server.listeners = resolveListeners(fullConfig.Listeners, fullConfig.Server, server.listenerCaps)
+	server.sni = fullConfig.SNI
+	if fullConfig.Cluster.enabled() {
+		tunnel, err := NewRelayTunnel(fullConfig.Cluster)
+		if err != nil {
+			log.Fatalf("Invalid cluster config: %v", err)
+		}
+		server.tunnel = tunnel
+	}
+	server.region = fullConfig.Server.Region
+	server.instanceID = relayInstanceID(fullConfig.Cluster)
+	server.publicHost = fullConfig.Server.PublicHost
+	horizon, err := newSplitHorizon(fullConfig.SplitHorizon, config.TenantPortStart, config.TenantPortEnd)
+	if err != nil {
+		log.Fatalf("Invalid splitHorizon config: %v", err)
+	}
+	server.horizon = horizon
+	connStringTemplates, err := parseConnectionStringTemplates(fullConfig.ConnectionStrings)
+	if err != nil {
+		log.Fatalf("Invalid connectionStrings config: %v", err)
+	}
+	server.connStringTemplates = connStringTemplates
+	serviceEndpointTemplates, err := parseServiceEndpoints(fullConfig.ServiceEndpoints)
+	if err != nil {
+		log.Fatalf("Invalid serviceEndpoints config: %v", err)
+	}
+	server.serviceEndpointTemplates = serviceEndpointTemplates
+	server.fallbacks = fullConfig.Server.FallbackEndpoints
+	server.reservePorts(fullConfig.Server.ReservedPorts)
+	server.parkedHold = time.Duration(fullConfig.Server.ParkedHoldSeconds) * time.Second
+	server.portAllocation = fullConfig.Server.PortAllocation
+
+	// A blocklist that can't be read would let offboarded tenants back in
+	blocklist, err := OpenTenantBlocklist(fullConfig.Server.TenantBlocklist)
+	if err != nil {
+		log.Fatalf("Tenant blocklist unavailable at %s: %v", fullConfig.Server.TenantBlocklist, err)
+	}
+	server.blocklist = blocklist
+
+	if fullConfig.PortHistory.File != "" {
+		portHistory, err := OpenPortHistory(fullConfig.PortHistory)
+		if err != nil {
+			log.Printf("⚠️  Port history kept in memory only: %v", err)
+		} else {
+			server.portHistory = portHistory
+		}
+	}
+
+	slo, err := NewSLOTracker(fullConfig.SLO)
+	if err != nil {
+		log.Printf("⚠️  SLO samples kept in memory only: %v", err)
+		slo, _ = NewSLOTracker(SLOConfig{TargetPercent: fullConfig.SLO.TargetPercent})
+	}
+	server.slo = slo
+
+	// Replay port assignments from before a crash or restart
+	journal, assigned, err := OpenPortJournal(fullConfig.Server.PortJournal)
+	if err != nil {
+		log.Printf("⚠️  Port journal unavailable at %s, assignments will not survive a crash: %v", fullConfig.Server.PortJournal, err)
+	} else {
+		server.journal = journal
+		server.restoreJournaledPorts(assigned)
+		log.Printf("🔄 Restored %d port assignment(s) from %s", len(assigned), fullConfig.Server.PortJournal)
+	}
+
+	// The older server.* switches are defaults for their feature flags
+	featureDefaults := map[string]bool{
+		featureTDSFriendlyErrors: fullConfig.Server.TDSFriendlyErrors,
+		featureProtocolGuard:     fullConfig.Server.ProtocolGuard,
+	}
+	for name, enabled := range fullConfig.Features {
+		featureDefaults[name] = enabled
+	}
+	features, err := NewFeatureFlags(featureDefaults)
+	if err != nil {
+		log.Fatalf("Invalid feature flags: %v", err)
+	}
+	server.features = features
+	localTime := time.UTC
+	if tz := fullConfig.Server.QuotaTimezone; tz != "" {
+		location, err := time.LoadLocation(tz)
+		if err != nil {
+			log.Fatalf("Invalid server.quotaTimezone %q: %v", tz, err)
+		}
+		localTime = location
+		server.quotas = NewQuotaTracker(location)
+	}
+	ledger, err := NewComplianceLedger(fullConfig.Compliance, localTime)
+	if err != nil {
+		log.Printf("⚠️  Compliance ledger unavailable: %v", err)
+	}
+	server.ledger = ledger
+	server.admission = fullConfig.Admission
+	if fullConfig.Admission.RegistrationsPerSecond > 0 {
+		server.registrationBucket = NewRegistrationBucket(fullConfig.Admission.RegistrationsPerSecond, fullConfig.Admission.RegistrationBurst)
+	}
+	server.streamBudget = fullConfig.StreamBudget
+	server.progressLog = fullConfig.ProgressLog
+	server.localControl = fullConfig.LocalControl
+	server.resumption = newTLSResumption(fullConfig.TLSResumption)
+	server.tiers = fullConfig.Tiers
+	if fullConfig.LoadShedding.enabled() {
+		server.shedder = NewLoadShedder(fullConfig.LoadShedding)
+	}
+	server.idleTimeout = time.Duration(fullConfig.Forwarding.IdleTimeoutSec) * time.Second
+	if fullConfig.Forwarding.Concurrency == concurrencyPool {
+		server.copyPool = NewCopyPool(fullConfig.Forwarding)
+		server.copyPool.Start(server.watchdog)
+	}
+	if fullConfig.IPReputation.URL != "" {
+		server.reputation = NewIPReputation(fullConfig.IPReputation)
+		if fullConfig.IPReputation.PublicKey == "" {
+			log.Printf("⚠️  IP reputation feed %s is not signature-checked; set ipReputation.publicKey", fullConfig.IPReputation.URL)
+		}
+	}
+	server.canaries = fullConfig.Canaries
+	server.credentialRotation = fullConfig.CredentialRotation
+	server.credentialPolicies = NewCredentialPolicies(fullConfig.CredentialPolicies)
+	server.sourceIPs = NewSourceIPTracker(fullConfig.SourceIPs)
+	server.instanceRegistration = fullConfig.InstanceRegistration
+	server.deregistration = fullConfig.Deregistration
+	server.flowControl = fullConfig.FlowControl.withDefaults()
+	server.portForecast = NewPortForecaster(fullConfig.PortForecast)
+	server.federation = fullConfig.Federation
+	if fullConfig.LatencyInjection.enabled() {
+		server.latency = NewLatencyInjector()
+		log.Printf("⚠️  Latency injection is enabled: admins can slow tenants down on purpose. Never enable it on a production relay.")
+	}
+	if fullConfig.SIEM.Address != "" {
+		siem, err := NewSIEMExporter(fullConfig.SIEM, instance.Name)
+		if err != nil {
+			log.Fatalf("Invalid siem config: %v", err)
+		}
+		server.siem = siem
+		server.events.export = siem.exportEvent
+	}
+	if fullConfig.Server.HandshakeTimeoutSec > 0 {
+		server.handshakeTimeout = time.Duration(fullConfig.Server.HandshakeTimeoutSec) * time.Second
+	}
+	server.holdUntilHISAck = fullConfig.Server.HoldUntilHISAck
+	if fullConfig.Server.MaxControlMessageBytes > 0 {
+		server.maxControlMsg = fullConfig.Server.MaxControlMessageBytes
+	}
+	if fullConfig.Server.HISAckTimeoutSec > 0 {
+		server.hisAckTimeout = time.Duration(fullConfig.Server.HISAckTimeoutSec) * time.Second
+	}
+	if fullConfig.Server.PreloginTimeoutSec > 0 {
+		server.preloginTimeout = time.Duration(fullConfig.Server.PreloginTimeoutSec) * time.Second
+	}
+	if fullConfig.Server.StreamOpenTimeoutSec > 0 {
+		server.streamOpenTimeout = time.Duration(fullConfig.Server.StreamOpenTimeoutSec) * time.Second
+	}
+	if fullConfig.Server.MaxRegistrationsPerHour != 0 {
+		// A negative value disables flap suppression
+		server.registrations = NewRegistrationTracker(fullConfig.Server.MaxRegistrationsPerHour, server.events)
+	}
+	if fullConfig.Server.DegradedAfterFailures > 0 {
+		server.degradedAfterFailures = fullConfig.Server.DegradedAfterFailures
 	}
+	server.virtualInstance = instance.Name
+	server.events.virtualInstance = instance.Name
+	server.healthPort = fullConfig.Server.HealthCheckPort
+	return server
 }
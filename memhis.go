@@ -0,0 +1,158 @@
+package main
+
+import (
+	"sync"
+)
+
+// MemoryHIS is an in-memory HISBackend for tests: it records every
+// notification and answers register-port with RegisterResponse. Setting Err
+// makes every call fail, as during a HIS outage.
+type MemoryHIS struct {
+	RegisterResponse RegisterPortResponse
+	Err              error
+
+	registrations   []RegisterPortRequest
+	unregistrations []UnregisterPortRequest
+	heartbeats      []HeartbeatRequest
+	quotaReports    []QuotaExceededRequest
+	rotations       []CredentialRotatedRequest
+	instances       []InstanceRegistrationRequest
+	reconciles      []ReconcileRequest
+	changed         chan struct{} // closed and replaced on every notification
+	mu              sync.Mutex
+}
+
+// NewMemoryHIS creates a MemoryHIS that accepts every registration
+func NewMemoryHIS() *MemoryHIS {
+	return &MemoryHIS{
+		RegisterResponse: RegisterPortResponse{Success: true},
+		changed:          make(chan struct{}),
+	}
+}
+
+// record runs add under the lock and wakes waiters, returning the configured error
+func (m *MemoryHIS) record(add func()) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	add()
+	close(m.changed)
+	m.changed = make(chan struct{})
+	return m.Err
+}
+
+// RegisterPort records the request and returns RegisterResponse
+func (m *MemoryHIS) RegisterPort(req RegisterPortRequest) (*RegisterPortResponse, error) {
+	if err := m.record(func() { m.registrations = append(m.registrations, req) }); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	resp := m.RegisterResponse
+	m.mu.Unlock()
+	return &resp, nil
+}
+
+// UnregisterPort records the request
+func (m *MemoryHIS) UnregisterPort(req UnregisterPortRequest) error {
+	return m.record(func() { m.unregistrations = append(m.unregistrations, req) })
+}
+
+// ReportQuotaExceeded records the request
+func (m *MemoryHIS) ReportQuotaExceeded(req QuotaExceededRequest) error {
+	return m.record(func() { m.quotaReports = append(m.quotaReports, req) })
+}
+
+// SendHeartbeat records the request
+func (m *MemoryHIS) SendHeartbeat(req HeartbeatRequest) error {
+	return m.record(func() { m.heartbeats = append(m.heartbeats, req) })
+}
+
+// ReportCredentialRotated records the request
+func (m *MemoryHIS) ReportCredentialRotated(req CredentialRotatedRequest) error {
+	return m.record(func() { m.rotations = append(m.rotations, req) })
+}
+
+// RegisterInstance records the request
+func (m *MemoryHIS) RegisterInstance(req InstanceRegistrationRequest) error {
+	return m.record(func() { m.instances = append(m.instances, req) })
+}
+
+// Reconcile records the request
+func (m *MemoryHIS) Reconcile(target string, req ReconcileRequest) error {
+	return m.record(func() { m.reconciles = append(m.reconciles, req) })
+}
+
+// Metrics reports notification counts in place of per-target statistics
+func (m *MemoryHIS) Metrics() []map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return []map[string]interface{}{{
+		"name":            "memory",
+		"primary":         true,
+		"registrations":   len(m.registrations),
+		"unregistrations": len(m.unregistrations),
+		"heartbeats":      len(m.heartbeats),
+		"quotaReports":    len(m.quotaReports),
+		"rotations":       len(m.rotations),
+		"instances":       len(m.instances),
+		"reconciles":      len(m.reconciles),
+	}}
+}
+
+// Registrations returns the register-port requests received so far
+func (m *MemoryHIS) Registrations() []RegisterPortRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]RegisterPortRequest(nil), m.registrations...)
+}
+
+// Unregistrations returns the unregister-port requests received so far
+func (m *MemoryHIS) Unregistrations() []UnregisterPortRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]UnregisterPortRequest(nil), m.unregistrations...)
+}
+
+// Heartbeats returns the heartbeats received so far
+func (m *MemoryHIS) Heartbeats() []HeartbeatRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]HeartbeatRequest(nil), m.heartbeats...)
+}
+
+// QuotaReports returns the quota-exceeded reports received so far
+func (m *MemoryHIS) QuotaReports() []QuotaExceededRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]QuotaExceededRequest(nil), m.quotaReports...)
+}
+
+// CredentialRotations returns the credential-rotated reports received so far
+func (m *MemoryHIS) CredentialRotations() []CredentialRotatedRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]CredentialRotatedRequest(nil), m.rotations...)
+}
+
+// InstanceRegistrations returns the relay instance registrations received so far
+func (m *MemoryHIS) InstanceRegistrations() []InstanceRegistrationRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]InstanceRegistrationRequest(nil), m.instances...)
+}
+
+// Reconciles returns the tenant snapshots received so far
+func (m *MemoryHIS) Reconciles() []ReconcileRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]ReconcileRequest(nil), m.reconciles...)
+}
+
+// Changed returns a channel closed by the next notification, so tests can
+// wait for the relay's background HIS calls without sleeping
+func (m *MemoryHIS) Changed() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.changed
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// mirrorQueueSize bounds buffered chunks per mirrored connection; when the
+// mirror target can't keep up it is abandoned rather than slowing the client
+const mirrorQueueSize = 256
+
+// trafficMirror copies client->agent traffic to a secondary target in
+// fire-and-forget fashion. Responses from the target are discarded and the
+// mirrored bytes are never counted against the tenant.
+type trafficMirror struct {
+	tenantID string
+	target   string
+	queue    chan []byte
+	closed   bool
+	mu       sync.Mutex
+}
+
+func startMirror(tenantID, target string) *trafficMirror {
+	m := &trafficMirror{
+		tenantID: tenantID,
+		target:   target,
+		queue:    make(chan []byte, mirrorQueueSize),
+	}
+	go m.run()
+	return m
+}
+
+// Write never fails and never blocks the primary copy
+func (m *trafficMirror) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return len(p), nil
+	}
+
+	chunk := make([]byte, len(p))
+	copy(chunk, p)
+	select {
+	case m.queue <- chunk:
+	default:
+		log.Printf("⚠️  Mirror to %s for tenant %s fell behind, abandoning", m.target, m.tenantID)
+		m.closed = true
+		close(m.queue)
+	}
+	return len(p), nil
+}
+
+func (m *trafficMirror) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.closed {
+		m.closed = true
+		close(m.queue)
+	}
+}
+
+func (m *trafficMirror) run() {
+	conn, err := net.DialTimeout("tcp", m.target, 5*time.Second)
+	if err != nil {
+		log.Printf("⚠️  Mirror to %s for tenant %s failed: %v", m.target, m.tenantID, err)
+		for range m.queue {
+		}
+		return
+	}
+	defer conn.Close()
+
+	go io.Copy(io.Discard, conn)
+
+	for chunk := range m.queue {
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(chunk); err != nil {
+			log.Printf("⚠️  Mirror to %s for tenant %s stopped: %v", m.target, m.tenantID, err)
+			for range m.queue {
+			}
+			return
+		}
+	}
+}
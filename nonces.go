@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// nonceNamespaceJTI holds JWT IDs of single-use registration tokens
+	nonceNamespaceJTI = "jti"
+
+	nonceCompactInterval = 10 * time.Minute
+	// nonceDefaultLifetime applies to tokens without an expiry
+	nonceDefaultLifetime = 24 * time.Hour
+)
+
+// nonceRecord is one line of the nonce log. Values are stored hashed so
+// one-time codes can't be recovered from disk.
+type nonceRecord struct {
+	Namespace string    `json:"ns"`
+	Hash      string    `json:"h"`
+	ExpiresAt time.Time `json:"exp"`
+}
+
+// NonceStore remembers single-use values (JWT IDs, enrollment codes) until
+// they expire, persisting them so a restart doesn't reopen a replay window.
+// Uses are appended to a log that is compacted as entries expire.
+type NonceStore struct {
+	path string
+	file *os.File
+	seen map[string]time.Time // namespace + hash -> expiry
+	mu   sync.Mutex
+}
+
+// NewNonceStore opens the store in dir, loading unexpired values. An empty dir
+// keeps values in memory only.
+func NewNonceStore(dir string) (*NonceStore, error) {
+	store := &NonceStore{seen: make(map[string]time.Time)}
+	if dir == "" {
+		return store, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create nonce directory: %w", err)
+	}
+	store.path = filepath.Join(dir, "nonces.jsonl")
+
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	if err := store.compact(); err != nil {
+		return nil, err
+	}
+	if len(store.seen) > 0 {
+		log.Printf("Loaded %d unexpired nonces from %s", len(store.seen), store.path)
+	}
+	return store, nil
+}
+
+func nonceKey(namespace, value string) (key, hash string) {
+	sum := sha256.Sum256([]byte(value))
+	hash = hex.EncodeToString(sum[:])
+	return namespace + ":" + hash, hash
+}
+
+func (n *NonceStore) load() error {
+	file, err := os.Open(n.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open nonce log: %w", err)
+	}
+	defer file.Close()
+
+	now := clock.BaseNow()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec nonceRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A torn final line from a crash is expected; skip it
+			continue
+		}
+		if rec.ExpiresAt.After(now) {
+			n.seen[rec.Namespace+":"+rec.Hash] = rec.ExpiresAt
+		}
+	}
+	return scanner.Err()
+}
+
+// Use records a single-use value and reports whether it was fresh. A value
+// already used in the namespace and not yet expired returns false.
+func (n *NonceStore) Use(namespace, value string, expiresAt time.Time) (bool, error) {
+	key, hash := nonceKey(namespace, value)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if exp, ok := n.seen[key]; ok && clock.BaseNow().Before(exp) {
+		return false, nil
+	}
+	n.seen[key] = expiresAt
+
+	if n.file == nil {
+		return true, nil
+	}
+	line, err := json.Marshal(nonceRecord{Namespace: namespace, Hash: hash, ExpiresAt: expiresAt})
+	if err != nil {
+		return true, err
+	}
+	if _, err := n.file.Write(append(line, '\n')); err != nil {
+		return true, fmt.Errorf("failed to persist nonce: %w", err)
+	}
+	return true, nil
+}
+
+// Len returns the number of unexpired values held
+func (n *NonceStore) Len() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.seen)
+}
+
+// Run periodically drops expired values and compacts the log
+func (n *NonceStore) Run() {
+	ticker := clock.NewTicker(nonceCompactInterval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		n.mu.Lock()
+		err := n.compactLocked()
+		n.mu.Unlock()
+		if err != nil {
+			log.Printf("⚠️  Failed to compact nonce log: %v", err)
+		}
+	}
+}
+
+func (n *NonceStore) compact() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.compactLocked()
+}
+
+// compactLocked rewrites the log with only unexpired values; callers hold n.mu
+func (n *NonceStore) compactLocked() error {
+	now := clock.BaseNow()
+	for key, exp := range n.seen {
+		if !exp.After(now) {
+			delete(n.seen, key)
+		}
+	}
+	if n.path == "" {
+		return nil
+	}
+
+	tmp := n.path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	for key, exp := range n.seen {
+		namespace, hash := splitNonceKey(key)
+		line, _ := json.Marshal(nonceRecord{Namespace: namespace, Hash: hash, ExpiresAt: exp})
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	out.Close()
+	if err := os.Rename(tmp, n.path); err != nil {
+		return err
+	}
+
+	if n.file != nil {
+		n.file.Close()
+	}
+	n.file, err = os.OpenFile(n.path, os.O_APPEND|os.O_WRONLY, 0600)
+	return err
+}
+
+func splitNonceKey(key string) (namespace, hash string) {
+	for i := len(key) - 1; i >= 0; i-- {
+		if key[i] == ':' {
+			return key[:i], key[i+1:]
+		}
+	}
+	return "", key
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	adminSessionCookie = "relay_admin_session"
+	oidcStateCookie    = "relay_oidc_state"
+	adminSessionTTL    = 8 * time.Hour
+	// jwksRefreshInterval limits refetching the IdP's keys when a token names
+	// an unknown key ID
+	jwksRefreshInterval = time.Minute
+)
+
+// OIDCConfig enables single sign-on for the admin API against a corporate
+// IdP. API callers send the IdP's JWT as a bearer token; the dashboard logs in
+// with the authorization code flow at /admin/login. The IdP's group or role
+// claim is mapped to viewer, operator or admin.
+type OIDCConfig struct {
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret"`
+	RedirectURL  string `json:"redirectUrl"` // this relay's /admin/callback as the IdP sees it
+	// Audience expected in bearer tokens; default ClientID
+	Audience string `json:"audience"`
+	// RolesClaim names the claim holding the user's groups or roles; default "roles"
+	RolesClaim string `json:"rolesClaim"`
+	// RoleMappings maps IdP groups or roles to relay roles; users without a
+	// mapped group are refused
+	RoleMappings map[string]string `json:"roleMappings"`
+}
+
+// validateOIDCConfig checks SSO settings when an issuer is configured
+func validateOIDCConfig(cfg OIDCConfig) error {
+	if cfg.Issuer == "" {
+		return nil
+	}
+	switch {
+	case !strings.HasPrefix(cfg.Issuer, "https://"):
+		return fmt.Errorf("oidc.issuer must be an https URL")
+	case cfg.ClientID == "":
+		return fmt.Errorf("oidc.clientId is required")
+	case len(cfg.RoleMappings) == 0:
+		return fmt.Errorf("oidc.roleMappings is required")
+	case cfg.RedirectURL != "" && cfg.ClientSecret == "":
+		return fmt.Errorf("oidc.clientSecret is required for dashboard login (oidc.redirectUrl)")
+	}
+	for group, role := range cfg.RoleMappings {
+		if roleRank[role] == 0 {
+			return fmt.Errorf("oidc.roleMappings[%q]: unknown role %q (use viewer, operator or admin)", group, role)
+		}
+	}
+	return nil
+}
+
+// oidcProvider verifies IdP tokens and runs the dashboard login
+type oidcProvider struct {
+	cfg        OIDCConfig
+	httpClient *http.Client
+	sessionKey []byte
+
+	authURL   string
+	tokenURL  string
+	jwksURL   string
+	keys      map[string]crypto.PublicKey // by key ID
+	fetchedAt time.Time
+	mu        sync.Mutex
+}
+
+func newOIDCProvider(cfg OIDCConfig) *oidcProvider {
+	if cfg.Audience == "" {
+		cfg.Audience = cfg.ClientID
+	}
+	if cfg.RolesClaim == "" {
+		cfg.RolesClaim = "roles"
+	}
+
+	// Sessions are signed with a key derived from the client secret, so every
+	// relay instance behind the load balancer accepts them
+	mac := hmac.New(sha256.New, []byte(cfg.ClientSecret))
+	mac.Write([]byte("tatbeeb-link admin session"))
+
+	return &oidcProvider{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		sessionKey: mac.Sum(nil),
+	}
+}
+
+// discover loads the IdP's endpoints once
+func (p *oidcProvider) discover(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.jwksURL != "" {
+		return nil
+	}
+
+	var doc struct {
+		Issuer        string `json:"issuer"`
+		AuthEndpoint  string `json:"authorization_endpoint"`
+		TokenEndpoint string `json:"token_endpoint"`
+		JWKSURI       string `json:"jwks_uri"`
+	}
+	discoveryURL := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, discoveryURL, &doc); err != nil {
+		return fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	if doc.Issuer != p.cfg.Issuer || doc.JWKSURI == "" {
+		return fmt.Errorf("OIDC discovery returned issuer %q, expected %q", doc.Issuer, p.cfg.Issuer)
+	}
+	p.authURL, p.tokenURL, p.jwksURL = doc.AuthEndpoint, doc.TokenEndpoint, doc.JWKSURI
+	return nil
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// key returns the IdP signing key with the given ID, refetching the key set
+// when the ID is unknown, e.g. after the IdP rotated its keys
+func (p *oidcProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	if err := p.discover(ctx); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if clock.Since(p.fetchedAt) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	p.fetchedAt = clock.Now()
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.jwksURL, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch IdP keys: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if k.Crv != "P-256" || errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	p.keys = keys
+
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// verifyToken checks an IdP-signed JWT (RS256 or ES256) and returns its claims
+func (p *oidcProvider) verifyToken(ctx context.Context, token, audience string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid JWT format")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode header: %w", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("failed to parse header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode signature: %w", err)
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+			return nil, fmt.Errorf("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, fmt.Errorf("invalid signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode payload: %w", err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("failed to parse claims: %w", err)
+	}
+
+	now := float64(clock.BaseNow().Unix())
+	if iss, _ := claims["iss"].(string); iss != p.cfg.Issuer {
+		return nil, fmt.Errorf("invalid issuer: %s", iss)
+	}
+	if !claimContains(claims["aud"], audience) {
+		return nil, fmt.Errorf("invalid audience")
+	}
+	if exp, ok := claims["exp"].(float64); !ok || exp < now {
+		return nil, fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && nbf > now+60 {
+		return nil, fmt.Errorf("token not valid yet")
+	}
+	return claims, nil
+}
+
+// claimContains reports whether a string or string-array claim holds want
+func claimContains(claim interface{}, want string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == want
+	case []interface{}:
+		for _, item := range v {
+			if s, _ := item.(string); s == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// principal maps verified claims to a principal with the highest role any of
+// the user's groups grants
+func (p *oidcProvider) principal(claims map[string]interface{}, method string) (*adminPrincipal, error) {
+	name := ""
+	for _, claim := range []string{"preferred_username", "email", "sub"} {
+		if name, _ = claims[claim].(string); name != "" {
+			break
+		}
+	}
+
+	var groups []string
+	switch v := claims[p.cfg.RolesClaim].(type) {
+	case string:
+		groups = strings.Fields(v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+
+	role := ""
+	for _, group := range groups {
+		if mapped := p.cfg.RoleMappings[group]; roleRank[mapped] > roleRank[role] {
+			role = mapped
+		}
+	}
+	if role == "" {
+		return nil, fmt.Errorf("user %s has no relay role", name)
+	}
+	return &adminPrincipal{Name: name, Method: method, Role: role}, nil
+}
+
+// verifyBearer authenticates an API call carrying an IdP access or ID token
+func (p *oidcProvider) verifyBearer(ctx context.Context, token string) (*adminPrincipal, error) {
+	claims, err := p.verifyToken(ctx, token, p.cfg.Audience)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bearer token: %w", err)
+	}
+	return p.principal(claims, "oidc")
+}
+
+// adminSession is the signed content of the dashboard session cookie
+type adminSession struct {
+	Name    string `json:"name"`
+	Role    string `json:"role"`
+	Expires int64  `json:"exp"`
+}
+
+func (p *oidcProvider) signSession(session adminSession) string {
+	payload, _ := json.Marshal(session)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, p.sessionKey)
+	mac.Write([]byte(encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+var errSessionInvalid = errors.New("invalid or expired session")
+
+// verifySession authenticates a dashboard request by its session cookie
+func (p *oidcProvider) verifySession(value string) (*adminPrincipal, error) {
+	encoded, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, errSessionInvalid
+	}
+	mac := hmac.New(sha256.New, p.sessionKey)
+	mac.Write([]byte(encoded))
+	expected := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return nil, errSessionInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errSessionInvalid
+	}
+	var session adminSession
+	if err := json.Unmarshal(payload, &session); err != nil || session.Expires < clock.BaseNow().Unix() {
+		return nil, errSessionInvalid
+	}
+	return &adminPrincipal{Name: session.Name, Method: "session", Role: session.Role}, nil
+}
+
+// handleLogin (GET /admin/login) starts the authorization code flow
+func (p *oidcProvider) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if err := p.discover(r.Context()); err != nil {
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	var raw [16]byte
+	rand.Read(raw[:])
+	state := base64.RawURLEncoding.EncodeToString(raw[:])
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/admin/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(p.cfg.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.cfg.ClientID},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"scope":         {"openid profile email"},
+		"state":         {state},
+		"nonce":         {state},
+	}
+	http.Redirect(w, r, p.authURL+"?"+query.Encode(), http.StatusFound)
+}
+
+// handleCallback (GET /admin/callback) exchanges the code for an ID token
+// and sets the session cookie
+func (p *oidcProvider) handleCallback(w http.ResponseWriter, r *http.Request) {
+	stateCookie, err := r.Cookie(oidcStateCookie)
+	state := r.URL.Query().Get("state")
+	if err != nil || state == "" || !hmac.Equal([]byte(state), []byte(stateCookie.Value)) {
+		writeJSONError(w, http.StatusBadRequest, "login state mismatch, start again at /admin/login")
+		return
+	}
+	if idpErr := r.URL.Query().Get("error"); idpErr != "" {
+		writeJSONError(w, http.StatusUnauthorized, "login refused by identity provider: "+idpErr)
+		return
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {r.URL.Query().Get("code")},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"client_secret": {p.cfg.ClientSecret},
+	}
+	resp, err := p.httpClient.PostForm(p.tokenURL, form)
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("token exchange failed: %v", err))
+		return
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens) != nil {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("token exchange returned %d", resp.StatusCode))
+		return
+	}
+
+	claims, err := p.verifyToken(r.Context(), tokens.IDToken, p.cfg.ClientID)
+	if err == nil && claims["nonce"] != state {
+		err = fmt.Errorf("nonce mismatch")
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, fmt.Sprintf("invalid ID token: %v", err))
+		return
+	}
+	principal, err := p.principal(claims, "session")
+	if err != nil {
+		writeJSONError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	expires := clock.BaseNow().Add(adminSessionTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminSessionCookie,
+		Value:    p.signSession(adminSession{Name: principal.Name, Role: principal.Role, Expires: expires.Unix()}),
+		Path:     "/admin/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(p.cfg.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/admin/", MaxAge: -1})
+	log.Printf("🔑 Admin login: %s as %s from %s", principal.Name, principal.Role, r.RemoteAddr)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"principal": principal.Name,
+		"role":      principal.Role,
+		"expiresAt": expires.UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPacketTraceDuration = 5 * time.Minute
+	maxPacketTraceDuration     = time.Hour
+	// maxPacketTraceRecords bounds a trace's memory; later packets are dropped
+	maxPacketTraceRecords = 200000
+
+	traceDirectionClientToAgent = "client_to_agent"
+	traceDirectionAgentToClient = "agent_to_client"
+)
+
+// PacketTraceRecord is one line of a packet trace: a TDS packet header, the
+// point a direction stopped being TDS, or a connection opening or closing.
+// Payload bytes are never captured.
+type PacketTraceRecord struct {
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"` // packet, opaque, open, close
+	ConnID    uint64    `json:"connId"`
+	Direction string    `json:"direction,omitempty"`
+	Type      string    `json:"type,omitempty"`
+	Status    byte      `json:"status,omitempty"`
+	Length    int       `json:"length,omitempty"`
+}
+
+// packetTrace samples the packet headers of a tenant's connections opened
+// during its window. The records stay downloadable after it ends.
+type packetTrace struct {
+	tenantID  string
+	startedAt time.Time
+	until     time.Time
+	stopped   bool
+	records   []PacketTraceRecord
+	dropped   int
+	mu        sync.Mutex
+}
+
+// PacketTracer keeps the latest header trace of each tenant in memory
+type PacketTracer struct {
+	traces map[string]*packetTrace
+	mu     sync.Mutex
+}
+
+// NewPacketTracer creates a tracer without traces
+func NewPacketTracer() *PacketTracer {
+	return &PacketTracer{traces: make(map[string]*packetTrace)}
+}
+
+// Start begins a trace of the tenant for duration, replacing its previous
+// trace
+func (t *PacketTracer) Start(tenantID string, duration time.Duration) error {
+	if duration <= 0 || duration > maxPacketTraceDuration {
+		return fmt.Errorf("duration must be between 1s and %v", maxPacketTraceDuration)
+	}
+	now := clock.Now()
+	trace := &packetTrace{tenantID: tenantID, startedAt: now, until: now.Add(duration)}
+
+	t.mu.Lock()
+	t.traces[tenantID] = trace
+	t.mu.Unlock()
+
+	log.Printf("🔬 Packet header trace started for tenant %s until %s", tenantID, trace.until.Format(time.RFC3339))
+	return nil
+}
+
+// Stop ends the tenant's trace early, keeping its records
+func (t *PacketTracer) Stop(tenantID string) bool {
+	trace := t.get(tenantID)
+	if trace == nil {
+		return false
+	}
+	trace.mu.Lock()
+	trace.stopped = true
+	trace.mu.Unlock()
+	log.Printf("🔬 Packet header trace stopped for tenant %s", tenantID)
+	return true
+}
+
+func (t *PacketTracer) get(tenantID string) *packetTrace {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.traces[tenantID]
+}
+
+// For returns the tenant's trace if it is running, or nil
+func (t *PacketTracer) For(tenantID string) *packetTrace {
+	trace := t.get(tenantID)
+	if trace == nil || !trace.active(clock.Now()) {
+		return nil
+	}
+	return trace
+}
+
+// Status describes the tenant's latest trace for the admin API
+func (t *PacketTracer) Status(tenantID string) map[string]interface{} {
+	status := map[string]interface{}{
+		"tenantId": tenantID,
+		"active":   false,
+	}
+	trace := t.get(tenantID)
+	if trace == nil {
+		return status
+	}
+
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	status["active"] = trace.activeLocked(clock.Now())
+	status["startedAt"] = trace.startedAt.Format(time.RFC3339)
+	status["until"] = trace.until.Format(time.RFC3339)
+	status["records"] = len(trace.records)
+	status["dropped"] = trace.dropped
+	return status
+}
+
+// Records returns a copy of the tenant's latest trace
+func (t *PacketTracer) Records(tenantID string) ([]PacketTraceRecord, bool) {
+	trace := t.get(tenantID)
+	if trace == nil {
+		return nil, false
+	}
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	return append([]PacketTraceRecord(nil), trace.records...), true
+}
+
+func (trace *packetTrace) active(now time.Time) bool {
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	return trace.activeLocked(now)
+}
+
+// activeLocked reports whether the window is still open. Callers hold
+// trace.mu.
+func (trace *packetTrace) activeLocked(now time.Time) bool {
+	return !trace.stopped && now.Before(trace.until)
+}
+
+// add appends a record while the window is open
+func (trace *packetTrace) add(record PacketTraceRecord) {
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+
+	if !trace.activeLocked(record.Time) {
+		return
+	}
+	if len(trace.records) >= maxPacketTraceRecords {
+		trace.dropped++
+		return
+	}
+	trace.records = append(trace.records, record)
+}
+
+// observer returns a writer that traces the packet headers of one direction
+// of a connection
+func (trace *packetTrace) observer(connID uint64, direction string) *packetTraceObserver {
+	return &packetTraceObserver{trace: trace, connID: connID, direction: direction}
+}
+
+// packetTraceObserver records each TDS packet header written through it
+type packetTraceObserver struct {
+	trace     *packetTrace
+	connID    uint64
+	direction string
+	scanner   tdsHeaderScanner
+}
+
+func (o *packetTraceObserver) Write(p []byte) (int, error) {
+	now := clock.Now()
+	o.scanner.scan(p, func(header tdsHeader) {
+		o.trace.add(PacketTraceRecord{
+			Time:      now,
+			Kind:      "packet",
+			ConnID:    o.connID,
+			Direction: o.direction,
+			Type:      tdsPacketTypeNames[header.Type],
+			Status:    header.Status,
+			Length:    header.Length,
+		})
+	}, func() {
+		o.trace.add(PacketTraceRecord{Time: now, Kind: "opaque", ConnID: o.connID, Direction: o.direction})
+	})
+	return len(p), nil
+}
+
+// handleAdminTenantTrace starts (PUT {"durationSeconds": n}), stops (DELETE)
+// or shows (GET) a tenant's packet header trace; GET ?download=1 exports it
+// as JSON lines
+func (s *RelayServer) handleAdminTenantTrace(w http.ResponseWriter, r *http.Request, tenantID string) {
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("download") != "" {
+			records, ok := s.packetTraces.Records(tenantID)
+			if !ok {
+				writeJSONError(w, http.StatusNotFound, "no packet trace for tenant")
+				return
+			}
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "trace-" + tenantID + ".jsonl"}))
+			enc := json.NewEncoder(w)
+			for _, record := range records {
+				enc.Encode(record)
+			}
+			return
+		}
+
+	case http.MethodPut:
+		var req struct {
+			DurationSeconds int `json:"durationSeconds"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		duration := defaultPacketTraceDuration
+		if req.DurationSeconds != 0 {
+			duration = time.Duration(req.DurationSeconds) * time.Second
+		}
+		if err := s.packetTraces.Start(tenantID, duration); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.events.Emit("packet_trace_started", tenantID, fmt.Sprintf("packet header trace for %v (by %s)", duration, adminActor(r)))
+
+	case http.MethodDelete:
+		if !s.packetTraces.Stop(tenantID) {
+			writeJSONError(w, http.StatusNotFound, "no packet trace for tenant")
+			return
+		}
+		s.events.Emit("packet_trace_stopped", tenantID, fmt.Sprintf("packet header trace stopped (by %s)", adminActor(r)))
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.packetTraces.Status(tenantID))
+}
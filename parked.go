@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxHeldConns bounds how many client connections a parked port keeps
+// waiting for its agent
+const maxHeldConns = 64
+
+// heldConn is a client connection accepted on a parked port
+type heldConn struct {
+	conn  net.Conn
+	timer *Timer // closes the connection when the hold expires
+}
+
+// parkedPort keeps a reserved tenant port bound while its agent is away, so
+// health checks see it open and the port can't be taken by another process.
+// Connections are refused, or held for up to hold when it is non-zero.
+type parkedPort struct {
+	tenantID string
+	port     int
+	listener net.Listener
+	hold     time.Duration
+
+	held []*heldConn
+	mu   sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// validateReservedPorts checks that reserved ports are in the tenant range and
+// that no port is reserved twice
+func validateReservedPorts(reserved map[string]int, start, end int) error {
+	owners := make(map[int]string, len(reserved))
+	for tenantID, port := range reserved {
+		if tenantID == "" {
+			return fmt.Errorf("reserved port %d has an empty tenant ID", port)
+		}
+		if port < start || port > end {
+			return fmt.Errorf("reserved port %d for tenant %s is outside the tenant port range %d-%d", port, tenantID, start, end)
+		}
+		if other, ok := owners[port]; ok {
+			return fmt.Errorf("port %d is reserved for both %s and %s", port, other, tenantID)
+		}
+		owners[port] = tenantID
+	}
+	return nil
+}
+
+// reservePorts sets sticky tenant ports and removes them from the dynamic pool.
+// Must be called before Start.
+func (s *RelayServer) reservePorts(reserved map[string]int) {
+	reservedSet := make(map[int]bool, len(reserved))
+	for _, port := range reserved {
+		reservedSet[port] = true
+	}
+
+	pool := s.portPool[:0]
+	for _, port := range s.portPool {
+		if !reservedSet[port] {
+			pool = append(pool, port)
+		}
+	}
+	s.portPool = pool
+	s.reservedPorts = reserved
+}
+
+// parkReservedPorts binds every reserved port at startup so conflicts with
+// other processes surface at boot
+func (s *RelayServer) parkReservedPorts() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenantIDs := make([]string, 0, len(s.reservedPorts))
+	for tenantID := range s.reservedPorts {
+		tenantIDs = append(tenantIDs, tenantID)
+	}
+	sort.Strings(tenantIDs)
+
+	var conflicts []string
+	for _, tenantID := range tenantIDs {
+		if err := s.parkLocked(tenantID); err != nil {
+			conflicts = append(conflicts, err.Error())
+			continue
+		}
+		s.setTenantState(tenantID, tenantStateGracePeriod, "reserved port parked at startup")
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("reserved ports unavailable: %v", conflicts)
+	}
+
+	if len(tenantIDs) > 0 {
+		log.Printf("✅ Parked %d reserved tenant ports", len(tenantIDs))
+	}
+	return nil
+}
+
+// parkLocked binds a reserved port until its tenant registers. Caller holds s.mu.
+func (s *RelayServer) parkLocked(tenantID string) error {
+	port, ok := s.reservedPorts[tenantID]
+	if !ok || s.parked[tenantID] != nil {
+		return nil
+	}
+
+	listener, err := s.listenTenantPort(port, s.listeners.Tenant)
+	if err != nil {
+		s.events.Emit("port_conflict", tenantID, fmt.Sprintf("reserved port %d unavailable: %v", port, err))
+		return fmt.Errorf("port %d for tenant %s: %w", port, tenantID, err)
+	}
+
+	p := &parkedPort{
+		tenantID: tenantID,
+		port:     port,
+		listener: listener,
+		hold:     s.parkedHold,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	s.parked[tenantID] = p
+	go p.acceptLoop()
+	return nil
+}
+
+// unparkLocked stops a parked port's accept loop and hands over its listener
+// and any held connections. Caller holds s.mu.
+func (s *RelayServer) unparkLocked(tenantID string) (net.Listener, []net.Conn) {
+	p := s.parked[tenantID]
+	if p == nil {
+		return nil, nil
+	}
+	delete(s.parked, tenantID)
+
+	// Wake the blocked Accept without closing the listener
+	close(p.stop)
+	if tcp, ok := p.listener.(*net.TCPListener); ok {
+		tcp.SetDeadline(time.Now())
+	} else {
+		p.listener.Close()
+	}
+	<-p.done
+
+	tcp, ok := p.listener.(*net.TCPListener)
+	if !ok {
+		return nil, p.takeHeld()
+	}
+	tcp.SetDeadline(time.Time{})
+	return p.listener, p.takeHeld()
+}
+
+// acceptLoop refuses or holds connections until the port is unparked
+func (p *parkedPort) acceptLoop() {
+	defer close(p.done)
+
+	var backoff time.Duration
+	for {
+		conn, err := p.listener.Accept()
+		select {
+		case <-p.stop:
+			if conn != nil {
+				p.holdOrClose(conn)
+			}
+			return
+		default:
+		}
+		if err != nil {
+			if isTemporaryAcceptError(err) {
+				backoff = acceptBackoff(backoff)
+				clock.Sleep(backoff)
+				continue
+			}
+			log.Printf("Parked port %d for tenant %s listener error: %v", p.port, p.tenantID, err)
+			return
+		}
+		backoff = 0
+		p.holdOrClose(conn)
+	}
+}
+
+func (p *parkedPort) holdOrClose(conn net.Conn) {
+	if p.hold <= 0 {
+		conn.Close()
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.held) >= maxHeldConns {
+		conn.Close()
+		return
+	}
+	h := &heldConn{conn: conn}
+	h.timer = clock.AfterFunc(p.hold, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for i, other := range p.held {
+			if other == h {
+				p.held = append(p.held[:i], p.held[i+1:]...)
+				conn.Close()
+				return
+			}
+		}
+	})
+	p.held = append(p.held, h)
+}
+
+// takeHeld returns the connections still waiting for the agent
+func (p *parkedPort) takeHeld() []net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := make([]net.Conn, 0, len(p.held))
+	for _, h := range p.held {
+		if h.timer.Stop() {
+			conns = append(conns, h.conn)
+		} else {
+			h.conn.Close()
+		}
+	}
+	p.held = nil
+	return conns
+}
+
+// dispatchHeld forwards connections that arrived while the tenant's port was
+// parked, once the agent has its registration response
+func (s *RelayServer) dispatchHeld(tenant *Tenant, conns []net.Conn) {
+	for _, conn := range conns {
+		if s.refusedByReputation(conn) {
+			continue
+		}
+		if !tenant.acquireConn() {
+			conn.Close()
+			continue
+		}
+		go s.handleTenantConnection(tenant, conn)
+	}
+	if len(conns) > 0 {
+		log.Printf("Tenant %s: forwarding %d connections held while parked", tenant.ID, len(conns))
+	}
+}
+
+// parkedMetrics reports reserved ports and how many are parked. Callers hold s.mu.
+func (s *RelayServer) parkedMetrics() map[string]interface{} {
+	held := 0
+	for _, p := range s.parked {
+		p.mu.Lock()
+		held += len(p.held)
+		p.mu.Unlock()
+	}
+	return map[string]interface{}{
+		"reserved":   len(s.reservedPorts),
+		"parked":     len(s.parked),
+		"held_conns": held,
+	}
+}
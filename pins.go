@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+)
+
+// CertificatePins tells agents which relay keys to trust on the control
+// channel. Pins are base64 SHA-256 hashes of the certificate's
+// SubjectPublicKeyInfo, so they survive certificate renewals that keep the
+// key. Agents should accept any pin in Current or Next and replace their
+// stored set with both on every registration, so a planned key change never
+// strands them.
+type CertificatePins struct {
+	Algorithm string   `json:"algorithm"`
+	Current   []string `json:"current"`
+	Next      []string `json:"next,omitempty"`
+}
+
+// spkiPin hashes a DER certificate's public key
+func spkiPin(der []byte) (string, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// validatePins checks configured pins are base64 SHA-256 hashes
+func validatePins(pins []string) error {
+	for _, pin := range pins {
+		sum, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("pin %q is not a base64 SHA-256 hash", pin)
+		}
+	}
+	return nil
+}
+
+// newCertificatePins pins the control port certificate and adds the
+// configured pins of the next planned key
+func newCertificatePins(cert tls.Certificate, next []string) (*CertificatePins, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("certificate chain is empty")
+	}
+	pin, err := spkiPin(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	pins := &CertificatePins{Algorithm: "sha256", Current: []string{pin}}
+	for _, p := range next {
+		if p != pin {
+			pins.Next = append(pins.Next, p)
+		}
+	}
+	return pins, nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	portForecastInterval            = time.Hour
+	defaultPortForecastWindowDays   = 14
+	defaultPortForecastWarnDays     = 90
+	defaultPortForecastCriticalDays = 30
+	// minPortForecastTrendSpan is how much sampled history the trend needs
+	// before it is used; until then the onboarding rate stands in
+	minPortForecastTrendSpan = 24 * time.Hour
+)
+
+// Port exhaustion forecast levels
+const (
+	portForecastOK       = "ok"
+	portForecastWarning  = "warning"
+	portForecastCritical = "critical"
+)
+
+// PortForecastConfig sets the trend window and how far ahead of the projected
+// exhaustion date alerts fire
+type PortForecastConfig struct {
+	WindowDays   int `json:"windowDays"`   // default 14
+	WarnDays     int `json:"warnDays"`     // default 90
+	CriticalDays int `json:"criticalDays"` // default 30
+	// WarnUtilizationPercent also warns once this share of the pool is used,
+	// whatever the trend; 0 disables it
+	WarnUtilizationPercent int `json:"warnUtilizationPercent"`
+}
+
+// validatePortForecast checks the alert horizons are ordered
+func validatePortForecast(cfg PortForecastConfig) error {
+	if cfg.WarnUtilizationPercent > 100 {
+		return errors.New("warnUtilizationPercent must not exceed 100")
+	}
+	if cfg.WarnDays > 0 && cfg.CriticalDays > 0 && cfg.CriticalDays > cfg.WarnDays {
+		return errors.New("criticalDays must not exceed warnDays")
+	}
+	return nil
+}
+
+// withDefaults fills in the unset window and horizons
+func (c PortForecastConfig) withDefaults() PortForecastConfig {
+	if c.WindowDays == 0 {
+		c.WindowDays = defaultPortForecastWindowDays
+	}
+	if c.WarnDays == 0 {
+		c.WarnDays = defaultPortForecastWarnDays
+	}
+	if c.CriticalDays == 0 {
+		c.CriticalDays = defaultPortForecastCriticalDays
+	}
+	return c
+}
+
+func (c PortForecastConfig) window() time.Duration {
+	return time.Duration(c.WindowDays) * 24 * time.Hour
+}
+
+// portPoolSample is the pool's use at one point in time
+type portPoolSample struct {
+	at   time.Time
+	used int
+}
+
+// PortForecaster samples the tenant port pool hourly and projects when it
+// runs out from the consumption trend and the onboarding rate
+type PortForecaster struct {
+	cfg     PortForecastConfig
+	samples []portPoolSample // oldest first, within the window
+	level   string
+	mu      sync.Mutex
+}
+
+// NewPortForecaster creates a forecaster without history
+func NewPortForecaster(cfg PortForecastConfig) *PortForecaster {
+	return &PortForecaster{cfg: cfg.withDefaults(), level: portForecastOK}
+}
+
+// PortForecast is the projected exhaustion of the tenant port pool. Rates are
+// ports per day; the forecast uses the higher of the trend and the onboarding
+// rate so a quiet sample window doesn't hide steady growth.
+type PortForecast struct {
+	Capacity           int        `json:"capacity"`
+	Used               int        `json:"used"`
+	Available          int        `json:"available"`
+	UtilizationPercent float64    `json:"utilizationPercent"`
+	WindowDays         int        `json:"windowDays"`
+	TrendPerDay        *float64   `json:"trendPerDay,omitempty"` // nil until a day is sampled
+	OnboardingPerDay   float64    `json:"onboardingPerDay"`
+	RatePerDay         float64    `json:"ratePerDay"`
+	DaysUntilExhausted *float64   `json:"daysUntilExhausted,omitempty"` // nil while the pool isn't shrinking
+	ExhaustionDate     *time.Time `json:"exhaustionDate,omitempty"`
+	Level              string     `json:"level"`
+}
+
+// record adds a sample and drops those older than the window
+func (f *PortForecaster) record(sample portPoolSample) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.samples = append(f.samples, sample)
+	cutoff := sample.at.Add(-f.cfg.window())
+	i := 0
+	for i < len(f.samples) && f.samples[i].at.Before(cutoff) {
+		i++
+	}
+	f.samples = f.samples[i:]
+}
+
+// trend fits a least-squares line through the samples, in ports per day
+func (f *PortForecaster) trend() (float64, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := len(f.samples)
+	if n < 2 || f.samples[n-1].at.Sub(f.samples[0].at) < minPortForecastTrendSpan {
+		return 0, false
+	}
+	origin := f.samples[0].at
+	var sumX, sumY, sumXY, sumXX float64
+	for _, sample := range f.samples {
+		x := sample.at.Sub(origin).Hours() / 24
+		y := float64(sample.used)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	denominator := float64(n)*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, false
+	}
+	return (float64(n)*sumXY - sumX*sumY) / denominator, true
+}
+
+// forecast projects exhaustion from the pool's current use and the number of
+// tenants first given a port within the window
+func (f *PortForecaster) forecast(capacity, available, onboarded int, now time.Time) PortForecast {
+	cfg := f.cfg
+	fc := PortForecast{
+		Capacity:         capacity,
+		Used:             capacity - available,
+		Available:        available,
+		WindowDays:       cfg.WindowDays,
+		OnboardingPerDay: float64(onboarded) / float64(cfg.WindowDays),
+		Level:            portForecastOK,
+	}
+	if capacity > 0 {
+		fc.UtilizationPercent = math.Round(float64(fc.Used)*1000/float64(capacity)) / 10
+	}
+
+	fc.RatePerDay = fc.OnboardingPerDay
+	if trend, ok := f.trend(); ok {
+		fc.TrendPerDay = &trend
+		fc.RatePerDay = math.Max(trend, fc.OnboardingPerDay)
+	}
+
+	switch {
+	case available <= 0:
+		days := 0.0
+		fc.DaysUntilExhausted, fc.ExhaustionDate = &days, &now
+	case fc.RatePerDay > 0:
+		days := float64(available) / fc.RatePerDay
+		at := now.Add(time.Duration(days * 24 * float64(time.Hour))).UTC()
+		fc.DaysUntilExhausted, fc.ExhaustionDate = &days, &at
+	}
+
+	switch {
+	case fc.DaysUntilExhausted != nil && *fc.DaysUntilExhausted <= float64(cfg.CriticalDays):
+		fc.Level = portForecastCritical
+	case fc.DaysUntilExhausted != nil && *fc.DaysUntilExhausted <= float64(cfg.WarnDays):
+		fc.Level = portForecastWarning
+	case cfg.WarnUtilizationPercent > 0 && fc.UtilizationPercent >= float64(cfg.WarnUtilizationPercent):
+		fc.Level = portForecastWarning
+	}
+	return fc
+}
+
+// setLevel stores the latest level, returning the one it replaces
+func (f *PortForecaster) setLevel(level string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	previous := f.level
+	f.level = level
+	return previous
+}
+
+// FirstAssignedSince counts the tenants whose earliest retained port
+// assignment is at or after from, i.e. those onboarded since then
+func (h *PortHistory) FirstAssignedSince(from time.Time) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	first := make(map[string]time.Time)
+	for _, interval := range h.intervals {
+		if at, ok := first[interval.TenantID]; !ok || interval.Start.Before(at) {
+			first[interval.TenantID] = interval.Start
+		}
+	}
+	count := 0
+	for _, at := range first {
+		if !at.Before(from) {
+			count++
+		}
+	}
+	return count
+}
+
+// portCapacityLocked counts the ports the pool can hand to tenants, leaving
+// out reserved ports. Caller holds s.mu.
+func (s *RelayServer) portCapacityLocked() int {
+	if s.portAllocation == portAllocationHash {
+		return s.config.TenantPortEnd - s.config.TenantPortStart + 1 - len(s.reservedPorts)
+	}
+	return len(s.portPool)
+}
+
+// portForecastLocked projects the pool's exhaustion now. Caller holds s.mu.
+func (s *RelayServer) portForecastLocked() PortForecast {
+	now := clock.Now()
+	// Without a history file every tenant reconnecting after a restart would
+	// look newly onboarded, so only the sampled trend counts
+	onboarded := 0
+	if s.portHistory.path != "" {
+		onboarded = s.portHistory.FirstAssignedSince(now.Add(-s.portForecast.cfg.window()))
+	}
+	return s.portForecast.forecast(s.portCapacityLocked(), s.availablePortsLocked(), onboarded, now)
+}
+
+// runPortForecast samples the pool every hour and alerts when the projected
+// exhaustion date comes within the warning or critical horizon, until the
+// process exits
+func (s *RelayServer) runPortForecast() {
+	ticker := clock.NewTicker(portForecastInterval)
+	defer ticker.Stop()
+
+	for {
+		s.mu.RLock()
+		s.portForecast.record(portPoolSample{at: clock.Now(), used: s.portCapacityLocked() - s.availablePortsLocked()})
+		forecast := s.portForecastLocked()
+		s.mu.RUnlock()
+
+		if previous := s.portForecast.setLevel(forecast.Level); forecast.Level != previous {
+			s.portForecastChanged(forecast, previous)
+		}
+		<-ticker.C
+	}
+}
+
+// portForecastChanged logs and emits a move between forecast levels
+func (s *RelayServer) portForecastChanged(fc PortForecast, previous string) {
+	msg := fmt.Sprintf("tenant port pool %d/%d used (%.1f%%), %.2f ports/day", fc.Used, fc.Capacity, fc.UtilizationPercent, fc.RatePerDay)
+	if fc.ExhaustionDate != nil {
+		msg += fmt.Sprintf(", projected to run out on %s (in %.0f days)", fc.ExhaustionDate.Format("2006-01-02"), *fc.DaysUntilExhausted)
+	}
+	if fc.Level == portForecastOK {
+		log.Printf("✅ Port exhaustion %s cleared: %s", previous, msg)
+		s.events.Emit("port_exhaustion_cleared", "", msg)
+		return
+	}
+	log.Printf("⚠️  Port exhaustion %s: %s; request a wider tenant port range", fc.Level, msg)
+	s.events.Emit("port_exhaustion_"+fc.Level, "", msg)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// Port allocation strategies, set by server.portAllocation
+const (
+	portAllocationSequential = "sequential" // next unused port of the pool
+	portAllocationHash       = "hash"       // derived from the tenant ID
+)
+
+// validatePortAllocation checks the strategy name
+func validatePortAllocation(strategy string) error {
+	switch strategy {
+	case "", portAllocationSequential, portAllocationHash:
+		return nil
+	}
+	return fmt.Errorf("%q must be %q or %q", strategy, portAllocationSequential, portAllocationHash)
+}
+
+// hashedPortOffset places a tenant ID in a range of size ports with 32-bit
+// FNV-1a, so every relay with the same range derives the same port
+func hashedPortOffset(tenantID string, size int) int {
+	h := fnv.New32a()
+	h.Write([]byte(tenantID))
+	return int(h.Sum32() % uint32(size))
+}
+
+// hashedPortLocked probes linearly from the tenant's hashed port for one that
+// is neither in use nor reserved. Ports held in the journal for other tenants
+// are only taken once the rest are. Caller holds s.mu.
+func (s *RelayServer) hashedPortLocked(tenantID string) (int, bool) {
+	start := s.config.TenantPortStart
+	size := s.config.TenantPortEnd - start + 1
+	taken := s.portsTakenLocked()
+	held := make(map[int]bool, len(s.journaledPorts))
+	for id, port := range s.journaledPorts {
+		if id != tenantID {
+			held[port] = true
+		}
+	}
+
+	offset := hashedPortOffset(tenantID, size)
+	for _, skipHeld := range []bool{true, false} {
+		for i := 0; i < size; i++ {
+			port := start + (offset+i)%size
+			if taken[port] || (skipHeld && held[port]) {
+				continue
+			}
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+// portsTakenLocked returns the tenant ports that are reserved or in use,
+// including ports retired by a remap that still accept. Caller holds s.mu.
+func (s *RelayServer) portsTakenLocked() map[int]bool {
+	taken := make(map[int]bool, len(s.tenants)+len(s.reservedPorts))
+	for _, port := range s.reservedPorts {
+		taken[port] = true
+	}
+	for port := range s.portIndex {
+		taken[port] = true
+	}
+	return taken
+}
+
+// availablePortsLocked counts the ports a new tenant could still be given.
+// Caller holds s.mu.
+func (s *RelayServer) availablePortsLocked() int {
+	if s.portAllocation == portAllocationHash {
+		return s.config.TenantPortEnd - s.config.TenantPortStart + 1 - len(s.portsTakenLocked())
+	}
+	return len(s.portPool) - s.nextPortIndex
+}
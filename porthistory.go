@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	portHistoryAssigned = "assigned"
+	portHistoryReleased = "released"
+
+	defaultPortHistoryRetentionDays = 365
+	// portHistoryCompactEvery rewrites the file after this many appends
+	portHistoryCompactEvery = 10000
+	maxPortHistoryResults   = 1000
+)
+
+// PortHistoryConfig archives which tenant held which port when, for forensic
+// lookups; without a file the history lasts until the relay restarts
+type PortHistoryConfig struct {
+	File          string `json:"file"`
+	RetentionDays int    `json:"retentionDays"` // default 365
+}
+
+// PortHistoryRecord is one line of the port history file
+type PortHistoryRecord struct {
+	Op       string    `json:"op"`
+	TenantID string    `json:"tenantId"`
+	Port     int       `json:"port"`
+	At       time.Time `json:"at"`
+	// Restart marks a release written at startup for an interval the previous
+	// process never closed, e.g. after a crash
+	Restart bool `json:"restart,omitempty"`
+}
+
+// PortInterval is a span of time a tenant held a port. End is nil while the
+// port is still held.
+type PortInterval struct {
+	TenantID string     `json:"tenantId"`
+	Port     int        `json:"port"`
+	Start    time.Time  `json:"start"`
+	End      *time.Time `json:"end,omitempty"`
+	// EndedByRestart means the relay stopped without releasing the port, so
+	// End is when it started again: an upper bound, not the actual release
+	EndedByRestart bool `json:"endedByRestart,omitempty"`
+}
+
+// PortHistory keeps port assignment intervals, mirrored to an append-only
+// JSON lines file that is compacted on open and as it grows
+type PortHistory struct {
+	intervals []*PortInterval // by start
+	retention time.Duration
+	path      string
+	file      *os.File
+	appends   int
+	mu        sync.Mutex
+}
+
+// OpenPortHistory loads the retained history from cfg.File, if set. Intervals
+// the previous process left open are closed now and marked as ended by a
+// restart.
+func OpenPortHistory(cfg PortHistoryConfig) (*PortHistory, error) {
+	days := cfg.RetentionDays
+	if days == 0 {
+		days = defaultPortHistoryRetentionDays
+	}
+	h := &PortHistory{retention: time.Duration(days) * 24 * time.Hour, path: cfg.File}
+	if h.path == "" {
+		return h, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create port history dir: %w", err)
+	}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+
+	now := clock.BaseNow().UTC()
+	for _, interval := range h.intervals {
+		if interval.End == nil {
+			interval.End = &now
+			interval.EndedByRestart = true
+		}
+	}
+	if err := h.compactLocked(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// load folds the file's records into intervals, skipping a torn final line
+func (h *PortHistory) load() error {
+	file, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open port history: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record PortHistoryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		h.applyLocked(record)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read port history: %w", err)
+	}
+	return nil
+}
+
+// applyLocked folds one record into the intervals. A port has one holder at a
+// time, so an assignment also ends whatever interval was open on the port.
+// Callers hold h.mu.
+func (h *PortHistory) applyLocked(record PortHistoryRecord) {
+	at := record.At
+	for _, interval := range h.intervals {
+		if interval.End != nil || interval.Port != record.Port {
+			continue
+		}
+		if record.Op == portHistoryAssigned || interval.TenantID == record.TenantID {
+			interval.End = &at
+			interval.EndedByRestart = record.Restart
+		}
+	}
+	if record.Op == portHistoryAssigned {
+		h.intervals = append(h.intervals, &PortInterval{TenantID: record.TenantID, Port: record.Port, Start: at})
+	}
+}
+
+// recordsLocked turns the intervals back into file records. Callers hold h.mu.
+func (h *PortHistory) recordsLocked() []PortHistoryRecord {
+	records := make([]PortHistoryRecord, 0, 2*len(h.intervals))
+	for _, interval := range h.intervals {
+		records = append(records, PortHistoryRecord{Op: portHistoryAssigned, TenantID: interval.TenantID, Port: interval.Port, At: interval.Start})
+		if interval.End != nil {
+			records = append(records, PortHistoryRecord{Op: portHistoryReleased, TenantID: interval.TenantID, Port: interval.Port,
+				At: *interval.End, Restart: interval.EndedByRestart})
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].At.Before(records[j].At) })
+	return records
+}
+
+// pruneLocked drops intervals that ended before the retention window.
+// Callers hold h.mu.
+func (h *PortHistory) pruneLocked() {
+	cutoff := clock.BaseNow().Add(-h.retention)
+	kept := make([]*PortInterval, 0, len(h.intervals))
+	for _, interval := range h.intervals {
+		if interval.End == nil || interval.End.After(cutoff) {
+			kept = append(kept, interval)
+		}
+	}
+	h.intervals = kept
+	h.appends = 0
+}
+
+// compactLocked prunes the intervals, rewrites the file with those retained
+// and reopens it for appending. Callers hold h.mu.
+func (h *PortHistory) compactLocked() error {
+	h.pruneLocked()
+	if h.file != nil {
+		h.file.Close()
+		h.file = nil
+	}
+	tmp := h.path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to compact port history: %w", err)
+	}
+	w := bufio.NewWriter(out)
+	enc := json.NewEncoder(w)
+	for _, record := range h.recordsLocked() {
+		enc.Encode(record)
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to compact port history: %w", err)
+	}
+	out.Close()
+	if err := os.Rename(tmp, h.path); err != nil {
+		return fmt.Errorf("failed to compact port history: %w", err)
+	}
+
+	file, err := os.OpenFile(h.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open port history: %w", err)
+	}
+	h.file = file
+	return nil
+}
+
+// record applies an assignment or release and appends it to the file
+func (h *PortHistory) record(op, tenantID string, port int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	record := PortHistoryRecord{Op: op, TenantID: tenantID, Port: port, At: clock.BaseNow().UTC()}
+	h.applyLocked(record)
+	h.appends++
+	if h.file == nil {
+		if h.appends >= portHistoryCompactEvery {
+			h.pruneLocked()
+		}
+		return
+	}
+	if h.appends >= portHistoryCompactEvery {
+		if err := h.compactLocked(); err != nil {
+			log.Printf("⚠️  %v", err)
+		}
+		return
+	}
+	if err := json.NewEncoder(h.file).Encode(record); err != nil {
+		log.Printf("⚠️  Failed to append to port history %s: %v", h.path, err)
+	}
+}
+
+// Assigned records that tenantID now holds port
+func (h *PortHistory) Assigned(tenantID string, port int) {
+	h.record(portHistoryAssigned, tenantID, port)
+}
+
+// Released records that tenantID no longer holds port
+func (h *PortHistory) Released(tenantID string, port int) {
+	h.record(portHistoryReleased, tenantID, port)
+}
+
+// Query returns the intervals overlapping [from, to], newest first, limited
+// to a port and tenant when they are set
+func (h *PortHistory) Query(port int, tenantID string, from, to time.Time) []PortInterval {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	matches := []PortInterval{}
+	for i := len(h.intervals) - 1; i >= 0 && len(matches) < maxPortHistoryResults; i-- {
+		interval := h.intervals[i]
+		if (port != 0 && interval.Port != port) || (tenantID != "" && interval.TenantID != tenantID) {
+			continue
+		}
+		if interval.Start.After(to) || (interval.End != nil && interval.End.Before(from)) {
+			continue
+		}
+		matches = append(matches, *interval)
+	}
+	return matches
+}
+
+// handleAdminPortHistory serves GET /admin/ports/history?port=&tenant= with
+// either at= (who held the port at that instant) or from= and to=, RFC3339
+func (s *RelayServer) handleAdminPortHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	query := r.URL.Query()
+
+	var port int
+	if v := query.Get("port"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 65535 {
+			writeJSONError(w, http.StatusBadRequest, "port must be between 1 and 65535")
+			return
+		}
+		port = n
+	}
+	tenantID := query.Get("tenant")
+	if port == 0 && tenantID == "" {
+		writeJSONError(w, http.StatusBadRequest, "port or tenant is required")
+		return
+	}
+
+	times := map[string]time.Time{}
+	for _, name := range []string{"at", "from", "to"} {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("%s must be an RFC3339 time", name))
+			return
+		}
+		times[name] = t
+	}
+	from, to := times["from"], times["to"]
+	if at, ok := times["at"]; ok {
+		from, to = at, at
+	}
+	if to.IsZero() {
+		to = clock.BaseNow()
+	}
+	if to.Before(from) {
+		writeJSONError(w, http.StatusBadRequest, "to must not be before from")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"intervals": s.portHistory.Query(port, tenantID, from, to),
+	})
+}
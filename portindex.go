@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// portIndexEntry is the registered tenant holding a port. Retired ports are
+// the old ports of a remap that still accept connections.
+type portIndexEntry struct {
+	TenantID string `json:"tenantId"`
+	Port     int    `json:"port"`
+	Retired  bool   `json:"retired,omitempty"`
+}
+
+// portIndexViolation is an invariant check that failed
+type portIndexViolation struct {
+	At      time.Time `json:"at"`
+	Problem string    `json:"problem"`
+}
+
+// maxPortIndexViolations is how many failed checks are kept for the admin API
+const maxPortIndexViolations = 50
+
+// indexPortLocked records that tenantID holds port. A port held by another
+// tenant is left alone and reported. Caller holds s.mu.
+func (s *RelayServer) indexPortLocked(port int, tenantID string, retired bool) {
+	if owner, ok := s.portIndex[port]; ok && owner.TenantID != tenantID {
+		s.portIndexViolationLocked(fmt.Sprintf("port %d indexed for tenant %s is held by tenant %s", port, tenantID, owner.TenantID))
+		return
+	}
+	s.portIndex[port] = portIndexEntry{TenantID: tenantID, Port: port, Retired: retired}
+}
+
+// unindexPortLocked drops port if tenantID holds it. Caller holds s.mu.
+func (s *RelayServer) unindexPortLocked(port int, tenantID string) {
+	if owner, ok := s.portIndex[port]; ok && owner.TenantID == tenantID {
+		delete(s.portIndex, port)
+	}
+}
+
+// tenantByPortLocked returns the registered tenant holding port, including a
+// remapped tenant's old port while it still accepts. Caller holds s.mu.
+func (s *RelayServer) tenantByPortLocked(port int) (*Tenant, portIndexEntry, bool) {
+	entry, ok := s.portIndex[port]
+	if !ok {
+		return nil, portIndexEntry{}, false
+	}
+	tenant, ok := s.tenants[entry.TenantID]
+	return tenant, entry, ok
+}
+
+// checkPortIndexLocked verifies the index matches the tenants after a
+// mutation: every tenant's port and retired port indexed to it, and nothing
+// else. Failures are logged, kept for the admin API and emitted as events.
+// Caller holds s.mu.
+func (s *RelayServer) checkPortIndexLocked() {
+	expected := 0
+	for _, tenant := range s.tenants {
+		ports := []int{tenant.AssignedPort}
+		if tenant.retiredListener != nil {
+			ports = append(ports, tenant.PreviousPort)
+		}
+		for _, port := range ports {
+			expected++
+			if owner, ok := s.portIndex[port]; !ok || owner.TenantID != tenant.ID {
+				s.portIndexViolationLocked(fmt.Sprintf("port %d of tenant %s is indexed to %q", port, tenant.ID, owner.TenantID))
+			}
+		}
+	}
+	if len(s.portIndex) != expected {
+		for port, owner := range s.portIndex {
+			tenant, ok := s.tenants[owner.TenantID]
+			if !ok || (tenant.AssignedPort != port && (tenant.PreviousPort != port || tenant.retiredListener == nil)) {
+				s.portIndexViolationLocked(fmt.Sprintf("port %d is indexed to tenant %s, which doesn't hold it", port, owner.TenantID))
+			}
+		}
+	}
+}
+
+// portIndexViolationLocked records a failed invariant. Caller holds s.mu.
+func (s *RelayServer) portIndexViolationLocked(problem string) {
+	log.Printf("⚠️  Port index invariant violated: %s", problem)
+	s.portIndexViolations = append(s.portIndexViolations, portIndexViolation{At: clock.Now().UTC(), Problem: problem})
+	if len(s.portIndexViolations) > maxPortIndexViolations {
+		s.portIndexViolations = s.portIndexViolations[1:]
+	}
+	s.portIndexViolationCount++
+	s.events.Emit("port_index_violation", "", problem)
+}
+
+// portIndexMetricsLocked reports the index size and failed checks. Caller
+// holds s.mu.
+func (s *RelayServer) portIndexMetricsLocked() map[string]interface{} {
+	return map[string]interface{}{
+		"entries":              len(s.portIndex),
+		"invariant_violations": s.portIndexViolationCount,
+	}
+}
+
+// handleAdminPorts serves GET /admin/ports, the port index with any failed
+// invariant checks, and GET /admin/ports/{port}, the tenant holding a port
+func (s *RelayServer) handleAdminPorts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	param := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/ports"), "/")
+	if param == "" {
+		entries := make([]portIndexEntry, 0, len(s.portIndex))
+		for _, entry := range s.portIndex {
+			entries = append(entries, entry)
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Port < entries[j].Port })
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"ports":               entries,
+			"invariantViolations": s.portIndexViolationCount,
+			"recentViolations":    append([]portIndexViolation{}, s.portIndexViolations...),
+		})
+		return
+	}
+
+	port, err := strconv.Atoi(param)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	tenant, entry, ok := s.tenantByPortLocked(port)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "no registered tenant holds this port")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"port":     port,
+		"tenantId": tenant.ID,
+		"retired":  entry.Retired,
+		"tenant":   s.tenantSnapshot(tenant),
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// progressScanInterval is how often live connections are checked for a due
+// progress record, and so the resolution of idle times
+const progressScanInterval = 10 * time.Second
+
+// ProgressLogConfig enables periodic progress records for long-lived client
+// connections, which otherwise only log at close. A record is written when
+// either threshold is crossed since the previous one; zero disables it.
+type ProgressLogConfig struct {
+	IntervalMinutes int `json:"intervalMinutes"`
+	EveryMegabytes  int `json:"everyMegabytes"`
+}
+
+func (c ProgressLogConfig) enabled() bool {
+	return c.IntervalMinutes > 0 || c.EveryMegabytes > 0
+}
+
+// connProgress is the progress log state of one connection; only the
+// progress loop touches it
+type connProgress struct {
+	loggedAt    time.Time
+	loggedBytes int64
+	lastBytes   int64
+	changedAt   time.Time
+}
+
+// RunProgressLog writes progress records for live connections until the
+// process exits
+func (t *ConnTable) RunProgressLog(cfg ProgressLogConfig) {
+	interval := time.Duration(cfg.IntervalMinutes) * time.Minute
+	everyBytes := int64(cfg.EveryMegabytes) << 20
+
+	ticker := clock.NewTicker(progressScanInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		t.mu.Lock()
+		conns := make([]*trackedConn, 0, len(t.conns))
+		for _, c := range t.conns {
+			conns = append(conns, c)
+		}
+		t.mu.Unlock()
+
+		for _, c := range conns {
+			p := &c.progress
+			if p.loggedAt.IsZero() {
+				p.loggedAt, p.changedAt = c.startedAt, c.startedAt
+			}
+
+			up, down := c.bytes()
+			total := up + down
+			if total != p.lastBytes {
+				p.lastBytes, p.changedAt = total, now
+			}
+
+			due := (interval > 0 && now.Sub(p.loggedAt) >= interval) ||
+				(everyBytes > 0 && total-p.loggedBytes >= everyBytes)
+			if !due {
+				continue
+			}
+
+			elapsed := now.Sub(c.startedAt)
+			sinceLast := now.Sub(p.loggedAt)
+			log.Printf("📊 Connection %d tenant %s from %s: %s up, %s down in %v (avg %s/s, last %v %s/s), idle %v",
+				c.id, c.tenantID, c.clientAddr, formatBytes(up), formatBytes(down), elapsed.Round(time.Second),
+				formatBytes(bytesPerSecond(total, elapsed)), sinceLast.Round(time.Second),
+				formatBytes(bytesPerSecond(total-p.loggedBytes, sinceLast)), now.Sub(p.changedAt).Round(time.Second))
+			p.loggedAt, p.loggedBytes = now, total
+		}
+	}
+}
+
+func bytesPerSecond(n int64, d time.Duration) int64 {
+	if d < time.Second {
+		return n
+	}
+	return int64(float64(n) / d.Seconds())
+}
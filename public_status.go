@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// publicStatusCacheTTL is how long the public summary is reused; the
+	// endpoint is unauthenticated and may be polled by every status page visitor
+	publicStatusCacheTTL = 15 * time.Second
+	// publicStatusWindow is how far back departed tenants count as expected
+	publicStatusWindow = 24 * time.Hour
+	// publicStatusDegradedPercent is the connected share below which the relay
+	// reports itself degraded
+	publicStatusDegradedPercent = 90.0
+)
+
+// Incident is an operator-declared incident shown on the public status page
+type Incident struct {
+	Active    bool      `json:"active"`
+	Message   string    `json:"message,omitempty"`
+	StartedAt time.Time `json:"startedAt,omitempty"`
+}
+
+// PublicStatus is the aggregate health summary served without authentication.
+// It must never contain per-tenant detail.
+type PublicStatus struct {
+	Status           string    `json:"status"` // operational, degraded or incident
+	Region           string    `json:"region,omitempty"`
+	TenantsConnected float64   `json:"tenantsConnectedPercent"`
+	Incident         *Incident `json:"incident,omitempty"`
+	UpdatedAt        time.Time `json:"updatedAt"`
+}
+
+// publicStatusCache holds the last computed summary and the incident flag
+type publicStatusCache struct {
+	status   *PublicStatus
+	incident Incident
+	mu       sync.Mutex
+}
+
+// handlePublicStatus serves the cached aggregate status
+func (s *RelayServer) handlePublicStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=30")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	writeJSON(w, http.StatusOK, s.publicStatus())
+}
+
+func (s *RelayServer) publicStatus() *PublicStatus {
+	c := &s.statusCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.status != nil && clock.Since(c.status.UpdatedAt) < publicStatusCacheTTL {
+		return c.status
+	}
+
+	// Tenants that left recently and haven't come back count as disconnected
+	s.mu.RLock()
+	connected := len(s.tenants)
+	degraded := 0
+	for _, tenant := range s.tenants {
+		tenant.mu.Lock()
+		if tenant.Degraded {
+			degraded++
+		}
+		tenant.mu.Unlock()
+	}
+	missing := make(map[string]bool)
+	cutoff := clock.Now().Add(-publicStatusWindow)
+	for _, d := range s.departures.Recent("") {
+		if _, back := s.tenants[d.TenantID]; !back && d.ClosedAt.After(cutoff) {
+			missing[d.TenantID] = true
+		}
+	}
+	s.mu.RUnlock()
+
+	percent := 100.0
+	if expected := connected + len(missing); expected > 0 {
+		percent = float64(connected) / float64(expected) * 100
+	}
+
+	status := &PublicStatus{
+		Status:           "operational",
+		Region:           s.region,
+		TenantsConnected: float64(int(percent*10)) / 10,
+		UpdatedAt:        clock.Now(),
+	}
+	if percent < publicStatusDegradedPercent || (connected > 0 && degraded*10 > connected) {
+		status.Status = "degraded"
+	}
+	if c.incident.Active {
+		incident := c.incident
+		status.Status = "incident"
+		status.Incident = &incident
+	}
+
+	c.status = status
+	return status
+}
+
+// setIncident raises or clears the public incident flag and drops the cached
+// summary so the change shows immediately
+func (s *RelayServer) setIncident(incident Incident) {
+	c := &s.statusCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if incident.Active && !c.incident.Active {
+		incident.StartedAt = clock.Now()
+	} else if incident.Active {
+		incident.StartedAt = c.incident.StartedAt
+	}
+	c.incident = incident
+	c.status = nil
+}
+
+// handleAdminIncident shows (GET), raises (PUT {"message": "..."}) or clears
+// (DELETE) the incident shown on the public status page
+func (s *RelayServer) handleAdminIncident(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPut:
+		var req struct {
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		s.setIncident(Incident{Active: true, Message: req.Message})
+		s.events.Emit("incident_raised", "", req.Message)
+		log.Printf("🚨 Public incident raised by %s: %s", adminActor(r), req.Message)
+
+	case http.MethodDelete:
+		s.setIncident(Incident{})
+		s.events.Emit("incident_cleared", "", "public incident cleared")
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	s.statusCache.mu.Lock()
+	incident := s.statusCache.incident
+	s.statusCache.mu.Unlock()
+	writeJSON(w, http.StatusOK, incident)
+}
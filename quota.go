@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	quotaKindConnection = "connection"
+	quotaKindDaily      = "daily"
+)
+
+var (
+	errConnectionByteCap = errors.New("per-connection byte cap exceeded")
+	errDailyByteCap      = errors.New("daily byte cap exceeded")
+)
+
+// dailyUsage is one tenant's transfer on one calendar day
+type dailyUsage struct {
+	day      string
+	bytes    int64
+	notified bool
+}
+
+// QuotaTracker counts each tenant's bytes per calendar day in the configured
+// time zone. Usage is kept per tenant ID so re-registering doesn't reset it.
+type QuotaTracker struct {
+	location *time.Location
+	usage    map[string]*dailyUsage
+	mu       sync.Mutex
+}
+
+// NewQuotaTracker creates a tracker whose days start at midnight in location
+func NewQuotaTracker(location *time.Location) *QuotaTracker {
+	return &QuotaTracker{
+		location: location,
+		usage:    make(map[string]*dailyUsage),
+	}
+}
+
+// todayLocked returns the tenant's usage for today; callers hold q.mu
+func (q *QuotaTracker) todayLocked(tenantID string) *dailyUsage {
+	day := clock.BaseNow().In(q.location).Format("2006-01-02")
+	u, ok := q.usage[tenantID]
+	if !ok || u.day != day {
+		u = &dailyUsage{day: day}
+		q.usage[tenantID] = u
+	}
+	return u
+}
+
+// Used returns the bytes the tenant transferred today
+func (q *QuotaTracker) Used(tenantID string) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.todayLocked(tenantID).bytes
+}
+
+// Add records transferred bytes and returns today's total
+func (q *QuotaTracker) Add(tenantID string, n int64) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u := q.todayLocked(tenantID)
+	u.bytes += n
+	return u.bytes
+}
+
+// firstExceeded reports whether this is the first time today the tenant hit
+// its daily cap, so the event and HIS notification are sent once per day
+func (q *QuotaTracker) firstExceeded(tenantID string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u := q.todayLocked(tenantID)
+	if u.notified {
+		return false
+	}
+	u.notified = true
+	return true
+}
+
+// capWriter stops a copy once the connection or the tenant's day would go
+// over its byte cap. Both directions of a connection share connBytes.
+type capWriter struct {
+	w         io.Writer
+	quotas    *QuotaTracker
+	tenant    *Tenant
+	connBytes *int64
+}
+
+func (c *capWriter) Write(p []byte) (int, error) {
+	n := int64(len(p))
+	if limit := c.tenant.MaxBytesPerConnection; limit > 0 && atomic.LoadInt64(c.connBytes)+n > limit {
+		return 0, errConnectionByteCap
+	}
+	if limit := c.tenant.MaxBytesPerDay; limit > 0 && c.quotas.Used(c.tenant.ID)+n > limit {
+		return 0, errDailyByteCap
+	}
+
+	written, err := c.w.Write(p)
+	atomic.AddInt64(c.connBytes, int64(written))
+	c.quotas.Add(c.tenant.ID, int64(written))
+	return written, err
+}
+
+// byteCapExceeded audits a byte cap being hit and notifies HIS. Daily caps
+// are reported once per day.
+func (s *RelayServer) byteCapExceeded(tenant *Tenant, kind string, limit, used int64) {
+	if kind == quotaKindDaily && !s.quotas.firstExceeded(tenant.ID) {
+		return
+	}
+
+	s.events.Emit("byte_cap_exceeded", tenant.ID,
+		fmt.Sprintf("%s byte cap of %s reached (%s used)", kind, formatBytes(limit), formatBytes(used)))
+
+	go func() {
+		req := QuotaExceededRequest{
+			TenantID:   tenant.ID,
+			Kind:       kind,
+			LimitBytes: limit,
+			UsedBytes:  used,
+			At:         clock.BaseNow(),
+		}
+		if err := s.hisClient.ReportQuotaExceeded(req); err != nil {
+			log.Printf("⚠️  Failed to report %s byte cap to HIS for tenant %s: %v", kind, tenant.ID, err)
+		}
+	}()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// reconcileReasonHISRecovered is why a snapshot is pushed after an outage
+const reconcileReasonHISRecovered = "his_recovered"
+
+// ReconcileRequest is the relay's full view of its tenants, pushed to a HIS
+// target once it recovers from an outage, so ports and credentials HIS
+// missed while it was down reconverge without an operator
+type ReconcileRequest struct {
+	RelayInstanceID string            `json:"relayInstanceId"`
+	VirtualInstance string            `json:"virtualInstance,omitempty"`
+	Reason          string            `json:"reason"`
+	GeneratedAt     time.Time         `json:"generatedAt"`
+	Tenants         []ReconcileTenant `json:"tenants"`
+}
+
+// ReconcileTenant is one registered tenant: its port registration, lifecycle
+// state and current SQL credential. Tenants HIS knows but the snapshot lacks
+// are no longer served by this instance.
+type ReconcileTenant struct {
+	RegisterPortRequest
+	State        string    `json:"state"`
+	SQLUser      string    `json:"sqlUser"`
+	SQLPassword  string    `json:"sqlPassword"`
+	RegisteredAt time.Time `json:"registeredAt"`
+}
+
+// hisReconcileState counts the snapshots pushed after HIS outages
+type hisReconcileState struct {
+	runs        int64
+	failures    int64
+	lastAt      time.Time
+	lastTarget  string
+	lastTenants int
+	lastError   string
+	mu          sync.Mutex
+	running     sync.Mutex // one snapshot at a time
+}
+
+// reconcileSnapshot describes every registered tenant
+func (s *RelayServer) reconcileSnapshot(reason string) ReconcileRequest {
+	s.mu.RLock()
+	tenants := make([]*Tenant, 0, len(s.tenants))
+	for _, tenant := range s.tenants {
+		tenants = append(tenants, tenant)
+	}
+	s.mu.RUnlock()
+
+	req := ReconcileRequest{
+		RelayInstanceID: s.instanceID,
+		VirtualInstance: s.virtualInstance,
+		Reason:          reason,
+		GeneratedAt:     clock.BaseNow().UTC(),
+		Tenants:         make([]ReconcileTenant, 0, len(tenants)),
+	}
+	for _, tenant := range tenants {
+		entry := ReconcileTenant{
+			RegisterPortRequest: s.registerPortRequest(tenant),
+			State:               s.tenantStates.State(tenant.ID),
+		}
+		tenant.mu.Lock()
+		entry.SQLUser = tenant.SQLUser
+		entry.SQLPassword = tenant.SQLPassword
+		entry.RegisteredAt = tenant.RegisteredAt.UTC()
+		tenant.mu.Unlock()
+		req.Tenants = append(req.Tenants, entry)
+	}
+	return req
+}
+
+// reconcileHIS pushes the current tenant set to a HIS target whose circuit
+// breaker just closed. A push that fails in a new outage is retried when the
+// target recovers from it.
+func (s *RelayServer) reconcileHIS(target string) {
+	state := &s.hisReconcile
+	state.running.Lock()
+	defer state.running.Unlock()
+
+	req := s.reconcileSnapshot(reconcileReasonHISRecovered)
+	err := s.hisClient.Reconcile(target, req)
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.runs++
+	state.lastAt = clock.BaseNow()
+	state.lastTarget = target
+	state.lastTenants = len(req.Tenants)
+	if err != nil {
+		state.failures++
+		state.lastError = err.Error()
+		msg := fmt.Sprintf("snapshot of %d tenants to HIS target %s failed: %v", len(req.Tenants), target, err)
+		log.Printf("⚠️  HIS reconciliation %s", msg)
+		s.events.Emit("his_reconcile_failed", "", msg)
+		return
+	}
+	state.lastError = ""
+	msg := fmt.Sprintf("pushed %d tenants to HIS target %s after it recovered", len(req.Tenants), target)
+	log.Printf("🔄 HIS reconciliation: %s", msg)
+	s.events.Emit("his_reconciled", "", msg)
+}
+
+// hisReconcileMetrics reports the snapshots pushed after HIS outages
+func (s *RelayServer) hisReconcileMetrics() map[string]interface{} {
+	state := &s.hisReconcile
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	metrics := map[string]interface{}{
+		"runs":     state.runs,
+		"failures": state.failures,
+	}
+	if !state.lastAt.IsZero() {
+		metrics["last_at"] = state.lastAt.UTC().Format(time.RFC3339)
+		metrics["last_target"] = state.lastTarget
+		metrics["last_tenants"] = state.lastTenants
+		metrics["last_error"] = state.lastError
+	}
+	return metrics
+}
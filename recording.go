@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRecordingDir      = "/var/lib/tatbeeb-link/recordings"
+	defaultRecordingMaxBytes = 10 << 20 // per tenant
+	maxRecordingDuration     = 7 * 24 * time.Hour
+)
+
+// RecordingConfig configures forensic recording storage
+type RecordingConfig struct {
+	Dir               string `json:"dir"`
+	MaxBytesPerTenant int64  `json:"maxBytesPerTenant"`
+}
+
+// RecordingEntry is one line of a forensic recording. Recordings hold
+// connection metadata only, never payload bytes, so they are PHI-safe.
+type RecordingEntry struct {
+	Time               time.Time      `json:"time"`
+	Kind               string         `json:"kind"` // connection_open, connection_close, prelogin, login, minute
+	ConnID             uint64         `json:"connId,omitempty"`
+	ClientAddr         string         `json:"clientAddr,omitempty"`
+	BytesClientToAgent int64          `json:"bytesClientToAgent,omitempty"`
+	BytesAgentToClient int64          `json:"bytesAgentToClient,omitempty"`
+	PacketTypes        map[string]int `json:"packetTypes,omitempty"`
+}
+
+// tenantRecording is an active recording for one tenant. Byte counts and
+// packet types are aggregated per minute.
+type tenantRecording struct {
+	tenantID    string
+	startedAt   time.Time
+	until       time.Time
+	file        *os.File
+	written     int64
+	maxBytes    int64
+	truncated   bool
+	bytesUp     int64
+	bytesDown   int64
+	packetTypes map[string]int
+	mu          sync.Mutex
+}
+
+// Recorder manages per-tenant forensic recordings stored as JSON lines
+type Recorder struct {
+	dir      string
+	maxBytes int64
+	active   map[string]*tenantRecording
+	mu       sync.Mutex
+}
+
+// NewRecorder creates a recorder writing to dir
+func NewRecorder(cfg RecordingConfig) (*Recorder, error) {
+	if cfg.Dir == "" {
+		cfg.Dir = defaultRecordingDir
+	}
+	if cfg.MaxBytesPerTenant <= 0 {
+		cfg.MaxBytesPerTenant = defaultRecordingMaxBytes
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create recording dir: %w", err)
+	}
+	return &Recorder{
+		dir:      cfg.Dir,
+		maxBytes: cfg.MaxBytesPerTenant,
+		active:   make(map[string]*tenantRecording),
+	}, nil
+}
+
+func (r *Recorder) path(tenantID string) string {
+	return filepath.Join(r.dir, url.PathEscape(tenantID)+".jsonl")
+}
+
+// Start begins (or extends) recording a tenant for the given duration. A new
+// recording replaces the previous file.
+func (r *Recorder) Start(tenantID string, duration time.Duration) (*tenantRecording, error) {
+	if duration <= 0 || duration > maxRecordingDuration {
+		return nil, fmt.Errorf("duration must be between 1m and %v", maxRecordingDuration)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if rec, ok := r.active[tenantID]; ok {
+		rec.mu.Lock()
+		rec.until = clock.Now().Add(duration)
+		rec.mu.Unlock()
+		return rec, nil
+	}
+
+	file, err := os.OpenFile(r.path(tenantID), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	rec := &tenantRecording{
+		tenantID:    tenantID,
+		startedAt:   clock.BaseNow(),
+		until:       clock.Now().Add(duration),
+		file:        file,
+		maxBytes:    r.maxBytes,
+		packetTypes: make(map[string]int),
+	}
+	r.active[tenantID] = rec
+	log.Printf("🔎 Forensic recording started for tenant %s until %s", tenantID, rec.until.Format(time.RFC3339))
+	return rec, nil
+}
+
+// Stop ends a tenant's recording, keeping the file for export
+func (r *Recorder) Stop(tenantID string) {
+	r.mu.Lock()
+	rec, ok := r.active[tenantID]
+	delete(r.active, tenantID)
+	r.mu.Unlock()
+
+	if ok {
+		rec.close()
+		log.Printf("🔎 Forensic recording stopped for tenant %s", tenantID)
+	}
+}
+
+// For returns the tenant's active recording, or nil
+func (r *Recorder) For(tenantID string) *tenantRecording {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.active[tenantID]
+}
+
+// Status describes a tenant's recording for the admin API
+func (r *Recorder) Status(tenantID string) map[string]interface{} {
+	status := map[string]interface{}{
+		"tenantId": tenantID,
+		"active":   false,
+	}
+	if info, err := os.Stat(r.path(tenantID)); err == nil {
+		status["sizeBytes"] = info.Size()
+	}
+
+	if rec := r.For(tenantID); rec != nil {
+		rec.mu.Lock()
+		status["active"] = true
+		status["startedAt"] = rec.startedAt.Format(time.RFC3339)
+		status["until"] = rec.until.Format(time.RFC3339)
+		status["truncated"] = rec.truncated
+		rec.mu.Unlock()
+	}
+	return status
+}
+
+// Run flushes per-minute aggregates and ends expired recordings
+func (r *Recorder) Run() {
+	ticker := clock.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+
+		r.mu.Lock()
+		recordings := make([]*tenantRecording, 0, len(r.active))
+		for _, rec := range r.active {
+			recordings = append(recordings, rec)
+		}
+		r.mu.Unlock()
+
+		now := clock.Now()
+		for _, rec := range recordings {
+			rec.flushMinute(clock.BaseNow())
+
+			rec.mu.Lock()
+			expired := now.After(rec.until)
+			rec.mu.Unlock()
+			if expired {
+				r.Stop(rec.tenantID)
+			}
+		}
+	}
+}
+
+func (rec *tenantRecording) flushMinute(now time.Time) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	entry := RecordingEntry{
+		Time:               now,
+		Kind:               "minute",
+		BytesClientToAgent: rec.bytesUp,
+		BytesAgentToClient: rec.bytesDown,
+		PacketTypes:        rec.packetTypes,
+	}
+	rec.bytesUp, rec.bytesDown = 0, 0
+	rec.packetTypes = make(map[string]int)
+	rec.writeLocked(entry)
+}
+
+// Record appends an entry to the recording
+func (rec *tenantRecording) Record(entry RecordingEntry) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.writeLocked(entry)
+}
+
+// writeLocked appends an entry unless the size bound was reached; callers hold rec.mu
+func (rec *tenantRecording) writeLocked(entry RecordingEntry) {
+	if rec.file == nil || rec.truncated {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	if rec.written+int64(len(line)) > rec.maxBytes {
+		rec.truncated = true
+		log.Printf("⚠️  Forensic recording for tenant %s reached %d bytes, no longer recording", rec.tenantID, rec.maxBytes)
+		return
+	}
+	n, err := rec.file.Write(line)
+	rec.written += int64(n)
+	if err != nil {
+		log.Printf("⚠️  Failed to write forensic recording for tenant %s: %v", rec.tenantID, err)
+	}
+}
+
+func (rec *tenantRecording) close() {
+	rec.flushMinute(clock.BaseNow())
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.file.Close()
+	rec.file = nil
+}
+
+// observer returns a writer that records the byte counts and TDS packet
+// types of one direction of a connection
+func (rec *tenantRecording) observer(connID uint64, clientToAgent bool) *tdsObserver {
+	return &tdsObserver{rec: rec, connID: connID, clientToAgent: clientToAgent}
+}
+
+// tdsObserver counts the TDS packet types in a byte stream without keeping
+// any payload
+type tdsObserver struct {
+	rec           *tenantRecording
+	connID        uint64
+	clientToAgent bool
+	scanner       tdsHeaderScanner
+}
+
+func (o *tdsObserver) Write(p []byte) (int, error) {
+	n := len(p)
+
+	o.rec.mu.Lock()
+	defer o.rec.mu.Unlock()
+
+	if o.clientToAgent {
+		o.rec.bytesUp += int64(n)
+	} else {
+		o.rec.bytesDown += int64(n)
+	}
+
+	o.scanner.scan(p, func(header tdsHeader) {
+		o.rec.packetTypes[tdsPacketTypeNames[header.Type]]++
+		if o.clientToAgent && header.Type == tdsPacketPrelogin {
+			o.rec.writeLocked(RecordingEntry{Time: clock.BaseNow(), Kind: "prelogin", ConnID: o.connID})
+		}
+		if o.clientToAgent && header.Type == tdsPacketLogin7 {
+			o.rec.writeLocked(RecordingEntry{Time: clock.BaseNow(), Kind: "login", ConnID: o.connID})
+		}
+	}, func() {
+		o.rec.packetTypes["opaque"]++
+	})
+	return n, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+var errTenantNotRegistered = errors.New("tenant not registered")
+
+// maxRemapGrace bounds how long a remapped tenant's old port keeps accepting
+const maxRemapGrace = 7 * 24 * time.Hour
+
+// remapTenantPort moves a registered tenant to newPort. Connections on the old
+// port keep running until they finish; the old port keeps accepting new ones
+// for grace (zero stops it at once), then closes. HIS is sent the new port
+// with the old one as previousPort so it can update stored connection strings.
+func (s *RelayServer) remapTenantPort(tenantID string, newPort int, grace time.Duration) (oldPort int, err error) {
+	if grace < 0 || grace > maxRemapGrace {
+		return 0, fmt.Errorf("grace must be between 0 and %v", maxRemapGrace)
+	}
+
+	s.mu.Lock()
+	tenant, ok := s.tenants[tenantID]
+	if !ok {
+		s.mu.Unlock()
+		return 0, errTenantNotRegistered
+	}
+	if err := s.checkRemapPortLocked(tenant, newPort); err != nil {
+		s.mu.Unlock()
+		return 0, err
+	}
+
+	listener, err := s.listenTenantPort(newPort, s.listeners.Tenant)
+	if err != nil {
+		s.mu.Unlock()
+		return 0, fmt.Errorf("failed to listen on port %d: %w", newPort, err)
+	}
+	if err := s.journalPortLocked(journalAssign, tenantID, newPort); err != nil {
+		listener.Close()
+		s.mu.Unlock()
+		return 0, err
+	}
+	s.takePoolPortLocked(newPort)
+
+	// Only one old port is kept open at a time
+	if tenant.retiredListener != nil {
+		tenant.retiredListener.Close()
+		s.unindexPortLocked(tenant.PreviousPort, tenantID)
+		s.portHistory.Released(tenantID, tenant.PreviousPort)
+	}
+	oldPort = tenant.AssignedPort
+	retired := tenant.Listener
+	tenant.retiredListener = retired
+	tenant.Listener = listener
+	tenant.mu.Lock()
+	tenant.AssignedPort = newPort
+	tenant.PreviousPort = oldPort
+	tenant.mu.Unlock()
+	s.indexPortLocked(oldPort, tenantID, true)
+	s.indexPortLocked(newPort, tenantID, false)
+	s.checkPortIndexLocked()
+	s.portHistory.Assigned(tenantID, newPort)
+	s.mu.Unlock()
+
+	go s.acceptTenantConnections(tenant, listener)
+	if grace == 0 {
+		s.closeRetiredListener(tenant, retired)
+	} else {
+		clock.AfterFunc(grace, func() { s.closeRetiredListener(tenant, retired) })
+	}
+
+	log.Printf("🔀 Tenant %s remapped from port %d to %d (old port accepts for %v)", tenantID, oldPort, newPort, grace)
+	s.events.Emit("port_deprecated", tenantID,
+		fmt.Sprintf("port %d replaced by %d; old port stops accepting at %s", oldPort, newPort, clock.Now().Add(grace).Format(time.RFC3339)))
+
+	// Let HIS rewrite stored connection strings right away
+	go func() {
+		if result := s.syncTenant(tenant); result.Error != "" {
+			log.Printf("⚠️  Failed to report remapped port to HIS for tenant %s: %s", tenantID, result.Error)
+		}
+	}()
+	return oldPort, nil
+}
+
+// checkRemapPortLocked rejects ports outside the tenant range or owned by
+// someone else. Caller holds s.mu.
+func (s *RelayServer) checkRemapPortLocked(tenant *Tenant, port int) error {
+	if port < s.config.TenantPortStart || port > s.config.TenantPortEnd {
+		return fmt.Errorf("port %d is outside the tenant port range %d-%d", port, s.config.TenantPortStart, s.config.TenantPortEnd)
+	}
+	if _, ok := s.reservedPorts[tenant.ID]; ok {
+		return fmt.Errorf("tenant %s has a reserved port; change server.reservedPorts instead", tenant.ID)
+	}
+	for id, reserved := range s.reservedPorts {
+		if reserved == port {
+			return fmt.Errorf("port %d is reserved for tenant %s", port, id)
+		}
+	}
+	if owner, ok := s.portIndex[port]; ok {
+		return fmt.Errorf("port %d is in use by tenant %s", port, owner.TenantID)
+	}
+	return nil
+}
+
+// takePoolPortLocked removes a not yet allocated port from the pool so it
+// isn't handed to a new tenant, reporting whether it was there. Caller holds s.mu.
+func (s *RelayServer) takePoolPortLocked(port int) bool {
+	for i := s.nextPortIndex; i < len(s.portPool); i++ {
+		if s.portPool[i] == port {
+			s.portPool = append(s.portPool[:i], s.portPool[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// closeRetiredListener stops a remapped tenant's old port from accepting
+func (s *RelayServer) closeRetiredListener(tenant *Tenant, retired net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tenant.retiredListener != retired {
+		return
+	}
+	retired.Close()
+	tenant.retiredListener = nil
+	s.unindexPortLocked(tenant.PreviousPort, tenant.ID)
+	s.checkPortIndexLocked()
+	s.portHistory.Released(tenant.ID, tenant.PreviousPort)
+	log.Printf("Tenant %s old port %d closed", tenant.ID, tenant.PreviousPort)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultReputationRefresh = 15 * time.Minute
+	// maxReputationFeedBytes bounds a feed download
+	maxReputationFeedBytes = 32 << 20
+	// reputationSignatureHeader carries the base64 Ed25519 signature of the body
+	reputationSignatureHeader = "X-Signature"
+)
+
+// IPReputationConfig points at an external blocklist feed applied to tenant
+// listeners. The feed is plain text with one IP or CIDR per line; blank lines
+// and # comments are ignored.
+type IPReputationConfig struct {
+	URL            string `json:"url"`
+	RefreshSeconds int    `json:"refreshSeconds"`
+	// PublicKey is a base64 Ed25519 key; when set, feeds whose X-Signature
+	// header doesn't verify are rejected and the previous list stays in use
+	PublicKey string `json:"publicKey"`
+}
+
+// validateIPReputationConfig checks the feed URL and public key
+func validateIPReputationConfig(cfg IPReputationConfig) error {
+	if cfg.URL == "" {
+		return nil
+	}
+	if !strings.HasPrefix(cfg.URL, "https://") && !strings.HasPrefix(cfg.URL, "http://") {
+		return fmt.Errorf("url must be http(s)")
+	}
+	if cfg.PublicKey != "" {
+		key, err := base64.StdEncoding.DecodeString(cfg.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("publicKey must be a base64 Ed25519 public key")
+		}
+	}
+	return nil
+}
+
+// ipBlocklist is one parsed version of the feed
+type ipBlocklist struct {
+	addrs    map[string]bool // single addresses, by canonical string
+	networks []*net.IPNet
+}
+
+func (b *ipBlocklist) contains(ip net.IP) bool {
+	if b.addrs[ip.String()] {
+		return true
+	}
+	for _, network := range b.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIPBlocklist reads a feed, skipping comments and reporting the first bad line
+func parseIPBlocklist(data []byte) (*ipBlocklist, error) {
+	list := &ipBlocklist{addrs: make(map[string]bool)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.Contains(line, "/") {
+			_, network, err := net.ParseCIDR(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid CIDR %q", lineNo, line)
+			}
+			ones, bits := network.Mask.Size()
+			if ones == bits {
+				list.addrs[network.IP.String()] = true
+			} else {
+				list.networks = append(list.networks, network)
+			}
+			continue
+		}
+		ip := net.ParseIP(line)
+		if ip == nil {
+			return nil, fmt.Errorf("line %d: invalid IP %q", lineNo, line)
+		}
+		list.addrs[ip.String()] = true
+	}
+	return list, scanner.Err()
+}
+
+// IPReputation keeps the latest blocklist from the feed and answers lookups
+// for tenant listeners
+type IPReputation struct {
+	cfg         IPReputationConfig
+	publicKey   ed25519.PublicKey
+	httpClient  *http.Client
+	list        atomic.Value // *ipBlocklist
+	blocked     int64
+	lastRefresh time.Time
+	lastError   string
+	mu          sync.Mutex
+}
+
+// NewIPReputation creates a feed client; Run loads and refreshes the list
+func NewIPReputation(cfg IPReputationConfig) *IPReputation {
+	r := &IPReputation{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+	if cfg.PublicKey != "" {
+		key, _ := base64.StdEncoding.DecodeString(cfg.PublicKey)
+		r.publicKey = ed25519.PublicKey(key)
+	}
+	r.list.Store(&ipBlocklist{addrs: make(map[string]bool)})
+	return r
+}
+
+// Run refreshes the list until the process exits; failures keep the previous list
+func (r *IPReputation) Run() {
+	interval := time.Duration(r.cfg.RefreshSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultReputationRefresh
+	}
+
+	for {
+		if err := r.refresh(); err != nil {
+			log.Printf("⚠️  IP reputation feed refresh failed, keeping previous list: %v", err)
+		}
+		clock.Sleep(interval)
+	}
+}
+
+func (r *IPReputation) refresh() error {
+	list, err := r.fetch()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		r.lastError = err.Error()
+		return err
+	}
+	r.list.Store(list)
+	r.lastRefresh = clock.Now()
+	r.lastError = ""
+	log.Printf("🔄 IP reputation feed loaded: %d addresses, %d networks", len(list.addrs), len(list.networks))
+	return nil
+}
+
+func (r *IPReputation) fetch() (*ipBlocklist, error) {
+	resp, err := r.httpClient.Get(r.cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch feed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("feed returned status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxReputationFeedBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read feed: %w", err)
+	}
+	if len(body) > maxReputationFeedBytes {
+		return nil, fmt.Errorf("feed larger than %d bytes", maxReputationFeedBytes)
+	}
+
+	if r.publicKey != nil {
+		signature, err := base64.StdEncoding.DecodeString(resp.Header.Get(reputationSignatureHeader))
+		if err != nil || !ed25519.Verify(r.publicKey, body, signature) {
+			return nil, fmt.Errorf("feed signature missing or invalid")
+		}
+	}
+	return parseIPBlocklist(body)
+}
+
+// Blocked reports whether the connection's source address is on the list
+func (r *IPReputation) Blocked(remoteAddr net.Addr) bool {
+	host, _, err := net.SplitHostPort(remoteAddr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	if !r.list.Load().(*ipBlocklist).contains(ip) {
+		return false
+	}
+	atomic.AddInt64(&r.blocked, 1)
+	return true
+}
+
+// Metrics reports list size, refresh state and blocked connections
+func (r *IPReputation) Metrics() map[string]interface{} {
+	list := r.list.Load().(*ipBlocklist)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	metrics := map[string]interface{}{
+		"addresses": len(list.addrs),
+		"networks":  len(list.networks),
+		"blocked":   atomic.LoadInt64(&r.blocked),
+		"signed":    r.publicKey != nil,
+		"lastError": r.lastError,
+	}
+	if !r.lastRefresh.IsZero() {
+		metrics["lastRefresh"] = r.lastRefresh.Format(time.RFC3339)
+	}
+	return metrics
+}
+
+// refusedByReputation closes a tenant-port connection from a listed source
+func (s *RelayServer) refusedByReputation(conn net.Conn) bool {
+	if s.reputation == nil || !s.reputation.Blocked(conn.RemoteAddr()) {
+		return false
+	}
+	s.siem.Record(siemReputationRefused, "", conn.RemoteAddr().String(), "source is on the IP reputation list")
+	conn.Close()
+	return true
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultTicketRotateMinutes = 60
+	// ticketKeyGenerations is how many key generations decrypt tickets: the
+	// current one and its predecessors, so tickets survive a couple of
+	// rotations and instances with slightly skewed clocks interoperate
+	ticketKeyGenerations = 3
+	minTicketSecretLen   = 32
+)
+
+// TLSResumptionConfig shares TLS session ticket keys between relay instances
+// so an agent reconnecting through the load balancer resumes its session on
+// any of them. Keys are derived from TicketSecret and the current rotation
+// period, so instances agree without talking to each other. Without a secret
+// each instance uses its own automatically rotated keys.
+type TLSResumptionConfig struct {
+	TicketSecret  string `json:"ticketSecret"`
+	RotateMinutes int    `json:"rotateMinutes"`
+}
+
+// validateTLSResumption checks the shared ticket secret is long enough to key
+// the ticket cipher
+func validateTLSResumption(cfg TLSResumptionConfig) error {
+	if cfg.TicketSecret != "" && len(cfg.TicketSecret) < minTicketSecretLen {
+		return fmt.Errorf("ticketSecret must be at least %d bytes", minTicketSecretLen)
+	}
+	if cfg.RotateMinutes < 0 {
+		return fmt.Errorf("rotateMinutes must not be negative")
+	}
+	return nil
+}
+
+// tlsResumption rotates shared ticket keys and counts how many control port
+// handshakes resumed a session
+type tlsResumption struct {
+	secret []byte
+	rotate time.Duration
+	epoch  int64 // current key generation, atomic
+
+	handshakes int64
+	resumed    int64
+}
+
+func newTLSResumption(cfg TLSResumptionConfig) *tlsResumption {
+	minutes := cfg.RotateMinutes
+	if minutes == 0 {
+		minutes = defaultTicketRotateMinutes
+	}
+	return &tlsResumption{
+		secret: []byte(cfg.TicketSecret),
+		rotate: time.Duration(minutes) * time.Minute,
+	}
+}
+
+// ticketKey derives the key of one generation
+func (r *tlsResumption) ticketKey(epoch int64) [32]byte {
+	var label [8]byte
+	binary.BigEndian.PutUint64(label[:], uint64(epoch))
+
+	mac := hmac.New(sha256.New, r.secret)
+	mac.Write([]byte("tatbeeb-link session ticket key"))
+	mac.Write(label[:])
+
+	var key [32]byte
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+// install sets the keys of the generation current at now, newest first, as
+// the first key encrypts new tickets
+func (r *tlsResumption) install(config *tls.Config, now time.Time) {
+	epoch := now.UnixNano() / int64(r.rotate)
+	keys := make([][32]byte, 0, ticketKeyGenerations)
+	for i := int64(0); i < ticketKeyGenerations; i++ {
+		keys = append(keys, r.ticketKey(epoch-i))
+	}
+	config.SetSessionTicketKeys(keys)
+	atomic.StoreInt64(&r.epoch, epoch)
+}
+
+// shared reports whether ticket keys are derived from a shared secret
+func (r *tlsResumption) shared() bool {
+	return len(r.secret) > 0
+}
+
+// Run rotates the shared ticket keys on config at each period boundary
+func (r *tlsResumption) Run(config *tls.Config) {
+	for {
+		now := clock.BaseNow()
+		clock.Sleep(now.Truncate(r.rotate).Add(r.rotate).Sub(now))
+		r.install(config, clock.BaseNow())
+		log.Printf("🔄 Rotated TLS session ticket keys")
+	}
+}
+
+// observe records a completed control port handshake
+func (r *tlsResumption) observe(state tls.ConnectionState) {
+	atomic.AddInt64(&r.handshakes, 1)
+	if state.DidResume {
+		atomic.AddInt64(&r.resumed, 1)
+	}
+}
+
+// Metrics reports the resumption rate for /metrics
+func (r *tlsResumption) Metrics() map[string]interface{} {
+	handshakes := atomic.LoadInt64(&r.handshakes)
+	resumed := atomic.LoadInt64(&r.resumed)
+	metrics := map[string]interface{}{
+		"handshakes": handshakes,
+		"resumed":    resumed,
+		"sharedKeys": r.shared(),
+	}
+	if handshakes > 0 {
+		metrics["resumptionRate"] = float64(resumed) / float64(handshakes)
+	}
+	if r.shared() {
+		metrics["keyGeneration"] = atomic.LoadInt64(&r.epoch)
+		metrics["rotateMinutes"] = int(r.rotate / time.Minute)
+	}
+	return metrics
+}
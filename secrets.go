@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Secret values in the config may point elsewhere instead of holding the
+// secret itself, for containers that mount secrets as env vars or pipe them in
+const (
+	secretPrefixEnv       = "env:"        // env:NAME reads an environment variable
+	secretPrefixEnvBase64 = "env+base64:" // env+base64:NAME reads and base64-decodes one
+	secretPrefixBase64    = "base64:"     // base64:DATA decodes inline data
+	secretPrefixFile      = "file:"       // file:/path reads a file
+	secretPrefixStdin     = "stdin:"      // stdin:NAME looks NAME up in a JSON object read from stdin
+)
+
+// secretResolver expands secret references. Stdin is read at most once, and
+// only if a value refers to it.
+type secretResolver struct {
+	stdin     io.Reader
+	stdinVals map[string]string
+	stdinErr  error
+	stdinRead bool
+}
+
+func newSecretResolver(stdin io.Reader) *secretResolver {
+	return &secretResolver{stdin: stdin}
+}
+
+// resolve returns the secret a config value refers to; other values are
+// returned unchanged
+func (r *secretResolver) resolve(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretPrefixEnvBase64):
+		name := strings.TrimPrefix(value, secretPrefixEnvBase64)
+		encoded, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return decodeBase64Secret(encoded)
+
+	case strings.HasPrefix(value, secretPrefixEnv):
+		name := strings.TrimPrefix(value, secretPrefixEnv)
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, nil
+
+	case strings.HasPrefix(value, secretPrefixBase64):
+		return decodeBase64Secret(strings.TrimPrefix(value, secretPrefixBase64))
+
+	case strings.HasPrefix(value, secretPrefixFile):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(value, secretPrefixFile))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+
+	case strings.HasPrefix(value, secretPrefixStdin):
+		name := strings.TrimPrefix(value, secretPrefixStdin)
+		if err := r.readStdin(); err != nil {
+			return "", err
+		}
+		secret, ok := r.stdinVals[name]
+		if !ok {
+			return "", fmt.Errorf("%q not found in secrets read from stdin", name)
+		}
+		return secret, nil
+	}
+	return value, nil
+}
+
+func (r *secretResolver) readStdin() error {
+	if r.stdinRead {
+		return r.stdinErr
+	}
+	r.stdinRead = true
+
+	data, err := ioutil.ReadAll(r.stdin)
+	if err != nil {
+		r.stdinErr = fmt.Errorf("failed to read secrets from stdin: %w", err)
+		return r.stdinErr
+	}
+	if err := json.Unmarshal(data, &r.stdinVals); err != nil {
+		r.stdinErr = fmt.Errorf("secrets on stdin must be a JSON object of strings: %w", err)
+	}
+	return r.stdinErr
+}
+
+func decodeBase64Secret(encoded string) (string, error) {
+	encoded = strings.TrimSpace(encoded)
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		if decoded, err = base64.RawStdEncoding.DecodeString(encoded); err != nil {
+			return "", fmt.Errorf("invalid base64: %w", err)
+		}
+	}
+	return string(decoded), nil
+}
+
+// resolveSecrets expands secret references in place, returning a problem for
+// each one that can't be resolved
+func (c *RelayFileConfig) resolveSecrets(r *secretResolver) []string {
+	var problems []string
+	expand := func(key string, value *string) {
+		resolved, err := r.resolve(*value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", key, err))
+			return
+		}
+		*value = resolved
+	}
+
+	expand("tls.certPem", &c.TLS.CertPEM)
+	expand("tls.keyPem", &c.TLS.KeyPEM)
+	expand("jwt.secret", &c.JWT.Secret)
+	for i := range c.JWT.PreviousSecrets {
+		expand(fmt.Sprintf("jwt.previousSecrets[%d]", i), &c.JWT.PreviousSecrets[i])
+	}
+	for i := range c.JWT.Issuers {
+		expand(fmt.Sprintf("jwt.issuers[%d].secret", i), &c.JWT.Issuers[i].Secret)
+		for j := range c.JWT.Issuers[i].PreviousSecrets {
+			expand(fmt.Sprintf("jwt.issuers[%d].previousSecrets[%d]", i, j), &c.JWT.Issuers[i].PreviousSecrets[j])
+		}
+	}
+	expand("his.relaySharedSecret", &c.HIS.RelaySharedSecret)
+	for i := range c.HIS.Targets {
+		expand(fmt.Sprintf("his.targets[%d].relaySharedSecret", i), &c.HIS.Targets[i].RelaySharedSecret)
+	}
+	expand("admin.token", &c.Admin.Token)
+	for i := range c.Admin.Principals {
+		expand(fmt.Sprintf("admin.principals[%d].token", i), &c.Admin.Principals[i].Token)
+	}
+	expand("admin.oidc.clientSecret", &c.Admin.OIDC.ClientSecret)
+	expand("tlsResumption.ticketSecret", &c.TLSResumption.TicketSecret)
+	expand("cluster.secret", &c.Cluster.Secret)
+	expand("federation.hashSecret", &c.Federation.HashSecret)
+	return problems
+}
+
+// loadTLSCertificate loads a certificate and key from files or inline PEM
+func loadTLSCertificate(cfg TLSMaterialConfig) (tls.Certificate, error) {
+	certPEM, keyPEM := []byte(cfg.CertPEM), []byte(cfg.KeyPEM)
+	if cfg.CertPEM == "" {
+		data, err := ioutil.ReadFile(cfg.CertFile)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to read certificate: %w", err)
+		}
+		certPEM = data
+	}
+	if cfg.KeyPEM == "" {
+		data, err := ioutil.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to read key: %w", err)
+		}
+		keyPEM = data
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
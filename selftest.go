@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/tatbeeb/tatbeeb-link/common"
+)
+
+const (
+	selfTestTenant  = "selftest"
+	selfTestIssuer  = "tatbeeb-link-relay-selftest"
+	selfTestTimeout = 10 * time.Second
+	selfTestPayload = 64 << 10
+)
+
+// runSelfTest checks a deployed build end to end without touching the real
+// ports or HIS: an embedded agent registers over TLS with the configured
+// certificate, the relay notifies a stub HIS, and a synthetic client
+// connection is echoed back through the agent. Each step is logged; the
+// first failure is returned.
+func runSelfTest(cfg *RelayFileConfig) error {
+	step := func(name string, err error) error {
+		if err != nil {
+			log.Printf("❌ Self-test: %s: %v", name, err)
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		log.Printf("✅ Self-test: %s", name)
+		return nil
+	}
+
+	cert, err := loadTLSCertificate(cfg.TLS)
+	if err := step("load TLS certificate", err); err != nil {
+		return err
+	}
+
+	hisSecret, jwtSecret := randomSelfTestSecret(), randomSelfTestSecret()
+	his, err := startSelfTestHIS(hisSecret)
+	if err := step("start stub HIS", err); err != nil {
+		return err
+	}
+	defer his.Close()
+
+	instanceID := relayInstanceID(cfg.Cluster)
+	hisClient, err := NewMultiHISClient([]HISTargetConfig{{
+		Name:              "selftest",
+		BackendURL:        his.URL,
+		RelaySharedSecret: hisSecret,
+	}}, cfg.HIS.Network, instanceID)
+	if err := step("create HIS client", err); err != nil {
+		return err
+	}
+
+	server := NewRelayServer(&common.RelayConfig{
+		TenantPortStart:         cfg.Server.TenantPortStart,
+		TenantPortEnd:           cfg.Server.TenantPortEnd,
+		MaxConnectionsPerTenant: cfg.Server.MaxConnectionsPerTenant,
+	}, hisClient, []JWTIssuerConfig{{
+		Issuer:    selfTestIssuer,
+		Audiences: []string{selfTestIssuer},
+		Secret:    jwtSecret,
+	}})
+	server.instanceID = instanceID
+	server.region = cfg.Server.Region
+	server.publicHost = cfg.Server.PublicHost
+
+	// The tenant port is bound on loopback at any free port, so a relay
+	// already running on this host is left alone
+	tenantAddrs := make(chan string, 1)
+	server.listenTenantPort = func(port int, tuning ListenerTuning) (net.Listener, error) {
+		listener, err := listenTCP("127.0.0.1:0", tuning)
+		if err == nil {
+			select {
+			case tenantAddrs <- listener.Addr().String():
+			default:
+			}
+		}
+		return listener, err
+	}
+
+	control, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   server.controlALPNProtocols(),
+	})
+	if err := step("open TLS control listener", err); err != nil {
+		return err
+	}
+	go server.Serve(control)
+	defer server.Stop()
+
+	agent, err := connectSelfTestAgent(control.Addr().String(), jwtSecret)
+	if err := step("register agent over TLS", err); err != nil {
+		return err
+	}
+	defer agent.Close()
+
+	err = his.waitForRegistration(selfTestTenant, selfTestTimeout)
+	if err := step("HIS register-port notification", err); err != nil {
+		return err
+	}
+
+	var tenantAddr string
+	select {
+	case tenantAddr = <-tenantAddrs:
+		err = nil
+	case <-time.After(selfTestTimeout):
+		err = errors.New("tenant port was not opened")
+	}
+	if err == nil {
+		err = echoThroughRelay(tenantAddr)
+	}
+	return step("forward a client connection", err)
+}
+
+// randomSelfTestSecret is a throwaway secret for the stub HIS and issuer
+func randomSelfTestSecret() string {
+	raw := make([]byte, 32)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// echoThroughRelay sends random bytes to the tenant port and expects the
+// agent to echo them back unchanged
+func echoThroughRelay(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, selfTestTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to dial tenant port: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(selfTestTimeout))
+
+	sent := make([]byte, selfTestPayload)
+	rand.Read(sent)
+	go conn.Write(sent)
+
+	received := make([]byte, len(sent))
+	if _, err := io.ReadFull(conn, received); err != nil {
+		return fmt.Errorf("failed to read echo: %w", err)
+	}
+	if !bytes.Equal(sent, received) {
+		return errors.New("echoed bytes differ from those sent")
+	}
+	return nil
+}
+
+// selfTestHIS is a stub HIS backend that records register-port calls and
+// accepts every other notification
+type selfTestHIS struct {
+	URL string
+
+	secret     string
+	registered chan RegisterPortRequest
+	server     *http.Server
+}
+
+// startSelfTestHIS serves the stub on a loopback port
+func startSelfTestHIS(secret string) (*selfTestHIS, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	h := &selfTestHIS{
+		URL:        "http://" + listener.Addr().String(),
+		secret:     secret,
+		registered: make(chan RegisterPortRequest, 16),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/tatbeeb-link/register-port", h.handleRegisterPort)
+	mux.HandleFunc("/", h.handleOther)
+	h.server = &http.Server{Handler: mux}
+	go h.server.Serve(listener)
+	return h, nil
+}
+
+func (h *selfTestHIS) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if !hmac.Equal([]byte(r.Header.Get("X-Relay-Secret")), []byte(h.secret)) {
+		http.Error(w, "invalid relay secret", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (h *selfTestHIS) handleRegisterPort(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+	var req RegisterPortRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	select {
+	case h.registered <- req:
+	default:
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RegisterPortResponse{Success: true})
+}
+
+func (h *selfTestHIS) handleOther(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"success":true}`))
+}
+
+// waitForRegistration waits for register-port to be called for tenantID
+func (h *selfTestHIS) waitForRegistration(tenantID string, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case req := <-h.registered:
+			if req.TenantID != tenantID {
+				continue
+			}
+			if req.Port == 0 {
+				return errors.New("register-port reported no port")
+			}
+			return nil
+		case <-deadline:
+			return errors.New("register-port was not called")
+		}
+	}
+}
+
+// Close stops the stub
+func (h *selfTestHIS) Close() error {
+	return h.server.Close()
+}
+
+// selfTestAgent is a minimal agent: it registers like the real one and
+// echoes every data stream the relay opens
+type selfTestAgent struct {
+	session *yamux.Session
+}
+
+// connectSelfTestAgent dials the control port with the agent ALPN protocol
+// and registers selfTestTenant with a token of the self-test issuer
+func connectSelfTestAgent(addr, jwtSecret string) (*selfTestAgent, error) {
+	// The relay presents the configured certificate, whose names need not
+	// resolve to loopback, so it is not verified here
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: selfTestTimeout}, "tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{alpnControl},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto != alpnControl {
+		conn.Close()
+		return nil, fmt.Errorf("relay negotiated ALPN %q, want %q", proto, alpnControl)
+	}
+
+	session, err := yamux.Client(conn, nil)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create yamux session: %w", err)
+	}
+	agent := &selfTestAgent{session: session}
+	if err := agent.register(jwtSecret); err != nil {
+		session.Close()
+		return nil, err
+	}
+	go agent.serveStreams()
+	return agent, nil
+}
+
+func (a *selfTestAgent) register(jwtSecret string) error {
+	control, err := a.session.OpenStream()
+	if err != nil {
+		return fmt.Errorf("failed to open control stream: %w", err)
+	}
+	control.SetDeadline(time.Now().Add(selfTestTimeout))
+
+	token, err := signSelfTestToken(jwtSecret)
+	if err != nil {
+		return fmt.Errorf("failed to sign token: %w", err)
+	}
+	data, err := common.EncodeMessage(common.MsgTypeRegister, common.RegisterPayload{
+		TenantID: selfTestTenant,
+		JWT:      token,
+		Version:  "selftest",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode registration: %w", err)
+	}
+	if _, err := control.Write(data); err != nil {
+		return fmt.Errorf("failed to send registration: %w", err)
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(control).Decode(&raw); err != nil {
+		return fmt.Errorf("failed to read registration response: %w", err)
+	}
+	msg, err := common.DecodeMessage(raw)
+	if err != nil {
+		return fmt.Errorf("failed to decode registration response: %w", err)
+	}
+	switch msg.Type {
+	case common.MsgTypeRegistered:
+		control.SetDeadline(time.Time{})
+		return nil
+	case common.MsgTypeError:
+		var payload common.ErrorPayload
+		common.DecodePayload(msg, &payload)
+		return fmt.Errorf("registration refused: %s: %s", payload.Code, payload.Message)
+	default:
+		return fmt.Errorf("unexpected registration response: %s", msg.Type)
+	}
+}
+
+// serveStreams echoes each data stream until the session closes
+func (a *selfTestAgent) serveStreams() {
+	for {
+		stream, err := a.session.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			io.Copy(stream, stream)
+		}()
+	}
+}
+
+// Close ends the agent's session
+func (a *selfTestAgent) Close() error {
+	return a.session.Close()
+}
+
+// signSelfTestToken mints an HS256 token for selfTestTenant
+func signSelfTestToken(secret string) (string, error) {
+	now := time.Now()
+	payload, err := json.Marshal(map[string]interface{}{
+		"sub": selfTestTenant,
+		"iss": selfTestIssuer,
+		"aud": selfTestIssuer,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	body := base64.RawURLEncoding.EncodeToString(payload)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(header + "." + body))
+	return header + "." + body + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
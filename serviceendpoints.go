@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// ServiceEndpointConfig templates the host and port advertised for one
+// service type, e.g. a per-tenant DNS name for SQL or a shared HL7 ingress.
+// Empty fields default to server.publicHost and the tenant's port.
+type ServiceEndpointConfig struct {
+	Host string `json:"host"`
+	Port string `json:"port"`
+}
+
+// serviceEndpointData is what service endpoint templates can reference
+type serviceEndpointData struct {
+	Service        string
+	TenantID       string
+	OrganizationID string
+	Region         string // this relay's region
+	AgentRegion    string
+	PublicHost     string
+	Port           int // the tenant's assigned port
+}
+
+var serviceEndpointFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+}
+
+// serviceEndpointTemplate is a parsed ServiceEndpointConfig
+type serviceEndpointTemplate struct {
+	host *template.Template
+	port *template.Template
+}
+
+// parseServiceEndpoints parses the templates per service type. The SQL
+// service is always advertised, by default on the public host and the
+// tenant's port. Each template is tried on sample data so a port that does not
+// render as a number fails the boot rather than a registration.
+func parseServiceEndpoints(configured map[string]ServiceEndpointConfig) (map[string]*serviceEndpointTemplate, error) {
+	sources := map[string]ServiceEndpointConfig{serviceSQL: {}}
+	for service, cfg := range configured {
+		if service == "" || strings.ToLower(service) != service {
+			return nil, fmt.Errorf("service type %q must be lowercase and not empty", service)
+		}
+		sources[service] = cfg
+	}
+
+	templates := make(map[string]*serviceEndpointTemplate, len(sources))
+	for service, cfg := range sources {
+		if cfg.Host == "" {
+			cfg.Host = "{{.PublicHost}}"
+		}
+		if cfg.Port == "" {
+			cfg.Port = "{{.Port}}"
+		}
+		host, err := template.New(service + ".host").Funcs(serviceEndpointFuncs).Option("missingkey=error").Parse(cfg.Host)
+		if err != nil {
+			return nil, fmt.Errorf("%s host: %w", service, err)
+		}
+		port, err := template.New(service + ".port").Funcs(serviceEndpointFuncs).Option("missingkey=error").Parse(cfg.Port)
+		if err != nil {
+			return nil, fmt.Errorf("%s port: %w", service, err)
+		}
+		tmpl := &serviceEndpointTemplate{host: host, port: port}
+
+		sample := serviceEndpointData{Service: service, TenantID: "tenant", OrganizationID: "org",
+			Region: "region", AgentRegion: "region", PublicHost: defaultPublicHost, Port: 50000}
+		if _, err := tmpl.render(sample); err != nil {
+			return nil, fmt.Errorf("%s: %w", service, err)
+		}
+		templates[service] = tmpl
+	}
+	return templates, nil
+}
+
+// render executes the templates into an endpoint
+func (t *serviceEndpointTemplate) render(data serviceEndpointData) (AdvertisedEndpoint, error) {
+	var host, port strings.Builder
+	if err := t.host.Execute(&host, data); err != nil {
+		return AdvertisedEndpoint{}, fmt.Errorf("host: %w", err)
+	}
+	if host.Len() == 0 {
+		return AdvertisedEndpoint{}, fmt.Errorf("host rendered empty")
+	}
+	if err := t.port.Execute(&port, data); err != nil {
+		return AdvertisedEndpoint{}, fmt.Errorf("port: %w", err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(port.String()))
+	if err != nil || n < 1 || n > 65535 {
+		return AdvertisedEndpoint{}, fmt.Errorf("port rendered %q, not a port", port.String())
+	}
+	return AdvertisedEndpoint{Host: host.String(), Port: n}, nil
+}
+
+// advertisedServices picks the service types a registering agent is shown
+// endpoints for: those it declares that have a template and its token
+// allows. SQL, the service the relay forwards, is always included.
+func (s *RelayServer) advertisedServices(declared, allowed []string) []string {
+	services := []string{serviceSQL}
+	for _, service := range declared {
+		if service == serviceSQL || containsString(services, service) {
+			continue
+		}
+		if _, ok := s.serviceEndpointTemplates[service]; !ok {
+			continue
+		}
+		if len(allowed) > 0 && !containsString(allowed, service) {
+			continue
+		}
+		services = append(services, service)
+	}
+	sort.Strings(services[1:])
+	return services
+}
+
+// serviceEndpoint renders where clients reach the tenant's service, falling
+// back to the public host and the tenant's port if the template fails
+func (s *RelayServer) serviceEndpoint(tenant *Tenant, service string) AdvertisedEndpoint {
+	fallback := AdvertisedEndpoint{Host: s.publicHost, Port: tenant.AssignedPort}
+	tmpl, ok := s.serviceEndpointTemplates[service]
+	if !ok {
+		return fallback
+	}
+
+	tenant.mu.Lock()
+	data := serviceEndpointData{
+		Service:        service,
+		TenantID:       tenant.ID,
+		OrganizationID: tenant.OrganizationID,
+		Region:         s.region,
+		AgentRegion:    tenant.Region,
+		PublicHost:     s.publicHost,
+		Port:           tenant.AssignedPort,
+	}
+	tenant.mu.Unlock()
+
+	endpoint, err := tmpl.render(data)
+	if err != nil {
+		log.Printf("⚠️  Failed to render %s endpoint for tenant %s, advertising %s:%d: %v",
+			service, tenant.ID, fallback.Host, fallback.Port, err)
+		return fallback
+	}
+	return endpoint
+}
+
+// serviceEndpoints renders an endpoint for each service the tenant registered
+func (s *RelayServer) serviceEndpoints(tenant *Tenant) map[string]AdvertisedEndpoint {
+	tenant.mu.Lock()
+	services := append([]string(nil), tenant.Services...)
+	tenant.mu.Unlock()
+	if len(services) == 0 {
+		services = []string{serviceSQL}
+	}
+
+	endpoints := make(map[string]AdvertisedEndpoint, len(services))
+	for _, service := range services {
+		endpoints[service] = s.serviceEndpoint(tenant, service)
+	}
+	return endpoints
+}
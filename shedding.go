@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Load shedding levels, from least to most severe. Gold tenants are never shed.
+const (
+	shedNone   int32 = iota
+	shedDelay        // accepts for bronze tenants are delayed
+	shedRefuse       // bronze clients are refused, silver accepts delayed
+)
+
+const (
+	defaultShedDelayMillis = 250
+	shedCheckInterval      = time.Second
+)
+
+// LoadSheddingConfig protects gold tenants when the relay is overloaded by
+// slowing down, then refusing, clients of lower tiers before they are
+// accepted. Zero disables a threshold.
+type LoadSheddingConfig struct {
+	CPUPercent        float64 `json:"cpuPercent"`        // delay bronze accepts above this CPU
+	Connections       int     `json:"connections"`       // or this many active connections
+	RefuseCPUPercent  float64 `json:"refuseCpuPercent"`  // refuse bronze clients above this CPU
+	RefuseConnections int     `json:"refuseConnections"` // or this many active connections
+	DelayMillis       int     `json:"delayMillis"`       // how long each delayed accept waits
+	// Bytes held in writes agents haven't accepted, across all tenants, see
+	// flowControl
+	PendingBytes       int64 `json:"pendingBytes"`       // delay bronze accepts above this
+	RefusePendingBytes int64 `json:"refusePendingBytes"` // refuse bronze clients above this
+}
+
+func (c LoadSheddingConfig) enabled() bool {
+	return c.CPUPercent > 0 || c.Connections > 0 || c.RefuseCPUPercent > 0 || c.RefuseConnections > 0 ||
+		c.PendingBytes > 0 || c.RefusePendingBytes > 0
+}
+
+// validateLoadShedding checks refusal thresholds sit above delay thresholds
+func validateLoadShedding(cfg LoadSheddingConfig) error {
+	if cfg.CPUPercent < 0 || cfg.RefuseCPUPercent < 0 || cfg.Connections < 0 || cfg.RefuseConnections < 0 || cfg.DelayMillis < 0 ||
+		cfg.PendingBytes < 0 || cfg.RefusePendingBytes < 0 {
+		return fmt.Errorf("thresholds and delayMillis must not be negative")
+	}
+	if cfg.CPUPercent > 0 && cfg.RefuseCPUPercent > 0 && cfg.RefuseCPUPercent < cfg.CPUPercent {
+		return fmt.Errorf("refuseCpuPercent must not be below cpuPercent")
+	}
+	if cfg.Connections > 0 && cfg.RefuseConnections > 0 && cfg.RefuseConnections < cfg.Connections {
+		return fmt.Errorf("refuseConnections must not be below connections")
+	}
+	if cfg.PendingBytes > 0 && cfg.RefusePendingBytes > 0 && cfg.RefusePendingBytes < cfg.PendingBytes {
+		return fmt.Errorf("refusePendingBytes must not be below pendingBytes")
+	}
+	return nil
+}
+
+// LoadShedder tracks the current shedding level and what it shed per tier
+type LoadShedder struct {
+	cfg   LoadSheddingConfig
+	delay time.Duration
+	level int32 // shedNone, shedDelay or shedRefuse, atomic
+
+	delayed map[string]*int64 // accepts delayed per tier
+	refused map[string]*int64 // clients refused per tier
+	// backpressureDelays counts accepts delayed because the tenant's own
+	// backpressure is saturated, atomic
+	backpressureDelays int64
+}
+
+// NewLoadShedder creates a shedder from the config
+func NewLoadShedder(cfg LoadSheddingConfig) *LoadShedder {
+	delayMillis := cfg.DelayMillis
+	if delayMillis == 0 {
+		delayMillis = defaultShedDelayMillis
+	}
+	l := &LoadShedder{
+		cfg:     cfg,
+		delay:   time.Duration(delayMillis) * time.Millisecond,
+		delayed: make(map[string]*int64),
+		refused: make(map[string]*int64),
+	}
+	for _, tier := range tiersInOrder {
+		l.delayed[tier] = new(int64)
+		l.refused[tier] = new(int64)
+	}
+	return l
+}
+
+// levelFor derives the shedding level from current load
+func (l *LoadShedder) levelFor(cpu float64, connections int, pending int64) int32 {
+	cfg := l.cfg
+	switch {
+	case cfg.RefuseCPUPercent > 0 && cpu >= cfg.RefuseCPUPercent,
+		cfg.RefuseConnections > 0 && connections >= cfg.RefuseConnections,
+		cfg.RefusePendingBytes > 0 && pending >= cfg.RefusePendingBytes:
+		return shedRefuse
+	case cfg.CPUPercent > 0 && cpu >= cfg.CPUPercent,
+		cfg.Connections > 0 && connections >= cfg.Connections,
+		cfg.PendingBytes > 0 && pending >= cfg.PendingBytes:
+		return shedDelay
+	}
+	return shedNone
+}
+
+// action returns whether a new client of a tenant in this tier should wait
+// before being accepted, or be refused outright
+func (l *LoadShedder) action(tier string) (delay time.Duration, refuse bool) {
+	level := atomic.LoadInt32(&l.level)
+	switch {
+	case tier == tierGold || level == shedNone:
+		return 0, false
+	case tier == tierBronze && level == shedRefuse:
+		return 0, true
+	case tier == tierBronze || level == shedRefuse:
+		return l.delay, false
+	}
+	return 0, false
+}
+
+// Metrics reports the current level and what was shed per tier
+func (l *LoadShedder) Metrics() map[string]interface{} {
+	delayed := make(map[string]int64, len(l.delayed))
+	refused := make(map[string]int64, len(l.refused))
+	for tier, n := range l.delayed {
+		delayed[tier] = atomic.LoadInt64(n)
+	}
+	for tier, n := range l.refused {
+		refused[tier] = atomic.LoadInt64(n)
+	}
+	return map[string]interface{}{
+		"level":          shedLevelName(atomic.LoadInt32(&l.level)),
+		"delayMillis":    l.delay.Milliseconds(),
+		"delayedAccepts": delayed,
+		"refusedClients": refused,
+		// Accepts delayed for tenants whose own backpressure is saturated
+		"backpressureDelays": atomic.LoadInt64(&l.backpressureDelays),
+	}
+}
+
+func shedLevelName(level int32) string {
+	switch level {
+	case shedDelay:
+		return "delay"
+	case shedRefuse:
+		return "refuse"
+	}
+	return "none"
+}
+
+// runLoadShedding re-evaluates the shedding level every second until the
+// process exits, logging each change
+func (s *RelayServer) runLoadShedding() {
+	ticker := clock.NewTicker(shedCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+
+		cpu, _ := s.load.Current()
+		s.mu.RLock()
+		connections := s.getTotalConnections()
+		s.mu.RUnlock()
+		pending := s.totalPendingBytes()
+
+		level := s.shedder.levelFor(cpu, connections, pending)
+		previous := atomic.SwapInt32(&s.shedder.level, level)
+		if level == previous {
+			continue
+		}
+		msg := fmt.Sprintf("load shedding %s -> %s (CPU %.0f%%, %d connections, %d bytes pending to agents)",
+			shedLevelName(previous), shedLevelName(level), cpu, connections, pending)
+		if level > previous {
+			log.Printf("⚠️  %s", msg)
+		} else {
+			log.Printf("✅ %s", msg)
+		}
+		s.events.Emit("load_shedding", "", msg)
+	}
+}
+
+// shedBeforeAccept delays the tenant's next accept while the relay sheds
+// load, or while the tenant's own backpressure is saturated, leaving clients
+// in the listen backlog instead of slowing everyone
+func (s *RelayServer) shedBeforeAccept(tenant *Tenant) {
+	if s.shedder == nil {
+		return
+	}
+	if tenant.backpressureSaturated() {
+		atomic.AddInt64(&s.shedder.backpressureDelays, 1)
+		clock.Sleep(s.shedder.delay)
+		return
+	}
+	tier := tenant.tier()
+	if delay, _ := s.shedder.action(tier); delay > 0 {
+		atomic.AddInt64(s.shedder.delayed[tier], 1)
+		clock.Sleep(delay)
+	}
+}
+
+// shedAccepted refuses a just-accepted client of a bronze tenant while the
+// relay is overloaded, reporting whether it did
+func (s *RelayServer) shedAccepted(tenant *Tenant, conn net.Conn) bool {
+	if s.shedder == nil {
+		return false
+	}
+	tier := tenant.tier()
+	if _, refuse := s.shedder.action(tier); !refuse {
+		return false
+	}
+	atomic.AddInt64(s.shedder.refused[tier], 1)
+	go func() {
+		defer conn.Close()
+		s.rejectClient(conn, tenant.ID, "The relay is overloaded, please try again shortly")
+	}()
+	return true
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SIEM export formats and syslog framings
+const (
+	siemFormatCEF  = "cef"
+	siemFormatLEEF = "leef"
+
+	siemFramingOctet   = "octet-counting" // RFC 6587, as RFC 5425 requires over TLS
+	siemFramingNewline = "newline"
+)
+
+const (
+	// siemQueueSize bounds the records waiting for the collector; later ones
+	// are dropped and counted
+	siemQueueSize   = 1000
+	siemDialTimeout = 10 * time.Second
+	siemMaxBackoff  = time.Minute
+
+	// siemSyslogFacility is authpriv, where security events are expected
+	siemSyslogFacility = 10
+)
+
+// SIEMConfig sends security events to a SOC's syslog collector
+type SIEMConfig struct {
+	Address string `json:"address"` // host:port of the collector; empty disables export
+	Format  string `json:"format"`  // cef (default) or leef
+	TLS     bool   `json:"tls"`
+	CAFile  string `json:"caFile"`  // verifies the collector; system roots when empty
+	Framing string `json:"framing"` // octet-counting (default) or newline
+}
+
+// validateSIEM checks the format, framing and address
+func validateSIEM(cfg SIEMConfig) error {
+	if cfg.Address == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		return fmt.Errorf("address %q must be host:port", cfg.Address)
+	}
+	switch cfg.Format {
+	case "", siemFormatCEF, siemFormatLEEF:
+	default:
+		return fmt.Errorf("format %q must be %q or %q", cfg.Format, siemFormatCEF, siemFormatLEEF)
+	}
+	switch cfg.Framing {
+	case "", siemFramingOctet, siemFramingNewline:
+	default:
+		return fmt.Errorf("framing %q must be %q or %q", cfg.Framing, siemFramingOctet, siemFramingNewline)
+	}
+	if cfg.CAFile != "" && !cfg.TLS {
+		return errors.New("caFile requires tls")
+	}
+	return nil
+}
+
+// siemSignature identifies a kind of security event to the SIEM
+type siemSignature struct {
+	ID       string
+	Name     string
+	Severity int // 0-10
+}
+
+// siemEventSignatures are the relay events exported, by event type
+var siemEventSignatures = map[string]siemSignature{
+	"tenant_blocked":        {"200", "Tenant blocked", 6},
+	"tenant_unblocked":      {"201", "Tenant unblocked", 3},
+	"tenant_killed":         {"210", "Tenant kill switch used", 8},
+	"access_freeze_started": {"211", "Tenant access frozen", 5},
+	"tenant_state_changed":  {"212", "Tenant state changed", 3},
+	"tenant_flapping":       {"300", "Tenant registration flapping", 5},
+	"byte_cap_exceeded":     {"301", "Tenant byte cap exceeded", 5},
+}
+
+// Security events reported as they happen rather than through the event log,
+// which would be flooded by them
+var (
+	siemAgentAuthFailed     = siemSignature{"100", "Agent authentication failed", 7}
+	siemAdminAuthFailed     = siemSignature{"101", "Admin authentication failed", 7}
+	siemHISAuthFailed       = siemSignature{"102", "HIS call signature rejected", 7}
+	siemRegistrationBlocked = siemSignature{"103", "Blocked tenant attempted to register", 7}
+	siemProtocolRejected    = siemSignature{"302", "Non-TDS client rejected", 6}
+	siemReputationRefused   = siemSignature{"303", "Client refused by IP reputation", 6}
+	siemSourceIPCapRefused  = siemSignature{"304", "Client refused by source IP cap", 5}
+)
+
+// siemRecord is one security event to export
+type siemRecord struct {
+	Time      time.Time
+	Signature siemSignature
+	TenantID  string
+	Source    string // remote host:port, if any
+	Message   string
+}
+
+// SIEMExporter formats security events as CEF or LEEF and sends them to a
+// syslog collector over TCP, optionally TLS, reconnecting with backoff
+type SIEMExporter struct {
+	cfg             SIEMConfig
+	dialTLS         *tls.Config // nil for plain TCP
+	hostname        string
+	virtualInstance string
+	queue           chan siemRecord
+
+	sent      int64 // atomic
+	dropped   int64 // queue full, atomic
+	failures  int64 // failed dials and writes, atomic
+	connected int32 // atomic
+}
+
+// NewSIEMExporter prepares the exporter; Run connects and sends
+func NewSIEMExporter(cfg SIEMConfig, virtualInstance string) (*SIEMExporter, error) {
+	if cfg.Format == "" {
+		cfg.Format = siemFormatCEF
+	}
+	if cfg.Framing == "" {
+		cfg.Framing = siemFramingOctet
+	}
+	hostname, _ := os.Hostname()
+	e := &SIEMExporter{
+		cfg:             cfg,
+		hostname:        hostname,
+		virtualInstance: virtualInstance,
+		queue:           make(chan siemRecord, siemQueueSize),
+	}
+	if cfg.TLS {
+		host, _, _ := net.SplitHostPort(cfg.Address)
+		e.dialTLS = &tls.Config{MinVersion: tls.VersionTLS12, ServerName: host}
+		if cfg.CAFile != "" {
+			pem, err := ioutil.ReadFile(cfg.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read SIEM CA: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in SIEM CA %s", cfg.CAFile)
+			}
+			e.dialTLS.RootCAs = pool
+		}
+	}
+	return e, nil
+}
+
+// Record queues a security event without blocking; a nil exporter ignores it
+func (e *SIEMExporter) Record(sig siemSignature, tenantID, source, message string) {
+	if e == nil {
+		return
+	}
+	e.enqueue(siemRecord{Time: clock.BaseNow(), Signature: sig, TenantID: tenantID, Source: source, Message: message})
+}
+
+// exportEvent queues a relay event if it is security relevant
+func (e *SIEMExporter) exportEvent(event Event) {
+	sig, ok := siemEventSignatures[event.Type]
+	if !ok {
+		return
+	}
+	e.enqueue(siemRecord{Time: event.Time, Signature: sig, TenantID: event.TenantID, Message: event.Message})
+}
+
+func (e *SIEMExporter) enqueue(rec siemRecord) {
+	select {
+	case e.queue <- rec:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+	}
+}
+
+// Run sends queued records until the process exits. A record that could not
+// be written is sent again on the next connection.
+func (e *SIEMExporter) Run() {
+	var conn net.Conn
+	var backoff time.Duration
+	for rec := range e.queue {
+		frame := e.frame(rec)
+		for {
+			if conn == nil {
+				var err error
+				conn, err = e.dial()
+				if err != nil {
+					atomic.AddInt64(&e.failures, 1)
+					backoff *= 2
+					if backoff == 0 {
+						backoff = time.Second
+					}
+					if backoff > siemMaxBackoff {
+						backoff = siemMaxBackoff
+					}
+					log.Printf("⚠️  SIEM collector %s unreachable, retrying in %v: %v", e.cfg.Address, backoff, err)
+					clock.Sleep(backoff)
+					continue
+				}
+				backoff = 0
+				atomic.StoreInt32(&e.connected, 1)
+				log.Printf("✅ Connected to SIEM collector %s (%s)", e.cfg.Address, e.cfg.Format)
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(siemDialTimeout))
+			if _, err := conn.Write(frame); err != nil {
+				atomic.AddInt64(&e.failures, 1)
+				atomic.StoreInt32(&e.connected, 0)
+				log.Printf("⚠️  SIEM collector %s write failed, reconnecting: %v", e.cfg.Address, err)
+				conn.Close()
+				conn = nil
+				continue
+			}
+			atomic.AddInt64(&e.sent, 1)
+			break
+		}
+	}
+}
+
+// dial connects to the collector, over TLS if configured
+func (e *SIEMExporter) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: siemDialTimeout, KeepAlive: 30 * time.Second}
+	if e.dialTLS != nil {
+		return tls.DialWithDialer(dialer, "tcp", e.cfg.Address, e.dialTLS)
+	}
+	return dialer.Dial("tcp", e.cfg.Address)
+}
+
+// frame wraps a record in an RFC 5424 syslog message with the configured
+// framing
+func (e *SIEMExporter) frame(rec siemRecord) []byte {
+	var payload string
+	if e.cfg.Format == siemFormatLEEF {
+		payload = e.leef(rec)
+	} else {
+		payload = e.cef(rec)
+	}
+
+	hostname := e.hostname
+	if hostname == "" {
+		hostname = "-"
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s tatbeeb-link - %s - %s",
+		siemSyslogFacility*8+syslogSeverity(rec.Signature.Severity),
+		rec.Time.UTC().Format(time.RFC3339Nano), hostname, rec.Signature.ID, payload)
+
+	if e.cfg.Framing == siemFramingNewline {
+		return []byte(msg + "\n")
+	}
+	return []byte(strconv.Itoa(len(msg)) + " " + msg)
+}
+
+// syslogSeverity maps a 0-10 event severity to a syslog severity
+func syslogSeverity(severity int) int {
+	switch {
+	case severity >= 8:
+		return 2 // critical
+	case severity >= 6:
+		return 4 // warning
+	default:
+		return 5 // notice
+	}
+}
+
+// cef formats a record as ArcSight Common Event Format
+func (e *SIEMExporter) cef(rec siemRecord) string {
+	ext := []string{"rt=" + strconv.FormatInt(rec.Time.UnixNano()/int64(time.Millisecond), 10)}
+	if host, port, err := net.SplitHostPort(rec.Source); err == nil {
+		ext = append(ext, "src="+cefValue(host), "spt="+cefValue(port))
+	}
+	if e.hostname != "" {
+		ext = append(ext, "dvchost="+cefValue(e.hostname))
+	}
+	if rec.TenantID != "" {
+		ext = append(ext, "cs1Label=tenantId", "cs1="+cefValue(rec.TenantID))
+	}
+	if e.virtualInstance != "" {
+		ext = append(ext, "cs2Label=virtualInstance", "cs2="+cefValue(e.virtualInstance))
+	}
+	if rec.Message != "" {
+		ext = append(ext, "msg="+cefValue(rec.Message))
+	}
+	return fmt.Sprintf("CEF:0|Tatbeeb|Tatbeeb Link Relay|%s|%s|%s|%d|%s",
+		cefHeader(version), cefHeader(rec.Signature.ID), cefHeader(rec.Signature.Name), rec.Signature.Severity, strings.Join(ext, " "))
+}
+
+// leef formats a record as IBM QRadar Log Event Extended Format 1.0
+func (e *SIEMExporter) leef(rec siemRecord) string {
+	attrs := []string{
+		"devTime=" + rec.Time.UTC().Format("Jan 02 2006 15:04:05.000 UTC"),
+		"devTimeFormat=MMM dd yyyy HH:mm:ss.SSS z",
+		"cat=" + leefValue(rec.Signature.Name),
+		"sev=" + strconv.Itoa(leefSeverity(rec.Signature.Severity)),
+	}
+	if host, port, err := net.SplitHostPort(rec.Source); err == nil {
+		attrs = append(attrs, "src="+leefValue(host), "srcPort="+leefValue(port))
+	}
+	if rec.TenantID != "" {
+		attrs = append(attrs, "tenantId="+leefValue(rec.TenantID))
+	}
+	if e.virtualInstance != "" {
+		attrs = append(attrs, "virtualInstance="+leefValue(e.virtualInstance))
+	}
+	if rec.Message != "" {
+		attrs = append(attrs, "msg="+leefValue(rec.Message))
+	}
+	return fmt.Sprintf("LEEF:1.0|Tatbeeb|Tatbeeb Link Relay|%s|%s|%s",
+		leefHeader(version), leefHeader(rec.Signature.ID), strings.Join(attrs, "\t"))
+}
+
+// leefSeverity maps 0-10 to LEEF's 1-10
+func leefSeverity(severity int) int {
+	if severity < 1 {
+		return 1
+	}
+	return severity
+}
+
+var (
+	cefHeaderEscaper  = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefValueEscaper   = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+	leefHeaderEscaper = strings.NewReplacer(`|`, `\|`, "\n", " ", "\r", " ", "\t", " ")
+	leefValueEscaper  = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+)
+
+func cefHeader(s string) string  { return cefHeaderEscaper.Replace(s) }
+func cefValue(s string) string   { return cefValueEscaper.Replace(s) }
+func leefHeader(s string) string { return leefHeaderEscaper.Replace(s) }
+func leefValue(s string) string  { return leefValueEscaper.Replace(s) }
+
+// Metrics reports delivery to the collector
+func (e *SIEMExporter) Metrics() map[string]interface{} {
+	return map[string]interface{}{
+		"address":   e.cfg.Address,
+		"format":    e.cfg.Format,
+		"connected": atomic.LoadInt32(&e.connected) == 1,
+		"queued":    len(e.queue),
+		"sent":      atomic.LoadInt64(&e.sent),
+		"dropped":   atomic.LoadInt64(&e.dropped),
+		"failures":  atomic.LoadInt64(&e.failures),
+	}
+}
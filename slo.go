@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSLOTargetPercent = 99.5
+	sloSampleInterval       = time.Minute
+	// sloRetention is the longest report window; samples are kept in hourly
+	// buckets for this long
+	sloRetention = 30 * 24 * time.Hour
+
+	// Why a tenant was sampled as unavailable
+	sloReasonRegistering  = "registering"
+	sloReasonDegraded     = "stream_open_failures"
+	sloReasonDraining     = "relay_draining"
+	sloReasonDisconnected = "agent_disconnected"
+)
+
+// sloWindows are the rolling windows availability is reported over
+var sloWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", sloRetention},
+}
+
+// SLOConfig sets the availability target tenants are measured against.
+// Without a file the samples last until the relay restarts.
+type SLOConfig struct {
+	TargetPercent float64 `json:"targetPercent"` // default 99.5
+	File          string  `json:"file"`
+}
+
+// validateSLO checks the target is a percentage short of 100
+func validateSLO(cfg SLOConfig) error {
+	if cfg.TargetPercent < 0 || cfg.TargetPercent >= 100 {
+		return errors.New("targetPercent must be at least 0 and below 100")
+	}
+	return nil
+}
+
+// sloBucket counts one hour of minute samples for a tenant. Excluded minutes,
+// e.g. an access freeze, count neither for nor against the tenant.
+type sloBucket struct {
+	Hour     int64          `json:"hour"` // unix hour
+	Up       int            `json:"up"`
+	Excluded int            `json:"excluded,omitempty"`
+	Down     map[string]int `json:"down,omitempty"` // by reason
+}
+
+// sloTenant is a tenant's hourly buckets, oldest first
+type sloTenant struct {
+	Since   time.Time    `json:"since"`
+	Buckets []*sloBucket `json:"buckets"`
+}
+
+// TenantSLO is a tenant's availability over one window. Only minutes the
+// relay was running are sampled, so relay downtime is not charged to tenants.
+type TenantSLO struct {
+	TenantID               string         `json:"tenantId"`
+	Window                 string         `json:"window"`
+	AvailabilityPercent    float64        `json:"availabilityPercent"`
+	UpMinutes              int            `json:"upMinutes"`
+	DownMinutes            int            `json:"downMinutes"`
+	ExcludedMinutes        int            `json:"excludedMinutes,omitempty"`
+	BudgetMinutes          float64        `json:"budgetMinutes"`
+	BudgetRemainingMinutes float64        `json:"budgetRemainingMinutes"`
+	Breaching              bool           `json:"breaching"`
+	DownReasons            map[string]int `json:"downReasons,omitempty"`
+}
+
+// SLOTracker samples every tenant it has seen once a minute and reports their
+// availability against the target over rolling windows
+type SLOTracker struct {
+	target   float64
+	path     string
+	tenants  map[string]*sloTenant
+	lastSave int64 // unix hour
+	mu       sync.Mutex
+}
+
+// NewSLOTracker loads the retained samples from cfg.File, if set
+func NewSLOTracker(cfg SLOConfig) (*SLOTracker, error) {
+	target := cfg.TargetPercent
+	if target == 0 {
+		target = defaultSLOTargetPercent
+	}
+	t := &SLOTracker{target: target, path: cfg.File, tenants: make(map[string]*sloTenant)}
+	if t.path == "" {
+		return t, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create SLO dir: %w", err)
+	}
+	data, err := os.ReadFile(t.path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SLO samples: %w", err)
+	}
+	if err := json.Unmarshal(data, &t.tenants); err != nil {
+		return nil, fmt.Errorf("failed to parse SLO samples: %w", err)
+	}
+	if t.tenants == nil {
+		t.tenants = make(map[string]*sloTenant)
+	}
+	return t, nil
+}
+
+// sloOutcome classifies a tenant state: up, excluded or down with a reason
+func sloOutcome(state string) (up, excluded bool, reason string) {
+	switch state {
+	case tenantStateActive:
+		return true, false, ""
+	case tenantStateSuspended:
+		return false, true, ""
+	case tenantStateRegistering:
+		return false, false, sloReasonRegistering
+	case tenantStateDegraded:
+		return false, false, sloReasonDegraded
+	case tenantStateDraining:
+		return false, false, sloReasonDraining
+	default:
+		return false, false, sloReasonDisconnected
+	}
+}
+
+// Record adds one minute sample for tenantID
+func (t *SLOTracker) Record(tenantID, state string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tenant, ok := t.tenants[tenantID]
+	if !ok {
+		tenant = &sloTenant{Since: now.UTC()}
+		t.tenants[tenantID] = tenant
+	}
+	hour := now.Unix() / 3600
+	var bucket *sloBucket
+	if n := len(tenant.Buckets); n > 0 && tenant.Buckets[n-1].Hour == hour {
+		bucket = tenant.Buckets[n-1]
+	} else {
+		bucket = &sloBucket{Hour: hour}
+		tenant.Buckets = append(tenant.Buckets, bucket)
+	}
+
+	up, excluded, reason := sloOutcome(state)
+	switch {
+	case up:
+		bucket.Up++
+	case excluded:
+		bucket.Excluded++
+	default:
+		if bucket.Down == nil {
+			bucket.Down = make(map[string]int)
+		}
+		bucket.Down[reason]++
+	}
+}
+
+// Tracked returns the IDs of the tenants being sampled
+func (t *SLOTracker) Tracked() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ids := make([]string, 0, len(t.tenants))
+	for tenantID := range t.tenants {
+		ids = append(ids, tenantID)
+	}
+	return ids
+}
+
+// prune drops buckets older than the retention, and tenants that were never
+// up for a whole retention period, e.g. clinics that were decommissioned
+func (t *SLOTracker) prune(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cutoff := now.Add(-sloRetention).Unix() / 3600
+	for tenantID, tenant := range t.tenants {
+		kept := tenant.Buckets[:0]
+		everUp := false
+		for _, bucket := range tenant.Buckets {
+			if bucket.Hour > cutoff {
+				kept = append(kept, bucket)
+				everUp = everUp || bucket.Up > 0
+			}
+		}
+		tenant.Buckets = kept
+		if !everUp && now.Sub(tenant.Since) > sloRetention {
+			delete(t.tenants, tenantID)
+		}
+	}
+}
+
+// save rewrites the samples file, at most once an hour
+func (t *SLOTracker) save(now time.Time) {
+	if t.path == "" {
+		return
+	}
+	t.mu.Lock()
+	hour := now.Unix() / 3600
+	if hour == t.lastSave {
+		t.mu.Unlock()
+		return
+	}
+	t.lastSave = hour
+	data, err := json.Marshal(t.tenants)
+	t.mu.Unlock()
+	if err != nil {
+		log.Printf("⚠️  Failed to encode SLO samples: %v", err)
+		return
+	}
+
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("⚠️  Failed to save SLO samples to %s: %v", t.path, err)
+		return
+	}
+	if err := os.Rename(tmp, t.path); err != nil {
+		log.Printf("⚠️  Failed to save SLO samples to %s: %v", t.path, err)
+	}
+}
+
+// reportLocked sums a tenant's buckets within the window. Callers hold t.mu.
+func (t *SLOTracker) reportLocked(tenantID string, tenant *sloTenant, window string, duration time.Duration, now time.Time) TenantSLO {
+	report := TenantSLO{TenantID: tenantID, Window: window, DownReasons: map[string]int{}}
+	cutoff := now.Add(-duration).Unix() / 3600
+	for _, bucket := range tenant.Buckets {
+		if bucket.Hour <= cutoff {
+			continue
+		}
+		report.UpMinutes += bucket.Up
+		report.ExcludedMinutes += bucket.Excluded
+		for reason, minutes := range bucket.Down {
+			report.DownMinutes += minutes
+			report.DownReasons[reason] += minutes
+		}
+	}
+
+	counted := report.UpMinutes + report.DownMinutes
+	report.AvailabilityPercent = 100
+	if counted > 0 {
+		report.AvailabilityPercent = 100 * float64(report.UpMinutes) / float64(counted)
+	}
+	report.BudgetMinutes = float64(counted) * (100 - t.target) / 100
+	report.BudgetRemainingMinutes = report.BudgetMinutes - float64(report.DownMinutes)
+	report.Breaching = report.AvailabilityPercent < t.target
+	return report
+}
+
+// Report returns every tenant's availability over the window, worst first
+func (t *SLOTracker) Report(window string, now time.Time) ([]TenantSLO, error) {
+	var duration time.Duration
+	for _, w := range sloWindows {
+		if w.name == window {
+			duration = w.duration
+		}
+	}
+	if duration == 0 {
+		return nil, fmt.Errorf("unknown window %q", window)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	reports := make([]TenantSLO, 0, len(t.tenants))
+	for tenantID, tenant := range t.tenants {
+		reports = append(reports, t.reportLocked(tenantID, tenant, window, duration, now))
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].AvailabilityPercent != reports[j].AvailabilityPercent {
+			return reports[i].AvailabilityPercent < reports[j].AvailabilityPercent
+		}
+		return reports[i].TenantID < reports[j].TenantID
+	})
+	return reports, nil
+}
+
+// Metrics reports each tenant's availability per window and how many breach
+// the target
+func (t *SLOTracker) Metrics() map[string]interface{} {
+	now := clock.BaseNow()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	breaching := make(map[string]int, len(sloWindows))
+	availability := make(map[string]map[string]float64, len(t.tenants))
+	for tenantID, tenant := range t.tenants {
+		availability[tenantID] = make(map[string]float64, len(sloWindows))
+		for _, w := range sloWindows {
+			report := t.reportLocked(tenantID, tenant, w.name, w.duration, now)
+			availability[tenantID][w.name] = report.AvailabilityPercent
+			if report.Breaching {
+				breaching[w.name]++
+			}
+		}
+	}
+	return map[string]interface{}{
+		"targetPercent": t.target,
+		"breaching":     breaching,
+		"availability":  availability,
+	}
+}
+
+// runSLOSampler samples every registered or previously seen tenant once a
+// minute. A tenant that is gone keeps being sampled as disconnected.
+func (s *RelayServer) runSLOSampler() {
+	ticker := clock.NewTicker(sloSampleInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		tenantIDs := map[string]bool{}
+		for _, tenantID := range s.slo.Tracked() {
+			tenantIDs[tenantID] = true
+		}
+		s.mu.RLock()
+		for tenantID := range s.tenants {
+			tenantIDs[tenantID] = true
+		}
+		s.mu.RUnlock()
+
+		for tenantID := range tenantIDs {
+			s.slo.Record(tenantID, s.tenantStates.State(tenantID), now)
+		}
+		s.slo.prune(now)
+		s.slo.save(now)
+	}
+}
+
+// handleAdminSLO serves GET /admin/slo?window=24h|7d|30d[&breaching=1], each
+// tenant's availability worst first
+func (s *RelayServer) handleAdminSLO(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		window = "7d"
+	}
+	reports, err := s.slo.Report(window, clock.BaseNow())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "window must be one of 24h, 7d or 30d")
+		return
+	}
+	if r.URL.Query().Get("breaching") == "1" {
+		breaching := reports[:0]
+		for _, report := range reports {
+			if report.Breaching {
+				breaching = append(breaching, report)
+			}
+		}
+		reports = breaching
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"targetPercent": s.slo.target,
+		"window":        window,
+		"tenants":       reports,
+	})
+}
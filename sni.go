@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sniCertReloadInterval = 5 * time.Minute
+	sniHandshakeTimeout   = 10 * time.Second
+)
+
+// SNIConfig enables hostname-based routing: SQL clients connect to one shared
+// TLS port and are routed by SNI hostname <tenantId><HostSuffix>
+type SNIConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Port       int    `json:"port"`
+	HostSuffix string `json:"hostSuffix"`
+	CertDir    string `json:"certDir"`
+}
+
+// SNICertStore serves per-tenant certificates loaded from a directory. Each
+// certificate is indexed by the DNS names it covers, so both individually
+// issued and wildcard certificates work. Files are <name>.crt (or .pem) with a
+// matching <name>.key.
+type SNICertStore struct {
+	dir      string
+	fallback *tls.Certificate
+	certs    map[string]*tls.Certificate
+	mu       sync.RWMutex
+}
+
+// NewSNICertStore loads certificates from dir; fallback is served when no
+// certificate matches the requested hostname
+func NewSNICertStore(dir string, fallback *tls.Certificate) (*SNICertStore, error) {
+	store := &SNICertStore{
+		dir:      dir,
+		fallback: fallback,
+		certs:    make(map[string]*tls.Certificate),
+	}
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Reload rescans the certificate directory, picking up newly issued certificates
+func (cs *SNICertStore) Reload() error {
+	if cs.dir == "" {
+		return nil
+	}
+
+	entries, err := os.ReadDir(cs.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read certificate directory: %w", err)
+	}
+
+	certs := make(map[string]*tls.Certificate)
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".crt" && ext != ".pem") {
+			continue
+		}
+
+		certFile := filepath.Join(cs.dir, entry.Name())
+		keyFile := strings.TrimSuffix(certFile, ext) + ".key"
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.Printf("⚠️  Skipping SNI certificate %s: %v", certFile, err)
+			continue
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			log.Printf("⚠️  Skipping SNI certificate %s: %v", certFile, err)
+			continue
+		}
+		cert.Leaf = leaf
+
+		for _, name := range leaf.DNSNames {
+			certs[strings.ToLower(name)] = &cert
+		}
+	}
+
+	cs.mu.Lock()
+	cs.certs = certs
+	cs.mu.Unlock()
+
+	log.Printf("Loaded SNI certificates for %d hostnames from %s", len(certs), cs.dir)
+	return nil
+}
+
+// GetCertificate selects a certificate by exact hostname, then by wildcard
+func (cs *SNICertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(hello.ServerName)
+
+	cs.mu.RLock()
+	cert, ok := cs.certs[name]
+	if !ok {
+		if dot := strings.Index(name, "."); dot > 0 {
+			cert, ok = cs.certs["*"+name[dot:]]
+		}
+	}
+	cs.mu.RUnlock()
+
+	if ok {
+		return cert, nil
+	}
+	if cs.fallback != nil {
+		return cs.fallback, nil
+	}
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
+
+func (cs *SNICertStore) reloadPeriodically() {
+	ticker := clock.NewTicker(sniCertReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		if err := cs.Reload(); err != nil {
+			log.Printf("⚠️  SNI certificate reload failed: %v", err)
+		}
+	}
+}
+
+// startSNIListener accepts SQL clients on the shared SNI port and routes each
+// to the tenant named by its TLS server name
+func (s *RelayServer) startSNIListener(store *SNICertStore) error {
+	tcpListener, err := listenTCP(fmt.Sprintf(":%d", s.sni.Port), s.listeners.SNI)
+	if err != nil {
+		return fmt.Errorf("failed to start SNI listener: %w", err)
+	}
+	listener := tls.NewListener(tcpListener, &tls.Config{
+		GetCertificate: store.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	})
+
+	log.Printf("   SNI routing: port %d, hosts *%s", s.sni.Port, s.sni.HostSuffix)
+
+	go func() {
+		var backoff time.Duration
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if isTemporaryAcceptError(err) {
+					backoff = acceptBackoff(backoff)
+					log.Printf("SNI accept error: %v; retrying in %v", err, backoff)
+					clock.Sleep(backoff)
+					continue
+				}
+				log.Printf("SNI listener stopped: %v", err)
+				return
+			}
+			backoff = 0
+
+			go s.routeSNIConnection(conn.(*tls.Conn))
+		}
+	}()
+	return nil
+}
+
+func (s *RelayServer) routeSNIConnection(conn *tls.Conn) {
+	if s.refusedByReputation(conn) {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(sniHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		log.Printf("SNI handshake from %s failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	serverName := strings.ToLower(conn.ConnectionState().ServerName)
+	tenant := s.tenantForHostname(serverName)
+	if tenant == nil {
+		// The tenant may be registered on another instance of the cluster
+		if label, ok := s.sniLabel(serverName); ok && s.tunnel != nil {
+			s.proxyToOwner(label, conn)
+			return
+		}
+		log.Printf("SNI connection from %s for unknown host %q", conn.RemoteAddr(), serverName)
+		conn.Close()
+		return
+	}
+
+	if !tenant.acquireConn() {
+		log.Printf("Tenant %s connection limit reached (%d)", tenant.ID, tenant.MaxConns)
+		conn.Close()
+		return
+	}
+
+	s.handleTenantConnection(tenant, conn)
+}
+
+// tenantForHostname maps <tenantId><HostSuffix> to a registered tenant.
+// Hostnames are case-insensitive, tenant IDs may not be.
+func (s *RelayServer) tenantForHostname(hostname string) *Tenant {
+	label, ok := s.sniLabel(hostname)
+	if !ok {
+		return nil
+	}
+	return s.tenantByIDFold(label)
+}
+
+// sniLabel returns the tenant label of <tenantId><HostSuffix>
+func (s *RelayServer) sniLabel(hostname string) (string, bool) {
+	suffix := strings.ToLower(s.sni.HostSuffix)
+	if !strings.HasSuffix(hostname, suffix) {
+		return "", false
+	}
+	label := strings.TrimSuffix(hostname, suffix)
+	if label == "" || strings.Contains(label, ".") {
+		return "", false
+	}
+	return label, true
+}
+
+// tenantByIDFold finds a registered tenant by ID, ignoring case if there is
+// no exact match
+func (s *RelayServer) tenantByIDFold(label string) *Tenant {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if tenant, ok := s.tenants[label]; ok {
+		return tenant
+	}
+	for id, tenant := range s.tenants {
+		if strings.EqualFold(id, label) {
+			return tenant
+		}
+	}
+	return nil
+}
+
+// sniHostname returns the hostname a tenant is reachable at in SNI mode
+func (s *RelayServer) sniHostname(tenantID string) string {
+	return strings.ToLower(tenantID) + s.sni.HostSuffix
+}
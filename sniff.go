@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// defaultPreloginTimeout bounds how long a client may take to send its first
+// bytes when the protocol guard is enabled, so half-open clients never get an
+// agent stream
+const defaultPreloginTimeout = 5 * time.Second
+
+// errPreloginTimeout means the client sent no complete first packet header in time
+var errPreloginTimeout = errors.New("no pre-login bytes received")
+
+// protocolValidators check a client's first bytes per service
+var protocolValidators = map[string]struct {
+	length   int
+	validate func(first []byte) error
+}{
+	serviceSQL: {tdsHeaderLength, validateTDSPrelogin},
+}
+
+// validateTDSPrelogin accepts a TDS packet header that starts a SQL Server
+// session: PRELOGIN, or LOGIN7/legacy login from old clients
+func validateTDSPrelogin(first []byte) error {
+	switch {
+	case bytes.HasPrefix(first, []byte("GET ")), bytes.HasPrefix(first, []byte("POST ")),
+		bytes.HasPrefix(first, []byte("HEAD ")), bytes.HasPrefix(first, []byte("OPTIONS ")):
+		return fmt.Errorf("looks like HTTP")
+	case first[0] == 0x16:
+		return fmt.Errorf("looks like a raw TLS handshake")
+	}
+
+	switch first[0] {
+	case tdsPacketPrelogin, tdsPacketLogin7, 0x02:
+	default:
+		return fmt.Errorf("unexpected first packet type 0x%02x", first[0])
+	}
+	if length := binary.BigEndian.Uint16(first[2:4]); length < tdsHeaderLength {
+		return fmt.Errorf("invalid TDS packet length %d", length)
+	}
+	return nil
+}
+
+// sniffClient reads the client's first bytes and checks they match the
+// service's protocol before anything is forwarded into the clinic network.
+// It returns a reader that replays the sniffed bytes followed by the rest of
+// the connection.
+func sniffClient(clientConn net.Conn, service string, timeout time.Duration) (io.Reader, error) {
+	validator, ok := protocolValidators[service]
+	if !ok {
+		return clientConn, nil
+	}
+
+	first := make([]byte, validator.length)
+	clientConn.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := io.ReadFull(clientConn, first); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fmt.Errorf("%w within %v", errPreloginTimeout, timeout)
+		}
+		return nil, fmt.Errorf("failed to read first bytes: %w", err)
+	}
+	clientConn.SetReadDeadline(time.Time{})
+
+	if err := validator.validate(first); err != nil {
+		return nil, err
+	}
+	return io.MultiReader(bytes.NewReader(first), clientConn), nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSourceIPWindow = time.Hour
+	// maxSourceIPCap bounds per-tenant caps the same way connection limits are
+	maxSourceIPCap = 1000
+)
+
+// SourceIPConfig tracks which addresses connect to each tenant. A source IP
+// counts towards a tenant while it has a connection open and for
+// windowMinutes after its last one closes. maxPerTenant caps the distinct
+// IPs a tenant accepts; HIS may set a per-tenant cap in register-port
+// responses, which wins. 0 records without enforcing.
+type SourceIPConfig struct {
+	WindowMinutes int `json:"windowMinutes"` // default 60
+	MaxPerTenant  int `json:"maxPerTenant"`
+}
+
+// window returns how long a source IP counts after its last connection
+func (c SourceIPConfig) window() time.Duration {
+	if c.WindowMinutes > 0 {
+		return time.Duration(c.WindowMinutes) * time.Minute
+	}
+	return defaultSourceIPWindow
+}
+
+// validateSourceIPs checks the window and cap
+func validateSourceIPs(cfg SourceIPConfig) error {
+	if cfg.WindowMinutes < 0 {
+		return errors.New("windowMinutes must not be negative")
+	}
+	if cfg.MaxPerTenant < 0 || cfg.MaxPerTenant > maxSourceIPCap {
+		return fmt.Errorf("maxPerTenant must be between 0 and %d", maxSourceIPCap)
+	}
+	return nil
+}
+
+// SourceIP is one address seen connecting to a tenant
+type SourceIP struct {
+	IP          string    `json:"ip"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+	Active      int       `json:"active"`      // connections open now
+	Connections int64     `json:"connections"` // accepted within the window
+}
+
+// tenantSourceIPs is a tenant's source IPs within the window. refused holds
+// when each refused IP was last refused, so each is reported once a window.
+type tenantSourceIPs struct {
+	ips     map[string]*SourceIP
+	refused map[string]time.Time
+}
+
+// SourceIPTracker records the distinct source IPs of each tenant over a
+// sliding window, by tenant ID so the set survives re-registration
+type SourceIPTracker struct {
+	cfg     SourceIPConfig
+	tenants map[string]*tenantSourceIPs
+	refused int64
+	mu      sync.Mutex
+}
+
+// NewSourceIPTracker creates an empty tracker
+func NewSourceIPTracker(cfg SourceIPConfig) *SourceIPTracker {
+	return &SourceIPTracker{cfg: cfg, tenants: make(map[string]*tenantSourceIPs)}
+}
+
+// pruneLocked drops IPs without open connections whose window is over.
+// Caller holds t.mu.
+func (t *SourceIPTracker) pruneLocked(tenantID string, now time.Time) *tenantSourceIPs {
+	set := t.tenants[tenantID]
+	if set == nil {
+		return nil
+	}
+	cutoff := now.Add(-t.cfg.window())
+	for ip, seen := range set.ips {
+		if seen.Active == 0 && seen.LastSeen.Before(cutoff) {
+			delete(set.ips, ip)
+		}
+	}
+	for ip, at := range set.refused {
+		if at.Before(cutoff) {
+			delete(set.refused, ip)
+		}
+	}
+	if len(set.ips) == 0 && len(set.refused) == 0 {
+		delete(t.tenants, tenantID)
+		return nil
+	}
+	return set
+}
+
+// Admit records a connection from ip. A new IP beyond max is refused; the
+// second result is true the first time ip is refused within the window.
+func (t *SourceIPTracker) Admit(tenantID, ip string, max int) (admitted, firstRefusal bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := clock.Now()
+	set := t.pruneLocked(tenantID, now)
+	if set == nil {
+		set = &tenantSourceIPs{ips: make(map[string]*SourceIP), refused: make(map[string]time.Time)}
+		t.tenants[tenantID] = set
+	}
+
+	seen, ok := set.ips[ip]
+	if !ok {
+		if max > 0 && len(set.ips) >= max {
+			t.refused++
+			_, refusedBefore := set.refused[ip]
+			set.refused[ip] = now
+			return false, !refusedBefore
+		}
+		seen = &SourceIP{IP: ip, FirstSeen: now}
+		set.ips[ip] = seen
+	}
+	seen.LastSeen = now
+	seen.Active++
+	seen.Connections++
+	return true, false
+}
+
+// Release records that a connection from ip closed; the window starts now
+func (t *SourceIPTracker) Release(tenantID, ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if set := t.tenants[tenantID]; set != nil {
+		if seen, ok := set.ips[ip]; ok && seen.Active > 0 {
+			seen.Active--
+			seen.LastSeen = clock.Now()
+		}
+	}
+}
+
+// List returns the tenant's source IPs within the window, most recent first
+func (t *SourceIPTracker) List(tenantID string) []SourceIP {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	set := t.pruneLocked(tenantID, clock.Now())
+	if set == nil {
+		return nil
+	}
+	ips := make([]SourceIP, 0, len(set.ips))
+	for _, seen := range set.ips {
+		ips = append(ips, *seen)
+	}
+	sort.Slice(ips, func(i, j int) bool { return ips[i].LastSeen.After(ips[j].LastSeen) })
+	return ips
+}
+
+// Addresses returns the tenant's source IPs within the window, sorted, for HIS
+func (t *SourceIPTracker) Addresses(tenantID string) []string {
+	ips := t.List(tenantID)
+	addresses := make([]string, 0, len(ips))
+	for _, seen := range ips {
+		addresses = append(addresses, seen.IP)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// Count returns how many source IPs the tenant has within the window
+func (t *SourceIPTracker) Count(tenantID string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if set := t.pruneLocked(tenantID, clock.Now()); set != nil {
+		return len(set.ips)
+	}
+	return 0
+}
+
+// Metrics reports the window, the default cap and refused connections
+func (t *SourceIPTracker) Metrics() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := clock.Now()
+	tracked := 0
+	for tenantID := range t.tenants {
+		if set := t.pruneLocked(tenantID, now); set != nil {
+			tracked += len(set.ips)
+		}
+	}
+	return map[string]interface{}{
+		"window_minutes":  int(t.cfg.window() / time.Minute),
+		"max_per_tenant":  t.cfg.MaxPerTenant,
+		"tracked_ips":     tracked,
+		"refused_accepts": t.refused,
+		"tenants_tracked": len(t.tenants),
+	}
+}
+
+// maxSourceIPs returns the tenant's cap: HIS's, then the relay's. 0 means
+// no cap.
+func (s *RelayServer) maxSourceIPs(tenant *Tenant) int {
+	tenant.mu.Lock()
+	defer tenant.mu.Unlock()
+	return s.maxSourceIPsLocked(tenant)
+}
+
+// maxSourceIPsLocked is maxSourceIPs for callers holding tenant.mu
+func (s *RelayServer) maxSourceIPsLocked(tenant *Tenant) int {
+	if tenant.hisMaxSourceIPs > 0 {
+		return tenant.hisMaxSourceIPs
+	}
+	return s.sourceIPs.cfg.MaxPerTenant
+}
+
+// setHISMaxSourceIPs applies the source IP cap HIS returned for a tenant; 0
+// leaves the relay's cap
+func (s *RelayServer) setHISMaxSourceIPs(tenant *Tenant, max int) {
+	if max < 0 || max > maxSourceIPCap {
+		log.Printf("⚠️  Ignoring HIS source IP cap %d for tenant %s", max, tenant.ID)
+		return
+	}
+	tenant.mu.Lock()
+	defer tenant.mu.Unlock()
+	if max != tenant.hisMaxSourceIPs {
+		log.Printf("Tenant %s source IP cap from HIS: %d", tenant.ID, max)
+	}
+	tenant.hisMaxSourceIPs = max
+}
+
+// sourceIPOf returns the IP of a connection's remote address
+func sourceIPOf(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// refusedBySourceIPCap records the connection's source IP, refusing it if the
+// tenant is at its cap of distinct IPs. The caller closes refused connections
+// and releases the IP of admitted ones when they close.
+func (s *RelayServer) refusedBySourceIPCap(tenant *Tenant, conn net.Conn) bool {
+	max := s.maxSourceIPs(tenant)
+	ip := sourceIPOf(conn)
+	admitted, firstRefusal := s.sourceIPs.Admit(tenant.ID, ip, max)
+	if admitted {
+		return false
+	}
+
+	msg := fmt.Sprintf("source IP %s refused: %d distinct source IPs already connected within %v", ip, max, s.sourceIPs.cfg.window())
+	if firstRefusal {
+		log.Printf("⛔ Tenant %s %s", tenant.ID, msg)
+		s.events.Emit("source_ip_cap_reached", tenant.ID, msg)
+	}
+	s.siem.Record(siemSourceIPCapRefused, tenant.ID, conn.RemoteAddr().String(), msg)
+	s.rejectClient(conn, tenant.ID, "This clinic does not accept connections from more HIS servers")
+	return true
+}
+
+// handleAdminTenantSourceIPs serves GET /admin/tenants/{id}/source-ips, the
+// addresses that connected to the tenant within the window
+func (s *RelayServer) handleAdminTenantSourceIPs(w http.ResponseWriter, r *http.Request, tenantID string) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	max := s.sourceIPs.cfg.MaxPerTenant
+	s.mu.RLock()
+	tenant, ok := s.tenants[tenantID]
+	s.mu.RUnlock()
+	if ok {
+		max = s.maxSourceIPs(tenant)
+	}
+	ips := s.sourceIPs.List(tenantID)
+	if ips == nil {
+		ips = []SourceIP{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tenantId":      tenantID,
+		"registered":    ok,
+		"windowMinutes": int(s.sourceIPs.cfg.window() / time.Minute),
+		"maxSourceIPs":  max,
+		"sourceIps":     ips,
+	})
+}
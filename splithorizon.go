@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// SplitHorizonConfig advertises a second, internal endpoint for tenant ports,
+// e.g. the relay's private IP for on-prem HIS nodes while cloud nodes use the
+// public host
+type SplitHorizonConfig struct {
+	InternalHost string `json:"internalHost"`
+	// InternalPortOffset is added to tenant ports on the internal endpoint,
+	// for NAT that maps ports; usually 0
+	InternalPortOffset int `json:"internalPortOffset"`
+	// InternalNetworks are client CIDRs that are shown the internal endpoint
+	// on the status endpoint
+	InternalNetworks []string `json:"internalNetworks"`
+}
+
+// AdvertisedEndpoint is where SQL clients reach a tenant's port
+type AdvertisedEndpoint struct {
+	Host              string            `json:"host"`
+	Port              int               `json:"port"`
+	ConnectionStrings map[string]string `json:"connectionStrings,omitempty"`
+}
+
+// splitHorizon is the parsed SplitHorizonConfig
+type splitHorizon struct {
+	host       string
+	portOffset int
+	networks   []*net.IPNet
+}
+
+// newSplitHorizon parses cfg; it returns nil when no internal host is set
+func newSplitHorizon(cfg SplitHorizonConfig, portStart, portEnd int) (*splitHorizon, error) {
+	if cfg.InternalHost == "" {
+		if len(cfg.InternalNetworks) > 0 || cfg.InternalPortOffset != 0 {
+			return nil, fmt.Errorf("internalHost is required with internalNetworks or internalPortOffset")
+		}
+		return nil, nil
+	}
+	if portStart+cfg.InternalPortOffset < 1 || portEnd+cfg.InternalPortOffset > 65535 {
+		return nil, fmt.Errorf("internalPortOffset %d moves tenant ports outside 1-65535", cfg.InternalPortOffset)
+	}
+
+	horizon := &splitHorizon{host: cfg.InternalHost, portOffset: cfg.InternalPortOffset}
+	for _, cidr := range cfg.InternalNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid internal network %q", cidr)
+		}
+		horizon.networks = append(horizon.networks, network)
+	}
+	return horizon, nil
+}
+
+// internal reports whether remoteAddr is in one of the internal networks
+func (h *splitHorizon) internal(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range h.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// internalEndpoint is the tenant's internal endpoint with its connection
+// strings, or nil without split-horizon
+func (s *RelayServer) internalEndpoint(tenant *Tenant) *AdvertisedEndpoint {
+	if s.horizon == nil {
+		return nil
+	}
+	port := tenant.AssignedPort + s.horizon.portOffset
+	return &AdvertisedEndpoint{
+		Host:              s.horizon.host,
+		Port:              port,
+		ConnectionStrings: s.connectionStringsFor(tenant, s.horizon.host, port),
+	}
+}
+
+// endpointFor picks the endpoint to show a client: the internal one for
+// clients in the internal networks, otherwise the public one. Connection
+// strings are left out.
+func (s *RelayServer) endpointFor(tenant *Tenant, remoteAddr string) AdvertisedEndpoint {
+	if s.horizon != nil && s.horizon.internal(remoteAddr) {
+		return AdvertisedEndpoint{Host: s.horizon.host, Port: tenant.AssignedPort + s.horizon.portOffset}
+	}
+	return s.serviceEndpoint(tenant, serviceSQL)
+}
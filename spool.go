@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	spoolKindRegisterPort   = "register-port"
+	spoolKindUnregisterPort = "unregister-port"
+
+	spoolInitialBackoff = 5 * time.Second
+	spoolMaxBackoff     = 10 * time.Minute
+	spoolReplayInterval = 5 * time.Second
+)
+
+// SpoolEntry is a HIS notification waiting to be delivered
+type SpoolEntry struct {
+	Kind        string          `json:"kind"`
+	TenantID    string          `json:"tenantId"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	LastError   string          `json:"lastError"`
+}
+
+func (e *SpoolEntry) key() string {
+	return e.Kind + "-" + url.PathEscape(e.TenantID)
+}
+
+// HISSpool persists HIS notifications that failed and replays them with
+// exponential backoff until HIS acknowledges them. Only the latest
+// notification of each kind is kept per tenant.
+type HISSpool struct {
+	dir       string
+	hisClient HISNotifier
+	entries   map[string]*SpoolEntry
+	retries   map[string]int64 // kind -> replay attempts, for metrics
+	mu        sync.Mutex
+
+	// onDelivered, when set, is called after a replayed notification is acknowledged
+	onDelivered func(kind, tenantID string)
+}
+
+// NewHISSpool creates a spool backed by dir, loading entries left by a previous
+// run. An empty dir keeps the spool in memory only.
+func NewHISSpool(dir string, hisClient HISNotifier) (*HISSpool, error) {
+	spool := &HISSpool{
+		dir:       dir,
+		hisClient: hisClient,
+		entries:   make(map[string]*SpoolEntry),
+		retries:   make(map[string]int64),
+	}
+
+	if dir == "" {
+		return spool, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list spool directory: %w", err)
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Printf("⚠️  Skipping unreadable spool file %s: %v", file, err)
+			continue
+		}
+		var entry SpoolEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			log.Printf("⚠️  Skipping corrupt spool file %s: %v", file, err)
+			continue
+		}
+		spool.entries[entry.key()] = &entry
+	}
+
+	if len(spool.entries) > 0 {
+		log.Printf("Loaded %d pending HIS notifications from %s", len(spool.entries), dir)
+	}
+
+	return spool, nil
+}
+
+// Enqueue records a failed notification, replacing any older one of the same
+// kind for the tenant. payload is the request body for the notification kind.
+func (sp *HISSpool) Enqueue(kind, tenantID string, payload interface{}, cause error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("⚠️  Failed to encode HIS notification for tenant %s: %v", tenantID, err)
+		return
+	}
+
+	entry := &SpoolEntry{
+		Kind:        kind,
+		TenantID:    tenantID,
+		Payload:     data,
+		CreatedAt:   clock.BaseNow(),
+		Attempts:    1,
+		NextAttempt: clock.BaseNow().Add(spoolInitialBackoff),
+		LastError:   cause.Error(),
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	sp.entries[entry.key()] = entry
+	if err := sp.persist(entry); err != nil {
+		log.Printf("⚠️  Failed to persist HIS notification for tenant %s: %v", tenantID, err)
+	}
+}
+
+// Discard drops a pending notification, e.g. after a newer one was delivered
+func (sp *HISSpool) Discard(kind, tenantID string) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	key := (&SpoolEntry{Kind: kind, TenantID: tenantID}).key()
+	if _, ok := sp.entries[key]; ok {
+		delete(sp.entries, key)
+		sp.remove(key)
+	}
+}
+
+// Pending returns the number of notifications waiting for delivery
+func (sp *HISSpool) Pending() int {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return len(sp.entries)
+}
+
+// Run replays due notifications until the process exits
+func (sp *HISSpool) Run() {
+	ticker := clock.NewTicker(spoolReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		sp.replayDue()
+	}
+}
+
+func (sp *HISSpool) replayDue() {
+	now := clock.BaseNow()
+
+	sp.mu.Lock()
+	due := make([]SpoolEntry, 0)
+	for _, entry := range sp.entries {
+		if !entry.NextAttempt.After(now) {
+			due = append(due, *entry)
+		}
+	}
+	sp.mu.Unlock()
+
+	for _, entry := range due {
+		err := sp.deliver(&entry)
+
+		sp.mu.Lock()
+		sp.retries[entry.Kind]++
+		current, ok := sp.entries[entry.key()]
+		// Skip entries that were replaced or discarded while we were sending
+		if !ok || !current.CreatedAt.Equal(entry.CreatedAt) {
+			sp.mu.Unlock()
+			continue
+		}
+
+		if err == nil {
+			delete(sp.entries, entry.key())
+			sp.remove(entry.key())
+			sp.mu.Unlock()
+			log.Printf("✅ Replayed %s notification to HIS for tenant %s after %d attempts",
+				entry.Kind, entry.TenantID, entry.Attempts+1)
+			if sp.onDelivered != nil {
+				sp.onDelivered(entry.Kind, entry.TenantID)
+			}
+			continue
+		}
+
+		current.Attempts++
+		current.LastError = err.Error()
+		current.NextAttempt = clock.BaseNow().Add(spoolBackoff(current.Attempts))
+		if perr := sp.persist(current); perr != nil {
+			log.Printf("⚠️  Failed to persist HIS notification for tenant %s: %v", current.TenantID, perr)
+		}
+		sp.mu.Unlock()
+
+		log.Printf("⚠️  HIS %s replay failed for tenant %s (attempt %d, next in %s): %v",
+			entry.Kind, entry.TenantID, current.Attempts, current.NextAttempt.Sub(clock.BaseNow()).Round(time.Second), err)
+	}
+}
+
+func (sp *HISSpool) deliver(entry *SpoolEntry) error {
+	switch entry.Kind {
+	case spoolKindRegisterPort:
+		var req RegisterPortRequest
+		if err := json.Unmarshal(entry.Payload, &req); err != nil {
+			return fmt.Errorf("invalid spooled payload: %w", err)
+		}
+		_, err := sp.hisClient.RegisterPort(req)
+		return err
+	case spoolKindUnregisterPort:
+		var req UnregisterPortRequest
+		if err := json.Unmarshal(entry.Payload, &req); err != nil {
+			return fmt.Errorf("invalid spooled payload: %w", err)
+		}
+		return sp.hisClient.UnregisterPort(req)
+	default:
+		return fmt.Errorf("unknown notification kind: %s", entry.Kind)
+	}
+}
+
+// Retries returns replay attempts per notification kind, which match the HIS
+// endpoint names
+func (sp *HISSpool) Retries() map[string]int64 {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	retries := make(map[string]int64, len(sp.retries))
+	for kind, n := range sp.retries {
+		retries[kind] = n
+	}
+	return retries
+}
+
+// persist writes the entry atomically; callers hold sp.mu
+func (sp *HISSpool) persist(entry *SpoolEntry) error {
+	if sp.dir == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(sp.dir, entry.key()+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// remove deletes the entry's file; callers hold sp.mu
+func (sp *HISSpool) remove(key string) {
+	if sp.dir == "" {
+		return
+	}
+	path := filepath.Join(sp.dir, key+".json")
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("⚠️  Failed to remove spool file %s: %v", path, err)
+	}
+}
+
+func spoolBackoff(attempts int) time.Duration {
+	backoff := spoolInitialBackoff
+	for i := 1; i < attempts && backoff < spoolMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > spoolMaxBackoff {
+		backoff = spoolMaxBackoff
+	}
+	return backoff
+}
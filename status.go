@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// statusTokenScope marks a JWT as a read-only status token for one tenant.
+// HIS mints these for clinic IT admins; they can't be used to register.
+const statusTokenScope = "tunnel:status"
+
+// handleTenantStatus serves GET /status/{tenantId} to holders of a status
+// token for that tenant, passed as a bearer token or ?token=
+func (s *RelayServer) handleTenantStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	tenantID := strings.TrimPrefix(r.URL.Path, "/status/")
+	if tenantID == "" || strings.Contains(tenantID, "/") {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	claims, err := s.jwtCache.Verify(token, s.jwtIssuers)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "invalid status token")
+		return
+	}
+	// Answer the same way for other tenants as for bad tokens, so a token
+	// can't be used to probe which tenants exist
+	if claims.Scope != statusTokenScope || claims.Sub != tenantID {
+		log.Printf("Status token for %s (scope %q) rejected for tenant %s", claims.Sub, claims.Scope, tenantID)
+		writeJSONError(w, http.StatusUnauthorized, "invalid status token")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, s.tenantStatus(tenantID, r.RemoteAddr))
+}
+
+// tenantStatus summarizes a tenant's tunnel for its own IT admins, without
+// credentials or relay internals. The endpoint shown depends on whether the
+// caller at remoteAddr is on an internal network.
+func (s *RelayServer) tenantStatus(tenantID, remoteAddr string) map[string]interface{} {
+	status := map[string]interface{}{
+		"tenantId":  tenantID,
+		"connected": false,
+	}
+
+	s.mu.RLock()
+	tenant, ok := s.tenants[tenantID]
+	s.mu.RUnlock()
+
+	if ok {
+		endpoint := s.endpointFor(tenant, remoteAddr)
+		tenant.mu.Lock()
+		status["connected"] = true
+		status["state"] = tenant.state()
+		status["connectedSince"] = tenant.RegisteredAt.Format(time.RFC3339)
+		status["lastSeen"] = tenant.LastSeen.Format(time.RFC3339)
+		status["activeConnections"] = tenant.ActiveConns
+		status["endpoint"] = endpoint
+		tenant.mu.Unlock()
+		return status
+	}
+
+	status["state"] = "disconnected"
+	if departures := s.departures.Recent(tenantID); len(departures) > 0 {
+		last := departures[len(departures)-1]
+		status["lastSeen"] = last.ClosedAt.Format(time.RFC3339)
+		status["disconnectReason"] = last.Reason
+	}
+	return status
+}
@@ -0,0 +1,65 @@
+package main
+
+import "fmt"
+
+// defaultStreamsPerTenant matches yamux's default accept backlog on the agent,
+// beyond which stream opens stall and fail with confusing errors
+const defaultStreamsPerTenant = 256
+
+// StreamBudgetConfig caps concurrent yamux streams per tenant and across the
+// relay; zero uses the default per tenant and no global cap
+type StreamBudgetConfig struct {
+	PerTenant int `json:"perTenant"`
+	Total     int `json:"total"`
+}
+
+// streamsInUse counts a tenant's open streams, excluding the control stream
+func streamsInUse(tenant *Tenant) int {
+	n := tenant.ControlSession.NumStreams() - 1
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// streamBudgetExceeded returns why a new client connection can't get an
+// agent stream, or ""
+func (s *RelayServer) streamBudgetExceeded(tenant *Tenant) string {
+	if used := streamsInUse(tenant); used >= s.streamBudget.PerTenant {
+		return fmt.Sprintf("tenant stream budget exhausted (%d of %d streams in use)", used, s.streamBudget.PerTenant)
+	}
+	if s.streamBudget.Total <= 0 {
+		return ""
+	}
+
+	s.mu.RLock()
+	total := s.totalStreamsLocked()
+	s.mu.RUnlock()
+	if total >= s.streamBudget.Total {
+		return fmt.Sprintf("relay stream budget exhausted (%d of %d streams in use)", total, s.streamBudget.Total)
+	}
+	return ""
+}
+
+// totalStreamsLocked counts streams in use across tenants. Caller holds s.mu.
+func (s *RelayServer) totalStreamsLocked() int {
+	total := 0
+	for _, tenant := range s.tenants {
+		total += streamsInUse(tenant)
+	}
+	return total
+}
+
+// streamBudgetMetrics reports global stream usage and headroom. Callers hold s.mu.
+func (s *RelayServer) streamBudgetMetrics() map[string]interface{} {
+	total := s.totalStreamsLocked()
+	metrics := map[string]interface{}{
+		"in_use":     total,
+		"per_tenant": s.streamBudget.PerTenant,
+	}
+	if s.streamBudget.Total > 0 {
+		metrics["budget"] = s.streamBudget.Total
+		metrics["headroom"] = s.streamBudget.Total - total
+	}
+	return metrics
+}
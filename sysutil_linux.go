@@ -0,0 +1,122 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// tcpFastOpen is TCP_FASTOPEN, which package syscall doesn't define
+const tcpFastOpen = 0x17
+
+// tcpFastOpenSysctl holds the kernel's TCP Fast Open mode; bit 2 enables it
+// for servers
+const tcpFastOpenSysctl = "/proc/sys/net/ipv4/tcp_fastopen"
+
+// detectListenerCapabilities checks the kernel allows TCP Fast Open on
+// listeners. Defer-accept is always available on Linux.
+func detectListenerCapabilities() listenerCapabilities {
+	caps := listenerCapabilities{DeferAccept: true}
+	data, err := os.ReadFile(tcpFastOpenSysctl)
+	if err != nil {
+		caps.FastOpenReason = fmt.Sprintf("cannot read net.ipv4.tcp_fastopen: %v", err)
+		return caps
+	}
+	mode, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		caps.FastOpenReason = fmt.Sprintf("unexpected net.ipv4.tcp_fastopen %q", strings.TrimSpace(string(data)))
+		return caps
+	}
+	if mode&2 == 0 {
+		caps.FastOpenReason = fmt.Sprintf("net.ipv4.tcp_fastopen=%d does not enable it for servers (set bit 2, e.g. 3)", mode)
+		return caps
+	}
+	caps.FastOpen = true
+	return caps
+}
+
+// setListenerOptions applies TCP Fast Open and defer-accept to a socket
+// before it starts listening
+func setListenerOptions(fd uintptr, tuning ListenerTuning) error {
+	if tuning.FastOpen {
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen, tuning.FastOpenQueue); err != nil {
+			return fmt.Errorf("TCP Fast Open: %w", err)
+		}
+	}
+	if tuning.DeferAcceptSeconds > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, tuning.DeferAcceptSeconds); err != nil {
+			return fmt.Errorf("defer accept: %w", err)
+		}
+	}
+	return nil
+}
+
+// setListenBacklog changes the accept queue length of a listening TCP socket.
+// Linux applies a repeated listen(2) call to the existing socket.
+func setListenBacklog(l net.Listener, backlog int) error {
+	tcpListener, ok := l.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("unsupported listener type %T", l)
+	}
+
+	raw, err := tcpListener.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var listenErr error
+	if err := raw.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), backlog)
+	}); err != nil {
+		return err
+	}
+	return listenErr
+}
+
+// fdUsage reports the number of open file descriptors and the soft limit
+func fdUsage() (open int, limit uint64, err error) {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, 0, err
+	}
+
+	return len(entries), rlimit.Cur, nil
+}
+
+// processCPUTime returns user plus system CPU time consumed by the process
+func processCPUTime() (time.Duration, error) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, err
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano()), nil
+}
+
+// raiseFDLimit lifts the soft RLIMIT_NOFILE to the hard limit and returns the
+// resulting soft limit
+func raiseFDLimit() (uint64, error) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, err
+	}
+
+	if rlimit.Cur < rlimit.Max {
+		previous := rlimit.Cur
+		rlimit.Cur = rlimit.Max
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+			return previous, err
+		}
+	}
+	return rlimit.Cur, nil
+}
@@ -0,0 +1,36 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var errUnsupportedPlatform = errors.New("not supported on this platform")
+
+func detectListenerCapabilities() listenerCapabilities {
+	reason := errUnsupportedPlatform.Error()
+	return listenerCapabilities{FastOpenReason: reason, DeferAcceptReason: reason}
+}
+
+func setListenerOptions(fd uintptr, tuning ListenerTuning) error {
+	return errUnsupportedPlatform
+}
+
+func setListenBacklog(l net.Listener, backlog int) error {
+	return errUnsupportedPlatform
+}
+
+func fdUsage() (open int, limit uint64, err error) {
+	return 0, 0, errUnsupportedPlatform
+}
+
+func processCPUTime() (time.Duration, error) {
+	return 0, errUnsupportedPlatform
+}
+
+func raiseFDLimit() (uint64, error) {
+	return 0, errUnsupportedPlatform
+}
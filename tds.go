@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/binary"
+	"unicode/utf16"
+)
+
+const (
+	tdsPacketTabularResult = 0x04
+	tdsStatusEOM           = 0x01
+	tdsTokenError          = 0xAA
+	tdsTokenDone           = 0xFD
+	tdsDoneError           = 0x0002
+
+	// tdsRelayErrorNumber is the error number reported for relay-side failures
+	tdsRelayErrorNumber = 50000
+	// tdsSeverityFatal makes clients treat the error as connection-terminating
+	tdsSeverityFatal = 20
+)
+
+// tdsPacketTypeNames names the TDS packet types a client or server may send
+var tdsPacketTypeNames = map[byte]string{
+	0x01: "sql_batch",
+	0x02: "pre_tds7_login",
+	0x03: "rpc",
+	0x04: "tabular_result",
+	0x06: "attention",
+	0x07: "bulk_load",
+	0x08: "fedauth_token",
+	0x0E: "transaction_manager",
+	0x10: "login7",
+	0x11: "sspi",
+	0x12: "prelogin",
+}
+
+const (
+	tdsPacketLogin7   = 0x10
+	tdsPacketPrelogin = 0x12
+	tdsHeaderLength   = 8
+)
+
+// tdsErrorPacket builds a TDS tabular result carrying an ERROR and DONE token,
+// so SQL clients show a readable message instead of a bare "connection reset"
+func tdsErrorPacket(message string) []byte {
+	var token []byte
+	token = append(token, tdsTokenError)
+
+	var body []byte
+	body = binary.LittleEndian.AppendUint32(body, tdsRelayErrorNumber)
+	body = append(body, 1, tdsSeverityFatal) // state, class
+	body = appendUSVarChar(body, message)
+	body = appendBVarChar(body, "Tatbeeb Link Relay")
+	body = appendBVarChar(body, "")
+	body = binary.LittleEndian.AppendUint32(body, 0) // line number
+
+	token = binary.LittleEndian.AppendUint16(token, uint16(len(body)))
+	token = append(token, body...)
+
+	token = append(token, tdsTokenDone)
+	token = binary.LittleEndian.AppendUint16(token, tdsDoneError)
+	token = binary.LittleEndian.AppendUint16(token, 0) // current command
+	token = binary.LittleEndian.AppendUint64(token, 0) // row count
+
+	packet := []byte{tdsPacketTabularResult, tdsStatusEOM}
+	packet = binary.BigEndian.AppendUint16(packet, uint16(8+len(token)))
+	packet = append(packet, 0, 0, 1, 0) // SPID, packet ID, window
+	return append(packet, token...)
+}
+
+func appendUSVarChar(b []byte, s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(units)))
+	for _, u := range units {
+		b = binary.LittleEndian.AppendUint16(b, u)
+	}
+	return b
+}
+
+func appendBVarChar(b []byte, s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b = append(b, byte(len(units)))
+	for _, u := range units {
+		b = binary.LittleEndian.AppendUint16(b, u)
+	}
+	return b
+}
+
+// tdsHeader is the header of one TDS packet
+type tdsHeader struct {
+	Type   byte
+	Status byte
+	Length int // including the header
+}
+
+// tdsHeaderScanner follows TDS packet headers across the writes of one
+// direction of a stream, skipping packet bodies without keeping them. It
+// gives up at the first header that isn't TDS, e.g. once the stream switches
+// to TLS.
+type tdsHeaderScanner struct {
+	header    [tdsHeaderLength]byte
+	headerLen int
+	remaining int
+	opaque    bool
+}
+
+// scan calls packet for each header completed in p. Once a header isn't TDS,
+// opaque is called and the rest of the stream is ignored.
+func (sc *tdsHeaderScanner) scan(p []byte, packet func(tdsHeader), opaque func()) {
+	for len(p) > 0 && !sc.opaque {
+		if sc.remaining > 0 {
+			skip := sc.remaining
+			if skip > len(p) {
+				skip = len(p)
+			}
+			sc.remaining -= skip
+			p = p[skip:]
+			continue
+		}
+
+		copied := copy(sc.header[sc.headerLen:], p)
+		sc.headerLen += copied
+		p = p[copied:]
+		if sc.headerLen < tdsHeaderLength {
+			return
+		}
+		sc.headerLen = 0
+
+		header := tdsHeader{
+			Type:   sc.header[0],
+			Status: sc.header[1],
+			Length: int(binary.BigEndian.Uint16(sc.header[2:4])),
+		}
+		if _, known := tdsPacketTypeNames[header.Type]; !known || header.Length < tdsHeaderLength {
+			sc.opaque = true
+			opaque()
+			return
+		}
+		sc.remaining = header.Length - tdsHeaderLength
+		packet(header)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tenantStateHealthy = "healthy" // serving without stream open failures
+
+	defaultTenantPageSize = 100
+	maxTenantPageSize     = 1000
+)
+
+// tenantQuery filters, sorts and pages the admin tenant list
+type tenantQuery struct {
+	organization string
+	labels       map[string]string
+	state        string
+	portMin      int
+	portMax      int
+	seenWithin   time.Duration // only tenants seen within this long
+	notSeenFor   time.Duration // only tenants not seen for at least this long
+	sortBy       string
+	descending   bool
+	limit        int
+	offset       int
+}
+
+// tenantRow holds the fields a tenant is filtered and sorted on
+type tenantRow struct {
+	tenant       *Tenant
+	id           string
+	organization string
+	state        string
+	port         int
+	registeredAt time.Time
+	lastSeen     time.Time
+	activeConns  int
+}
+
+var tenantSortFields = map[string]func(a, b tenantRow) bool{
+	"id":          func(a, b tenantRow) bool { return a.id < b.id },
+	"port":        func(a, b tenantRow) bool { return a.port < b.port },
+	"registered":  func(a, b tenantRow) bool { return a.registeredAt.Before(b.registeredAt) },
+	"lastSeen":    func(a, b tenantRow) bool { return a.lastSeen.Before(b.lastSeen) },
+	"connections": func(a, b tenantRow) bool { return a.activeConns < b.activeConns },
+}
+
+// parseTenantQuery reads org, label, state, portMin, portMax, seenWithin,
+// notSeenFor, sort (prefix "-" for descending), limit and offset
+func parseTenantQuery(values url.Values) (*tenantQuery, error) {
+	q := &tenantQuery{
+		organization: values.Get("org"),
+		state:        values.Get("state"),
+		sortBy:       "id",
+		limit:        defaultTenantPageSize,
+	}
+
+	var err error
+	if q.labels, err = parseLabelSelector(values["label"]); err != nil {
+		return nil, err
+	}
+
+	switch q.state {
+	case "", tenantStateHealthy, tenantStateDegraded:
+	default:
+		return nil, fmt.Errorf("state must be %s or %s", tenantStateHealthy, tenantStateDegraded)
+	}
+
+	ints := map[string]*int{"portMin": &q.portMin, "portMax": &q.portMax, "limit": &q.limit, "offset": &q.offset}
+	for name, dst := range ints {
+		if v := values.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%s must be a non-negative integer", name)
+			}
+			*dst = n
+		}
+	}
+	if q.limit == 0 || q.limit > maxTenantPageSize {
+		q.limit = maxTenantPageSize
+	}
+
+	durations := map[string]*time.Duration{"seenWithin": &q.seenWithin, "notSeenFor": &q.notSeenFor}
+	for name, dst := range durations {
+		if v := values.Get(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("%s must be a duration such as 15m", name)
+			}
+			*dst = d
+		}
+	}
+
+	if v := values.Get("sort"); v != "" {
+		q.descending = strings.HasPrefix(v, "-")
+		q.sortBy = strings.TrimPrefix(v, "-")
+		if _, ok := tenantSortFields[q.sortBy]; !ok {
+			return nil, fmt.Errorf("cannot sort by %q", q.sortBy)
+		}
+	}
+	return q, nil
+}
+
+func (q *tenantQuery) matches(row tenantRow, labels map[string]string, now time.Time) bool {
+	if q.organization != "" && row.organization != q.organization {
+		return false
+	}
+	if q.state != "" && row.state != q.state {
+		return false
+	}
+	if q.portMin > 0 && row.port < q.portMin {
+		return false
+	}
+	if q.portMax > 0 && row.port > q.portMax {
+		return false
+	}
+	if q.seenWithin > 0 && now.Sub(row.lastSeen) > q.seenWithin {
+		return false
+	}
+	if q.notSeenFor > 0 && now.Sub(row.lastSeen) < q.notSeenFor {
+		return false
+	}
+	return matchesLabels(labels, q.labels)
+}
+
+// queryTenants returns one page of matching tenants and the total match
+// count; callers hold s.mu
+func (s *RelayServer) queryTenants(q *tenantQuery) ([]*Tenant, int) {
+	now := clock.Now()
+	rows := make([]tenantRow, 0, len(s.tenants))
+	for id, tenant := range s.tenants {
+		tenant.mu.Lock()
+		row := tenantRow{
+			tenant:       tenant,
+			id:           id,
+			organization: tenant.OrganizationID,
+			state:        tenant.state(),
+			port:         tenant.AssignedPort,
+			registeredAt: tenant.RegisteredAt,
+			lastSeen:     tenant.LastSeen,
+			activeConns:  tenant.ActiveConns,
+		}
+		tenant.mu.Unlock()
+
+		if q.matches(row, s.tenantLabels(id), now) {
+			rows = append(rows, row)
+		}
+	}
+
+	less := tenantSortFields[q.sortBy]
+	sort.Slice(rows, func(i, j int) bool {
+		if q.descending {
+			return less(rows[j], rows[i])
+		}
+		return less(rows[i], rows[j])
+	})
+
+	total := len(rows)
+	if q.offset >= total {
+		return nil, total
+	}
+	rows = rows[q.offset:]
+	if len(rows) > q.limit {
+		rows = rows[:q.limit]
+	}
+
+	tenants := make([]*Tenant, len(rows))
+	for i, row := range rows {
+		tenants[i] = row.tenant
+	}
+	return tenants, total
+}
+
+// state summarizes the tenant's health; callers hold t.mu
+func (t *Tenant) state() string {
+	if t.Degraded {
+		return tenantStateDegraded
+	}
+	return tenantStateHealthy
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Lifecycle states of a tenant. The state is kept by tenant ID, so it
+// outlives the Tenant while a reserved port waits for the agent.
+// registering lasts until the port accepts clients (after HIS confirms it
+// with holdUntilHISAck); active, degraded and suspended are serving states,
+// suspended meaning an access freeze is in effect; draining is a relay
+// shutdown in progress, or open connections finishing after the agent's
+// control session was lost; grace_period keeps a reserved port parked until the
+// agent returns; evicted means the port was released.
+const (
+	tenantStateRegistering = "registering"
+	tenantStateActive      = "active"
+	tenantStateDegraded    = "degraded"
+	tenantStateDraining    = "draining"
+	tenantStateSuspended   = "suspended"
+	tenantStateGracePeriod = "grace_period"
+	tenantStateEvicted     = "evicted"
+)
+
+// tenantStatesInOrder lists the states for metrics, in lifecycle order
+var tenantStatesInOrder = []string{
+	tenantStateRegistering, tenantStateActive, tenantStateDegraded, tenantStateSuspended,
+	tenantStateDraining, tenantStateGracePeriod, tenantStateEvicted,
+}
+
+// tenantStateTransitions is the state machine: the states each state may move
+// to. The empty state is a tenant the relay has not seen yet.
+var tenantStateTransitions = map[string][]string{
+	"":                     {tenantStateRegistering, tenantStateGracePeriod},
+	tenantStateRegistering: {tenantStateActive, tenantStateDegraded, tenantStateSuspended, tenantStateGracePeriod, tenantStateEvicted},
+	tenantStateActive:      {tenantStateDegraded, tenantStateSuspended, tenantStateDraining, tenantStateGracePeriod, tenantStateEvicted},
+	tenantStateDegraded:    {tenantStateActive, tenantStateSuspended, tenantStateDraining, tenantStateGracePeriod, tenantStateEvicted},
+	tenantStateSuspended:   {tenantStateActive, tenantStateDegraded, tenantStateDraining, tenantStateGracePeriod, tenantStateEvicted},
+	tenantStateDraining:    {tenantStateGracePeriod, tenantStateEvicted},
+	tenantStateGracePeriod: {tenantStateRegistering, tenantStateEvicted},
+	tenantStateEvicted:     {tenantStateRegistering},
+}
+
+// servingStates are the states of a tenant whose port forwards clients
+var servingStates = []string{tenantStateActive, tenantStateDegraded, tenantStateSuspended}
+
+const (
+	// maxTenantStateHistory bounds the transitions kept per tenant
+	maxTenantStateHistory = 20
+	// evictedStateRetention is how long an evicted tenant's state is kept
+	evictedStateRetention = time.Hour
+)
+
+// TenantStateTransition records one move through the state machine
+type TenantStateTransition struct {
+	From   string    `json:"from,omitempty"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// TenantState is a tenant's current lifecycle state and recent transitions
+type TenantState struct {
+	State   string                  `json:"state"`
+	Since   time.Time               `json:"since"`
+	Reason  string                  `json:"reason"`
+	History []TenantStateTransition `json:"history,omitempty"`
+}
+
+// TenantStates tracks the lifecycle state of every tenant the relay knows
+type TenantStates struct {
+	tenants     map[string]*TenantState
+	transitions int64
+	rejected    int64
+	mu          sync.Mutex
+}
+
+// NewTenantStates creates an empty state tracker
+func NewTenantStates() *TenantStates {
+	return &TenantStates{tenants: make(map[string]*TenantState)}
+}
+
+// Transition moves the tenant to state to. With from given, it only applies
+// when the current state is one of them. It returns the previous state and
+// whether the state changed; a move the state machine forbids is refused.
+func (t *TenantStates) Transition(tenantID, to, reason string, from ...string) (string, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := clock.Now()
+	t.pruneLocked(now)
+
+	current := t.tenants[tenantID]
+	previous := ""
+	if current != nil {
+		previous = current.State
+	}
+	if previous == to || (len(from) > 0 && !containsString(from, previous)) {
+		return previous, false, nil
+	}
+	if !containsString(tenantStateTransitions[previous], to) {
+		t.rejected++
+		return previous, false, fmt.Errorf("transition %s -> %s is not allowed", stateName(previous), to)
+	}
+
+	if current == nil {
+		current = &TenantState{}
+		t.tenants[tenantID] = current
+	}
+	current.History = append(current.History, TenantStateTransition{From: previous, To: to, Reason: reason, At: now})
+	if len(current.History) > maxTenantStateHistory {
+		current.History = current.History[len(current.History)-maxTenantStateHistory:]
+	}
+	current.State, current.Since, current.Reason = to, now, reason
+	t.transitions++
+	return previous, true, nil
+}
+
+// pruneLocked forgets tenants evicted long ago. Callers hold t.mu.
+func (t *TenantStates) pruneLocked(now time.Time) {
+	for tenantID, state := range t.tenants {
+		if state.State == tenantStateEvicted && now.Sub(state.Since) > evictedStateRetention {
+			delete(t.tenants, tenantID)
+		}
+	}
+}
+
+// Get returns a copy of the tenant's state
+func (t *TenantStates) Get(tenantID string) (TenantState, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.tenants[tenantID]
+	if !ok {
+		return TenantState{}, false
+	}
+	copied := *state
+	copied.History = append([]TenantStateTransition(nil), state.History...)
+	return copied, true
+}
+
+// State returns the tenant's current state, or "" if it is unknown
+func (t *TenantStates) State(tenantID string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if state, ok := t.tenants[tenantID]; ok {
+		return state.State
+	}
+	return ""
+}
+
+// Metrics counts tenants per state
+func (t *TenantStates) Metrics() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	counts := make(map[string]int, len(tenantStatesInOrder))
+	for _, state := range tenantStatesInOrder {
+		counts[state] = 0
+	}
+	for _, state := range t.tenants {
+		counts[state.State]++
+	}
+	return map[string]interface{}{
+		"counts":      counts,
+		"transitions": t.transitions,
+		"rejected":    t.rejected,
+	}
+}
+
+func stateName(state string) string {
+	if state == "" {
+		return "(none)"
+	}
+	return state
+}
+
+// setTenantState moves a tenant through the state machine, logging and
+// emitting an event for every change
+func (s *RelayServer) setTenantState(tenantID, to, reason string, from ...string) {
+	previous, changed, err := s.tenantStates.Transition(tenantID, to, reason, from...)
+	if err != nil {
+		log.Printf("⚠️  Tenant %s state not changed: %v (%s)", tenantID, err, reason)
+		return
+	}
+	if !changed {
+		return
+	}
+	s.events.Emit("tenant_state_changed", tenantID, fmt.Sprintf("%s -> %s: %s", stateName(previous), to, reason))
+}
+
+// servingState is the state of a tenant forwarding clients: suspended during
+// an access freeze or kill switch block, degraded while the agent fails stream
+// opens, else active
+func (s *RelayServer) servingState(tenantID string, degraded bool) string {
+	if _, frozen := s.activeFreeze(tenantID); frozen {
+		return tenantStateSuspended
+	}
+	if _, killed := s.killedUntil(tenantID); killed {
+		return tenantStateSuspended
+	}
+	if degraded {
+		return tenantStateDegraded
+	}
+	return tenantStateActive
+}
+
+// settleTenantState re-evaluates a serving tenant after its health or access
+// freeze changed. Tenants still registering, draining or gone are left alone.
+func (s *RelayServer) settleTenantState(tenantID, reason string) {
+	s.mu.RLock()
+	tenant, ok := s.tenants[tenantID]
+	s.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	tenant.mu.Lock()
+	degraded := tenant.Degraded
+	tenant.mu.Unlock()
+
+	s.setTenantState(tenantID, s.servingState(tenantID, degraded), reason, servingStates...)
+}
+
+// activateTenant ends a tenant's registration once its port accepts clients
+func (s *RelayServer) activateTenant(tenant *Tenant) {
+	s.mu.RLock()
+	current := s.tenants[tenant.ID] == tenant
+	s.mu.RUnlock()
+	if !current {
+		return
+	}
+
+	tenant.mu.Lock()
+	degraded := tenant.Degraded
+	tenant.mu.Unlock()
+
+	s.setTenantState(tenant.ID, s.servingState(tenant.ID, degraded), "port accepting connections", tenantStateRegistering)
+}
@@ -0,0 +1,179 @@
+// Package testutil holds a reference fake agent for end-to-end tests of the
+// relay: it registers over a control connection the way the real agent does
+// and serves the relay's data streams with a handler.
+package testutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/hashicorp/yamux"
+	"github.com/tatbeeb/tatbeeb-link/common"
+)
+
+// ControlProtocol is the ALPN protocol agents offer when dialing the relay's
+// TLS control port
+const ControlProtocol = "tatbeeb-link/1"
+
+// Registration is the relay's answer to a successful registration
+type Registration struct {
+	common.RegisteredPayload
+	ConnectionStrings map[string]string `json:"connectionStrings,omitempty"`
+}
+
+// RegistrationError is returned by ConnectAgent when the relay refuses the agent
+type RegistrationError struct {
+	common.ErrorPayload
+	Retryable         bool `json:"retryable,omitempty"`
+	RetryAfterSeconds int  `json:"retryAfterSeconds,omitempty"`
+}
+
+func (e *RegistrationError) Error() string {
+	return fmt.Sprintf("registration refused: %s: %s", e.Code, e.Message)
+}
+
+// FakeAgent is a registered agent session
+type FakeAgent struct {
+	Registration Registration
+	// Control receives control messages sent after registration, such as
+	// pings, throttle hints and steering
+	Control chan *common.Message
+
+	session *yamux.Session
+	control *json.Decoder
+	wg      sync.WaitGroup
+}
+
+// ConnectAgent registers tenantID over conn, which is already connected to
+// the relay's control port (TLS or a local control listener), and serves each
+// data stream the relay opens with handler
+func ConnectAgent(conn net.Conn, tenantID, token string, handler func(net.Conn)) (*FakeAgent, error) {
+	session, err := yamux.Client(conn, nil)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create yamux session: %w", err)
+	}
+
+	control, err := session.OpenStream()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to open control stream: %w", err)
+	}
+
+	data, err := common.EncodeMessage(common.MsgTypeRegister, common.RegisterPayload{
+		TenantID: tenantID,
+		JWT:      token,
+		Version:  "testutil",
+	})
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to encode registration: %w", err)
+	}
+	if _, err := control.Write(data); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to send registration: %w", err)
+	}
+
+	decoder := json.NewDecoder(control)
+	msg, err := readMessage(decoder)
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to read registration response: %w", err)
+	}
+
+	agent := &FakeAgent{
+		Control: make(chan *common.Message, 16),
+		session: session,
+		control: decoder,
+	}
+	switch msg.Type {
+	case common.MsgTypeRegistered:
+		if err := common.DecodePayload(msg, &agent.Registration); err != nil {
+			session.Close()
+			return nil, fmt.Errorf("failed to decode registration response: %w", err)
+		}
+	case common.MsgTypeError:
+		regErr := &RegistrationError{}
+		common.DecodePayload(msg, regErr)
+		session.Close()
+		return nil, regErr
+	default:
+		session.Close()
+		return nil, fmt.Errorf("unexpected registration response: %s", msg.Type)
+	}
+
+	agent.wg.Add(2)
+	go agent.readControl()
+	go agent.acceptStreams(handler)
+	return agent, nil
+}
+
+// readMessage reads the next JSON control message, however it is framed
+func readMessage(decoder *json.Decoder) (*common.Message, error) {
+	var raw json.RawMessage
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+	return common.DecodeMessage(raw)
+}
+
+func (a *FakeAgent) readControl() {
+	defer a.wg.Done()
+	defer close(a.Control)
+
+	for {
+		msg, err := readMessage(a.control)
+		if err != nil {
+			return
+		}
+		select {
+		case a.Control <- msg:
+		default:
+			// Nobody is draining Control; drop rather than stall the session
+		}
+	}
+}
+
+func (a *FakeAgent) acceptStreams(handler func(net.Conn)) {
+	defer a.wg.Done()
+
+	for {
+		stream, err := a.session.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			handler(stream)
+		}()
+	}
+}
+
+// Close ends the agent's session, as if the agent went offline
+func (a *FakeAgent) Close() error {
+	err := a.session.Close()
+	a.wg.Wait()
+	return err
+}
+
+// EchoHandler writes back everything it reads, standing in for SQL Server
+func EchoHandler(conn net.Conn) {
+	io.Copy(conn, conn)
+}
+
+// ProxyHandler forwards each stream to addr, e.g. a local database under test
+func ProxyHandler(addr string) func(net.Conn) {
+	return func(conn net.Conn) {
+		backend, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		defer backend.Close()
+
+		go io.Copy(backend, conn)
+		io.Copy(conn, backend)
+	}
+}
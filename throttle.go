@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/tatbeeb/tatbeeb-link/common"
+)
+
+// msgTypeThrottle tells an agent to pace its own sends to the tenant's cap, so
+// excess bytes aren't pushed over a slow clinic uplink only to be held back here
+const msgTypeThrottle = "throttle"
+
+// ThrottleHint is the payload of a throttle message; MaxKbps 0 lifts the cap
+type ThrottleHint struct {
+	MaxKbps int    `json:"maxKbps"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// sendThrottleHint pushes the tenant's current bandwidth cap to its agent
+func (s *RelayServer) sendThrottleHint(tenant *Tenant, reason string) {
+	tenant.mu.Lock()
+	hint := ThrottleHint{MaxKbps: tenant.MaxBandwidthKbps, Reason: reason}
+	tenant.mu.Unlock()
+
+	data, err := common.EncodeMessage(msgTypeThrottle, hint)
+	if err != nil {
+		log.Printf("Failed to encode throttle message for tenant %s: %v", tenant.ID, err)
+		return
+	}
+	if err := tenant.writeControl(data); err != nil {
+		log.Printf("Failed to send throttle hint to tenant %s: %v", tenant.ID, err)
+		return
+	}
+	log.Printf("Tenant %s asked to self-throttle to %d kbps (%s)", tenant.ID, hint.MaxKbps, reason)
+}
+
+// setTenantBandwidth changes a registered tenant's cap (0 removes it) and
+// tells the agent. Open connections follow the new rate.
+func (s *RelayServer) setTenantBandwidth(tenantID string, kbps int) error {
+	if kbps < 0 {
+		return fmt.Errorf("maxKbps must not be negative")
+	}
+
+	s.mu.RLock()
+	tenant, ok := s.tenants[tenantID]
+	s.mu.RUnlock()
+	if !ok {
+		return errTenantNotRegistered
+	}
+
+	tenant.mu.Lock()
+	tenant.MaxBandwidthKbps = kbps
+	if tenant.upLimiter == nil {
+		if kbps > 0 {
+			tenant.upLimiter = NewBandwidthLimiter(kbps)
+			tenant.downLimiter = NewBandwidthLimiter(kbps)
+		}
+	} else {
+		tenant.upLimiter.SetRate(kbps)
+		tenant.downLimiter.SetRate(kbps)
+	}
+	tenant.mu.Unlock()
+
+	s.sendThrottleHint(tenant, "bandwidth cap changed")
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Tenant priority tiers, best first. A tenant's tier comes from its "tier"
+// label, else the "tier" claim of its registration token, else the default.
+const (
+	tierGold    = "gold"
+	tierSilver  = "silver"
+	tierBronze  = "bronze"
+	defaultTier = tierSilver
+
+	tierLabel = "tier"
+)
+
+// Where a tenant's tier came from
+const (
+	tierSourceLabel   = "label"
+	tierSourceToken   = "token"
+	tierSourceDefault = "default"
+)
+
+// tiersInOrder lists the tiers best first
+var tiersInOrder = []string{tierGold, tierSilver, tierBronze}
+
+func validTier(tier string) bool {
+	return containsString(tiersInOrder, tier)
+}
+
+// TierConfig sets a tier's QoS defaults. They apply when neither an admin,
+// HIS nor the registration token set the limit; zero keeps the relay default.
+type TierConfig struct {
+	MaxConnections   int `json:"maxConnections"`
+	MaxBandwidthKbps int `json:"maxBandwidthKbps"`
+}
+
+// validateTiers checks tier names and limits
+func validateTiers(tiers map[string]TierConfig) error {
+	names := make([]string, 0, len(tiers))
+	for name := range tiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cfg := tiers[name]
+		switch {
+		case !validTier(name):
+			return fmt.Errorf("unknown tier %q (want %s, %s or %s)", name, tierGold, tierSilver, tierBronze)
+		case cfg.MaxConnections < 0 || cfg.MaxConnections > maxConnLimit:
+			return fmt.Errorf("%s.maxConnections must be between 0 and %d", name, maxConnLimit)
+		case cfg.MaxBandwidthKbps < 0:
+			return fmt.Errorf("%s.maxBandwidthKbps must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// tierStats aggregates service per tier, so the difference between tiers can
+// be verified from /metrics
+type tierStats struct {
+	connections        int64
+	bytes              int64
+	streamOpens        int64
+	streamOpenNanos    int64
+	streamOpenFailures int64
+}
+
+// TierStats holds the aggregate stats of every tier
+type TierStats struct {
+	tiers map[string]*tierStats
+}
+
+// NewTierStats creates zeroed stats for each tier
+func NewTierStats() *TierStats {
+	t := &TierStats{tiers: make(map[string]*tierStats, len(tiersInOrder))}
+	for _, tier := range tiersInOrder {
+		t.tiers[tier] = &tierStats{}
+	}
+	return t
+}
+
+func (t *TierStats) get(tier string) *tierStats {
+	if stats, ok := t.tiers[tier]; ok {
+		return stats
+	}
+	return t.tiers[defaultTier]
+}
+
+// Connection counts a forwarded client connection and its bytes once closed
+func (t *TierStats) Connection(tier string, bytes int64) {
+	stats := t.get(tier)
+	atomic.AddInt64(&stats.connections, 1)
+	atomic.AddInt64(&stats.bytes, bytes)
+}
+
+// StreamOpen records how long opening a stream to the agent took
+func (t *TierStats) StreamOpen(tier string, took time.Duration, err error) {
+	stats := t.get(tier)
+	if err != nil {
+		atomic.AddInt64(&stats.streamOpenFailures, 1)
+		return
+	}
+	atomic.AddInt64(&stats.streamOpens, 1)
+	atomic.AddInt64(&stats.streamOpenNanos, int64(took))
+}
+
+// resolveTierLocked picks the tenant's tier from its label, token claim or the
+// default. Caller holds tenant.mu.
+func (s *RelayServer) resolveTierLocked(tenant *Tenant) (tier, source string) {
+	if label := s.tenantLabels(tenant.ID)[tierLabel]; validTier(label) {
+		return label, tierSourceLabel
+	}
+	if validTier(tenant.tokenTier) {
+		return tenant.tokenTier, tierSourceToken
+	}
+	return defaultTier, tierSourceDefault
+}
+
+// tier returns the tenant's current tier
+func (t *Tenant) tier() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.Tier
+}
+
+// refreshTenantTier re-resolves a registered tenant's tier after its labels
+// changed and recomputes the limits that depend on it
+func (s *RelayServer) refreshTenantTier(tenantID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenant, ok := s.tenants[tenantID]
+	if !ok {
+		return
+	}
+	tenant.mu.Lock()
+	previous := tenant.Tier
+	tenant.Tier, tenant.TierSource = s.resolveTierLocked(tenant)
+	tier := tenant.Tier
+	tenant.mu.Unlock()
+
+	if tier != previous {
+		log.Printf("Tenant %s tier %s -> %s", tenantID, previous, tier)
+		s.events.Emit("tenant_tier_changed", tenantID, fmt.Sprintf("%s -> %s", previous, tier))
+		s.applyConnLimitLocked(tenant)
+	}
+}
+
+// tierMetrics reports tenants, live connections and service received per
+// tier. Callers hold s.mu.
+func (s *RelayServer) tierMetrics() map[string]interface{} {
+	tenants := make(map[string]int, len(tiersInOrder))
+	active := make(map[string]int, len(tiersInOrder))
+	for _, tenant := range s.tenants {
+		tenant.mu.Lock()
+		tenants[tenant.Tier]++
+		active[tenant.Tier] += tenant.ActiveConns
+		tenant.mu.Unlock()
+	}
+
+	metrics := make(map[string]interface{}, len(tiersInOrder))
+	for _, tier := range tiersInOrder {
+		stats := s.tierStats.get(tier)
+		opens := atomic.LoadInt64(&stats.streamOpens)
+		var avgOpenMs float64
+		if opens > 0 {
+			avgOpenMs = float64(atomic.LoadInt64(&stats.streamOpenNanos)) / float64(opens) / 1e6
+		}
+		entry := map[string]interface{}{
+			"tenants":            tenants[tier],
+			"activeConns":        active[tier],
+			"connections":        atomic.LoadInt64(&stats.connections),
+			"bytes":              atomic.LoadInt64(&stats.bytes),
+			"streamOpenAvgMs":    avgOpenMs,
+			"streamOpenFailures": atomic.LoadInt64(&stats.streamOpenFailures),
+		}
+		if s.shedder != nil {
+			entry["shedDelayedAccepts"] = atomic.LoadInt64(s.shedder.delayed[tier])
+			entry["shedRefusedClients"] = atomic.LoadInt64(s.shedder.refused[tier])
+		}
+		if s.copyPool != nil {
+			entry["poolQueueWaitAvgMs"] = s.copyPool.avgWaitMs(tier)
+		}
+		metrics[tier] = entry
+	}
+	return metrics
+}
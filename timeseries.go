@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	timeSeriesInterval = time.Minute
+	// timeSeriesPoints keeps 24 hours of minute snapshots
+	timeSeriesPoints = 24 * 60
+)
+
+// TimeSeriesConfig persists the minute snapshots so history survives a
+// restart; without a file it is kept in memory only
+type TimeSeriesConfig struct {
+	File string `json:"file"`
+}
+
+// MetricsPoint is one minute snapshot of relay activity. Bytes are those
+// forwarded during the minute ending at Time.
+type MetricsPoint struct {
+	Time               time.Time `json:"time"`
+	Tenants            int       `json:"tenants"`
+	Connections        int       `json:"connections"`
+	BytesClientToAgent int64     `json:"bytesClientToAgent"`
+	BytesAgentToClient int64     `json:"bytesAgentToClient"`
+	CPUPercent         float64   `json:"cpuPercent"`
+}
+
+// TimeSeries keeps the last 24 hours of minute snapshots, optionally mirrored
+// to an append-only JSON lines file that is compacted as it grows
+type TimeSeries struct {
+	points  []MetricsPoint // oldest first
+	path    string
+	file    *os.File
+	appends int
+	mu      sync.Mutex
+}
+
+// OpenTimeSeries loads the last 24 hours from path, if set, and opens it for
+// appending
+func OpenTimeSeries(path string) (*TimeSeries, error) {
+	t := &TimeSeries{path: path}
+	if path == "" {
+		return t, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create time series dir: %w", err)
+	}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	if err := t.compactLocked(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// load reads the points of the last 24 hours, skipping a torn final line
+func (t *TimeSeries) load() error {
+	file, err := os.Open(t.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open time series: %w", err)
+	}
+	defer file.Close()
+
+	cutoff := clock.BaseNow().Add(-timeSeriesPoints * timeSeriesInterval)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var point MetricsPoint
+		if err := json.Unmarshal(scanner.Bytes(), &point); err != nil || point.Time.Before(cutoff) {
+			continue
+		}
+		t.points = append(t.points, point)
+	}
+	if len(t.points) > timeSeriesPoints {
+		t.points = t.points[len(t.points)-timeSeriesPoints:]
+	}
+	return scanner.Err()
+}
+
+// compactLocked rewrites the file with the retained points and reopens it
+// for appending. Callers hold t.mu.
+func (t *TimeSeries) compactLocked() error {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+
+	tmp := t.path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to compact time series: %w", err)
+	}
+	w := bufio.NewWriter(out)
+	enc := json.NewEncoder(w)
+	for _, point := range t.points {
+		enc.Encode(point)
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to compact time series: %w", err)
+	}
+	out.Close()
+	if err := os.Rename(tmp, t.path); err != nil {
+		return fmt.Errorf("failed to compact time series: %w", err)
+	}
+
+	file, err := os.OpenFile(t.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open time series: %w", err)
+	}
+	t.file = file
+	t.appends = 0
+	return nil
+}
+
+// Add records a snapshot, dropping those older than 24 hours
+func (t *TimeSeries) Add(point MetricsPoint) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.points = append(t.points, point)
+	if len(t.points) > timeSeriesPoints {
+		t.points = append([]MetricsPoint(nil), t.points[len(t.points)-timeSeriesPoints:]...)
+	}
+	if t.file == nil {
+		return
+	}
+
+	// The file keeps at most two days of lines between compactions
+	if t.appends >= timeSeriesPoints {
+		if err := t.compactLocked(); err != nil {
+			log.Printf("⚠️  %v", err)
+		}
+		return
+	}
+	if err := json.NewEncoder(t.file).Encode(point); err != nil {
+		log.Printf("⚠️  Failed to append to time series %s: %v", t.path, err)
+	}
+	t.appends++
+}
+
+// Since returns the snapshots taken at or after since, oldest first
+func (t *TimeSeries) Since(since time.Time) []MetricsPoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	points := make([]MetricsPoint, 0, len(t.points))
+	for _, point := range t.points {
+		if !point.Time.Before(since) {
+			points = append(points, point)
+		}
+	}
+	return points
+}
+
+// runTimeSeries takes a snapshot every minute until the process exits
+func (s *RelayServer) runTimeSeries() {
+	lastUp := atomic.LoadInt64(&s.counters.bytesClientToAgent)
+	lastDown := atomic.LoadInt64(&s.counters.bytesAgentToClient)
+
+	ticker := clock.NewTicker(timeSeriesInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		up := atomic.LoadInt64(&s.counters.bytesClientToAgent)
+		down := atomic.LoadInt64(&s.counters.bytesAgentToClient)
+		cpu, _ := s.load.Current()
+
+		s.mu.RLock()
+		point := MetricsPoint{
+			Time:               now.UTC().Truncate(time.Second),
+			Tenants:            len(s.tenants),
+			Connections:        s.getTotalConnections(),
+			BytesClientToAgent: up - lastUp,
+			BytesAgentToClient: down - lastDown,
+			CPUPercent:         cpu,
+		}
+		s.mu.RUnlock()
+
+		s.timeSeries.Add(point)
+		lastUp, lastDown = up, down
+	}
+}
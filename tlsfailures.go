@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// maxTLSFailureSources bounds the per-source-IP breakdown; failures from
+// further addresses are only counted in the totals
+const maxTLSFailureSources = 256
+
+// TLS handshake failure causes on the control port
+const (
+	tlsCauseNotTLS            = "not_tls"             // plaintext or other protocol on the TLS port
+	tlsCauseProtocolVersion   = "protocol_version"    // agent TLS stack too old
+	tlsCauseCipherSuite       = "cipher_suite"        // no cipher suite in common
+	tlsCauseBadCertChain      = "bad_cert_chain"      // agent rejected our chain, e.g. clock skew or missing CA
+	tlsCauseClientCertMissing = "client_cert_missing" // client certificate required but not sent
+	tlsCauseTimeout           = "timeout"
+	tlsCauseClientClosed      = "client_closed" // connection dropped mid-handshake, often a silent cert rejection
+	tlsCauseOther             = "other"
+)
+
+// classifyTLSError maps a server-side handshake error to a failure cause
+func classifyTLSError(err error) string {
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &recordErr) {
+		return tlsCauseNotTLS
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return tlsCauseTimeout
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, net.ErrClosed) {
+		return tlsCauseClientClosed
+	}
+
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "unsupported versions") || strings.Contains(msg, "protocol version"):
+		return tlsCauseProtocolVersion
+	case strings.Contains(msg, "no cipher suite"):
+		return tlsCauseCipherSuite
+	case strings.Contains(msg, "didn't provide a certificate") || strings.Contains(msg, "certificate required"):
+		return tlsCauseClientCertMissing
+	case strings.Contains(msg, "certificate") || strings.Contains(msg, "unknown authority"):
+		return tlsCauseBadCertChain
+	}
+	return tlsCauseOther
+}
+
+// TLSFailureTracker counts control port TLS handshake failures by cause and
+// source IP
+type TLSFailureTracker struct {
+	total    int64
+	byCause  map[string]int64
+	bySource map[string]map[string]int64
+	mu       sync.Mutex
+}
+
+// NewTLSFailureTracker creates an empty tracker
+func NewTLSFailureTracker() *TLSFailureTracker {
+	return &TLSFailureTracker{
+		byCause:  make(map[string]int64),
+		bySource: make(map[string]map[string]int64),
+	}
+}
+
+// Record counts a failed handshake from remoteAddr
+func (t *TLSFailureTracker) Record(remoteAddr, cause string) {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.total++
+	t.byCause[cause]++
+
+	causes, ok := t.bySource[ip]
+	if !ok {
+		if len(t.bySource) >= maxTLSFailureSources {
+			return
+		}
+		causes = make(map[string]int64)
+		t.bySource[ip] = causes
+	}
+	causes[cause]++
+}
+
+// Metrics reports failure totals for /metrics
+func (t *TLSFailureTracker) Metrics() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	byCause := make(map[string]int64, len(t.byCause))
+	for cause, n := range t.byCause {
+		byCause[cause] = n
+	}
+	bySource := make(map[string]map[string]int64, len(t.bySource))
+	for ip, causes := range t.bySource {
+		copied := make(map[string]int64, len(causes))
+		for cause, n := range causes {
+			copied[cause] = n
+		}
+		bySource[ip] = copied
+	}
+	return map[string]interface{}{
+		"total":     t.total,
+		"by_cause":  byCause,
+		"by_source": bySource,
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// nonceNamespaceTunnel holds nonces of relay-to-relay tunnel hellos
+	nonceNamespaceTunnel = "relay-tunnel"
+
+	tunnelHelloTolerance = 30 * time.Second
+	tunnelDialTimeout    = 5 * time.Second
+	tunnelOwnerTTL       = 5 * time.Minute
+	maxTunnelLineBytes   = 4096
+	minClusterSecretLen  = 32
+)
+
+// Replies to a tunnel hello, one per line
+const (
+	tunnelReplyOK      = "OK"
+	tunnelReplyNotHere = "NOT_HERE" // the tenant isn't registered on this instance
+	tunnelReplyBusy    = "BUSY"     // the tenant is at its connection limit
+	tunnelReplyDenied  = "DENIED"   // the hello failed authentication
+)
+
+// ClusterConfig links relay instances, so a SQL client that reaches an
+// instance its tenant isn't registered on is proxied to the one it is
+type ClusterConfig struct {
+	InstanceID string        `json:"instanceId"`
+	TunnelPort int           `json:"tunnelPort"` // TLS port peers connect to
+	Secret     string        `json:"secret"`     // shared by every instance, signs tunnel hellos
+	CAFile     string        `json:"caFile"`     // verifies peer certificates; system roots when empty
+	Peers      []ClusterPeer `json:"peers"`
+}
+
+// ClusterPeer is another relay instance of the cluster
+type ClusterPeer struct {
+	ID      string `json:"id"`
+	Address string `json:"address"` // host:tunnelPort
+}
+
+func (c ClusterConfig) enabled() bool {
+	return c.TunnelPort > 0 || len(c.Peers) > 0
+}
+
+// relayInstanceID names this relay: the cluster instance ID, else the host name
+func relayInstanceID(cfg ClusterConfig) string {
+	if cfg.InstanceID != "" {
+		return cfg.InstanceID
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// validateCluster checks the instance, secret and peers
+func validateCluster(cfg ClusterConfig) error {
+	if !cfg.enabled() {
+		return nil
+	}
+	if cfg.InstanceID == "" {
+		return fmt.Errorf("instanceId is required")
+	}
+	if len(cfg.Secret) < minClusterSecretLen {
+		return fmt.Errorf("secret must be at least %d characters", minClusterSecretLen)
+	}
+	if cfg.TunnelPort < 1 || cfg.TunnelPort > 65535 {
+		return fmt.Errorf("tunnelPort must be between 1 and 65535")
+	}
+	seen := map[string]bool{cfg.InstanceID: true}
+	for i, peer := range cfg.Peers {
+		if peer.ID == "" || seen[peer.ID] {
+			return fmt.Errorf("peers[%d]: id must be set and unique", i)
+		}
+		seen[peer.ID] = true
+		if _, _, err := net.SplitHostPort(peer.Address); err != nil {
+			return fmt.Errorf("peers[%d]: address: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// tunnelHello opens a tunnel: the first line a peer sends, as JSON
+type tunnelHello struct {
+	From       string `json:"from"`
+	Tenant     string `json:"tenant"`
+	ClientAddr string `json:"clientAddr"`
+	Timestamp  int64  `json:"timestamp"`
+	Nonce      string `json:"nonce"`
+	Signature  string `json:"signature"`
+}
+
+// sign computes the hello's signature: hex HMAC-SHA256 with the cluster
+// secret over its other fields, one per line
+func (h tunnelHello) sign(secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d\n%s", h.From, h.Tenant, h.ClientAddr, h.Timestamp, h.Nonce)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// RelayTunnel carries SQL client connections between relay instances. Which
+// peer a tenant is registered on is learned by asking and cached for a while.
+type RelayTunnel struct {
+	cfg     ClusterConfig
+	dialTLS *tls.Config
+	owners  map[string]tunnelOwner // tenant ID -> peer it was last found on
+	mu      sync.Mutex
+
+	proxied  int64 // clients sent to a peer, atomic
+	served   int64 // clients received from peers, atomic
+	noOwner  int64 // clients no peer had the tenant for, atomic
+	rejected int64 // hellos that failed authentication, atomic
+}
+
+type tunnelOwner struct {
+	peer  ClusterPeer
+	until time.Time
+}
+
+// NewRelayTunnel prepares the tunnel from the cluster config
+func NewRelayTunnel(cfg ClusterConfig) (*RelayTunnel, error) {
+	dialTLS := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cluster CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in cluster CA %s", cfg.CAFile)
+		}
+		dialTLS.RootCAs = pool
+	}
+	return &RelayTunnel{
+		cfg:     cfg,
+		dialTLS: dialTLS,
+		owners:  make(map[string]tunnelOwner),
+	}, nil
+}
+
+// candidates lists the peers to ask for a tenant, the cached owner first
+func (t *RelayTunnel) candidates(tenantID string) []ClusterPeer {
+	t.mu.Lock()
+	owner, ok := t.owners[tenantID]
+	if ok && clock.Now().After(owner.until) {
+		delete(t.owners, tenantID)
+		ok = false
+	}
+	t.mu.Unlock()
+
+	peers := make([]ClusterPeer, 0, len(t.cfg.Peers))
+	if ok {
+		peers = append(peers, owner.peer)
+	}
+	for _, peer := range t.cfg.Peers {
+		if !ok || peer.ID != owner.peer.ID {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+func (t *RelayTunnel) setOwner(tenantID string, peer *ClusterPeer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if peer == nil {
+		delete(t.owners, tenantID)
+		return
+	}
+	t.owners[tenantID] = tunnelOwner{peer: *peer, until: clock.Now().Add(tunnelOwnerTTL)}
+}
+
+// open finds the peer a tenant is registered on and returns a tunnel to it,
+// ready to carry the client's bytes
+func (t *RelayTunnel) open(tenantID, clientAddr string) (net.Conn, error) {
+	for _, peer := range t.candidates(tenantID) {
+		conn, reply, err := t.dial(peer, tenantID, clientAddr)
+		switch {
+		case err != nil:
+			log.Printf("⚠️  Tunnel to relay %s (%s) failed: %v", peer.ID, peer.Address, err)
+		case reply == tunnelReplyOK:
+			t.setOwner(tenantID, &peer)
+			return conn, nil
+		case reply == tunnelReplyBusy:
+			conn.Close()
+			return nil, fmt.Errorf("tenant %s is at its connection limit on relay %s", tenantID, peer.ID)
+		case reply == tunnelReplyDenied:
+			conn.Close()
+			log.Printf("⚠️  Relay %s denied the tunnel hello, check cluster.secret and clocks", peer.ID)
+		default:
+			conn.Close()
+		}
+	}
+	t.setOwner(tenantID, nil)
+	return nil, fmt.Errorf("tenant %s is not registered on any peer", tenantID)
+}
+
+// dial connects to a peer, sends the signed hello and reads its reply
+func (t *RelayTunnel) dial(peer ClusterPeer, tenantID, clientAddr string) (net.Conn, string, error) {
+	host, _, _ := net.SplitHostPort(peer.Address)
+	cfg := t.dialTLS.Clone()
+	cfg.ServerName = host
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: tunnelDialTimeout}, "tcp", peer.Address, cfg)
+	if err != nil {
+		return nil, "", err
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	hello := tunnelHello{
+		From:       t.cfg.InstanceID,
+		Tenant:     tenantID,
+		ClientAddr: clientAddr,
+		Timestamp:  clock.BaseNow().Unix(),
+		Nonce:      hex.EncodeToString(nonce),
+	}
+	hello.Signature = hello.sign(t.cfg.Secret)
+	data, _ := json.Marshal(hello)
+
+	conn.SetDeadline(time.Now().Add(tunnelDialTimeout))
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		conn.Close()
+		return nil, "", fmt.Errorf("failed to send hello: %w", err)
+	}
+	reply, err := readTunnelLine(conn)
+	if err != nil {
+		conn.Close()
+		return nil, "", fmt.Errorf("failed to read reply: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, reply, nil
+}
+
+// Metrics reports the peers, cached owners and tunnel counts
+func (t *RelayTunnel) Metrics() map[string]interface{} {
+	t.mu.Lock()
+	owners := len(t.owners)
+	t.mu.Unlock()
+
+	return map[string]interface{}{
+		"instanceId":   t.cfg.InstanceID,
+		"peers":        len(t.cfg.Peers),
+		"cachedOwners": owners,
+		"proxied":      atomic.LoadInt64(&t.proxied),
+		"served":       atomic.LoadInt64(&t.served),
+		"noOwner":      atomic.LoadInt64(&t.noOwner),
+		"rejected":     atomic.LoadInt64(&t.rejected),
+	}
+}
+
+// readTunnelLine reads one line byte-by-byte, so none of the client bytes
+// that follow it are consumed
+func readTunnelLine(r io.Reader) (string, error) {
+	var line strings.Builder
+	buf := make([]byte, 1)
+	for line.Len() < maxTunnelLineBytes {
+		if _, err := r.Read(buf); err != nil {
+			return "", err
+		}
+		if buf[0] == '\n' {
+			return line.String(), nil
+		}
+		line.WriteByte(buf[0])
+	}
+	return "", fmt.Errorf("line longer than %d bytes", maxTunnelLineBytes)
+}
+
+// startTunnelListener accepts tunnels from peers on the cluster tunnel port
+func (s *RelayServer) startTunnelListener(cert tls.Certificate) error {
+	tcpListener, err := listenTCP(fmt.Sprintf(":%d", s.tunnel.cfg.TunnelPort), s.listeners.Tunnel)
+	if err != nil {
+		return fmt.Errorf("failed to start tunnel listener: %w", err)
+	}
+	listener := tls.NewListener(tcpListener, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+
+	log.Printf("   Relay tunnel: port %d, instance %s, %d peers", s.tunnel.cfg.TunnelPort, s.tunnel.cfg.InstanceID, len(s.tunnel.cfg.Peers))
+
+	go func() {
+		var backoff time.Duration
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if isTemporaryAcceptError(err) {
+					backoff = acceptBackoff(backoff)
+					log.Printf("Tunnel accept error: %v; retrying in %v", err, backoff)
+					clock.Sleep(backoff)
+					continue
+				}
+				log.Printf("Tunnel listener stopped: %v", err)
+				return
+			}
+			backoff = 0
+
+			go s.serveTunnel(conn)
+		}
+	}()
+	return nil
+}
+
+// serveTunnel authenticates a peer's hello and forwards the client it carries
+// to a tenant registered here. Tunnelled clients are never proxied onwards,
+// so a stale owner cache can't send a connection around in circles.
+func (s *RelayServer) serveTunnel(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(tunnelDialTimeout))
+	line, err := readTunnelLine(conn)
+	if err != nil {
+		log.Printf("Tunnel hello from %s failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	var hello tunnelHello
+	var clientAddr netip.AddrPort
+	if err := json.Unmarshal([]byte(line), &hello); err != nil {
+		err = fmt.Errorf("malformed hello: %w", err)
+	} else if err = s.verifyTunnelHello(hello); err == nil {
+		if clientAddr, err = netip.ParseAddrPort(hello.ClientAddr); err != nil {
+			err = fmt.Errorf("malformed client address: %w", err)
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&s.tunnel.rejected, 1)
+		log.Printf("⚠️  Tunnel from %s rejected: %v", conn.RemoteAddr(), err)
+		conn.Write([]byte(tunnelReplyDenied + "\n"))
+		conn.Close()
+		return
+	}
+
+	tenant := s.tenantByIDFold(hello.Tenant)
+	if tenant == nil {
+		conn.Write([]byte(tunnelReplyNotHere + "\n"))
+		conn.Close()
+		return
+	}
+	if !tenant.acquireConn() {
+		log.Printf("Tenant %s connection limit reached (%d), refusing tunnel from relay %s", tenant.ID, tenant.MaxConns, hello.From)
+		conn.Write([]byte(tunnelReplyBusy + "\n"))
+		conn.Close()
+		return
+	}
+	if _, err := conn.Write([]byte(tunnelReplyOK + "\n")); err != nil {
+		tenant.mu.Lock()
+		tenant.ActiveConns--
+		tenant.mu.Unlock()
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	atomic.AddInt64(&s.tunnel.served, 1)
+	log.Printf("🔀 Tunnel from relay %s: client %s for tenant %s", hello.From, hello.ClientAddr, tenant.ID)
+	s.handleTenantConnection(tenant, &tunnelledConn{Conn: conn, clientAddr: net.TCPAddrFromAddrPort(clientAddr)})
+}
+
+// tunnelledConn is a client connection proxied by a peer relay. RemoteAddr is
+// the client's address from the signed hello, not the peer's, so source IP
+// caps, the compliance ledger and the connection table see the client.
+type tunnelledConn struct {
+	net.Conn
+	clientAddr net.Addr
+}
+
+func (c *tunnelledConn) RemoteAddr() net.Addr {
+	return c.clientAddr
+}
+
+// CloseWrite half-closes the tunnel when its connection supports it
+func (c *tunnelledConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return errors.New("tunnel connection can't half-close")
+}
+
+// verifyTunnelHello checks the hello's signature, age and nonce
+func (s *RelayServer) verifyTunnelHello(hello tunnelHello) error {
+	if hello.Nonce == "" || len(hello.Nonce) > 64 {
+		return fmt.Errorf("missing or oversized nonce")
+	}
+	if !hmac.Equal([]byte(hello.Signature), []byte(hello.sign(s.tunnel.cfg.Secret))) {
+		return fmt.Errorf("invalid signature")
+	}
+	signedAt := time.Unix(hello.Timestamp, 0)
+	if skew := clock.BaseNow().Sub(signedAt); skew > tunnelHelloTolerance || skew < -tunnelHelloTolerance {
+		return fmt.Errorf("hello signed %v away from the relay clock", skew.Round(time.Second))
+	}
+	fresh, err := s.nonces.Use(nonceNamespaceTunnel, hello.Nonce, signedAt.Add(tunnelHelloTolerance))
+	if err != nil {
+		return fmt.Errorf("failed to record nonce: %w", err)
+	}
+	if !fresh {
+		return fmt.Errorf("replayed hello")
+	}
+	return nil
+}
+
+// tunnelOpener opens a tunnel to the instance a tenant is registered on, for
+// the Forwarder
+type tunnelOpener struct {
+	tunnel     *RelayTunnel
+	tenantID   string
+	clientAddr string
+}
+
+func (o *tunnelOpener) OpenStream() (net.Conn, error) {
+	return o.tunnel.open(o.tenantID, o.clientAddr)
+}
+
+// tunnelForward is the forward policy of a client proxied to a peer: the
+// owning instance applies the tenant's policy, this one only counts bytes
+type tunnelForward struct {
+	s *RelayServer
+}
+
+func (f tunnelForward) Admit(clientConn net.Conn) (io.Reader, error) {
+	return clientConn, nil
+}
+
+func (f tunnelForward) Opened(clientConn, stream net.Conn, stats *ForwardStats) (up, down io.Writer) {
+	return &countingWriter{w: stream, counter: &f.s.counters.bytesClientToAgent},
+		&countingWriter{w: clientConn, counter: &f.s.counters.bytesAgentToClient}
+}
+
+func (f tunnelForward) Finished(clientConn net.Conn, stats *ForwardStats, err error) {}
+
+// proxyToOwner forwards a client for a tenant that isn't registered here to
+// the peer it is registered on, closing the client when done
+func (s *RelayServer) proxyToOwner(tenantID string, conn net.Conn) {
+	defer conn.Close()
+
+	clientAddr := conn.RemoteAddr().String()
+	forwarder := &Forwarder{
+		Opener:      &tunnelOpener{tunnel: s.tunnel, tenantID: tenantID, clientAddr: clientAddr},
+		Policy:      tunnelForward{s: s},
+		IdleTimeout: s.idleTimeout,
+		Tick:        clockTick,
+	}
+	stats := &ForwardStats{Now: clock.BaseNow}
+	err := forwarder.Forward(conn, stats)
+	if errors.Is(err, errOpenStream) {
+		atomic.AddInt64(&s.tunnel.noOwner, 1)
+		log.Printf("SNI connection from %s for tenant %s: %v", clientAddr, tenantID, err)
+		return
+	}
+	atomic.AddInt64(&s.tunnel.proxied, 1)
+	up, down := stats.Bytes()
+	log.Printf("🔀 Proxied client %s for tenant %s to its relay: %d bytes up, %d down", clientAddr, tenantID, up, down)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.gitCommit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Commit and date fall back to the VCS stamp Go embeds when building from a checkout.
+var (
+	version   = "1.0.0"
+	gitCommit = ""
+	buildDate = ""
+)
+
+// BuildInfo identifies the relay build that served a request
+type BuildInfo struct {
+	Version   string   `json:"version"`
+	GitCommit string   `json:"gitCommit"`
+	BuildDate string   `json:"buildDate"`
+	GoVersion string   `json:"goVersion"`
+	Features  []string `json:"features,omitempty"`
+}
+
+var (
+	buildOnce sync.Once
+	build     BuildInfo
+)
+
+// relayBuild returns the version, commit, build date and Go version of this binary
+func relayBuild() BuildInfo {
+	buildOnce.Do(func() {
+		build = BuildInfo{
+			Version:   version,
+			GitCommit: gitCommit,
+			BuildDate: buildDate,
+			GoVersion: runtime.Version(),
+		}
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range info.Settings {
+				switch {
+				case setting.Key == "vcs.revision" && build.GitCommit == "":
+					build.GitCommit = setting.Value
+				case setting.Key == "vcs.time" && build.BuildDate == "":
+					build.BuildDate = setting.Value
+				}
+			}
+		}
+		if build.GitCommit == "" {
+			build.GitCommit = "unknown"
+		}
+		if build.BuildDate == "" {
+			build.BuildDate = "unknown"
+		}
+	})
+	return build
+}
+
+// versionInfo adds the globally enabled feature flags and optional
+// subsystems to the build info
+func (s *RelayServer) versionInfo() BuildInfo {
+	info := relayBuild()
+	for name, enabled := range s.features.State() {
+		if enabled {
+			info.Features = append(info.Features, name)
+		}
+	}
+	if s.sni.Enabled {
+		info.Features = append(info.Features, "sni")
+	}
+	if s.recorder != nil {
+		info.Features = append(info.Features, "recording")
+	}
+	if s.latency != nil {
+		info.Features = append(info.Features, "latency-injection")
+	}
+	if s.rejectReplayedJTI {
+		info.Features = append(info.Features, "replayProtection")
+	}
+	if s.adminAuth.enabled() {
+		info.Features = append(info.Features, "adminApi")
+	}
+	sort.Strings(info.Features)
+	return info
+}
+
+// handleVersion serves GET /version
+func (s *RelayServer) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.versionInfo())
+}
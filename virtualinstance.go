@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// virtualInstanceNamePattern keeps instance names usable in file names and
+// log lines
+var virtualInstanceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// VirtualInstance is one of the relays run by this process, e.g. a staging and
+// a production tenant pool on one VM. Each has its own listeners, HIS
+// backends and state; a process without virtualInstances runs one unnamed
+// instance.
+type VirtualInstance struct {
+	Name   string
+	Config *RelayFileConfig
+}
+
+// logSuffix names the instance in log lines, if it has a name
+func (v VirtualInstance) logSuffix() string {
+	if v.Name == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (virtual instance %s)", v.Name)
+}
+
+// Instances returns the relays to run: each virtual instance, else the
+// config itself
+func (c *RelayFileConfig) Instances() []VirtualInstance {
+	if len(c.instances) > 0 {
+		return c.instances
+	}
+	return []VirtualInstance{{Config: c}}
+}
+
+// loadVirtualInstances builds each virtualInstances entry by overlaying it on
+// the top-level settings, which hold what the instances share. Objects are
+// merged key by key; other values, arrays included, replace the shared ones.
+// Each instance is defaulted and validated on its own, then checked against
+// the others for ports and state paths they both use.
+func loadVirtualInstances(raw map[string]interface{}, shared *RelayFileConfig, resolver *secretResolver) ([]VirtualInstance, []string) {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	base := make(map[string]interface{}, len(raw))
+	for key, value := range raw {
+		if key != "virtualInstances" {
+			base[key] = value
+		}
+	}
+	defaults := *shared
+	defaults.fillStateDefaults()
+
+	names := make([]string, 0, len(shared.VirtualInstances))
+	for name := range shared.VirtualInstances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var instances []VirtualInstance
+	for _, name := range names {
+		prefix := "virtualInstances." + name
+		if !virtualInstanceNamePattern.MatchString(name) {
+			addf("%s: name must be up to 32 lowercase letters, digits and dashes", prefix)
+			continue
+		}
+		var overlay map[string]interface{}
+		if err := json.Unmarshal(shared.VirtualInstances[name], &overlay); err != nil || overlay == nil {
+			addf("%s: must be an object of relay settings", prefix)
+			continue
+		}
+		if _, ok := overlay["virtualInstances"]; ok {
+			addf("%s.virtualInstances: virtual instances cannot be nested", prefix)
+			delete(overlay, "virtualInstances")
+		}
+		problems = append(problems, unknownConfigKeys(overlay, reflect.TypeOf(shared), prefix)...)
+
+		data, err := json.Marshal(mergeConfigJSON(base, overlay))
+		if err != nil {
+			addf("%s: %v", prefix, err)
+			continue
+		}
+		cfg := &RelayFileConfig{}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			addf("%s: %v", prefix, err)
+			continue
+		}
+		instanceProblems := cfg.resolveSecrets(resolver)
+		cfg.applyDefaults()
+		cfg.fillStateDefaults()
+		cfg.isolateState(name, &defaults)
+		instanceProblems = append(instanceProblems, cfg.validate()...)
+		for _, problem := range instanceProblems {
+			addf("%s: %s", prefix, problem)
+		}
+		instances = append(instances, VirtualInstance{Name: name, Config: cfg})
+	}
+	return instances, append(problems, virtualInstanceClashes(instances)...)
+}
+
+// mergeConfigJSON overlays decoded JSON objects, recursing into objects
+func mergeConfigJSON(base, overlay map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(overlay))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range overlay {
+		if sub, ok := value.(map[string]interface{}); ok {
+			if baseSub, ok := merged[key].(map[string]interface{}); ok {
+				merged[key] = mergeConfigJSON(baseSub, sub)
+				continue
+			}
+		}
+		merged[key] = value
+	}
+	return merged
+}
+
+// fillStateDefaults sets the state directories that are otherwise defaulted
+// where they are opened
+func (c *RelayFileConfig) fillStateDefaults() {
+	if c.Recording.Dir == "" {
+		c.Recording.Dir = defaultRecordingDir
+	}
+	if c.Compliance.Dir == "" {
+		c.Compliance.Dir = defaultComplianceDir
+	}
+}
+
+// statePaths points at the files, directories and sockets a relay keeps its
+// state in, by config key
+func (c *RelayFileConfig) statePaths() map[string]*string {
+	return map[string]*string{
+		"server.portJournal":      &c.Server.PortJournal,
+		"server.tenantBlocklist":  &c.Server.TenantBlocklist,
+		"jwt.nonceDir":            &c.JWT.NonceDir,
+		"his.spoolDir":            &c.HIS.SpoolDir,
+		"admin.auditLog":          &c.Admin.AuditLog,
+		"timeSeries.file":         &c.TimeSeries.File,
+		"portHistory.file":        &c.PortHistory.File,
+		"slo.file":                &c.SLO.File,
+		"recording.dir":           &c.Recording.Dir,
+		"compliance.dir":          &c.Compliance.Dir,
+		"localControl.unixSocket": &c.LocalControl.UnixSocket,
+	}
+}
+
+// isolateState renames the state paths an instance inherited from the shared
+// settings after the instance, e.g. ports.journal becomes
+// ports-staging.journal, so instances never share a journal, blocklist or
+// spool
+func (c *RelayFileConfig) isolateState(name string, shared *RelayFileConfig) {
+	sharedPaths := shared.statePaths()
+	for key, path := range c.statePaths() {
+		if *path == "" || *path != *sharedPaths[key] {
+			continue
+		}
+		ext := filepath.Ext(*path)
+		*path = strings.TrimSuffix(*path, ext) + "-" + name + ext
+	}
+}
+
+// listenPorts returns the ports a relay binds besides its tenant ports, by
+// config key
+func (c *RelayFileConfig) listenPorts() map[string]int {
+	ports := map[string]int{
+		"server.controlPort":     c.Server.ControlPort,
+		"server.healthCheckPort": c.Server.HealthCheckPort,
+	}
+	if c.SNI.Enabled {
+		ports["sni.port"] = c.SNI.Port
+	}
+	if c.LocalControl.PlaintextPort > 0 {
+		ports["localControl.plaintextPort"] = c.LocalControl.PlaintextPort
+	}
+	if c.Cluster.enabled() && c.Cluster.TunnelPort > 0 {
+		ports["cluster.tunnelPort"] = c.Cluster.TunnelPort
+	}
+	return ports
+}
+
+// virtualInstanceClashes reports ports, tenant port ranges and state paths
+// used by more than one instance
+func virtualInstanceClashes(instances []VirtualInstance) []string {
+	var problems []string
+	type claim struct {
+		instance string
+		key      string
+	}
+	ports := map[int]claim{}
+	paths := map[string]claim{}
+	var claimed []int
+
+	for _, instance := range instances {
+		cfg := instance.Config
+		instancePorts := cfg.listenPorts()
+		keys := make([]string, 0, len(instancePorts))
+		for key := range instancePorts {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			port := instancePorts[key]
+			if other, ok := ports[port]; ok {
+				problems = append(problems, fmt.Sprintf("virtualInstances.%s.%s %d is also %s of virtual instance %s",
+					instance.Name, key, port, other.key, other.instance))
+				continue
+			}
+			ports[port] = claim{instance.Name, key}
+			claimed = append(claimed, port)
+		}
+
+		instancePaths := cfg.statePaths()
+		keys = keys[:0]
+		for key := range instancePaths {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			path := *instancePaths[key]
+			if path == "" {
+				continue
+			}
+			if other, ok := paths[path]; ok {
+				problems = append(problems, fmt.Sprintf("virtualInstances.%s.%s %s is also %s of virtual instance %s",
+					instance.Name, key, path, other.key, other.instance))
+				continue
+			}
+			paths[path] = claim{instance.Name, key}
+		}
+	}
+
+	for i, instance := range instances {
+		srv := instance.Config.Server
+		for _, other := range instances[i+1:] {
+			otherSrv := other.Config.Server
+			if srv.TenantPortStart <= otherSrv.TenantPortEnd && otherSrv.TenantPortStart <= srv.TenantPortEnd {
+				problems = append(problems, fmt.Sprintf("virtualInstances.%s tenant ports %d-%d overlap those of virtual instance %s (%d-%d)",
+					instance.Name, srv.TenantPortStart, srv.TenantPortEnd, other.Name, otherSrv.TenantPortStart, otherSrv.TenantPortEnd))
+			}
+		}
+		for _, port := range claimed {
+			owner := ports[port]
+			if owner.instance != instance.Name && port >= srv.TenantPortStart && port <= srv.TenantPortEnd {
+				problems = append(problems, fmt.Sprintf("virtualInstances.%s.%s %d is inside the tenant ports of virtual instance %s",
+					owner.instance, owner.key, port, instance.Name))
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Subsystems whose goroutines the watchdog tracks
+const (
+	goroutineAcceptLoop    = "tenant_accept_loop"
+	goroutineHeartbeatLoop = "heartbeat_loop"
+	goroutineKeepaliveLoop = "keepalive_loop"
+	goroutineConnHandler   = "connection_handler"
+	goroutineCopy          = "copy"
+)
+
+const (
+	watchdogInterval = 30 * time.Second
+	// watchdogSlack absorbs goroutines that are legitimately still winding
+	// down, e.g. heartbeat loops notice a departed tenant on their next tick
+	watchdogSlack = 5
+	// watchdogDriftChecks is how many consecutive checks must drift before a dump
+	watchdogDriftChecks = 2
+	maxGoroutineDump    = 64 << 10
+)
+
+// GoroutineWatchdog counts running goroutines per subsystem and compares
+// them with what the relay's state says should be running
+type GoroutineWatchdog struct {
+	counts   map[string]*int64
+	drifting map[string]int
+	mu       sync.Mutex
+}
+
+// NewGoroutineWatchdog creates a watchdog for the known subsystems
+func NewGoroutineWatchdog() *GoroutineWatchdog {
+	w := &GoroutineWatchdog{
+		counts:   make(map[string]*int64),
+		drifting: make(map[string]int),
+	}
+	for _, name := range []string{goroutineAcceptLoop, goroutineHeartbeatLoop, goroutineKeepaliveLoop, goroutineConnHandler, goroutineCopy} {
+		w.counts[name] = new(int64)
+	}
+	return w
+}
+
+// track records a goroutine starting in subsystem and returns the function
+// to call when it exits: defer w.track(goroutineCopy)()
+func (w *GoroutineWatchdog) track(subsystem string) func() {
+	counter := w.counts[subsystem]
+	atomic.AddInt64(counter, 1)
+	return func() { atomic.AddInt64(counter, -1) }
+}
+
+// actual returns the running goroutine count per subsystem
+func (w *GoroutineWatchdog) actual() map[string]int {
+	counts := make(map[string]int, len(w.counts))
+	for name, counter := range w.counts {
+		counts[name] = int(atomic.LoadInt64(counter))
+	}
+	return counts
+}
+
+// expectedGoroutines derives per-subsystem goroutine counts from relay
+// state; callers hold s.mu
+func (s *RelayServer) expectedGoroutines() map[string]int {
+	tenants := len(s.tenants)
+	return map[string]int{
+		goroutineAcceptLoop:    tenants,
+		goroutineHeartbeatLoop: tenants,
+		goroutineKeepaliveLoop: tenants,
+		goroutineConnHandler:   s.getTotalConnections(),
+		goroutineCopy:          s.expectedCopyGoroutines(),
+	}
+}
+
+// expectedCopyGoroutines is two per live connection, or the pool's fixed
+// worker count
+func (s *RelayServer) expectedCopyGoroutines() int {
+	if s.copyPool != nil {
+		return s.copyPool.workers
+	}
+	return 2 * len(s.conns.Snapshot(""))
+}
+
+// goroutineMetrics reports actual and expected goroutines for /metrics;
+// callers hold s.mu
+func (s *RelayServer) goroutineMetrics() map[string]interface{} {
+	expected := s.expectedGoroutines()
+	actual := s.watchdog.actual()
+
+	subsystems := make(map[string]interface{}, len(actual))
+	for name, n := range actual {
+		subsystems[name] = map[string]int{"actual": n, "expected": expected[name]}
+	}
+	return map[string]interface{}{
+		"total":      runtime.NumGoroutine(),
+		"subsystems": subsystems,
+	}
+}
+
+// runWatchdog periodically compares goroutine counts with relay state and
+// logs a goroutine dump when a subsystem keeps running more than expected
+func (s *RelayServer) runWatchdog() {
+	ticker := clock.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		s.checkGoroutines()
+	}
+}
+
+func (s *RelayServer) checkGoroutines() {
+	s.mu.RLock()
+	expected := s.expectedGoroutines()
+	s.mu.RUnlock()
+	actual := s.watchdog.actual()
+
+	w := s.watchdog
+	w.mu.Lock()
+	var leaking []string
+	for name, n := range actual {
+		if n > expected[name]+watchdogSlack {
+			w.drifting[name]++
+			if w.drifting[name] == watchdogDriftChecks {
+				leaking = append(leaking, name)
+			}
+		} else {
+			w.drifting[name] = 0
+		}
+	}
+	w.mu.Unlock()
+
+	if len(leaking) == 0 {
+		return
+	}
+	sort.Strings(leaking)
+
+	for _, name := range leaking {
+		s.events.Emit("goroutine_drift", "",
+			fmt.Sprintf("%s: %d goroutines running, %d expected", name, actual[name], expected[name]))
+	}
+
+	var dump bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&dump, 1)
+	if dump.Len() > maxGoroutineDump {
+		dump.Truncate(maxGoroutineDump)
+	}
+	log.Printf("⚠️  Goroutine drift in %v (%d goroutines total), dump follows:\n%s",
+		leaking, runtime.NumGoroutine(), dump.String())
+}